@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -15,11 +16,22 @@ const (
 )
 
 var (
+	remoteFlag = cli.StringFlag{
+		Name:  "remote",
+		Usage: "Name of remote storage from 'remotes' config section, general.remote_storage is used by default",
+	}
+	labelFlag = cli.StringSliceFlag{
+		Name:  "label",
+		Usage: "Label of backup as key=value, can be repeated",
+	}
 	version   = "unknown"
 	gitCommit = "unknown"
 	buildDate = "unknown"
 )
 
+// dryRunCommands - commands which support '--dry-run'
+var dryRunCommands = map[string]bool{"create": true, "restore": true, "upload": true, "delete": true, "clean_remote_broken": true}
+
 func main() {
 	log.SetOutput(os.Stdout)
 	cliapp := cli.NewApp()
@@ -28,6 +40,7 @@ func main() {
 	cliapp.UsageText = "clickhouse-backup <command> [-t, --tables=<db>.<table>] <backup_name>"
 	cliapp.Description = "Run as 'root' or 'clickhouse' user"
 	cliapp.Version = version
+	chbackup.Version = version
 
 	cliapp.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -36,6 +49,10 @@ func main() {
 			Usage:  "Config `FILE` name.",
 			EnvVar: "CLICKHOUSE_BACKUP_CONFIG",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print tables, partitions, parts and remote keys which create, restore, upload or delete would change, change nothing",
+		},
 	}
 	cliapp.CommandNotFound = func(c *cli.Context, command string) {
 		fmt.Printf("Error. Unknown command: '%s'\n\n", command)
@@ -61,51 +78,154 @@ func main() {
 		{
 			Name:        "create",
 			Usage:       "Create new backup",
-			UsageText:   "clickhouse-backup create [-t, --tables=<db>.<table>] <backup_name>",
-			Description: "Create new backup",
+			UsageText:   "clickhouse-backup create [-t, --tables=<db>.<table>] [--partitions=<partition_id>,<partition_id>] [--diff-from=<backup_name>] [--rbac] [--label=<key>=<value>] <backup_name>",
+			Description: "Create new backup, data parts unchanged since --diff-from backup are hard linked to its files",
+			Action: func(c *cli.Context) error {
+				labels, err := chbackup.ParseLabels(c.StringSlice("label"))
+				if err != nil {
+					return err
+				}
+				return chbackup.CreateBackup(context.Background(), *getConfig(c), c.Args().First(), c.String("t"), c.String("partitions"), c.String("diff-from"), c.Bool("rbac"), labels)
+			},
+			Flags: append(cliapp.Flags, labelFlag,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.StringFlag{
+					Name:  "partitions",
+					Usage: "Freeze only these partitions, comma separated partition IDs as in system.parts.partition_id",
+				},
+				cli.BoolFlag{
+					Name:  "rbac",
+					Usage: "Backup users, roles, quotas, settings profiles and row policies",
+				},
+				cli.StringFlag{
+					Name:   "diff-from",
+					Hidden: false,
+				},
+			),
+		},
+		{
+			Name:        "create_remote",
+			Usage:       "Create new backup and upload it to remote storage",
+			UsageText:   "clickhouse-backup create_remote [-t, --tables=<db>.<table>] [--partitions=<partition_id>,<partition_id>] [--diff-from=<backup_name>] [--rbac] [--label=<key>=<value>] [--keep-local] [--remote=<name>] <backup_name>",
+			Description: "Create new backup, upload it and remove local backup, local backup is kept when upload fails",
+			Action: func(c *cli.Context) error {
+				labels, err := chbackup.ParseLabels(c.StringSlice("label"))
+				if err != nil {
+					return err
+				}
+				return chbackup.CreateRemote(context.Background(), *getRemoteConfig(c), c.Args().First(), c.String("t"), c.String("partitions"), c.String("diff-from"), c.Bool("rbac"), labels, c.Bool("keep-local"))
+			},
+			Flags: append(cliapp.Flags, remoteFlag, labelFlag,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.StringFlag{
+					Name:  "partitions",
+					Usage: "Freeze only these partitions, comma separated partition IDs as in system.parts.partition_id",
+				},
+				cli.BoolFlag{
+					Name:  "rbac",
+					Usage: "Backup users, roles, quotas, settings profiles and row policies",
+				},
+				cli.StringFlag{
+					Name:  "diff-from",
+					Usage: "Local backup to hard link unchanged parts to and to upload increment from",
+				},
+				cli.BoolFlag{
+					Name:  "keep-local",
+					Usage: "Keep local backup after upload, e.g. to use it as --diff-from of the next backup",
+				},
+			),
+		},
+		{
+			Name:        "estimate",
+			Usage:       "Print size of tables and estimated size of their backup",
+			UsageText:   "clickhouse-backup estimate [--remote=<name>] [-t, --tables=<db>.<table>]",
+			Description: "Sum bytes_on_disk of active parts from system.parts and estimate size of archives in compression_format of remote storage",
 			Action: func(c *cli.Context) error {
-				return chbackup.CreateBackup(*getConfig(c), c.Args().First(), c.String("t"))
+				return chbackup.Estimate(*getRemoteConfig(c), c.String("t"))
+			},
+			Flags: append(cliapp.Flags, remoteFlag,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+			),
+		},
+		{
+			Name:        "export",
+			Usage:       "Write backup to stdout as archive",
+			UsageText:   "clickhouse-backup export [-t, --tables=<db>.<table>] [--partitions=<partition_id>,<partition_id>] [--rbac] [--compression=<format>] [<backup_name>]",
+			Description: "Write local backup to stdout, when <backup_name> isn't local backup new backup is created, written and removed",
+			Action: func(c *cli.Context) error {
+				return chbackup.ExportBackup(context.Background(), *getConfig(c), c.Args().First(), c.String("t"), c.String("partitions"), c.Bool("rbac"), c.String("compression"), os.Stdout)
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
 					Name:   "table, tables, t",
 					Hidden: false,
 				},
+				cli.StringFlag{
+					Name:  "partitions",
+					Usage: "Freeze only these partitions, comma separated partition IDs as in system.parts.partition_id",
+				},
+				cli.BoolFlag{
+					Name:  "rbac",
+					Usage: "Backup users, roles, quotas, settings profiles and row policies",
+				},
+				cli.StringFlag{
+					Name:  "compression",
+					Value: "tar",
+					Usage: "Format of archive: 'zstd', 'lz4', 'bzip2', 'gzip', 'sz', 'xz', 'tar'",
+				},
 			),
 		},
 		{
 			Name:      "upload",
 			Usage:     "Upload backup to remote storage",
-			UsageText: "clickhouse-backup upload [--diff-from=<backup_name>] <backup_name>",
+			UsageText: "clickhouse-backup upload [--diff-from=<backup_name>] [--remote=<name>] [-t, --tables=<db>.<table>] <backup_name>",
 			Action: func(c *cli.Context) error {
-				return chbackup.Upload(*getConfig(c), c.Args().First(), c.String("diff-from"))
+				return chbackup.Upload(context.Background(), *getRemoteConfig(c), c.Args().First(), c.String("diff-from"), c.String("t"))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
 					Name:   "diff-from",
 					Hidden: false,
 				},
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				remoteFlag,
 			),
 		},
 		{
 			Name:      "list",
 			Usage:     "Print list of backups",
-			UsageText: "clickhouse-backup list [all|local|remote] [latest|penult]",
+			UsageText: "clickhouse-backup list [--remote=<name>] [--label=<key>=<value>] [all|local|remote] [latest|penult]",
 			Action: func(c *cli.Context) error {
-				config := getConfig(c)
+				config := getRemoteConfig(c)
+				labels, err := chbackup.ParseLabels(c.StringSlice("label"))
+				if err != nil {
+					return err
+				}
 				switch c.Args().Get(0) {
 				case "local":
-					return chbackup.PrintLocalBackups(*config, c.Args().Get(1))
+					return chbackup.PrintLocalBackups(*config, c.Args().Get(1), labels)
 				case "remote":
-					return chbackup.PrintRemoteBackups(*config, c.Args().Get(1))
+					return chbackup.PrintRemoteBackups(context.Background(), *config, c.Args().Get(1), labels)
 				case "all", "":
 					fmt.Println("Local backups:")
-					if err := chbackup.PrintLocalBackups(*config, c.Args().Get(1)); err != nil {
+					if err := chbackup.PrintLocalBackups(*config, c.Args().Get(1), labels); err != nil {
 						return err
 					}
 					if config.General.RemoteStorage != "none" {
 						fmt.Println("Remote backups:")
-						if err := chbackup.PrintRemoteBackups(*config, c.Args().Get(1)); err != nil {
+						if err := chbackup.PrintRemoteBackups(context.Background(), *config, c.Args().Get(1), labels); err != nil {
 							return err
 						}
 					}
@@ -115,29 +235,185 @@ func main() {
 				}
 				return nil
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags, remoteFlag, labelFlag),
 		},
 		{
 			Name:      "download",
 			Usage:     "Download backup from remote storage",
-			UsageText: "clickhouse-backup download <backup_name>",
+			UsageText: "clickhouse-backup download [--remote=<name>] [-t, --tables=<db>.<table>] <backup_name>",
 			Action: func(c *cli.Context) error {
-				return chbackup.Download(*getConfig(c), c.Args().First())
+				return chbackup.Download(context.Background(), *getRemoteConfig(c), c.Args().First(), c.String("t"))
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				remoteFlag,
+			),
+		},
+		{
+			Name:      "copy",
+			Aliases:   []string{"replicate"},
+			Usage:     "Copy backup from one remote storage to another",
+			UsageText: "clickhouse-backup copy [--from=<remote>] --to=<remote> <backup_name>",
+			Action: func(c *cli.Context) error {
+				return chbackup.CopyBackup(context.Background(), *getConfig(c), c.Args().First(), c.String("from"), c.String("to"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Name of source remote from 'remotes' config section, general.remote_storage is used by default",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Name of destination remote from 'remotes' config section, general.remote_storage is used by default",
+				},
+			),
 		},
 		{
 			Name:      "restore",
 			Usage:     "Create schema and restore data from backup",
-			UsageText: "clickhouse-backup restore [--schema] [--data] [-t, --tables=<db>.<table>] <backup_name>",
+			UsageText: "clickhouse-backup restore [--schema] [--data] [-t, --tables=<db>.<table>] [--partitions=<partition_id>,<partition_id>] [--restore-database-mapping=<src>:<dst>] [--restore-table-mapping=<src>:<dst>] [--on-cluster=<cluster>] [--rbac] [--rm] [--restore-schema-as-non-replicated|--restore-schema-as-replicated] [--restore-uuid=keep|new] [--stdin [--compression=<format>]] <backup_name>",
 			Action: func(c *cli.Context) error {
-				return chbackup.Restore(*getConfig(c), c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"))
+				opts := chbackup.RestoreOptions{
+					Partitions:            c.String("partitions"),
+					DatabaseMapping:       c.String("restore-database-mapping"),
+					TableMapping:          c.String("restore-table-mapping"),
+					OnCluster:             c.String("on-cluster"),
+					RBAC:                  c.Bool("rbac"),
+					DropIfExists:          c.Bool("rm"),
+					SchemaAsNonReplicated: c.Bool("restore-schema-as-non-replicated"),
+					SchemaAsReplicated:    c.Bool("restore-schema-as-replicated"),
+					UUID:                  c.String("restore-uuid"),
+				}
+				if c.Bool("stdin") {
+					return chbackup.RestoreStream(context.Background(), *getConfig(c), os.Stdin, c.String("compression"), c.String("t"), c.Bool("s"), c.Bool("d"), opts)
+				}
+				return chbackup.Restore(context.Background(), *getConfig(c), c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"), opts)
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
 					Name:   "table, tables, t",
 					Hidden: false,
 				},
+				cli.StringFlag{
+					Name:  "partitions",
+					Usage: "Restore only parts of these partitions, comma separated partition IDs as in system.parts.partition_id",
+				},
+				cli.StringFlag{
+					Name:  "restore-database-mapping",
+					Usage: "Restore tables of databases into other databases, comma separated <src>:<dst> pairs",
+				},
+				cli.StringFlag{
+					Name:  "restore-table-mapping",
+					Usage: "Restore tables with other names, comma separated <src>:<dst> pairs",
+				},
+				cli.StringFlag{
+					Name:  "on-cluster",
+					Usage: "Create schema on all hosts of cluster with ON CLUSTER queries, data is restored on local host only",
+				},
+				cli.BoolFlag{
+					Name:  "rbac",
+					Usage: "Restore users, roles, quotas, settings profiles and row policies",
+				},
+				cli.BoolFlag{
+					Name:  "rm, drop-if-exists",
+					Usage: "Drop existing tables before they are created from backup, tables of Atomic databases are dropped with SYNC",
+				},
+				cli.BoolFlag{
+					Name:  "restore-schema-as-non-replicated",
+					Usage: "Create Replicated*MergeTree tables as *MergeTree without ZooKeeper path and replica name",
+				},
+				cli.BoolFlag{
+					Name:  "restore-schema-as-replicated",
+					Usage: "Create *MergeTree tables as Replicated*MergeTree with clickhouse.default_replica_path and default_replica_name",
+				},
+				cli.StringFlag{
+					Name:  "restore-uuid",
+					Usage: "'keep' restores tables with UUID of backup even when they're renamed, 'new' restores them with new UUID",
+				},
+				cli.BoolFlag{
+					Name:  "stdin",
+					Usage: "Restore backup written by export from stdin, name of backup is taken from stream",
+				},
+				cli.StringFlag{
+					Name:  "compression",
+					Value: "tar",
+					Usage: "Format of archive on stdin: 'zstd', 'lz4', 'bzip2', 'gzip', 'sz', 'xz', 'tar'",
+				},
+				cli.BoolFlag{
+					Name:   "schema, s",
+					Hidden: false,
+					Usage:  "Restore schema only",
+				},
+				cli.BoolFlag{
+					Name:   "data, d",
+					Hidden: false,
+					Usage:  "Restore data only",
+				},
+			),
+		},
+		{
+			Name:        "restore_remote",
+			Usage:       "Download backup from remote storage and restore it",
+			UsageText:   "clickhouse-backup restore_remote [--schema] [--data] [-t, --tables=<db>.<table>] [--partitions=<partition_id>,<partition_id>] [--restore-database-mapping=<src>:<dst>] [--restore-table-mapping=<src>:<dst>] [--on-cluster=<cluster>] [--rbac] [--rm] [--restore-schema-as-non-replicated|--restore-schema-as-replicated] [--restore-uuid=keep|new] [--remote=<name>] <backup_name>",
+			Description: "Download backup and restore it, download is skipped when local backup with the same name exists",
+			Action: func(c *cli.Context) error {
+				opts := chbackup.RestoreOptions{
+					Partitions:            c.String("partitions"),
+					DatabaseMapping:       c.String("restore-database-mapping"),
+					TableMapping:          c.String("restore-table-mapping"),
+					OnCluster:             c.String("on-cluster"),
+					RBAC:                  c.Bool("rbac"),
+					DropIfExists:          c.Bool("rm"),
+					SchemaAsNonReplicated: c.Bool("restore-schema-as-non-replicated"),
+					SchemaAsReplicated:    c.Bool("restore-schema-as-replicated"),
+					UUID:                  c.String("restore-uuid"),
+				}
+				return chbackup.RestoreRemote(context.Background(), *getRemoteConfig(c), c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"), opts)
+			},
+			Flags: append(cliapp.Flags, remoteFlag,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.StringFlag{
+					Name:  "partitions",
+					Usage: "Restore only parts of these partitions, comma separated partition IDs as in system.parts.partition_id",
+				},
+				cli.StringFlag{
+					Name:  "restore-database-mapping",
+					Usage: "Restore tables of databases into other databases, comma separated <src>:<dst> pairs",
+				},
+				cli.StringFlag{
+					Name:  "restore-table-mapping",
+					Usage: "Restore tables with other names, comma separated <src>:<dst> pairs",
+				},
+				cli.StringFlag{
+					Name:  "on-cluster",
+					Usage: "Create schema on all hosts of cluster with ON CLUSTER queries, data is restored on local host only",
+				},
+				cli.BoolFlag{
+					Name:  "rbac",
+					Usage: "Restore users, roles, quotas, settings profiles and row policies",
+				},
+				cli.BoolFlag{
+					Name:  "rm, drop-if-exists",
+					Usage: "Drop existing tables before they are created from backup, tables of Atomic databases are dropped with SYNC",
+				},
+				cli.BoolFlag{
+					Name:  "restore-schema-as-non-replicated",
+					Usage: "Create Replicated*MergeTree tables as *MergeTree without ZooKeeper path and replica name",
+				},
+				cli.BoolFlag{
+					Name:  "restore-schema-as-replicated",
+					Usage: "Create *MergeTree tables as Replicated*MergeTree with clickhouse.default_replica_path and default_replica_name",
+				},
+				cli.StringFlag{
+					Name:  "restore-uuid",
+					Usage: "'keep' restores tables with UUID of backup even when they're renamed, 'new' restores them with new UUID",
+				},
 				cli.BoolFlag{
 					Name:   "schema, s",
 					Hidden: false,
@@ -153,9 +429,19 @@ func main() {
 		{
 			Name:      "delete",
 			Usage:     "Delete specific backup",
-			UsageText: "clickhouse-backup delete <local|remote> <backup_name>",
+			UsageText: "clickhouse-backup delete [--remote=<name>] [--force-cascade] <local|remote> <backup_name>|--label=<key>=<value>",
 			Action: func(c *cli.Context) error {
-				config := getConfig(c)
+				config := getRemoteConfig(c)
+				labels, err := chbackup.ParseLabels(c.StringSlice("label"))
+				if err != nil {
+					return err
+				}
+				if len(labels) > 0 {
+					if c.Args().Get(1) != "" {
+						return fmt.Errorf("backup name and --label can't be used together")
+					}
+					return chbackup.RemoveBackupsByLabels(context.Background(), *config, c.Args().Get(0), labels, c.Bool("force-cascade"))
+				}
 				if c.Args().Get(1) == "" {
 					fmt.Fprintln(os.Stderr, "Backup name must be defined")
 					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
@@ -164,14 +450,65 @@ func main() {
 				case "local":
 					return chbackup.RemoveBackupLocal(*config, c.Args().Get(1))
 				case "remote":
-					return chbackup.RemoveBackupRemote(*config, c.Args().Get(1))
+					return chbackup.RemoveBackupRemote(context.Background(), *config, c.Args().Get(1), c.Bool("force-cascade"))
 				default:
 					fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", c.Args().Get(0))
 					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
 				}
 				return nil
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags, remoteFlag, labelFlag,
+				cli.BoolFlag{
+					Name:  "force-cascade, force",
+					Usage: "Remove remote backups uploaded with --diff-from this backup too, the newest ones first",
+				},
+			),
+		},
+		{
+			Name:      "verify",
+			Usage:     "Verify checksums of files, archives and data parts of backup without restoring it",
+			UsageText: "clickhouse-backup verify [--remote=<name>] <local|remote> <backup_name>",
+			Action: func(c *cli.Context) error {
+				config := getRemoteConfig(c)
+				if c.Args().Get(1) == "" {
+					fmt.Fprintln(os.Stderr, "Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				switch c.Args().Get(0) {
+				case "local":
+					return chbackup.VerifyLocal(context.Background(), *config, c.Args().Get(1))
+				case "remote":
+					return chbackup.VerifyRemote(context.Background(), *config, c.Args().Get(1))
+				default:
+					fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", c.Args().Get(0))
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				return nil
+			},
+			Flags: append(cliapp.Flags, remoteFlag),
+		},
+		{
+			Name:        "describe-remote",
+			Usage:       "Print tables, sizes, partitions and required backups of remote backup without downloading it",
+			UsageText:   "clickhouse-backup describe-remote [--remote=<name>] <backup_name>",
+			Description: "Read only metadata objects of backup: manifest.json, meta.json and dependencies of backups",
+			Action: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					fmt.Fprintln(os.Stderr, "Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				return chbackup.PrintDescribeRemote(context.Background(), *getRemoteConfig(c), c.Args().First())
+			},
+			Flags: append(cliapp.Flags, remoteFlag),
+		},
+		{
+			Name:      "check-remote",
+			Usage:     "Check credentials and permissions of remote storage by writing probe object",
+			UsageText: "clickhouse-backup check-remote [--remote=<name>]",
+			Action: func(c *cli.Context) error {
+				return chbackup.PrintCheckRemote(context.Background(), *getRemoteConfig(c))
+			},
+			Flags: append(cliapp.Flags, remoteFlag),
 		},
 		{
 			Name:  "default-config",
@@ -187,7 +524,7 @@ func main() {
 			UsageText:   "clickhouse-backup freeze [-t, --tables=<db>.<table>] <backup_name>",
 			Description: "Freeze tables",
 			Action: func(c *cli.Context) error {
-				return chbackup.Freeze(*getConfig(c), c.String("t"))
+				return chbackup.Freeze(context.Background(), *getConfig(c), "", c.String("t"), "")
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -204,13 +541,50 @@ func main() {
 			},
 			Flags: cliapp.Flags,
 		},
+		{
+			Name:        "clean_remote_broken",
+			Usage:       "Remove remote backups which can't be downloaded",
+			UsageText:   "clickhouse-backup clean_remote_broken [--remote=<name>] [--dry-run]",
+			Description: "Remove backups left by failed uploads without meta.json and backups with missing objects or required backups, --dry-run only prints them",
+			Action: func(c *cli.Context) error {
+				return chbackup.PrintCleanRemoteBroken(context.Background(), *getRemoteConfig(c))
+			},
+			Flags: append(cliapp.Flags, remoteFlag),
+		},
+		{
+			Name:      "watch",
+			Usage:     "Create and upload backups in cycles, increments against the last full backup",
+			UsageText: "clickhouse-backup watch [-t, --tables=<db>.<table>] [--watch-interval=1h] [--full-interval=24h]",
+			Action: func(c *cli.Context) error {
+				return chbackup.Watch(context.Background(), *getConfig(c), c.String("t"), c.String("watch-interval"), c.String("full-interval"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.StringFlag{
+					Name:  "watch-interval",
+					Usage: "Interval between backups, general.watch_interval by default",
+				},
+				cli.StringFlag{
+					Name:  "full-interval",
+					Usage: "Interval between full backups, general.full_interval by default",
+				},
+			),
+		},
 		{
 			Name:  "server",
 			Usage: "Run API server",
 			Action: func(c *cli.Context) error {
-				return chbackup.Server(*getConfig(c))
+				return chbackup.Server(*getConfig(c), getConfigPath(c), c.Bool("watch"))
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.BoolFlag{
+					Name:  "watch",
+					Usage: "Run watch cycles with general.watch_interval and general.full_interval, state is shown by GET /backup/watch",
+				},
+			),
 		},
 	}
 	if err := cliapp.Run(os.Args); err != nil {
@@ -218,15 +592,33 @@ func main() {
 	}
 }
 
-func getConfig(ctx *cli.Context) *chbackup.Config {
+func getConfigPath(ctx *cli.Context) string {
 	configPath := ctx.String("config")
 	if configPath == defaultConfigPath {
 		configPath = ctx.GlobalString("config")
 	}
+	return configPath
+}
 
-	config, err := chbackup.LoadConfig(configPath)
+func getConfig(ctx *cli.Context) *chbackup.Config {
+	config, err := chbackup.LoadConfig(getConfigPath(ctx))
 	if err != nil {
 		log.Fatal(err)
 	}
+	if ctx.Bool("dry-run") || ctx.GlobalBool("dry-run") {
+		if !dryRunCommands[ctx.Command.Name] {
+			log.Fatalf("--dry-run isn't supported by '%s', only by create, restore, upload, delete and clean_remote_broken", ctx.Command.Name)
+		}
+		config.General.DryRun = true
+	}
 	return config
 }
+
+// getRemoteConfig - config with remote storage selected by '--remote' flag
+func getRemoteConfig(ctx *cli.Context) *chbackup.Config {
+	config, err := getConfig(ctx).WithRemote(ctx.String("remote"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &config
+}
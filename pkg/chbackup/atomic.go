@@ -0,0 +1,202 @@
+package chbackup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// restoreUUIDKeep - tables are restored with UUID of backup even when they're renamed by restore mappings
+	restoreUUIDKeep = "keep"
+	// restoreUUIDNew - tables are restored without UUID of backup, ClickHouse generates new one
+	restoreUUIDNew = "new"
+)
+
+// Data of tables of Atomic databases is placed in 'store/<first 3 chars of uuid>/<uuid>' instead of 'data/<db>/<table>',
+// FREEZE puts it into 'shadow/<N>/store/...', moveShadow puts it into 'shadow/<db>/<table>' of backup by these paths,
+// so backups of Atomic and Ordinary databases have the same layout and can be restored into database of any engine
+
+// GetTableDataPaths - return data paths of MergeTree tables by 'db.table' from system.tables
+func (ch *ClickHouse) GetTableDataPaths() (map[string][]string, error) {
+	var tables []struct {
+		Database  string   `db:"database"`
+		Name      string   `db:"name"`
+		DataPaths []string `db:"data_paths"`
+	}
+	q := "SELECT database, name, data_paths FROM `system`.`tables` WHERE is_temporary = 0 AND engine LIKE '%MergeTree'"
+	if err := ch.conn.Select(&tables, q); err != nil {
+		return nil, fmt.Errorf("can't get data paths of tables with %v", err)
+	}
+	result := make(map[string][]string, len(tables))
+	for _, t := range tables {
+		result[fmt.Sprintf("%s.%s", t.Database, t.Name)] = t.DataPaths
+	}
+	return result, nil
+}
+
+// GetTableDataPath - return data path of table, 'data/<db>/<table>' of data path when it isn't known
+func (ch *ClickHouse) GetTableDataPath(database, table string) (string, error) {
+	var dataPaths [][]string
+	q := fmt.Sprintf("SELECT data_paths FROM `system`.`tables` WHERE database='%s' AND name='%s'", database, table)
+	if err := ch.conn.Select(&dataPaths, q); err == nil && len(dataPaths) == 1 && len(dataPaths[0]) > 0 {
+		return strings.TrimSuffix(dataPaths[0][0], "/"), nil
+	}
+	dataPath, err := ch.GetDataPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataPath, "data", TablePathEncode(database), TablePathEncode(table)), nil
+}
+
+// storePaths - '<db>/<table>' of backup by '<uuid prefix>/<uuid>' in store for tables of Atomic databases
+func storePaths(dataPaths map[string][]string) map[string]string {
+	result := map[string]string{}
+	for fullName, paths := range dataPaths {
+		names := strings.SplitN(fullName, ".", 2)
+		for _, dataPath := range paths {
+			i := strings.LastIndex(dataPath, "/store/")
+			if i == -1 {
+				continue
+			}
+			uuidPath := strings.Trim(dataPath[i+len("/store/"):], "/")
+			result[uuidPath] = path.Join(TablePathEncode(names[0]), TablePathEncode(names[1]))
+		}
+	}
+	return result
+}
+
+// getStorePaths - store paths of tables, ClickHouse without data_paths in system.tables doesn't have Atomic databases
+func getStorePaths(config Config) (map[string]string, error) {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	dataPaths, err := ch.GetTableDataPaths()
+	if err != nil {
+		log.Printf("Tables of Atomic databases aren't supported, %v", err)
+		return map[string]string{}, nil
+	}
+	return storePaths(dataPaths), nil
+}
+
+// walkMetadata - walk metadataPath like filepath.Walk, metadata directories of Atomic databases are symlinks to 'store',
+// they are followed and their files are passed to walkFn with paths inside of metadataPath
+func walkMetadata(metadataPath string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return walkFn(filePath, info, err)
+		}
+		target, err := filepath.EvalSymlinks(filePath)
+		if err != nil {
+			return walkFn(filePath, info, err)
+		}
+		return filepath.Walk(target, func(targetPath string, info os.FileInfo, err error) error {
+			return walkFn(filepath.Join(filePath, strings.TrimPrefix(targetPath, target)), info, err)
+		})
+	})
+}
+
+// namedCreateQuery - query of table of Atomic database is 'ATTACH TABLE _ UUID ...' in metadata, '_' is replaced by name of table,
+// UUID is kept, so restored table gets the same UUID and data path, e.g. for {uuid} macro in ZooKeeper path
+func namedCreateQuery(query, table string) string {
+	match := createQueryNameRE.FindStringSubmatchIndex(query)
+	if match == nil || query[match[6]:match[7]] != "_" {
+		return query
+	}
+	return query[:match[6]] + fmt.Sprintf("`%s`", table) + query[match[7]:]
+}
+
+// withoutUUID - CREATE query without UUID clause and UUID of inner table of materialized view,
+// Ordinary database doesn't accept them, table of Atomic database created without them gets new UUID
+func withoutUUID(query string) string {
+	match := createQueryNameRE.FindStringIndex(query)
+	if match == nil {
+		return query
+	}
+	return query[:match[1]] + innerUUIDRE.ReplaceAllString(createQueryUUIDRE.ReplaceAllString(query[match[1]:], ""), "")
+}
+
+// queryUUID - UUID of CREATE query, empty when query doesn't have it
+func queryUUID(query string) string {
+	match := createQueryNameRE.FindStringIndex(query)
+	if match == nil {
+		return ""
+	}
+	if uuid := createQueryUUIDRE.FindStringSubmatch(query[match[1]:]); uuid != nil {
+		return uuid[1]
+	}
+	return ""
+}
+
+// validateRestoreUUID - value of --restore-uuid, empty value keeps UUID of tables which aren't renamed by restore mappings
+func validateRestoreUUID(value string) error {
+	switch value {
+	case "", restoreUUIDKeep, restoreUUIDNew:
+		return nil
+	}
+	return fmt.Errorf("--restore-uuid should be '%s' or '%s', not '%s'", restoreUUIDKeep, restoreUUIDNew, value)
+}
+
+// GetTableUUID - UUID of table, empty for table of Ordinary database
+func (ch *ClickHouse) GetTableUUID(database, table string) (string, error) {
+	var uuids []string
+	q := fmt.Sprintf("SELECT toString(uuid) FROM `system`.`tables` WHERE database='%s' AND name='%s'", database, table)
+	if err := ch.conn.Select(&uuids, q); err != nil {
+		return "", fmt.Errorf("can't get uuid of table `%s`.`%s` with %v", database, table, err)
+	}
+	if len(uuids) == 0 || uuids[0] == "00000000-0000-0000-0000-000000000000" {
+		return "", nil
+	}
+	return uuids[0], nil
+}
+
+// innerIDTables - inner tables '.inner_id.<uuid of view>' of backup with UUID of restored views, view which is renamed
+// or restored with --restore-uuid=new gets new UUID, so does the name of its inner table and its path in 'store'
+func innerIDTables(ch *ClickHouse, metadataPath string, mapping RestoreMapping, tables []BackupTable) ([]BackupTable, error) {
+	var views RestoreTables
+	for i, table := range tables {
+		if !strings.HasPrefix(table.Name, innerIDTablePrefix) {
+			continue
+		}
+		if views == nil {
+			var err error
+			if views, err = parseSchemaPattern(metadataPath, ""); err != nil {
+				return nil, err
+			}
+		}
+		for _, view := range views {
+			if queryUUID(view.Query) != strings.TrimPrefix(table.Name, innerIDTablePrefix) {
+				continue
+			}
+			uuid, err := ch.GetTableUUID(mapping.database(view.Database), mapping.table(view.Table))
+			if err != nil {
+				return nil, err
+			}
+			if uuid != "" {
+				tables[i].Name = innerIDTablePrefix + uuid
+			}
+			break
+		}
+	}
+	return tables, nil
+}
+
+// GetDatabaseEngine - return engine of database
+func (ch *ClickHouse) GetDatabaseEngine(database string) (string, error) {
+	var engines []string
+	q := fmt.Sprintf("SELECT engine FROM `system`.`databases` WHERE name='%s'", database)
+	if err := ch.conn.Select(&engines, q); err != nil {
+		return "", fmt.Errorf("can't get engine of database `%s` with %v", database, err)
+	}
+	if len(engines) == 0 {
+		return "", fmt.Errorf("database `%s` doesn't exist", database)
+	}
+	return engines[0], nil
+}
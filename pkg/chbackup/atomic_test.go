@@ -0,0 +1,78 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoveShadowOfAtomicTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	shadowPath := filepath.Join(dir, "shadow")
+	backupPath := filepath.Join(dir, "backup")
+	files := []string{
+		"1/data/default/events/all_1_1_0/data.bin",
+		"1/store/f5b/f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c/all_2_2_0/data.bin",
+		"1/store/abc/abc00000-0000-0000-0000-000000000000/all_3_3_0/data.bin",
+	}
+	for _, file := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(shadowPath, file)), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(shadowPath, file), []byte("data"), 0640))
+	}
+	paths := storePaths(map[string][]string{
+		"atomic.my.table": {"/var/lib/clickhouse/store/f5b/f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c/"},
+		"default.events":  {"/var/lib/clickhouse/data/default/events/"},
+	})
+	assert.Equal(t, map[string]string{"f5b/f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c": "atomic/my%2Etable"}, paths)
+	parts, err := moveShadow(context.Background(), shadowPath, backupPath, paths, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default/events/all_1_1_0", "atomic/my%2Etable/all_2_2_0"}, parts)
+	assert.FileExists(t, filepath.Join(backupPath, "default/events/all_1_1_0/data.bin"))
+	assert.FileExists(t, filepath.Join(backupPath, "atomic/my%2Etable/all_2_2_0/data.bin"))
+	assert.NoDirExists(t, filepath.Join(backupPath, "abc"))
+}
+
+func TestAtomicMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storeMetadata := filepath.Join(dir, "store", "f5b", "f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c")
+	require.NoError(t, os.MkdirAll(storeMetadata, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(storeMetadata, "events.sql"), []byte("ATTACH TABLE _ UUID '0a6c0000-0a6c-4a4d-9e4e-3e1c2f3a4b5c' (`date` Date) ENGINE = MergeTree() ORDER BY date"), 0640))
+	metadataPath := filepath.Join(dir, "metadata")
+	require.NoError(t, os.MkdirAll(metadataPath, os.ModePerm))
+	require.NoError(t, os.Symlink(storeMetadata, filepath.Join(metadataPath, "atomic")))
+
+	tables, err := parseSchemaPattern(metadataPath, "atomic.*")
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "events", tables[0].Table)
+	assert.Equal(t, filepath.Join(metadataPath, "atomic", "events.sql"), tables[0].Path)
+	assert.Equal(t, "CREATE TABLE `events` UUID '0a6c0000-0a6c-4a4d-9e4e-3e1c2f3a4b5c' (`date` Date) ENGINE = MergeTree() ORDER BY date", tables[0].Query)
+	assert.Equal(t, "CREATE TABLE `events` (`date` Date) ENGINE = MergeTree() ORDER BY date", withoutUUID(tables[0].Query))
+}
+
+func TestRestoreUUID(t *testing.T) {
+	view := "CREATE MATERIALIZED VIEW `mv` UUID 'f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c' TO INNER UUID '0a6c0000-0a6c-4a4d-9e4e-3e1c2f3a4b5c' (`date` Date) ENGINE = MergeTree() ORDER BY date AS SELECT date FROM events"
+	assert.Equal(t, "f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c", queryUUID(view))
+	assert.Equal(t, "", queryUUID("CREATE TABLE `events` (`date` Date) ENGINE = Log"))
+	assert.Equal(t, "CREATE MATERIALIZED VIEW `mv` (`date` Date) ENGINE = MergeTree() ORDER BY date AS SELECT date FROM events", withoutUUID(view))
+
+	table := RestoreTable{Database: "prod", Table: "events", Query: "CREATE TABLE `events` UUID 'f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c' (`date` Date) ENGINE = Log"}
+	mapping, err := parseRestoreMapping("prod:staging", "")
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE `events` (`date` Date) ENGINE = Log", mapping.restoreTable(table).Query)
+	mapping.KeepUUID = true
+	assert.Equal(t, table.Query, mapping.restoreTable(table).Query)
+
+	assert.NoError(t, validateRestoreUUID(""))
+	assert.NoError(t, validateRestoreUUID(restoreUUIDNew))
+	assert.Error(t, validateRestoreUUID("random"))
+}
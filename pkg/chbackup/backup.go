@@ -1,6 +1,7 @@
 package chbackup
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -22,6 +23,8 @@ const (
 var (
 	// ErrUnknownClickhouseDataPath -
 	ErrUnknownClickhouseDataPath = errors.New("clickhouse data path is unknown, you can set data_path in config file")
+	// ErrBackupNotFound - wrapped by errors when requested backup doesn't exist
+	ErrBackupNotFound = errors.New("backup not found")
 )
 
 func addTable(tables []Table, table Table) []Table {
@@ -55,11 +58,11 @@ func parseTablePatternForFreeze(tables []Table, tablePattern string) []Table {
 	if tablePattern == "" {
 		return tables
 	}
-	tablePatterns := strings.Split(tablePattern, ",")
+	tablePatterns := withInnerTablePatterns(splitTablePattern(tablePattern))
 	var result []Table
 	for _, t := range tables {
 		for _, pattern := range tablePatterns {
-			if matched, _ := filepath.Match(pattern, fmt.Sprintf("%s.%s", t.Database, t.Name)); matched {
+			if matchPattern(pattern, fmt.Sprintf("%s.%s", t.Database, t.Name)) {
 				result = addTable(result, t)
 			}
 		}
@@ -70,13 +73,13 @@ func parseTablePatternForFreeze(tables []Table, tablePattern string) []Table {
 func parseTablePatternForRestoreData(tables map[string]BackupTable, tablePattern string) []BackupTable {
 	tablePatterns := []string{"*"}
 	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
+		tablePatterns = withInnerTablePatterns(splitTablePattern(tablePattern))
 	}
 	result := BackupTables{}
 	for _, t := range tables {
 		for _, pattern := range tablePatterns {
 			tableName := fmt.Sprintf("%s.%s", t.Database, t.Name)
-			if matched, _ := filepath.Match(pattern, tableName); matched {
+			if matchPattern(pattern, tableName) {
 				result = addBackupTable(result, t)
 			}
 		}
@@ -86,14 +89,15 @@ func parseTablePatternForRestoreData(tables map[string]BackupTable, tablePattern
 }
 
 func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables, error) {
+	dictionaries := RestoreTables{}
 	regularTables := RestoreTables{}
 	distributedTables := RestoreTables{}
 	viewTables := RestoreTables{}
 	tablePatterns := []string{"*"}
 	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
+		tablePatterns = withInnerTablePatterns(splitTablePattern(tablePattern))
 	}
-	if err := filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
+	if err := walkMetadata(metadataPath, func(filePath string, info os.FileInfo, err error) error {
 		if !strings.HasSuffix(filePath, ".sql") || !info.Mode().IsRegular() {
 			return nil
 		}
@@ -107,7 +111,7 @@ func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables
 		table, _ := url.PathUnescape(parts[1])
 		tableName := fmt.Sprintf("%s.%s", database, table)
 		for _, p := range tablePatterns {
-			if matched, _ := filepath.Match(p, tableName); matched {
+			if matchPattern(p, tableName) {
 				data, err := ioutil.ReadFile(filePath)
 				if err != nil {
 					return err
@@ -115,9 +119,15 @@ func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables
 				restoreTable := RestoreTable{
 					Database: database,
 					Table:    table,
-					Query:    strings.Replace(string(data), "ATTACH", "CREATE", 1),
+					Query:    namedCreateQuery(strings.Replace(string(data), "ATTACH", "CREATE", 1), table),
 					Path:     filePath,
 				}
+				// dictionaries are created before tables which use dictGet in expressions, source tables of dictionaries
+				// aren't required on creation because dictionaries are loaded on first use
+				if strings.HasPrefix(restoreTable.Query, "CREATE DICTIONARY") {
+					dictionaries = addRestoreTable(dictionaries, restoreTable)
+					return nil
+				}
 				if strings.Contains(restoreTable.Query, "ENGINE = Distributed") {
 					distributedTables = addRestoreTable(distributedTables, restoreTable)
 					return nil
@@ -135,10 +145,13 @@ func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables
 	}); err != nil {
 		return nil, err
 	}
+	dictionaries.Sort()
 	regularTables.Sort()
 	distributedTables.Sort()
 	viewTables.Sort()
-	result := append(regularTables, distributedTables...)
+	viewTables = sortViews(viewTables)
+	result := append(dictionaries, regularTables...)
+	result = append(result, distributedTables...)
 	result = append(result, viewTables...)
 	return result, nil
 }
@@ -177,10 +190,10 @@ func PrintTables(config Config) error {
 	return nil
 }
 
-func restoreSchema(config Config, backupName string, tablePattern string) error {
+func restoreSchema(ctx context.Context, config Config, backupName string, tablePattern string, mapping RestoreMapping, opts RestoreOptions) error {
 	if backupName == "" {
 		fmt.Println("Select backup for restore:")
-		PrintLocalBackups(config, "all")
+		PrintLocalBackups(config, "all", nil)
 		os.Exit(1)
 	}
 	dataPath := getDataPath(config)
@@ -199,6 +212,7 @@ func restoreSchema(config Config, backupName string, tablePattern string) error
 	if err != nil {
 		return err
 	}
+	tablesForRestore = newTableFilter(config.ClickHouse).restoreTables(tablesForRestore)
 	if len(tablesForRestore) == 0 {
 		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
 	}
@@ -210,13 +224,62 @@ func restoreSchema(config Config, backupName string, tablePattern string) error
 	}
 	defer ch.Close()
 
+	if err := restoreDictionaryConfigs(path.Join(dataPath, "backup", backupName)); err != nil {
+		return err
+	}
+	journal, err := loadRestoreJournal(dataPath, backupName)
+	if err != nil {
+		return err
+	}
 	for _, schema := range tablesForRestore {
-		if err := ch.CreateDatabase(schema.Database); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isInnerTable(schema.Table) {
+			log.Printf("Skip `%s`.`%s`, it is created by its materialized view", schema.Database, schema.Table)
+			continue
+		}
+		schema = mapping.restoreTable(schema)
+		if opts.SchemaAsNonReplicated {
+			schema.Query = nonReplicatedQuery(schema.Query)
+		} else if opts.SchemaAsReplicated {
+			schema.Query = replicatedQuery(schema.Query, config.ClickHouse.DefaultReplicaPath, config.ClickHouse.DefaultReplicaName)
+		}
+		if journal.isCreated(schema.Database, schema.Table) {
+			exists, err := ch.TableExists(schema.Database, schema.Table)
+			if err != nil {
+				return err
+			}
+			if exists {
+				log.Printf("Skip `%s`.`%s`, it is created by previous restore", schema.Database, schema.Table)
+				continue
+			}
+		}
+		publishTableEvent("restore", backupName, schema.Database, schema.Table)
+		if opts.DropIfExists {
+			if err := ch.DropTable(schema, opts.OnCluster); err != nil {
+				return fmt.Errorf("can't drop table `%s`.`%s` %v", schema.Database, schema.Table, err)
+			}
+		}
+		if opts.OnCluster != "" {
+			if err := ch.CreateDatabaseOnCluster(schema.Database, opts.OnCluster); err != nil {
+				return fmt.Errorf("can't create database `%s` on cluster '%s' %v", schema.Database, opts.OnCluster, err)
+			}
+			schema.Query = onClusterQuery(schema, opts.OnCluster)
+		} else if err := ch.CreateDatabase(schema.Database); err != nil {
 			return fmt.Errorf("can't create database `%s` %v", schema.Database, err)
 		}
+		if opts.UUID == restoreUUIDNew {
+			schema.Query = withoutUUID(schema.Query)
+		} else if engine, err := ch.GetDatabaseEngine(schema.Database); err == nil && engine == "Ordinary" {
+			schema.Query = withoutUUID(schema.Query)
+		}
 		if err := ch.CreateTable(schema); err != nil {
 			return fmt.Errorf("can't create table `%s`.`%s` %v", schema.Database, schema.Table, err)
 		}
+		if err := journal.created(schema.Database, schema.Table); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -239,9 +302,9 @@ func printBackups(backupList []Backup, format string, printSize bool) error {
 		}
 		for _, backup := range backupList {
 			if printSize {
-				fmt.Printf("- '%s'\t%s\t(created at %s)\n", backup.Name, FormatBytes(backup.Size), backup.Date.Format("02-01-2006 15:04:05"))
+				fmt.Printf("- '%s'\t%s\t(created at %s)%s\n", backup.Name, FormatBytes(backup.Size), backup.Date.Format("02-01-2006 15:04:05"), backupDetails(backup))
 			} else {
-				fmt.Printf("- '%s'\t(created at %s)\n", backup.Name, backup.Date.Format("02-01-2006 15:04:05"))
+				fmt.Printf("- '%s'\t(created at %s)%s\n", backup.Name, backup.Date.Format("02-01-2006 15:04:05"), backupDetails(backup))
 			}
 		}
 	default:
@@ -250,13 +313,13 @@ func printBackups(backupList []Backup, format string, printSize bool) error {
 	return nil
 }
 
-// PrintLocalBackups - print all backups stored locally
-func PrintLocalBackups(config Config, format string) error {
+// PrintLocalBackups - print all backups stored locally, only backups with all labels when labels aren't empty
+func PrintLocalBackups(config Config, format string, labels map[string]string) error {
 	backupList, err := ListLocalBackups(config)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return printBackups(backupList, format, false)
+	return printBackups(FilterBackups(backupList, BackupFilter{Labels: labels}), format, false)
 }
 
 // ListLocalBackups - return slice of all backups stored locally
@@ -284,10 +347,16 @@ func ListLocalBackups(config Config) ([]Backup, error) {
 		if !info.IsDir() {
 			continue
 		}
-		result = append(result, Backup{
+		backup := Backup{
 			Name: name,
 			Date: info.ModTime(),
-		})
+		}
+		manifest, err := readManifest(path.Join(backupsPath, name))
+		if err != nil {
+			log.Printf("can't read %s of '%s' with %v", ManifestFileName, name, err)
+		}
+		backup.setManifest(manifest)
+		result = append(result, backup)
 	}
 	sort.SliceStable(result, func(i, j int) bool {
 		return result[i].Date.Before(result[j].Date)
@@ -295,8 +364,8 @@ func ListLocalBackups(config Config) ([]Backup, error) {
 	return result, nil
 }
 
-// getRemoteBackups - get all backups stored on remote storage
-func getRemoteBackups(config Config) ([]Backup, error) {
+// getRemoteBackups - get all backups stored on remote storage with details and labels from manifest.json
+func getRemoteBackups(ctx context.Context, config Config) ([]Backup, error) {
 	if config.General.RemoteStorage == "none" {
 		fmt.Println("PrintRemoteBackups aborted: RemoteStorage set to \"none\"")
 		return []Backup{}, nil
@@ -310,24 +379,46 @@ func getRemoteBackups(config Config) ([]Backup, error) {
 		return []Backup{}, err
 	}
 
-	backupList, err := bd.BackupList()
+	backupList, err := bd.BackupList(ctx)
 	if err != nil {
 		return []Backup{}, err
 	}
-	return backupList, err
+	return bd.withManifests(ctx, backupList)
+}
+
+// GetRemoteBackup - find backup on remote storage by name
+func GetRemoteBackup(ctx context.Context, config Config, backupName string) (Backup, error) {
+	backupList, err := getRemoteBackups(ctx, config)
+	if err != nil {
+		return Backup{}, err
+	}
+	for _, backup := range backupList {
+		if backup.Name == backupName {
+			return backup, nil
+		}
+	}
+	return Backup{}, fmt.Errorf("%w: '%s' on remote storage", ErrBackupNotFound, backupName)
 }
 
-// PrintRemoteBackups - print all backups stored on remote storage
-func PrintRemoteBackups(config Config, format string) error {
-	backupList, err := getRemoteBackups(config)
+// PrintRemoteBackups - print all backups stored on remote storage, only backups with all labels when labels aren't empty
+func PrintRemoteBackups(ctx context.Context, config Config, format string, labels map[string]string) error {
+	if config.General.RemoteStorage == "none" {
+		fmt.Println("PrintRemoteBackups aborted: RemoteStorage set to \"none\"")
+		return nil
+	}
+	backupList, err := getRemoteBackups(ctx, config)
 	if err != nil {
 		return err
 	}
-	return printBackups(backupList, format, true)
+	return printBackups(FilterBackups(backupList, BackupFilter{Labels: labels}), format, true)
 }
 
-// Freeze - freeze tables by tablePattern
-func Freeze(config Config, tablePattern string) error {
+// Freeze - freeze tables by tablePattern, only partitions from comma separated list of partition IDs when partitions isn't empty,
+// freeze events are published for backupName, which is empty for standalone freeze
+func Freeze(ctx context.Context, config Config, backupName, tablePattern, partitions string) error {
+	if err := validatePatterns("--tables", splitTablePattern(tablePattern)); err != nil {
+		return err
+	}
 	ch := &ClickHouse{
 		Config: &config.ClickHouse,
 	}
@@ -340,15 +431,20 @@ func Freeze(config Config, tablePattern string) error {
 	if err != nil || dataPath == "" {
 		return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
 	}
-
-	shadowPath := filepath.Join(dataPath, "shadow")
-	files, err := ioutil.ReadDir(shadowPath)
+	disks, err := ch.GetDisks()
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("can't read %s directory: %v", shadowPath, err)
+		return err
+	}
+	for _, disk := range disks {
+		shadowPath := filepath.Join(disk.Path, "shadow")
+		files, err := ioutil.ReadDir(shadowPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("can't read %s directory: %v", shadowPath, err)
+			}
+		} else if len(files) > 0 {
+			return fmt.Errorf("'%s' is not empty, execute 'clean' command first", shadowPath)
 		}
-	} else if len(files) > 0 {
-		return fmt.Errorf("'%s' is not empty, execute 'clean' command first", shadowPath)
 	}
 
 	allTables, err := ch.GetTables()
@@ -359,16 +455,30 @@ func Freeze(config Config, tablePattern string) error {
 	if len(backupTables) == 0 {
 		return fmt.Errorf("there are no tables in Clickhouse, create something to freeze")
 	}
+	partitionIDs := parsePartitions(partitions)
+	tables := map[string]Table{}
+	names := []string{}
 	for _, table := range backupTables {
 		if table.Skip {
 			log.Printf("Skip `%s`.`%s`", table.Database, table.Name)
 			continue
 		}
-		if err := ch.FreezeTable(table); err != nil {
-			return err
-		}
+		name := fmt.Sprintf("%s.%s", table.Database, table.Name)
+		tables[name] = table
+		names = append(names, name)
 	}
-	return nil
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = runArchiveWorkers(ctx, config.General.CreateConcurrency, "freeze", names, func(name string) error {
+		table := tables[name]
+		publishTableEvent("freeze", backupName, table.Database, table.Name)
+		return ch.FreezeTable(table, partitionIDs)
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
 }
 
 // NewBackupName - return default backup name
@@ -378,23 +488,70 @@ func NewBackupName() string {
 
 // CreateBackup - create new backup of all tables matched by tablePattern
 // If backupName is empty string will use default backup name
-func CreateBackup(config Config, backupName, tablePattern string) error {
+// When ctx is cancelled partially created backup is removed
+// When rbac is set users, roles, quotas, settings profiles and row policies are saved too
+// Labels are saved to manifest.json of backup
+func CreateBackup(ctx context.Context, config Config, backupName, tablePattern, partitions, diffFrom string, rbac bool, labels map[string]string) error {
 	if backupName == "" {
 		backupName = NewBackupName()
 	}
+	if err := validatePatterns("--tables", splitTablePattern(tablePattern)); err != nil {
+		return err
+	}
+	if config.General.DryRun {
+		return dryRunCreate(config, backupName, tablePattern, partitions, diffFrom, rbac)
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
 	}
+	diffFromPath := ""
+	if diffFrom != "" {
+		if err := GetLocalBackup(config, diffFrom); err != nil {
+			return fmt.Errorf("can't create backup with %v", err)
+		}
+		diffFromPath = path.Join(dataPath, "backup", diffFrom)
+		if err := checkDiffFromPath(diffFromPath); err != nil {
+			return err
+		}
+	}
 	backupPath := path.Join(dataPath, "backup", backupName)
 	if _, err := os.Stat(backupPath); err == nil || !os.IsNotExist(err) {
 		return fmt.Errorf("can't create backup with '%s' already exists", backupPath)
 	}
+	if config.ClickHouse.UseEmbeddedBackupRestore {
+		if partitions != "" || rbac || len(labels) > 0 {
+			return fmt.Errorf("partitions, RBAC and labels aren't supported for embedded backups")
+		}
+		if diffFromPath != "" && !isEmbeddedBackup(diffFromPath) {
+			return fmt.Errorf("'%s' isn't embedded backup and can't be base of embedded backup", diffFrom)
+		}
+		log.Printf("Create embedded backup '%s'", backupName)
+		if err := createEmbeddedBackup(ctx, config, backupName, tablePattern, diffFrom); err != nil {
+			return err
+		}
+		return RemoveOldBackupsLocal(config)
+	}
 	if err := os.MkdirAll(backupPath, os.ModePerm); err != nil {
 		return fmt.Errorf("can't create backup with %v", err)
 	}
 	log.Printf("Create backup '%s'", backupName)
-	if err := Freeze(config, tablePattern); err != nil {
+	err := createBackup(ctx, config, dataPath, backupName, tablePattern, partitions, diffFromPath, rbac, labels)
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Backup '%s' is cancelled, removing", backupName)
+		if err := os.RemoveAll(backupPath); err != nil {
+			log.Printf("can't remove '%s' with %v", backupPath, err)
+		}
+		if err := Clean(config); err != nil {
+			log.Printf("can't clean shadow with %v", err)
+		}
+	}
+	return err
+}
+
+func createBackup(ctx context.Context, config Config, dataPath, backupName, tablePattern, partitions, diffFromPath string, rbac bool, labels map[string]string) error {
+	backupPath := path.Join(dataPath, "backup", backupName)
+	if err := Freeze(ctx, config, backupName, tablePattern, partitions); err != nil {
 		return err
 	}
 	log.Println("Copy metadata")
@@ -402,17 +559,12 @@ func CreateBackup(config Config, backupName, tablePattern string) error {
 	if err != nil {
 		return err
 	}
+	skipTables := newTableFilter(config.ClickHouse)
 	for _, schema := range schemaList {
-		skip := false
-		for _, filter := range config.ClickHouse.SkipTables {
-			if matched, _ := filepath.Match(filter, fmt.Sprintf("%s.%s", schema.Database, schema.Table)); matched {
-				skip = true
-				break
-			}
-		}
-		if skip {
+		if skipTables.skip(schema.Database, schema.Table) {
 			continue
 		}
+		publishTableEvent("create", backupName, schema.Database, schema.Table)
 		relativePath := strings.Trim(strings.TrimPrefix(schema.Path, path.Join(dataPath, "metadata")), "/")
 		newPath := path.Join(backupPath, "metadata", relativePath)
 		if err := copyFile(schema.Path, newPath); err != nil {
@@ -420,16 +572,53 @@ func CreateBackup(config Config, backupName, tablePattern string) error {
 		}
 	}
 	log.Println("  Done.")
+	if err := backupFileTables(ctx, config, backupPath, tablePattern, partitions); err != nil {
+		return err
+	}
+	if err := backupDictionaryConfigs(config, backupPath); err != nil {
+		return err
+	}
+	if rbac {
+		if err := createBackupRBAC(config, backupPath); err != nil {
+			return fmt.Errorf("can't backup RBAC with %v", err)
+		}
+	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	log.Println("Move shadow")
 	backupShadowDir := path.Join(backupPath, "shadow")
 	if err := os.MkdirAll(backupShadowDir, os.ModePerm); err != nil {
 		return err
 	}
-	shadowDir := path.Join(dataPath, "shadow")
-	if err := moveShadow(shadowDir, backupShadowDir); err != nil {
+	storePaths, err := getStorePaths(config)
+	if err != nil {
+		return err
+	}
+	disks, err := getDisks(config)
+	if err != nil {
 		return err
 	}
+	partDisks, err := moveDisksShadow(ctx, disks, backupShadowDir, storePaths, config.General.CreateConcurrency)
+	if err != nil {
+		return err
+	}
+	if err := writePartDisks(backupPath, partDisks); err != nil {
+		return fmt.Errorf("can't save disks of parts with %v", err)
+	}
+	if diffFromPath != "" {
+		linked, total, err := linkUnchangedParts(backupPath, diffFromPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d of %d parts are unchanged since '%s'", linked, total, filepath.Base(diffFromPath))
+	} else if config.General.DedupLocalParts {
+		dedupPreviousBackup(config, backupName, backupPath)
+	}
+	if err := writeManifest(config, backupPath, diffFromPath, partDisks, labels); err != nil {
+		return fmt.Errorf("can't save %s with %v", ManifestFileName, err)
+	}
 	if err := RemoveOldBackupsLocal(config); err != nil {
 		return err
 	}
@@ -437,30 +626,82 @@ func CreateBackup(config Config, backupName, tablePattern string) error {
 	return nil
 }
 
+// RestoreOptions - optional arguments of restore
+type RestoreOptions struct {
+	// Partitions - comma separated list of partition IDs, parts of other partitions aren't attached
+	Partitions string
+	// DatabaseMapping, TableMapping - comma separated 'src:dst' pairs, tables are restored with new names
+	DatabaseMapping string
+	TableMapping    string
+	// OnCluster - cluster to create schema on with ON CLUSTER queries, data is restored on local host only
+	OnCluster string
+	// RBAC - re-create users, roles, quotas, settings profiles and row policies saved by create --rbac before tables
+	RBAC bool
+	// DropIfExists - drop existing tables by restore --rm before they are created from backup
+	DropIfExists bool
+	// SchemaAsNonReplicated - create Replicated*MergeTree tables as *MergeTree, e.g. to restore backup of replica on standalone server
+	SchemaAsNonReplicated bool
+	// SchemaAsReplicated - create *MergeTree tables as Replicated*MergeTree with clickhouse.default_replica_path and default_replica_name
+	SchemaAsReplicated bool
+	// UUID - 'keep' restores all tables with UUID of backup, 'new' restores them with new UUID,
+	// by default UUID is kept for tables which aren't renamed by mappings
+	UUID string
+}
+
 // Restore - restore tables matched by tablePattern from backupName
-func Restore(config Config, backupName string, tablePattern string, schemaOnly bool, dataOnly bool) error {
+func Restore(ctx context.Context, config Config, backupName, tablePattern string, schemaOnly bool, dataOnly bool, opts RestoreOptions) error {
+	if err := validatePatterns("--tables", splitTablePattern(tablePattern)); err != nil {
+		return err
+	}
+	if opts.SchemaAsNonReplicated && opts.SchemaAsReplicated {
+		return fmt.Errorf("--restore-schema-as-non-replicated and --restore-schema-as-replicated can't be used together")
+	}
+	if err := validateRestoreUUID(opts.UUID); err != nil {
+		return err
+	}
+	if config.General.DryRun {
+		return dryRunRestore(config, backupName, tablePattern, schemaOnly, dataOnly, opts)
+	}
+	if dataPath := getDataPath(config); dataPath != "" && backupName != "" && isEmbeddedBackup(path.Join(dataPath, "backup", backupName)) {
+		return restoreEmbeddedBackup(ctx, config, backupName, tablePattern, schemaOnly, dataOnly, opts)
+	}
+	mapping, err := parseRestoreMapping(opts.DatabaseMapping, opts.TableMapping)
+	if err != nil {
+		return err
+	}
+	mapping.KeepUUID = opts.UUID == restoreUUIDKeep
+	if opts.RBAC {
+		if err := restoreRBAC(config, backupName); err != nil {
+			return err
+		}
+	}
 	if schemaOnly || (schemaOnly == dataOnly) {
-		err := restoreSchema(config, backupName, tablePattern)
+		err := restoreSchema(ctx, config, backupName, tablePattern, mapping, opts)
 		if err != nil {
 			return err
 		}
 	}
 	if dataOnly || (schemaOnly == dataOnly) {
-		err := RestoreData(config, backupName, tablePattern)
+		err := RestoreData(ctx, config, backupName, tablePattern, opts)
 		if err != nil {
 			return err
 		}
+		removeRestoreJournal(getDataPath(config), backupName)
 	}
 	return nil
 }
 
 // RestoreData - restore data for tables matched by tablePattern from backupName
-func RestoreData(config Config, backupName string, tablePattern string) error {
+func RestoreData(ctx context.Context, config Config, backupName, tablePattern string, opts RestoreOptions) error {
 	if backupName == "" {
 		fmt.Println("Select backup for restore:")
-		PrintLocalBackups(config, "all")
+		PrintLocalBackups(config, "all", nil)
 		os.Exit(1)
 	}
+	mapping, err := parseRestoreMapping(opts.DatabaseMapping, opts.TableMapping)
+	if err != nil {
+		return err
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
@@ -477,13 +718,37 @@ func RestoreData(config Config, backupName string, tablePattern string) error {
 	if err != nil {
 		return err
 	}
-	restoreTables := parseTablePatternForRestoreData(allBackupTables, tablePattern)
+	restoreTables := newTableFilter(config.ClickHouse).backupTables(parseTablePatternForRestoreData(allBackupTables, tablePattern))
 	chTables, err := ch.GetTables()
 	if err != nil {
 		return err
 	}
 	if len(restoreTables) == 0 {
-		return fmt.Errorf("backup doesn't have tables to restore")
+		fileTables, err := listFileTables(path.Join(dataPath, "backup", backupName), newTableFilter(config.ClickHouse).withTablePattern(tablePattern))
+		if err != nil {
+			return err
+		}
+		if len(fileTables) == 0 {
+			return fmt.Errorf("backup doesn't have tables to restore")
+		}
+	}
+	if partitionIDs := parsePartitions(opts.Partitions); len(partitionIDs) > 0 {
+		filtered := []BackupTable{}
+		for _, table := range restoreTables {
+			if table = filterPartitions(table, partitionIDs); len(table.Partitions) > 0 {
+				filtered = append(filtered, table)
+			}
+		}
+		if len(filtered) == 0 {
+			return fmt.Errorf("backup doesn't have partitions %s of tables to restore", strings.Join(partitionIDs, ", "))
+		}
+		restoreTables = filtered
+	}
+	for i := range restoreTables {
+		restoreTables[i] = mapping.backupTable(restoreTables[i])
+	}
+	if restoreTables, err = innerIDTables(ch, path.Join(dataPath, "backup", backupName, "metadata"), mapping, restoreTables); err != nil {
+		return err
 	}
 	missingTables := []string{}
 	for _, restoreTable := range restoreTables {
@@ -501,15 +766,32 @@ func RestoreData(config Config, backupName string, tablePattern string) error {
 	if len(missingTables) > 0 {
 		return fmt.Errorf("%s is not created. Restore schema first or create missing tables manually", strings.Join(missingTables, ", "))
 	}
+	journal, err := loadRestoreJournal(dataPath, backupName)
+	if err != nil {
+		return err
+	}
 	for _, table := range restoreTables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if table = journal.pendingParts(table); len(table.Partitions) == 0 {
+			log.Printf("Skip `%s`.`%s`, its parts are attached by previous restore", table.Database, table.Name)
+			continue
+		}
+		publishTableEvent("restore", backupName, table.Database, table.Name)
 		if err := ch.CopyData(table); err != nil {
 			return fmt.Errorf("can't restore `%s`.`%s` with %v", table.Database, table.Name, err)
 		}
-		if err := ch.AttachPatritions(table); err != nil {
-			return fmt.Errorf("can't attach partitions for table '%s.%s' with %v", table.Database, table.Name, err)
+		for _, part := range table.Partitions {
+			if err := ch.AttachPart(table, part.Name); err != nil {
+				return fmt.Errorf("can't attach partitions for table '%s.%s' with %v", table.Database, table.Name, err)
+			}
+			if err := journal.attached(table.Database, table.Name, part.Name); err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	return restoreFileTables(ctx, config, backupName, tablePattern, opts)
 }
 
 func getDataPath(config Config) string {
@@ -541,19 +823,27 @@ func GetLocalBackup(config Config, backupName string) error {
 			return nil
 		}
 	}
-	return fmt.Errorf("backup '%s' not found", backupName)
+	return fmt.Errorf("%w: '%s'", ErrBackupNotFound, backupName)
 }
 
-func Upload(config Config, backupName string, diffFrom string) error {
+// Upload - upload local backup to remote storage, partially uploaded archive is removed when ctx is cancelled.
+// Only tables matched by tablePattern are uploaded when it's set
+func Upload(ctx context.Context, config Config, backupName, diffFrom, tablePattern string) error {
 	if config.General.RemoteStorage == "none" {
 		fmt.Println("Upload aborted: RemoteStorage set to \"none\"")
 		return nil
 	}
 	if backupName == "" {
 		fmt.Println("Select backup for upload:")
-		PrintLocalBackups(config, "all")
+		PrintLocalBackups(config, "all", nil)
 		os.Exit(1)
 	}
+	if err := validatePatterns("--tables", splitTablePattern(tablePattern)); err != nil {
+		return err
+	}
+	if config.General.DryRun {
+		return dryRunUpload(ctx, config, backupName, diffFrom, tablePattern)
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
@@ -563,6 +853,7 @@ func Upload(config Config, backupName string, diffFrom string) error {
 	if err != nil {
 		return err
 	}
+	bd.skipTables = bd.skipTables.withTablePattern(tablePattern)
 
 	err = bd.Connect()
 	if err != nil {
@@ -572,32 +863,67 @@ func Upload(config Config, backupName string, diffFrom string) error {
 	if err := GetLocalBackup(config, backupName); err != nil {
 		return fmt.Errorf("can't upload with %s", err)
 	}
+	if err := bd.checkTablesUpload(ctx, backupName, tablePattern); err != nil {
+		return err
+	}
 	backupPath := path.Join(dataPath, "backup", backupName)
 	log.Printf("Upload backup '%s'", backupName)
 	diffFromPath := ""
 	if diffFrom != "" {
 		diffFromPath = path.Join(dataPath, "backup", diffFrom)
 	}
-	if err := bd.CompressedStreamUpload(backupPath, backupName, diffFromPath); err != nil {
+	upload := bd.CompressedStreamUpload
+	compressionFormat := bd.compressionFormat
+	switch {
+	case bd.remoteLayout == casLayout:
+		upload = bd.CASUpload
+		compressionFormat = "none"
+	case bd.uploadFormat == directoryLayout:
+		upload = bd.DirectoryUpload
+		compressionFormat = "none"
+	case bd.uploadConcurrency > 1 || bd.maxFileSize > 0:
+		upload = bd.TableStreamUpload
+	}
+	if err := setManifestCompression(backupPath, compressionFormat); err != nil {
+		return fmt.Errorf("can't update %s with %v", ManifestFileName, err)
+	}
+	// backup isn't listed until manifest is put again with 'completed' after all files
+	if err := bd.putManifest(ctx, backupPath, backupName, manifestUploading); err != nil {
+		return fmt.Errorf("can't upload %s with %v", ManifestFileName, err)
+	}
+	if err := upload(ctx, backupPath, backupName, diffFromPath); err != nil {
 		return fmt.Errorf("can't upload with %v", err)
 	}
-	if err := bd.RemoveOldBackups(bd.BackupsToKeep()); err != nil {
+	if err := bd.putManifest(ctx, backupPath, backupName, manifestCompleted); err != nil {
+		return fmt.Errorf("can't upload %s with %v", ManifestFileName, err)
+	}
+	if config.General.DeleteLocalAfterUpload {
+		if err := bd.removeUploadedBackup(ctx, config, backupName, tablePattern); err != nil {
+			return err
+		}
+	}
+	if err := bd.RemoveOldBackups(ctx, bd.Retention()); err != nil {
 		return fmt.Errorf("can't remove old backups: %v", err)
 	}
 	log.Println("  Done.")
 	return nil
 }
 
-func Download(config Config, backupName string) error {
+// Download - download backup from remote storage, partially downloaded backup is removed when ctx is cancelled.
+// Only tables matched by tablePattern are downloaded when it's set
+func Download(ctx context.Context, config Config, backupName, tablePattern string) error {
 	if config.General.RemoteStorage == "none" {
 		fmt.Println("Download aborted: RemoteStorage set to \"none\"")
 		return nil
 	}
 	if backupName == "" {
 		fmt.Println("Select backup for download:")
-		PrintRemoteBackups(config, "all")
+		PrintRemoteBackups(ctx, config, "all", nil)
 		os.Exit(1)
 	}
+	if err := validatePatterns("--tables", splitTablePattern(tablePattern)); err != nil {
+		return err
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
@@ -606,13 +932,21 @@ func Download(config Config, backupName string) error {
 	if err != nil {
 		return err
 	}
+	bd.skipTables = bd.skipTables.withTablePattern(tablePattern)
 
 	err = bd.Connect()
 	if err != nil {
 		return err
 	}
-	err = bd.CompressedStreamDownload(backupName, path.Join(dataPath, "backup", backupName))
+	backupPath := path.Join(dataPath, "backup", backupName)
+	err = bd.CompressedStreamDownload(ctx, backupName, backupPath)
 	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Download of '%s' is cancelled, removing", backupName)
+			if err := os.RemoveAll(backupPath); err != nil {
+				log.Printf("can't remove '%s' with %v", backupPath, err)
+			}
+		}
 		return err
 	}
 	log.Println("  Done.")
@@ -625,19 +959,28 @@ func Clean(config Config) error {
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
 	}
-	shadowDir := path.Join(dataPath, "shadow")
-	if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
-		log.Printf("%s directory does not exist, nothing to do", shadowDir)
-		return nil
+	disks, err := getDisks(config)
+	if err != nil {
+		disks = []Disk{{Name: defaultDisk, Path: dataPath}}
 	}
-	log.Printf("Clean %s", shadowDir)
-	if err := cleanDir(shadowDir); err != nil {
-		return fmt.Errorf("can't remove contents from directory %v: %v", shadowDir, err)
+	for _, disk := range disks {
+		shadowDir := path.Join(disk.Path, "shadow")
+		if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
+			log.Printf("%s directory does not exist, nothing to do", shadowDir)
+			continue
+		}
+		log.Printf("Clean %s", shadowDir)
+		if err := cleanDir(shadowDir); err != nil {
+			return fmt.Errorf("can't remove contents from directory %v: %v", shadowDir, err)
+		}
 	}
 	return nil
 }
 
 //
+// RemoveOldBackupsLocal - remove the oldest local backups except general.backups_to_keep_local newest ones,
+// files shared with other backups are hard links, but backups required by kept ones are kept so kept backups
+// can be uploaded with --diff-from them
 func RemoveOldBackupsLocal(config Config) error {
 	if config.General.BackupsToKeepLocal < 1 {
 		return nil
@@ -651,14 +994,36 @@ func RemoveOldBackupsLocal(config Config) error {
 		return ErrUnknownClickhouseDataPath
 	}
 	backupsToDelete := GetBackupsToDelete(backupList, config.General.BackupsToKeepLocal)
+	required := map[string]string{}
+	for _, backup := range backupList {
+		if backup.RequiredBackup != "" {
+			required[backup.Name] = backup.RequiredBackup
+		}
+	}
+	keptBackups := []string{}
+	// GetBackupsToDelete sorts backupList from the newest backup
+	for _, backup := range backupList[:len(backupList)-len(backupsToDelete)] {
+		keptBackups = append(keptBackups, backup.Name)
+	}
+	requiredByKept := requiredByBackups(required, keptBackups)
 	for _, backup := range backupsToDelete {
+		if requiredByKept[backup.Name] {
+			log.Printf("Local backup '%s' is kept, it's required by newer backups", backup.Name)
+			continue
+		}
+		log.Printf("Remove old local backup '%s'", backup.Name)
 		backupPath := path.Join(dataPath, "backup", backup.Name)
-		os.RemoveAll(backupPath)
+		if err := os.RemoveAll(backupPath); err != nil {
+			return fmt.Errorf("can't remove '%s' with %v", backupPath, err)
+		}
 	}
 	return nil
 }
 
 func RemoveBackupLocal(config Config, backupName string) error {
+	if config.General.DryRun {
+		return dryRunRemoveLocal(config, backupName)
+	}
 	backupList, err := ListLocalBackups(config)
 	if err != nil {
 		return err
@@ -669,17 +1034,23 @@ func RemoveBackupLocal(config Config, backupName string) error {
 	}
 	for _, backup := range backupList {
 		if backup.Name == backupName {
+			removeRestoreJournal(dataPath, backupName)
 			return os.RemoveAll(path.Join(dataPath, "backup", backupName))
 		}
 	}
-	return fmt.Errorf("backup '%s' not found", backupName)
+	return fmt.Errorf("%w: '%s'", ErrBackupNotFound, backupName)
 }
 
-func RemoveBackupRemote(config Config, backupName string) error {
+// RemoveBackupRemote - remove backup from remote storage, backups uploaded with --diff-from it are removed too when force is set by --force-cascade,
+// otherwise ErrBackupRequired is returned for such backup
+func RemoveBackupRemote(ctx context.Context, config Config, backupName string, force bool) error {
 	if config.General.RemoteStorage == "none" {
 		fmt.Println("RemoveBackupRemote aborted: RemoteStorage set to \"none\"")
 		return nil
 	}
+	if config.General.DryRun {
+		return dryRunRemoveRemote(ctx, config, backupName, force)
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
@@ -693,14 +1064,14 @@ func RemoveBackupRemote(config Config, backupName string) error {
 	if err != nil {
 		return fmt.Errorf("can't connect to remote storage with: %v", err)
 	}
-	backupList, err := bd.BackupList()
+	backupList, err := bd.BackupList(ctx)
 	if err != nil {
 		return err
 	}
 	for _, backup := range backupList {
 		if backup.Name == backupName {
-			return bd.RemoveBackup(backupName)
+			return bd.RemoveBackupChain(ctx, backupName, force)
 		}
 	}
-	return fmt.Errorf("backup '%s' not found on remote storage", backupName)
+	return fmt.Errorf("%w: '%s' on remote storage", ErrBackupNotFound, backupName)
 }
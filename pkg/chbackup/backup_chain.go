@@ -0,0 +1,131 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// requiredBackupFileName - file with name of required backup uploaded next to archive of backup uploaded as single archive with --diff-from,
+// meta.json inside of archive can't be read without downloading the whole archive
+const requiredBackupFileName = "required_backup"
+
+// ErrBackupRequired is returned when remote backup can't be removed because other backups are uploaded with --diff-from it
+var ErrBackupRequired = errors.New("backup is required by other backups")
+
+// putRequiredBackup - record dependency of backup uploaded as single archive
+func (bd *BackupDestination) putRequiredBackup(ctx context.Context, remotePath, requiredBackup string) error {
+	key := path.Join(bd.path, remotePath, requiredBackupFileName)
+	return bd.PutFile(ctx, key, ioutil.NopCloser(strings.NewReader(requiredBackup)))
+}
+
+// requiredBackups - name of required backup by name of each remote backup uploaded with --diff-from,
+// dependencies of backups uploaded as single archive before required_backup was introduced are unknown
+func (bd *BackupDestination) requiredBackups(ctx context.Context) (map[string]string, error) {
+	keys := []string{}
+	pool := path.Join(bd.path, casDir) + "/"
+	if err := bd.Walk(ctx, bd.path, func(f RemoteFile) {
+		if !strings.HasPrefix(f.Name(), bd.path) || strings.HasPrefix(f.Name(), pool) {
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(f.Name(), bd.path), "/"), "/")
+		if len(parts) == 2 && (parts[1] == MetaFileName || parts[1] == requiredBackupFileName) {
+			keys = append(keys, f.Name())
+		}
+	}); err != nil {
+		return nil, err
+	}
+	required := map[string]string{}
+	for _, key := range keys {
+		backupName := backupNameOfKey(bd.path, key)
+		if path.Base(key) == MetaFileName {
+			metafile, err := bd.readMetaFile(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if metafile.RequiredBackup != "" {
+				required[backupName] = metafile.RequiredBackup
+			}
+			continue
+		}
+		reader, err := bd.GetFileReader(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("can't read '%s' with %v", key, err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("can't read '%s' with %v", key, err)
+		}
+		if name := strings.TrimSpace(string(content)); name != "" {
+			required[backupName] = name
+		}
+	}
+	return required, nil
+}
+
+// dependentBackups - backups which require backupName directly or through other backups,
+// each backup is followed by backups it requires, so they can be removed in this order
+func dependentBackups(required map[string]string, backupName string) []string {
+	dependents := map[string][]string{}
+	for name, requiredBackup := range required {
+		dependents[requiredBackup] = append(dependents[requiredBackup], name)
+	}
+	result := []string{}
+	visited := map[string]bool{backupName: true}
+	var visit func(name string)
+	visit = func(name string) {
+		sort.Strings(dependents[name])
+		for _, dependent := range dependents[name] {
+			if visited[dependent] {
+				continue
+			}
+			visited[dependent] = true
+			visit(dependent)
+			result = append(result, dependent)
+		}
+	}
+	visit(backupName)
+	return result
+}
+
+// requiredByBackups - backups required by backups directly or through other backups
+func requiredByBackups(required map[string]string, backups []string) map[string]bool {
+	result := map[string]bool{}
+	for _, name := range backups {
+		for requiredBackup := required[name]; requiredBackup != "" && !result[requiredBackup]; requiredBackup = required[requiredBackup] {
+			result[requiredBackup] = true
+		}
+	}
+	return result
+}
+
+// errBackupRequired - error of removal of backup which other backups require without --force-cascade
+func errBackupRequired(backupName string, dependents []string) error {
+	return fmt.Errorf("%w: '%s' is required by '%s', use --force-cascade to remove them too", ErrBackupRequired, backupName, strings.Join(dependents, "', '"))
+}
+
+// RemoveBackupChain - remove backup, backups which require it are removed before it when force is set,
+// otherwise ErrBackupRequired is returned
+func (bd *BackupDestination) RemoveBackupChain(ctx context.Context, backupName string, force bool) error {
+	required, err := bd.requiredBackups(ctx)
+	if err != nil {
+		return fmt.Errorf("can't read dependencies of backups with %v", err)
+	}
+	dependents := dependentBackups(required, backupNameOfKey("", backupName))
+	if len(dependents) > 0 && !force {
+		return errBackupRequired(backupName, dependents)
+	}
+	for _, dependent := range dependents {
+		log.Printf("Remove '%s' which depends on '%s'", dependent, backupName)
+		if err := bd.RemoveBackup(ctx, dependent); err != nil {
+			return err
+		}
+	}
+	return bd.RemoveBackup(ctx, backupName)
+}
@@ -0,0 +1,87 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependentBackups(t *testing.T) {
+	required := map[string]string{"inc1": "base", "inc2": "inc1", "inc3": "base", "other": "full"}
+	assert.Equal(t, []string{"inc2", "inc1", "inc3"}, dependentBackups(required, "base"))
+	assert.Equal(t, []string{}, dependentBackups(required, "inc2"))
+	assert.Equal(t, map[string]bool{"inc1": true, "base": true}, requiredByBackups(required, []string{"inc2"}))
+}
+
+func TestRemoveBackupChain(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "backup_chain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storage := &FileStorage{Config: &FileConfig{Path: dir}}
+	require.NoError(t, storage.Connect())
+	bd := &BackupDestination{RemoteStorage: storage, disableProgressBar: true}
+	put := func(key, content string) {
+		require.NoError(t, storage.PutFile(ctx, key, ioutil.NopCloser(strings.NewReader(content))))
+	}
+	put("base.tar.gz", "archive")
+	put("inc1.tar.gz", "archive")
+	require.NoError(t, bd.putRequiredBackup(ctx, "inc1", "base"))
+	put("inc2/default.t1.tar.gz", "archive")
+	put("inc2/meta.json", `{"required_backup":"inc1","hardlinks":["shadow/default/t1/all_1_1_0/data.bin"],"archives":["default.t1.tar.gz"]}`)
+	put("full.tar.gz", "archive")
+
+	required, err := bd.requiredBackups(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"inc1": "base", "inc2": "inc1"}, required)
+
+	err = bd.RemoveBackupChain(ctx, "base.tar.gz", false)
+	assert.True(t, errors.Is(err, ErrBackupRequired))
+	assert.Contains(t, err.Error(), "'base.tar.gz' is required by 'inc2', 'inc1', use --force-cascade")
+	backups, err := bd.BackupList(ctx)
+	require.NoError(t, err)
+	assert.Len(t, backups, 4)
+
+	require.NoError(t, bd.RemoveBackupChain(ctx, "inc2", false))
+	require.NoError(t, bd.RemoveBackupChain(ctx, "base.tar.gz", true))
+	backups, err = bd.BackupList(ctx)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "full.tar.gz", backups[0].Name)
+	_, err = storage.GetFile(ctx, "inc1/"+requiredBackupFileName)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestRemoveOldBackupsKeepsRequired(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "backup_chain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storage := &FileStorage{Config: &FileConfig{Path: dir}}
+	require.NoError(t, storage.Connect())
+	bd := &BackupDestination{RemoteStorage: storage, disableProgressBar: true}
+	now := time.Now()
+	for i, name := range []string{"base.tar.gz", "other.tar.gz", "inc1.tar.gz"} {
+		require.NoError(t, storage.PutFile(ctx, name, ioutil.NopCloser(strings.NewReader("archive"))))
+		date := now.Add(time.Duration(i-3) * time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), date, date))
+	}
+	require.NoError(t, bd.putRequiredBackup(ctx, "inc1", "base"))
+
+	require.NoError(t, bd.RemoveOldBackups(ctx, RetentionPolicy{KeepLast: 1}))
+	backups, err := bd.BackupList(ctx)
+	require.NoError(t, err)
+	names := []string{}
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+	assert.Equal(t, []string{"base.tar.gz", "inc1.tar.gz"}, names)
+}
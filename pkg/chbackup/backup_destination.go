@@ -2,9 +2,13 @@ package chbackup
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -13,6 +17,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mholt/archiver"
@@ -27,16 +32,39 @@ const (
 	BufferSize = 4 * 1024 * 1024
 )
 
-// MetaFile - structure describe meta file that will be added to incremental backups archive.
-// Contains info of required files in backup and files
+// MetaFile - structure describe meta file that will be added to the end of backups archive.
+// Contains info of required files in backup and files, and SHA256 of each file in archive.
+// Archives are table archives relative to backup directory when backup is uploaded as archive per table,
+// ArchiveParts are numbers of objects of archives split by general.max_file_size.
+// Layout is 'cas' when files of backup are stored in content-addressable pool by their checksums
 type MetaFile struct {
-	RequiredBackup string   `json:"required_backup"`
-	Hardlinks      []string `json:"hardlinks"`
+	RequiredBackup string            `json:"required_backup"`
+	Hardlinks      []string          `json:"hardlinks"`
+	Checksums      map[string]string `json:"checksums,omitempty"`
+	Archives       []string          `json:"archives,omitempty"`
+	ArchiveParts   map[string]int    `json:"archive_parts,omitempty"`
+	Layout         string            `json:"layout,omitempty"`
+	// CompressionFormat - format of archives, download picks decompressor by it or by extension of archive for older backups
+	CompressionFormat string `json:"compression_format,omitempty"`
+}
+
+// hashingReader - calculate SHA256 of data read from file added to archive
+type hashingReader struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
 }
 
 var (
 	// ErrNotFound is returned when file/object cannot be found
 	ErrNotFound = errors.New("file not found")
+	// ErrObjectLocked is returned when file can't be deleted before end of its retention period or while legal hold is set
+	ErrObjectLocked = errors.New("file is protected by object lock")
 )
 
 // RemoteFile - interface describe file on remote storage
@@ -49,83 +77,239 @@ type RemoteFile interface {
 // RemoteStorage -
 type RemoteStorage interface {
 	Kind() string
-	GetFile(string) (RemoteFile, error)
-	DeleteFile(string) error
+	GetFile(ctx context.Context, key string) (RemoteFile, error)
+	DeleteFile(ctx context.Context, key string) error
 	Connect() error
-	Walk(string, func(RemoteFile)) error
-	GetFileReader(key string) (io.ReadCloser, error)
-	PutFile(key string, r io.ReadCloser) error
+	Walk(ctx context.Context, prefix string, process func(RemoteFile)) error
+	GetFileReader(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetFileReaderWithOffset - read file from offset, used to resume interrupted download
+	GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	PutFile(ctx context.Context, key string, r io.ReadCloser) error
+	// CheckBucket - check bucket exists and is accessible
+	CheckBucket(ctx context.Context) error
+}
+
+// BatchDeleter - remote storage which can delete many files by one request
+type BatchDeleter interface {
+	DeleteFiles(ctx context.Context, keys []string) error
+}
+
+// RangeReader - remote storage which reads range of file by one small request, e.g. S3 whose GetFileReader
+// downloads big files by parallel requests of part_size
+type RangeReader interface {
+	GetFileRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
 }
 
+// getFileRange - read at least length bytes of file from offset, storage without RangeReader reads file from offset
+func getFileRange(ctx context.Context, storage RemoteStorage, key string, offset, length int64) (io.ReadCloser, error) {
+	if rangeReader, ok := storage.(RangeReader); ok {
+		return rangeReader.GetFileRange(ctx, key, offset, length)
+	}
+	return storage.GetFileReaderWithOffset(ctx, key, offset)
+}
+
+// deleteBatchSize - max number of files deleted by one DeleteFiles call, limit of S3 DeleteObjects
+const deleteBatchSize = 1000
+
 type BackupDestination struct {
 	RemoteStorage
-	path               string
-	compressionFormat  string
-	compressionLevel   int
-	disableProgressBar bool
-	backupsToKeep      int
+	path                string
+	compressionFormat   string
+	compressionLevel    int
+	disableProgressBar  bool
+	retention           RetentionPolicy
+	resumableDownload   bool
+	uploadConcurrency   int
+	uploadLimiter       *bandwidthLimiter
+	downloadConcurrency int
+	remoteLayout        string
+	// uploadFormat - 'directory' uploads files of backup as objects without archives
+	uploadFormat string
+	// compressionConcurrency - threads of zstd compression
+	compressionConcurrency int
+	// maxFileSize - table archives are split into objects of this size, 0 means no limit
+	maxFileSize int64
+	// skipTables - files of tables skipped by skip_databases and skip_tables aren't uploaded,
+	// upload and download with --tables transfer only files of matched tables
+	skipTables tableFilter
 }
 
-func (bd *BackupDestination) RemoveOldBackups(keep int) error {
-	if keep < 1 {
+// RemoveOldBackups - remove remote backups which aren't kept by policy, backups required by kept backups
+// and backups protected by object lock are kept
+func (bd *BackupDestination) RemoveOldBackups(ctx context.Context, policy RetentionPolicy) error {
+	if !policy.Enabled() {
 		return nil
 	}
-	backupList, err := bd.BackupList()
+	backupList, err := bd.BackupList(ctx)
+	if err != nil {
+		return err
+	}
+	// backups being uploaded aren't counted, they are removed by clean_remote_broken when upload was interrupted
+	if backupList, err = bd.withManifests(ctx, backupList); err != nil {
+		return err
+	}
+	backupsToDelete, err := bd.oldBackups(ctx, backupList, policy)
 	if err != nil {
 		return err
 	}
-	backupsToDelete := GetBackupsToDelete(backupList, keep)
 	for _, backupToDelete := range backupsToDelete {
-		if err := bd.RemoveBackup(backupToDelete.Name); err != nil {
+		if err := bd.RemoveBackup(ctx, backupToDelete.Name); err != nil {
+			if errors.Is(err, ErrObjectLocked) {
+				log.Printf("Backup '%s' is kept: %v", backupToDelete.Name, err)
+				continue
+			}
 			return err
 		}
 	}
 	return nil
 }
 
-func (bd *BackupDestination) RemoveBackup(backupName string) error {
-	objects := []string{}
-	if err := bd.Walk(bd.path, func(f RemoteFile) {
-		if strings.HasPrefix(f.Name(), path.Join(bd.path, backupName)) {
-			objects = append(objects, f.Name())
+// oldBackups - backups of backupList which aren't kept by policy and aren't required by kept backups
+func (bd *BackupDestination) oldBackups(ctx context.Context, backupList []Backup, policy RetentionPolicy) ([]Backup, error) {
+	backupsToDelete := GetBackupsToDeleteByPolicy(backupList, policy)
+	if len(backupsToDelete) == 0 {
+		return backupsToDelete, nil
+	}
+	required, err := bd.requiredBackups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't read dependencies of backups with %v", err)
+	}
+	toDelete := map[string]bool{}
+	for _, backup := range backupsToDelete {
+		toDelete[backup.Name] = true
+	}
+	keptBackups := []string{}
+	for _, backup := range backupList {
+		if !toDelete[backup.Name] {
+			keptBackups = append(keptBackups, backupNameOfKey("", backup.Name))
 		}
-	}); err != nil {
+	}
+	requiredByKept := requiredByBackups(required, keptBackups)
+	result := []Backup{}
+	for _, backupToDelete := range backupsToDelete {
+		if requiredByKept[backupNameOfKey("", backupToDelete.Name)] {
+			log.Printf("Backup '%s' is kept, it's required by newer backups", backupToDelete.Name)
+			continue
+		}
+		result = append(result, backupToDelete)
+	}
+	return result, nil
+}
+
+// backupObjects - files of backup except files of pool
+func (bd *BackupDestination) backupObjects(ctx context.Context, backupName string) ([]RemoteFile, error) {
+	objects := []RemoteFile{}
+	pool := path.Join(bd.path, casDir) + "/"
+	err := bd.Walk(ctx, bd.path, func(f RemoteFile) {
+		if strings.HasPrefix(f.Name(), bd.path) && !strings.HasPrefix(f.Name(), pool) && backupNameOfKey(bd.path, f.Name()) == backupName {
+			objects = append(objects, f)
+		}
+	})
+	return objects, err
+}
+
+// RemoveBackup - remove files of backup, files of backup with cas layout are removed from pool when other backups don't reference them.
+// Backups which require it aren't checked, see RemoveBackupChain
+func (bd *BackupDestination) RemoveBackup(ctx context.Context, backupName string) error {
+	// backup uploaded as single archive is listed with extension
+	backupName = backupNameOfKey("", backupName)
+	files, err := bd.backupObjects(ctx, backupName)
+	if err != nil {
 		return err
 	}
-	for _, key := range objects {
-		err := bd.DeleteFile(key)
+	objects := make([]string, len(files))
+	metaName := path.Join(bd.path, backupName, MetaFileName)
+	hasMeta := false
+	for i, f := range files {
+		objects[i] = f.Name()
+		hasMeta = hasMeta || f.Name() == metaName
+	}
+	var metafile MetaFile
+	if hasMeta {
+		var err error
+		if metafile, err = bd.readMetaFile(ctx, metaName); err != nil {
+			return err
+		}
+	}
+	log.Printf("Remove '%s' from %s, %d files", backupName, bd.Kind(), len(objects))
+	bar := StartNewBar(!bd.disableProgressBar && len(objects) > 1, len(objects))
+	trackProgress(ctx, backupName, bar)
+	defer untrackProgress(ctx, backupName)
+	defer bar.Finish()
+	if err := bd.deleteKeys(ctx, objects, bar.Set); err != nil {
+		if errors.Is(err, ErrObjectLocked) {
+			// all files of backup are uploaded with the same retention, so the first locked file stops deletion
+			return fmt.Errorf("can't remove backup '%s': %w", backupName, err)
+		}
+		return err
+	}
+	if metafile.Layout == casLayout {
+		return bd.casRemoveUnreferenced(ctx, metafile.Checksums)
+	}
+	return nil
+}
+
+// readMetaFile - meta.json of backup uploaded as archive per table or with cas layout
+func (bd *BackupDestination) readMetaFile(ctx context.Context, metaName string) (MetaFile, error) {
+	var metafile MetaFile
+	reader, err := bd.GetFileReader(ctx, metaName)
+	if err != nil {
+		return metafile, fmt.Errorf("can't read '%s' with %v", metaName, err)
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(&metafile); err != nil {
+		return metafile, fmt.Errorf("can't parse '%s' with %v", metaName, err)
+	}
+	return metafile, nil
+}
+
+// deleteKeys - delete files by batches when storage supports it, deleted is called with number of deleted files,
+// deletion is stopped by the first error
+func (bd *BackupDestination) deleteKeys(ctx context.Context, keys []string, deleted func(int)) error {
+	batchDeleter, batch := bd.RemoteStorage.(BatchDeleter)
+	for i := 0; i < len(keys); {
+		var err error
+		n := 1
+		if batch {
+			n = deleteBatchSize
+			if i+n > len(keys) {
+				n = len(keys) - i
+			}
+			err = batchDeleter.DeleteFiles(ctx, keys[i:i+n])
+		} else {
+			err = bd.DeleteFile(ctx, keys[i])
+		}
 		if err != nil {
 			return err
 		}
+		i += n
+		deleted(i)
 	}
 	return nil
 }
 
-func (bd *BackupDestination) BackupsToKeep() int {
-	return bd.backupsToKeep
+// Retention - policy of general.backups_to_keep_remote and general.keep_*
+func (bd *BackupDestination) Retention() RetentionPolicy {
+	return bd.retention
 }
 
-func (bd *BackupDestination) BackupList() ([]Backup, error) {
+func (bd *BackupDestination) BackupList(ctx context.Context) ([]Backup, error) {
 	type ClickhouseBackup struct {
 		Metadata bool
 		Shadow   bool
 		Tar      bool
+		Meta     bool
 		Size     int64
 		Date     time.Time
 	}
 	files := map[string]ClickhouseBackup{}
 	path := bd.path
-	err := bd.Walk(path, func(o RemoteFile) {
+	err := bd.Walk(ctx, path, func(o RemoteFile) {
 		if strings.HasPrefix(o.Name(), path) {
 			key := strings.TrimPrefix(o.Name(), path)
 			key = strings.TrimPrefix(key, "/")
 			parts := strings.Split(key, "/")
-			if strings.HasSuffix(parts[0], ".tar") ||
-				strings.HasSuffix(parts[0], ".tar.lz4") ||
-				strings.HasSuffix(parts[0], ".tar.bz2") ||
-				strings.HasSuffix(parts[0], ".tar.gz") ||
-				strings.HasSuffix(parts[0], ".tar.sz") ||
-				strings.HasSuffix(parts[0], ".tar.xz") {
+			if formatOfArchive(parts[0]) != "" {
 				files[parts[0]] = ClickhouseBackup{
 					Tar:  true,
 					Date: o.LastModified(),
@@ -137,8 +321,15 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 				files[parts[0]] = ClickhouseBackup{
 					Metadata: b.Metadata || parts[1] == "metadata",
 					Shadow:   b.Shadow || parts[1] == "shadow",
+					Meta:     b.Meta || len(parts) == 2 && parts[1] == MetaFileName,
 					Date:     b.Date,
-					Size:     b.Size,
+					Size:     b.Size + o.Size(),
+				}
+				// backup uploaded as archive per table is complete when meta.json is uploaded
+				if len(parts) == 2 && parts[1] == MetaFileName {
+					b := files[parts[0]]
+					b.Date = o.LastModified()
+					files[parts[0]] = b
 				}
 			}
 		}
@@ -148,7 +339,7 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 	}
 	result := []Backup{}
 	for name, e := range files {
-		if e.Metadata && e.Shadow || e.Tar {
+		if e.Metadata && e.Shadow || e.Tar || e.Meta {
 			result = append(result, Backup{
 				Name: name,
 				Date: e.Date,
@@ -162,262 +353,554 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 	return result, nil
 }
 
-func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPath string) error {
+func (bd *BackupDestination) CompressedStreamDownload(ctx context.Context, remotePath string, localPath string) error {
 	if err := os.MkdirAll(localPath, os.ModePerm); err != nil {
 		return err
 	}
-	archiveName := path.Join(bd.path, fmt.Sprintf("%s.%s", remotePath, getExtension(bd.compressionFormat)))
 	if err := bd.Connect(); err != nil {
 		return err
 	}
 
-	reader, err := bd.GetFileReader(archiveName)
+	var metafile MetaFile
+	archiveName, file, err := bd.getBackupArchive(ctx, remotePath)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// backup is uploaded as archive per table
+		metafile, err = bd.tableStreamDownload(ctx, remotePath, localPath)
+	case err == nil:
+		if len(bd.skipTables.patterns) > 0 {
+			log.Printf("Backup '%s' is uploaded as single archive, the whole archive is read to extract matched tables", remotePath)
+		}
+		metafile, err = bd.archiveStreamDownload(ctx, file, archiveName, remotePath, localPath)
+	}
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
-	file, err := bd.GetFile(archiveName)
+	if metafile.RequiredBackup != "" {
+		requiredPath := filepath.Join(filepath.Dir(localPath), metafile.RequiredBackup)
+		if _, err := os.Stat(requiredPath); err == nil {
+			log.Printf("Backup '%s' required '%s'. It's already downloaded.", remotePath, metafile.RequiredBackup)
+		} else {
+			log.Printf("Backup '%s' required '%s'. Downloading.", remotePath, metafile.RequiredBackup)
+			// required backup is downloaded with all tables, local backup with part of tables would look complete
+			required := *bd
+			required.skipTables = bd.skipTables.withoutTablePattern()
+			err := required.CompressedStreamDownload(ctx, metafile.RequiredBackup, requiredPath)
+			if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("can't download '%s' with %v", metafile.RequiredBackup, err)
+			}
+		}
+	}
+	for _, hardlink := range metafile.Hardlinks {
+		if bd.skipTables.skipFile(hardlink) {
+			continue
+		}
+		newname := filepath.Join(localPath, hardlink)
+		extractDir := filepath.Dir(newname)
+		oldname := filepath.Join(filepath.Dir(localPath), metafile.RequiredBackup, hardlink)
+		if _, err := os.Stat(extractDir); os.IsNotExist(err) {
+			os.MkdirAll(extractDir, os.ModePerm)
+		}
+		if err := os.Link(oldname, newname); err != nil {
+			return err
+		}
+	}
+	return bd.downloadManifest(ctx, remotePath, localPath)
+}
+
+// getBackupArchive - backup uploaded as single archive, archive of compression_format is looked for first, then archives of other formats
+func (bd *BackupDestination) getBackupArchive(ctx context.Context, remotePath string) (string, RemoteFile, error) {
+	formats := []string{bd.compressionFormat}
+	for _, f := range compressionFormats {
+		if getExtension(f.format) != getExtension(bd.compressionFormat) {
+			formats = append(formats, f.format)
+		}
+	}
+	for _, format := range formats {
+		archiveName := path.Join(bd.path, fmt.Sprintf("%s.%s", remotePath, getExtension(format)))
+		file, err := bd.GetFile(ctx, archiveName)
+		if !errors.Is(err, ErrNotFound) {
+			return archiveName, file, err
+		}
+	}
+	return "", nil, ErrNotFound
+}
+
+// checkTablesUpload - upload with --tables is refused for backup which is already on remote storage,
+// its archives and meta.json would be replaced by ones with matched tables only
+func (bd *BackupDestination) checkTablesUpload(ctx context.Context, remotePath, tablePattern string) error {
+	if tablePattern == "" {
+		return nil
+	}
+	_, _, err := bd.getBackupArchive(ctx, remotePath)
+	for _, name := range []string{MetaFileName, ManifestFileName} {
+		if !errors.Is(err, ErrNotFound) {
+			break
+		}
+		_, err = bd.GetFile(ctx, path.Join(bd.path, remotePath, name))
+	}
+	switch {
+	case err == nil:
+		return fmt.Errorf("backup '%s' is already on %s, upload with --tables can't add tables to it, remove it first", remotePath, bd.Kind())
+	case errors.Is(err, ErrNotFound):
+		return nil
+	}
+	return err
+}
+
+// archiveStreamDownload - download and extract backup uploaded as single archive
+func (bd *BackupDestination) archiveStreamDownload(ctx context.Context, file RemoteFile, archiveName, remotePath, localPath string) (MetaFile, error) {
+	var metafile MetaFile
+	bar := StartNewByteBar(!bd.disableProgressBar, file.Size())
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	var archiveReader io.Reader
+	partialFile := ""
+	if bd.resumableDownload {
+		partialFile = partialPath(localPath, archiveName)
+		partial, err := bd.downloadPartial(ctx, archiveName, file, partialFile, bar)
+		if err != nil {
+			return metafile, err
+		}
+		defer partial.Close()
+		archiveReader = newContextReader(ctx, partial)
+	} else {
+		reader, err := bd.GetFileReader(ctx, archiveName)
+		if err != nil {
+			return metafile, err
+		}
+		defer reader.Close()
+		buf := buffer.New(BufferSize)
+		bufReader := nio.NewReader(newContextReader(ctx, reader), buf)
+		archiveReader = bar.NewProxyReader(bufReader)
+	}
+	metafile, checksums, err := bd.extractArchive(archiveReader, formatOfArchive(archiveName), remotePath, localPath)
+	if err == nil {
+		// meta.json is the last file of archive, so files are verified after extraction
+		err = verifyChecksums(bd.selectedChecksums(metafile.Checksums), checksums, archiveName)
+	}
+	if partialFile != "" && ctx.Err() == nil {
+		// complete archive is either extracted or corrupted, it is downloaded again in both cases
+		removePartial(partialFile)
+	}
 	if err != nil {
-		return err
+		return metafile, err
 	}
-	filesize := file.Size()
+	bar.Finish()
+	return metafile, nil
+}
 
-	bar := StartNewByteBar(!bd.disableProgressBar, filesize)
-	buf := buffer.New(BufferSize)
-	bufReader := nio.NewReader(reader, buf)
-	proxyReader := bar.NewProxyReader(bufReader)
-	z, _ := getArchiveReader(bd.compressionFormat)
-	if err := z.Open(proxyReader, 0); err != nil {
-		return err
+// extractArchive - extract files of archive of format to localPath, return meta.json if archive contains it and SHA256 of extracted files
+func (bd *BackupDestination) extractArchive(archiveReader io.Reader, format, remotePath, localPath string) (MetaFile, map[string]string, error) {
+	var metafile MetaFile
+	checksums := map[string]string{}
+	z, err := getArchiveReader(format)
+	if err != nil {
+		return metafile, checksums, err
+	}
+	if err := z.Open(archiveReader, 0); err != nil {
+		return metafile, checksums, err
 	}
 	defer z.Close()
-	var metafile MetaFile
 	for {
 		file, err := z.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return metafile, checksums, err
 		}
 		header, ok := file.Header.(*tar.Header)
 		if !ok {
-			return fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
+			return metafile, checksums, fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
 		}
 		if header.Name == MetaFileName {
 			b, err := ioutil.ReadAll(file)
 			if err != nil {
-				return fmt.Errorf("can't read %s", MetaFileName)
+				return metafile, checksums, fmt.Errorf("can't read %s", MetaFileName)
 			}
 			if err := json.Unmarshal(b, &metafile); err != nil {
-				return err
+				return metafile, checksums, err
 			}
 			continue
 		}
-		extractFile := filepath.Join(localPath, header.Name)
-		extractDir := filepath.Dir(extractFile)
-		if _, err := os.Stat(extractDir); os.IsNotExist(err) {
-			os.MkdirAll(extractDir, os.ModePerm)
+		if bd.skipTables.skipFile(header.Name) {
+			continue
 		}
-		dst, err := os.Create(extractFile)
+		publishFileEvent("download", remotePath, header.Name, header.Size)
+		checksum, err := extractArchiveFile(file, filepath.Join(localPath, header.Name))
 		if err != nil {
-			return err
-		}
-		if _, err := io.Copy(dst, file); err != nil {
-			return err
-		}
-		if err := dst.Close(); err != nil {
-			return err
-		}
-		if err := file.Close(); err != nil {
-			return err
+			return metafile, checksums, err
 		}
+		checksums[header.Name] = checksum
 	}
-	if metafile.RequiredBackup != "" {
-		log.Printf("Backup '%s' required '%s'. Downloading.", remotePath, metafile.RequiredBackup)
-		err := bd.CompressedStreamDownload(metafile.RequiredBackup, filepath.Join(filepath.Dir(localPath), metafile.RequiredBackup))
-		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("can't download '%s' with %v", metafile.RequiredBackup, err)
-		}
+	return metafile, checksums, nil
+}
+
+// extractArchiveFile - write file of archive to extractFile, return its SHA256
+func extractArchiveFile(file archiver.File, extractFile string) (string, error) {
+	extractDir := filepath.Dir(extractFile)
+	if _, err := os.Stat(extractDir); os.IsNotExist(err) {
+		os.MkdirAll(extractDir, os.ModePerm)
 	}
-	for _, hardlink := range metafile.Hardlinks {
-		newname := filepath.Join(localPath, hardlink)
-		extractDir := filepath.Dir(newname)
-		oldname := filepath.Join(filepath.Dir(localPath), metafile.RequiredBackup, hardlink)
-		if _, err := os.Stat(extractDir); os.IsNotExist(err) {
-			os.MkdirAll(extractDir, os.ModePerm)
+	dst, err := os.Create(extractFile)
+	if err != nil {
+		return "", err
+	}
+	fileHash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, fileHash), file); err != nil {
+		dst.Close()
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), nil
+}
+
+// selectedChecksums - checksums of files which aren't skipped by skipTables
+func (bd *BackupDestination) selectedChecksums(checksums map[string]string) map[string]string {
+	selected := map[string]string{}
+	for name, checksum := range checksums {
+		if !bd.skipTables.skipFile(name) {
+			selected[name] = checksum
 		}
-		if err := os.Link(oldname, newname); err != nil {
-			return err
+	}
+	return selected
+}
+
+// verifyChecksums - compare SHA256 of extracted files with meta.json, archives without checksums are not verified
+func verifyChecksums(expected, actual map[string]string, archiveName string) error {
+	for name, checksum := range expected {
+		if actual[name] != checksum {
+			return fmt.Errorf("checksum mismatch of '%s' in '%s', archive is corrupted", name, archiveName)
 		}
 	}
-	bar.Finish()
 	return nil
 }
 
-func (bd *BackupDestination) CompressedStreamUpload(localPath, remotePath, diffFromPath string) error {
+func (bd *BackupDestination) CompressedStreamUpload(ctx context.Context, localPath, remotePath, diffFromPath string) error {
 	archiveName := path.Join(bd.path, fmt.Sprintf("%s.%s", remotePath, getExtension(bd.compressionFormat)))
 
-	if _, err := bd.GetFile(archiveName); err != nil {
-		if err != ErrNotFound {
+	if _, err := bd.GetFile(ctx, archiveName); err != nil {
+		if !errors.Is(err, ErrNotFound) {
 			return err
 		}
 	}
 
-	var totalBytes int64
-	filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
-		if info.Mode().IsRegular() {
-			totalBytes += info.Size()
-		}
-		return nil
-	})
+	files, totalBytes, err := bd.uploadFiles(localPath)
+	if err != nil {
+		return err
+	}
 	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
-	if diffFromPath != "" {
-		fi, err := os.Stat(diffFromPath)
-		if err != nil {
-			return err
-		}
-		if !fi.IsDir() {
-			return fmt.Errorf("'%s' is not a directory", diffFromPath)
-		}
-		if isClickhouseShadow(filepath.Join(diffFromPath, "shadow")) {
-			return fmt.Errorf("'%s' is old format backup and doesn't supports diff", filepath.Base(diffFromPath))
-		}
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	if err := checkDiffFromPath(diffFromPath); err != nil {
+		return err
 	}
-	hardlinks := []string{}
+	result := newArchiveResult()
 
 	buf := buffer.New(BufferSize)
 	body, w := nio.Pipe(buf)
 	go func() (ferr error) {
 		defer w.CloseWithError(ferr)
-		iobuf := buffer.New(BufferSize)
-		z, _ := getArchiveWriter(bd.compressionFormat, bd.compressionLevel)
+		z, _ := getArchiveWriter(bd.compressionFormat, bd.compressionLevel, bd.compressionConcurrency)
 		if ferr = z.Create(w); ferr != nil {
 			return
 		}
 		defer z.Close()
-		if ferr = filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.Mode().IsRegular() {
-				return nil
-			}
-			bar.Add64(info.Size())
-			file, err := os.Open(filePath)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			relativePath := strings.TrimPrefix(strings.TrimPrefix(filePath, localPath), "/")
-			if diffFromPath != "" {
-				diffFromFile, err := os.Stat(filepath.Join(diffFromPath, relativePath))
-				if err == nil {
-					if os.SameFile(info, diffFromFile) {
-						hardlinks = append(hardlinks, relativePath)
-						return nil
-					}
-				}
-			}
-			bfile := nio.NewReader(file, iobuf)
-			defer bfile.Close()
-			return z.Write(archiver.File{
-				FileInfo: archiver.FileInfo{
-					FileInfo:   info,
-					CustomName: relativePath,
-				},
-				ReadCloser: bfile,
-			})
-		}); ferr != nil {
+		if ferr = writeArchiveFiles(ctx, z, localPath, remotePath, diffFromPath, files, bar, result); ferr != nil {
 			return
 		}
-		if len(hardlinks) > 0 {
-			metafile := MetaFile{
-				RequiredBackup: filepath.Base(diffFromPath),
-				Hardlinks:      hardlinks,
-			}
-			content, err := json.MarshalIndent(&metafile, "", "\t")
-			if err != nil {
-				ferr = fmt.Errorf("can't marshal json with %v", err)
-				return
-			}
-			tmpfile, err := ioutil.TempFile("", MetaFileName)
-			if err != nil {
-				ferr = fmt.Errorf("can't create meta.info with %v", err)
-				return
-			}
-			if _, err := tmpfile.Write(content); err != nil {
-				ferr = fmt.Errorf("can't write to meta.info with %v", err)
-				return
-			}
-			tmpfile.Close()
-			tmpFileName := tmpfile.Name()
-			defer os.Remove(tmpFileName)
-			info, err := os.Stat(tmpFileName)
-			if err != nil {
-				ferr = fmt.Errorf("can't get stat with %v", err)
-				return
+		// meta.json is always the last file of archive
+		metafile := result.metaFile(diffFromPath)
+		metafile.CompressionFormat = bd.compressionFormat
+		ferr = writeArchiveMetaFile(z, metafile)
+		return
+	}()
+
+	if err := bd.PutFile(ctx, archiveName, bd.uploadLimiter.reader(ctx, body)); err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Upload of '%s' is cancelled, removing '%s'", remotePath, archiveName)
+			if err := bd.DeleteFile(context.Background(), archiveName); err != nil {
+				log.Printf("can't remove '%s' with %v", archiveName, err)
 			}
-			mf, err := os.Open(tmpFileName)
-			if err != nil {
-				ferr = err
-				return
+		}
+		return err
+	}
+	if metafile := result.metaFile(diffFromPath); metafile.RequiredBackup != "" {
+		if err := bd.putRequiredBackup(ctx, remotePath, metafile.RequiredBackup); err != nil {
+			return fmt.Errorf("can't put %s with %v", requiredBackupFileName, err)
+		}
+	}
+	bar.Finish()
+	return nil
+}
+
+// listBackupFiles - regular files of local backup relative to localPath and their total size
+func listBackupFiles(localPath string) ([]string, int64, error) {
+	return listFilteredBackupFiles(localPath, tableFilter{})
+}
+
+// uploadFiles - files of local backup which are uploaded to archives or pool, manifest.json is uploaded next to backup by putManifest
+func (bd *BackupDestination) uploadFiles(localPath string) ([]string, int64, error) {
+	files, totalBytes, err := listFilteredBackupFiles(localPath, bd.skipTables)
+	if err != nil {
+		return nil, 0, err
+	}
+	result := make([]string, 0, len(files))
+	for _, file := range files {
+		if file == ManifestFileName {
+			if info, err := os.Stat(filepath.Join(localPath, file)); err == nil {
+				totalBytes -= info.Size()
 			}
-			defer mf.Close()
-			if err := z.Write(archiver.File{
-				FileInfo: archiver.FileInfo{
-					FileInfo:   info,
-					CustomName: MetaFileName,
-				},
-				ReadCloser: mf,
-			}); err != nil {
-				ferr = fmt.Errorf("can't add mata.json to archive with %v", err)
-				return
+			continue
+		}
+		result = append(result, file)
+	}
+	return result, totalBytes, nil
+}
+
+// listFilteredBackupFiles - regular files of local backup except files of tables skipped by filter
+func listFilteredBackupFiles(localPath string, filter tableFilter) ([]string, int64, error) {
+	files := []string{}
+	var totalBytes int64
+	err := filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			file := strings.TrimPrefix(strings.TrimPrefix(filePath, localPath), "/")
+			if filter.skipFile(file) {
+				return nil
 			}
+			files = append(files, file)
+			totalBytes += info.Size()
 		}
-		return
-	}()
+		return nil
+	})
+	return files, totalBytes, err
+}
+
+func checkDiffFromPath(diffFromPath string) error {
+	if diffFromPath == "" {
+		return nil
+	}
+	fi, err := os.Stat(diffFromPath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", diffFromPath)
+	}
+	if isClickhouseShadow(filepath.Join(diffFromPath, "shadow")) {
+		return fmt.Errorf("'%s' is old format backup and doesn't supports diff", filepath.Base(diffFromPath))
+	}
+	return nil
+}
+
+// archiveResult - hardlinks and checksums of files written by writeArchiveFiles, shared by archives of one backup
+type archiveResult struct {
+	hardlinks []string
+	checksums map[string]string
+	// parts - number of objects put for each archive
+	parts map[string]int
+	sync.Mutex
+}
+
+func newArchiveResult() *archiveResult {
+	return &archiveResult{hardlinks: []string{}, checksums: map[string]string{}, parts: map[string]int{}}
+}
+
+func (r *archiveResult) setParts(archive string, parts int) {
+	r.Lock()
+	defer r.Unlock()
+	r.parts[archive] = parts
+}
+
+func (r *archiveResult) partsOf(archive string) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.parts[archive]
+}
+
+func (r *archiveResult) metaFile(diffFromPath string) *MetaFile {
+	r.Lock()
+	defer r.Unlock()
+	sort.Strings(r.hardlinks)
+	metafile := &MetaFile{
+		Hardlinks: r.hardlinks,
+		Checksums: r.checksums,
+	}
+	for archive, parts := range r.parts {
+		if parts < 2 {
+			continue
+		}
+		if metafile.ArchiveParts == nil {
+			metafile.ArchiveParts = map[string]int{}
+		}
+		metafile.ArchiveParts[archive] = parts
+	}
+	if len(r.hardlinks) > 0 {
+		metafile.RequiredBackup = filepath.Base(diffFromPath)
+	}
+	return metafile
+}
+
+// writeArchiveFiles - add files to archive, files which are the same as in diffFromPath are collected as hardlinks
+func writeArchiveFiles(ctx context.Context, z archiver.Writer, localPath, remotePath, diffFromPath string, files []string, bar *Bar, result *archiveResult) error {
+	iobuf := buffer.New(BufferSize)
+	for _, relativePath := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writeArchiveFile(ctx, z, iobuf, localPath, remotePath, diffFromPath, relativePath, bar, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArchiveMetaFile - add meta.json to archive
+func writeArchiveMetaFile(z archiver.Writer, metafile *MetaFile) error {
+	content, err := json.MarshalIndent(metafile, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal json with %v", err)
+	}
+	tmpfile, err := ioutil.TempFile("", MetaFileName)
+	if err != nil {
+		return fmt.Errorf("can't create meta.info with %v", err)
+	}
+	tmpFileName := tmpfile.Name()
+	defer os.Remove(tmpFileName)
+	if _, err := tmpfile.Write(content); err != nil {
+		tmpfile.Close()
+		return fmt.Errorf("can't write to meta.info with %v", err)
+	}
+	tmpfile.Close()
+	info, err := os.Stat(tmpFileName)
+	if err != nil {
+		return fmt.Errorf("can't get stat with %v", err)
+	}
+	mf, err := os.Open(tmpFileName)
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+	if err := z.Write(archiver.File{
+		FileInfo: archiver.FileInfo{
+			FileInfo:   info,
+			CustomName: MetaFileName,
+		},
+		ReadCloser: mf,
+	}); err != nil {
+		return fmt.Errorf("can't add mata.json to archive with %v", err)
+	}
+	return nil
+}
 
-	if err := bd.PutFile(archiveName, body); err != nil {
+func writeArchiveFile(ctx context.Context, z archiver.Writer, iobuf buffer.Buffer, localPath, remotePath, diffFromPath, relativePath string, bar *Bar, result *archiveResult) error {
+	filePath := filepath.Join(localPath, relativePath)
+	info, err := os.Stat(filePath)
+	if err != nil {
 		return err
 	}
-	bar.Finish()
+	bar.Add64(info.Size())
+	if diffFromPath != "" {
+		diffFromFile, err := os.Stat(filepath.Join(diffFromPath, relativePath))
+		if err == nil {
+			if os.SameFile(info, diffFromFile) {
+				result.Lock()
+				result.hardlinks = append(result.hardlinks, relativePath)
+				result.Unlock()
+				return nil
+			}
+		}
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	publishFileEvent("upload", remotePath, relativePath, info.Size())
+	bfile := &hashingReader{ReadCloser: nio.NewReader(newContextReader(ctx, file), iobuf), hash: sha256.New()}
+	defer bfile.Close()
+	if err := z.Write(archiver.File{
+		FileInfo: archiver.FileInfo{
+			FileInfo:   info,
+			CustomName: relativePath,
+		},
+		ReadCloser: bfile,
+	}); err != nil {
+		return err
+	}
+	result.Lock()
+	result.checksums[relativePath] = hex.EncodeToString(bfile.hash.Sum(nil))
+	result.Unlock()
 	return nil
 }
 
+// NewBackupDestination - remote storage selected by general.remote_storage, its operations are retried by general.remote_max_retries,
+// files are encrypted when encryption.algorithm is set
 func NewBackupDestination(config Config) (*BackupDestination, error) {
+	if err := resolvePathMacros(&config); err != nil {
+		return nil, err
+	}
+	bd, err := newBackupDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	bd.RemoteStorage = newRetryStorage(bd.RemoteStorage, newRetryPolicy(config.General))
+	if config.Encryption.Algorithm != "" {
+		if bd.RemoteStorage, err = encryptStorage(bd.RemoteStorage, config.Encryption, bd.path); err != nil {
+			return nil, err
+		}
+	}
+	return bd, nil
+}
+
+func newBackupDestination(config Config) (*BackupDestination, error) {
+	bd := &BackupDestination{
+		disableProgressBar:     config.General.DisableProgressBar,
+		retention:              newRetentionPolicy(config),
+		resumableDownload:      config.General.ResumableDownload,
+		uploadConcurrency:      config.General.UploadConcurrency,
+		uploadLimiter:          newBandwidthLimiter(config.General.UploadMaxBandwidth),
+		downloadConcurrency:    config.General.DownloadConcurrency,
+		remoteLayout:           config.General.RemoteLayout,
+		uploadFormat:           config.General.UploadFormat,
+		compressionConcurrency: config.General.CompressionConcurrency,
+		maxFileSize:            config.General.MaxFileSize,
+		skipTables:             newTableFilter(config.ClickHouse),
+	}
 	switch config.General.RemoteStorage {
 	case "s3":
-		s3 := &S3{Config: &config.S3}
-		return &BackupDestination{
-			s3,
-			config.S3.Path,
-			config.S3.CompressionFormat,
-			config.S3.CompressionLevel,
-			config.General.DisableProgressBar,
-			config.General.BackupsToKeepRemote,
-		}, nil
+		bd.RemoteStorage = &S3{Config: &config.S3}
+		bd.path, bd.compressionFormat, bd.compressionLevel = config.S3.Path, config.S3.CompressionFormat, config.S3.CompressionLevel
 	case "gcs":
-		gcs := &GCS{Config: &config.GCS}
-		return &BackupDestination{
-			gcs,
-			config.GCS.Path,
-			config.GCS.CompressionFormat,
-			config.GCS.CompressionLevel,
-			config.General.DisableProgressBar,
-			config.General.BackupsToKeepRemote,
-		}, nil
+		bd.RemoteStorage = &GCS{Config: &config.GCS}
+		bd.path, bd.compressionFormat, bd.compressionLevel = config.GCS.Path, config.GCS.CompressionFormat, config.GCS.CompressionLevel
 	case "cos":
-		cos := &COS{Config: &config.COS}
-		return &BackupDestination{
-			cos,
-			config.COS.Path,
-			config.COS.CompressionFormat,
-			config.COS.CompressionLevel,
-			config.General.DisableProgressBar,
-			config.General.BackupsToKeepRemote,
-		}, nil
+		bd.RemoteStorage = &COS{Config: &config.COS}
+		bd.path, bd.compressionFormat, bd.compressionLevel = config.COS.Path, config.COS.CompressionFormat, config.COS.CompressionLevel
+	case "file":
+		if config.File.Path == "" {
+			return nil, fmt.Errorf("file.path is required for 'file' remote storage")
+		}
+		// FileStorage resolves keys against file.path itself
+		bd.RemoteStorage = &FileStorage{Config: &config.File}
+		bd.compressionFormat, bd.compressionLevel = config.File.CompressionFormat, config.File.CompressionLevel
+	case "plugin":
+		if config.Plugin.Socket == "" {
+			return nil, fmt.Errorf("plugin.socket is required for 'plugin' remote storage")
+		}
+		bd.RemoteStorage = &Plugin{Config: &config.Plugin}
+		bd.path, bd.compressionFormat, bd.compressionLevel = config.Plugin.Path, config.Plugin.CompressionFormat, config.Plugin.CompressionLevel
 	default:
 		return nil, fmt.Errorf("storage type '%s' not supported", config.General.RemoteStorage)
 	}
+	return bd, nil
 }
@@ -0,0 +1,248 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// BrokenBackup - remote backup which can't be downloaded, response of GET /backup/broken
+type BrokenBackup struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// remoteBackupObjects - objects of remote backup by key relative to backup directory
+type remoteBackupObjects struct {
+	archive bool
+	objects map[string]bool
+	size    int64
+	// lastModified - time of the newest object, upload which is still running keeps it fresh
+	lastModified time.Time
+}
+
+// brokenBackups - remote backups left by failed uploads without meta.json, backups whose meta.json references missing objects
+// and backups which require broken or missing backups. Backups of old format with 'metadata' and 'shadow' aren't checked.
+// Unfinished backups with objects modified during the last minAge may still be uploaded by another host, so they aren't broken
+func (bd *BackupDestination) brokenBackups(ctx context.Context, minAge time.Duration) ([]BrokenBackup, error) {
+	backups := map[string]*remoteBackupObjects{}
+	pool := map[string]bool{}
+	poolPrefix := path.Join(bd.path, casDir) + "/"
+	probePrefix := path.Join(bd.path, checkRemoteDir) + "/"
+	err := bd.Walk(ctx, bd.path, func(f RemoteFile) {
+		if !strings.HasPrefix(f.Name(), bd.path) || strings.HasPrefix(f.Name(), probePrefix) {
+			return
+		}
+		if strings.HasPrefix(f.Name(), poolPrefix) {
+			pool[path.Base(f.Name())] = true
+			return
+		}
+		backupName := backupNameOfKey(bd.path, f.Name())
+		b, ok := backups[backupName]
+		if !ok {
+			b = &remoteBackupObjects{objects: map[string]bool{}}
+			backups[backupName] = b
+		}
+		b.size += f.Size()
+		if f.LastModified().After(b.lastModified) {
+			b.lastModified = f.LastModified()
+		}
+		parts := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(f.Name(), bd.path), "/"), "/", 2)
+		if len(parts) == 1 {
+			b.archive = b.archive || formatOfArchive(parts[0]) != ""
+			return
+		}
+		b.objects[parts[1]] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	reasons := map[string]string{}
+	required := map[string]string{}
+	inProgress := func(b *remoteBackupObjects) bool {
+		return minAge > 0 && time.Since(b.lastModified) < minAge
+	}
+	for backupName, b := range backups {
+		if b.objects[ManifestFileName] {
+			manifest, err := bd.readRemoteManifest(ctx, backupName)
+			if err != nil {
+				reasons[backupName] = err.Error()
+				continue
+			}
+			if manifest != nil && manifest.State == manifestUploading {
+				if inProgress(b) {
+					continue
+				}
+				reasons[backupName] = fmt.Sprintf("%s is in state '%s', upload wasn't finished", ManifestFileName, manifestUploading)
+				continue
+			}
+		}
+		if b.archive {
+			continue
+		}
+		if !b.objects[MetaFileName] {
+			if (!b.hasDir("metadata") || !b.hasDir("shadow")) && !inProgress(b) {
+				reasons[backupName] = fmt.Sprintf("%s isn't found, upload wasn't finished", MetaFileName)
+			}
+			continue
+		}
+		metafile, err := bd.readMetaFile(ctx, path.Join(bd.path, backupName, MetaFileName))
+		if err != nil {
+			reasons[backupName] = err.Error()
+			continue
+		}
+		if missing := bd.missingObjects(metafile, b.objects, pool); len(missing) > 0 {
+			reasons[backupName] = fmt.Sprintf("%d objects aren't found, e.g. '%s'", len(missing), missing[0])
+			continue
+		}
+		if metafile.RequiredBackup != "" {
+			required[backupName] = metafile.RequiredBackup
+		}
+	}
+	// backup which requires broken or missing backup can't be downloaded too
+	for changed := true; changed; {
+		changed = false
+		for backupName, requiredBackup := range required {
+			if _, broken := reasons[backupName]; broken {
+				continue
+			}
+			if _, exists := backups[requiredBackup]; !exists {
+				reasons[backupName] = fmt.Sprintf("required backup '%s' isn't found", requiredBackup)
+				changed = true
+			} else if _, broken := reasons[requiredBackup]; broken {
+				reasons[backupName] = fmt.Sprintf("required backup '%s' is broken", requiredBackup)
+				changed = true
+			}
+		}
+	}
+	result := make([]BrokenBackup, 0, len(reasons))
+	for backupName, reason := range reasons {
+		result = append(result, BrokenBackup{Name: backupName, Size: backups[backupName].size, Reason: reason})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func (b *remoteBackupObjects) hasDir(dir string) bool {
+	for object := range b.objects {
+		if strings.HasPrefix(object, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// missingObjects - objects referenced by meta.json which aren't found, files of cas layout are looked up in pool
+func (bd *BackupDestination) missingObjects(metafile MetaFile, objects, pool map[string]bool) []string {
+	missing := []string{}
+	switch metafile.Layout {
+	case casLayout:
+		for _, checksum := range metafile.Checksums {
+			if !pool[checksum] {
+				missing = append(missing, bd.casKey(checksum))
+			}
+		}
+	case directoryLayout:
+		for name := range metafile.Checksums {
+			if !objects[name] {
+				missing = append(missing, name)
+			}
+		}
+	default:
+		for _, archive := range metafile.Archives {
+			for _, object := range metafile.archiveObjects("", archive) {
+				if !objects[object] {
+					missing = append(missing, object)
+				}
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// GetRemoteBrokenBackups - remote backups which can't be downloaded, see brokenBackups
+func GetRemoteBrokenBackups(ctx context.Context, config Config) ([]BrokenBackup, error) {
+	if config.General.RemoteStorage == "none" {
+		return nil, fmt.Errorf("remote storage is not configured")
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, err
+	}
+	return bd.brokenBackups(ctx, brokenBackupMinAge(config))
+}
+
+// brokenBackupMinAge - general.broken_backup_min_age, config is validated so parse error means 0
+func brokenBackupMinAge(config Config) time.Duration {
+	minAge, _ := time.ParseDuration(config.General.BrokenBackupMinAge)
+	return minAge
+}
+
+// CleanRemoteBroken - remove broken remote backups and return them, with --dry-run they're only returned.
+// Unfinished backups younger than general.broken_backup_min_age are kept, they may be uploaded right now
+func CleanRemoteBroken(ctx context.Context, config Config) ([]BrokenBackup, error) {
+	if config.General.RemoteStorage == "none" {
+		return nil, fmt.Errorf("clean_remote_broken requires general.remote_storage")
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, err
+	}
+	broken, err := bd.brokenBackups(ctx, brokenBackupMinAge(config))
+	if err != nil || config.General.DryRun {
+		return broken, err
+	}
+	removed := make([]BrokenBackup, 0, len(broken))
+	for _, backup := range broken {
+		log.Printf("Backup '%s' is broken: %s", backup.Name, backup.Reason)
+		if err := bd.RemoveBackup(ctx, backup.Name); err != nil {
+			if errors.Is(err, ErrObjectLocked) {
+				log.Printf("Backup '%s' is kept: %v", backup.Name, err)
+				continue
+			}
+			return removed, err
+		}
+		removed = append(removed, backup)
+	}
+	return removed, nil
+}
+
+// PrintCleanRemoteBroken - remove broken remote backups and print them
+func PrintCleanRemoteBroken(ctx context.Context, config Config) error {
+	broken, err := CleanRemoteBroken(ctx, config)
+	if config.General.DryRun {
+		fmt.Println("Dry run of clean_remote_broken, nothing is changed")
+	}
+	if len(broken) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSIZE\tREASON")
+		for _, backup := range broken {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", backup.Name, FormatBytes(backup.Size), backup.Reason)
+		}
+		w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	if !config.General.DryRun {
+		fmt.Printf("%d broken backups removed\n", len(broken))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokenBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broken")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		// complete backups
+		"full.tar.gz":                    "archive",
+		"tables/meta.json":               `{"archives":["default.t1.tar"]}`,
+		"tables/default.t1.tar":          "archive",
+		"increment/meta.json":            `{"required_backup":"tables","archives":["default.t1.tar"]}`,
+		"increment/default.t1.tar":       "archive",
+		"old/metadata/default/t1.sql":    "CREATE TABLE t1",
+		"old/shadow/default/t1/all/data": "part",
+		// broken backups
+		"partial/default.t1.tar":         "archive",
+		"uploading.tar.gz":               "archive",
+		"uploading/manifest.json":        `{"version":2,"state":"uploading"}`,
+		"missing/meta.json":              `{"archives":["default.t1.tar","default.t2.tar"]}`,
+		"missing/default.t1.tar":         "archive",
+		"orphan/meta.json":               `{"required_backup":"missing","archives":[]}`,
+		"directory/meta.json":            `{"layout":"directory","checksums":{"metadata/default/t1.sql":"sha"}}`,
+		".clickhouse-backup-check/probe": "probe",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, "backups", name)), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "backups", name), []byte(content), 0640))
+	}
+	bd := &BackupDestination{
+		RemoteStorage:      &FileStorage{Config: &FileConfig{Path: dir}},
+		path:               "backups",
+		disableProgressBar: true,
+	}
+	ctx := context.Background()
+	broken, err := bd.brokenBackups(ctx, 0)
+	require.NoError(t, err)
+	names := []string{}
+	for _, backup := range broken {
+		names = append(names, backup.Name)
+	}
+	assert.Equal(t, []string{"directory", "missing", "orphan", "partial", "uploading"}, names)
+	assert.Equal(t, "1 objects aren't found, e.g. 'default.t2.tar'", broken[1].Reason)
+	assert.Equal(t, "required backup 'missing' is broken", broken[2].Reason)
+
+	// unfinished backups which were just modified may be uploaded right now
+	inProgress, err := bd.brokenBackups(ctx, time.Hour)
+	require.NoError(t, err)
+	names = []string{}
+	for _, backup := range inProgress {
+		names = append(names, backup.Name)
+	}
+	assert.Equal(t, []string{"directory", "missing", "orphan"}, names)
+
+	for _, backup := range broken {
+		require.NoError(t, bd.RemoveBackup(ctx, backup.Name))
+	}
+	broken, err = bd.brokenBackups(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, broken)
+	backups, err := bd.BackupList(ctx)
+	require.NoError(t, err)
+	assert.Len(t, backups, 4)
+}
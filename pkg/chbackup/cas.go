@@ -0,0 +1,351 @@
+package chbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// casLayout - MetaFile.Layout of backup which files are stored in content-addressable pool
+	casLayout = "cas"
+	// casDir - directory of pool shared by backups with cas layout, each file is stored once as 'cas/<xx>/<sha256>'
+	casDir = "cas"
+)
+
+// casKey - key of file with SHA256 checksum in pool
+func (bd *BackupDestination) casKey(checksum string) string {
+	return path.Join(bd.path, casDir, checksum[:2], checksum)
+}
+
+// casPool - files in pool by checksum
+func (bd *BackupDestination) casPool(ctx context.Context) (map[string]RemoteFile, error) {
+	pool := map[string]RemoteFile{}
+	prefix := path.Join(bd.path, casDir) + "/"
+	err := bd.Walk(ctx, prefix, func(f RemoteFile) {
+		if strings.HasPrefix(f.Name(), prefix) {
+			pool[path.Base(f.Name())] = f
+		}
+	})
+	return pool, err
+}
+
+// casFile - file of pool with checksum, nil when it isn't in pool. Objects are checked one by one,
+// so upload and download don't list the whole pool which grows with every backup
+func (bd *BackupDestination) casFile(ctx context.Context, checksum string) (RemoteFile, error) {
+	file, err := bd.GetFile(ctx, bd.casKey(checksum))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return file, err
+}
+
+// fileChecksum - SHA256 of local file
+func fileChecksum(ctx context.Context, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, newContextReader(ctx, file)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), nil
+}
+
+// CASUpload - upload files of backup which aren't in pool yet by general.upload_concurrency workers, meta.json with checksums
+// of all files is uploaded the last. Files uploaded before failure are kept in pool, so they aren't uploaded again by the next attempt.
+// Files which were already in pool are checked again after meta.json is uploaded, delete of another backup running at the same time
+// could remove them before meta.json referenced them, such files are uploaded again. diffFromPath isn't used, unchanged files are already in pool
+func (bd *BackupDestination) CASUpload(ctx context.Context, localPath, remotePath, diffFromPath string) error {
+	if remotePath == casDir {
+		return fmt.Errorf("backup can't be named '%s' with cas layout", casDir)
+	}
+	metaName := path.Join(bd.path, remotePath, MetaFileName)
+	if _, err := bd.GetFile(ctx, metaName); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	files, totalBytes, err := bd.uploadFiles(localPath)
+	if err != nil {
+		return err
+	}
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	checksums := map[string]string{}
+	// pool - true for files which were already in pool, false for files uploaded by this upload
+	pool := map[string]bool{}
+	var uploaded, skipped int
+	var poolMutex sync.Mutex
+	_, err = runArchiveWorkers(ctx, bd.uploadConcurrency, "upload", files, func(relativePath string) error {
+		filePath := filepath.Join(localPath, relativePath)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		checksum, err := fileChecksum(ctx, filePath)
+		if err != nil {
+			return err
+		}
+		poolMutex.Lock()
+		checksums[relativePath] = checksum
+		_, seen := pool[checksum]
+		if seen {
+			// the same content is uploaded once when backup contains it in several files
+			skipped++
+		} else {
+			pool[checksum] = false
+		}
+		poolMutex.Unlock()
+		if seen {
+			bar.Add64(info.Size())
+			return nil
+		}
+		existing, err := bd.casFile(ctx, checksum)
+		if err != nil {
+			return err
+		}
+		poolMutex.Lock()
+		if existing != nil {
+			pool[checksum] = true
+			skipped++
+		} else {
+			uploaded++
+		}
+		poolMutex.Unlock()
+		if existing != nil {
+			bar.Add64(info.Size())
+			return nil
+		}
+		return bd.casPutFile(ctx, localPath, remotePath, relativePath, checksum, bar)
+	})
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(MetaFile{Hardlinks: []string{}, Checksums: checksums, Layout: casLayout}, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal json with %v", err)
+	}
+	if err := bd.PutFile(ctx, metaName, ioutil.NopCloser(bytes.NewReader(content))); err != nil {
+		return err
+	}
+	if err := bd.casRestoreRemoved(ctx, localPath, remotePath, checksums, pool); err != nil {
+		return err
+	}
+	bar.Finish()
+	log.Printf("Backup '%s': %d files uploaded, %d files are already in %s", remotePath, uploaded, skipped, casDir)
+	return nil
+}
+
+// casPutFile - upload local file of backup to pool
+func (bd *BackupDestination) casPutFile(ctx context.Context, localPath, remotePath, relativePath, checksum string, bar *Bar) error {
+	file, err := os.Open(filepath.Join(localPath, relativePath))
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	publishFileEvent("upload", remotePath, relativePath, info.Size())
+	body := &readCloser{Reader: bar.NewProxyReader(newContextReader(ctx, file)), Closer: file}
+	return bd.PutFile(ctx, bd.casKey(checksum), bd.uploadLimiter.reader(ctx, body))
+}
+
+// casRestoreRemoved - upload again files which were in pool before upload and were removed before meta.json referenced them
+func (bd *BackupDestination) casRestoreRemoved(ctx context.Context, localPath, remotePath string, checksums map[string]string, pool map[string]bool) error {
+	files := make([]string, 0, len(checksums))
+	restored := map[string]bool{}
+	for relativePath, checksum := range checksums {
+		if pool[checksum] && !restored[checksum] {
+			restored[checksum] = true
+			files = append(files, relativePath)
+		}
+	}
+	sort.Strings(files)
+	_, err := runArchiveWorkers(ctx, bd.uploadConcurrency, "upload", files, func(relativePath string) error {
+		checksum := checksums[relativePath]
+		existing, err := bd.casFile(ctx, checksum)
+		if err != nil || existing != nil {
+			return err
+		}
+		log.Printf("'%s' was removed from %s during upload of '%s', uploading it again", bd.casKey(checksum), casDir, remotePath)
+		return bd.casPutFile(ctx, localPath, remotePath, relativePath, checksum, StartNewByteBar(false, 0))
+	})
+	return err
+}
+
+// casDownload - download files of backup with cas layout from pool by general.download_concurrency workers
+func (bd *BackupDestination) casDownload(ctx context.Context, metafile MetaFile, remotePath, localPath string) error {
+	names := make([]string, 0, len(metafile.Checksums))
+	for name := range metafile.Checksums {
+		if !bd.skipTables.skipFile(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var totalBytes int64
+	var sizeMutex sync.Mutex
+	_, err := runArchiveWorkers(ctx, bd.downloadConcurrency, "download", names, func(name string) error {
+		file, err := bd.casFile(ctx, metafile.Checksums[name])
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return fmt.Errorf("file '%s' of '%s' isn't found in %s", name, remotePath, casDir)
+		}
+		sizeMutex.Lock()
+		totalBytes += file.Size()
+		sizeMutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	_, err = runArchiveWorkers(ctx, bd.downloadConcurrency, "download", names, func(name string) error {
+		checksum := metafile.Checksums[name]
+		return bd.downloadVerifiedFile(ctx, bd.casKey(checksum), remotePath, localPath, name, checksum, bar)
+	})
+	if err != nil {
+		return err
+	}
+	bar.Finish()
+	return nil
+}
+
+// downloadVerifiedFile - download object to file 'name' of backup and compare SHA256 of its content with checksum
+func (bd *BackupDestination) downloadVerifiedFile(ctx context.Context, key, remotePath, localPath, name, checksum string, bar *Bar) error {
+	reader, err := bd.GetFileReader(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	extractFile := filepath.Join(localPath, name)
+	if err := os.MkdirAll(filepath.Dir(extractFile), os.ModePerm); err != nil {
+		return err
+	}
+	dst, err := os.Create(extractFile)
+	if err != nil {
+		return err
+	}
+	fileHash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, fileHash), bar.NewProxyReader(newContextReader(ctx, reader)))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(fileHash.Sum(nil)) != checksum {
+		return fmt.Errorf("checksum mismatch of '%s' in '%s', file is corrupted", name, remotePath)
+	}
+	publishFileEvent("download", remotePath, name, size)
+	return nil
+}
+
+// casMissingFiles - files of pool referenced by metafile which aren't in pool of dst, they must be copied with backup
+func (bd *BackupDestination) casMissingFiles(ctx context.Context, metafile MetaFile, dst *BackupDestination) ([]RemoteFile, error) {
+	files := []RemoteFile{}
+	checked := map[string]bool{}
+	for _, checksum := range metafile.Checksums {
+		if checked[checksum] {
+			continue
+		}
+		checked[checksum] = true
+		existing, err := dst.casFile(ctx, checksum)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			continue
+		}
+		file, err := bd.casFile(ctx, checksum)
+		if err != nil {
+			return nil, err
+		}
+		if file == nil {
+			return nil, fmt.Errorf("'%s' isn't found in %s", checksum, casDir)
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+// casReferenced - checksums of files referenced by backups with cas layout, except backups from removed
+func (bd *BackupDestination) casReferenced(ctx context.Context, removed map[string]bool) (map[string]bool, error) {
+	metaFiles := []string{}
+	if err := bd.Walk(ctx, bd.path, func(f RemoteFile) {
+		parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(f.Name(), bd.path), "/"), "/")
+		if len(parts) == 2 && parts[1] == MetaFileName && !removed[parts[0]] {
+			metaFiles = append(metaFiles, f.Name())
+		}
+	}); err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{}
+	for _, metaName := range metaFiles {
+		metafile, err := bd.readMetaFile(ctx, metaName)
+		if err != nil {
+			return nil, err
+		}
+		if metafile.Layout != casLayout {
+			continue
+		}
+		for _, checksum := range metafile.Checksums {
+			referenced[checksum] = true
+		}
+	}
+	return referenced, nil
+}
+
+// casUnreferenced - sorted keys of files of pool with checksums which aren't referenced by backups except backups from removed
+func (bd *BackupDestination) casUnreferenced(ctx context.Context, checksums map[string]string, removed map[string]bool) ([]string, error) {
+	referenced, err := bd.casReferenced(ctx, removed)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, checksum := range checksums {
+		if !referenced[checksum] {
+			referenced[checksum] = true
+			keys = append(keys, bd.casKey(checksum))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// casRemoveUnreferenced - remove files of removed backup from pool when other backups don't reference them,
+// locked files are kept
+func (bd *BackupDestination) casRemoveUnreferenced(ctx context.Context, checksums map[string]string) error {
+	keys, err := bd.casUnreferenced(ctx, checksums, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Remove %d unreferenced files from %s", len(keys), casDir)
+	err = bd.deleteKeys(ctx, keys, func(int) {})
+	if errors.Is(err, ErrObjectLocked) {
+		log.Printf("Unreferenced files are kept in %s: %v", casDir, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package chbackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCASLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeBackup := func(name string, files map[string]string) string {
+		localPath := filepath.Join(dir, "backup", name)
+		for file, content := range files {
+			require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(localPath, file)), 0750))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(localPath, file), []byte(content), 0640))
+		}
+		return localPath
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "remote"), 0750))
+	bd := &BackupDestination{
+		RemoteStorage:       &FileStorage{Config: &FileConfig{Path: filepath.Join(dir, "remote")}},
+		path:                "backups",
+		disableProgressBar:  true,
+		uploadConcurrency:   2,
+		downloadConcurrency: 2,
+		remoteLayout:        casLayout,
+	}
+	ctx := context.Background()
+	files1 := map[string]string{
+		"metadata/default/t1.sql":              "CREATE TABLE t1",
+		"shadow/default/t1/all_1_1_0/data.bin": "part 1",
+		"shadow/default/t1/all_2_2_0/data.bin": "part 2",
+	}
+	files2 := map[string]string{
+		"metadata/default/t1.sql":              "CREATE TABLE t1",
+		"shadow/default/t1/all_1_1_0/data.bin": "part 1",
+		"shadow/default/t1/all_3_3_0/data.bin": "part 3",
+	}
+	require.NoError(t, bd.CASUpload(ctx, writeBackup("backup1", files1), "backup1", ""))
+	require.NoError(t, bd.CASUpload(ctx, writeBackup("backup2", files2), "backup2", ""))
+	pool, err := bd.casPool(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pool, 4)
+	backups, err := bd.BackupList(ctx)
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+
+	downloadPath := filepath.Join(dir, "download", "backup2")
+	require.NoError(t, bd.CompressedStreamDownload(ctx, "backup2", downloadPath))
+	for name, content := range files2 {
+		b, err := ioutil.ReadFile(filepath.Join(downloadPath, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	}
+
+	// only 'part 2' isn't referenced by backup2
+	items, err := bd.removeBackupItems(ctx, []string{"backup1"}, map[string]bool{"backup1": true})
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "backups/backup1/meta.json", items[0].Object)
+	part2 := sha256.Sum256([]byte("part 2"))
+	assert.Equal(t, bd.casKey(hex.EncodeToString(part2[:])), items[1].Object)
+	assert.Equal(t, int64(len("part 2")), items[1].Size)
+	require.NoError(t, bd.RemoveBackup(ctx, "backup1"))
+	pool, err = bd.casPool(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pool, 3)
+	require.NoError(t, bd.RemoveBackup(ctx, "backup2"))
+	pool, err = bd.casPool(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pool, 0)
+}
+
+func TestCASRestoreRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	localPath := filepath.Join(dir, "backup", "backup1")
+	require.NoError(t, os.MkdirAll(filepath.Join(localPath, "shadow"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(localPath, "shadow", "data.bin"), []byte("part 1"), 0640))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "remote"), 0750))
+	bd := &BackupDestination{
+		RemoteStorage:      &FileStorage{Config: &FileConfig{Path: filepath.Join(dir, "remote")}},
+		path:               "backups",
+		disableProgressBar: true,
+		uploadConcurrency:  1,
+		remoteLayout:       casLayout,
+	}
+	ctx := context.Background()
+	require.NoError(t, bd.CASUpload(ctx, localPath, "backup1", ""))
+	sum := sha256.Sum256([]byte("part 1"))
+	checksum := hex.EncodeToString(sum[:])
+	file, err := bd.casFile(ctx, checksum)
+	require.NoError(t, err)
+	require.NotNil(t, file)
+
+	// file found in pool by upload is removed by concurrent delete before meta.json references it
+	require.NoError(t, bd.DeleteFile(ctx, bd.casKey(checksum)))
+	file, err = bd.casFile(ctx, checksum)
+	require.NoError(t, err)
+	assert.Nil(t, file)
+	checksums := map[string]string{"shadow/data.bin": checksum}
+	require.NoError(t, bd.casRestoreRemoved(ctx, localPath, "backup1", checksums, map[string]bool{checksum: true}))
+	file, err = bd.casFile(ctx, checksum)
+	require.NoError(t, err)
+	require.NotNil(t, file)
+	assert.Equal(t, int64(len("part 1")), file.Size())
+}
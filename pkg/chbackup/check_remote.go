@@ -0,0 +1,126 @@
+package chbackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// checkRemoteDir - directory of probe objects written by CheckRemote, it isn't listed as backup
+const checkRemoteDir = ".clickhouse-backup-check"
+
+// RemoteCheck - result of one step of CheckRemote, Duration is in seconds
+type RemoteCheck struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// RemoteCheckResult - response of check-remote and /backup/check
+type RemoteCheckResult struct {
+	Storage string        `json:"storage"`
+	Status  string        `json:"status"`
+	Checks  []RemoteCheck `json:"checks"`
+}
+
+func (r *RemoteCheckResult) run(name string, step func() error) bool {
+	start := time.Now()
+	err := step()
+	check := RemoteCheck{Name: name, Status: "ok", Duration: time.Since(start).Seconds()}
+	if err != nil {
+		check.Status = "fail"
+		check.Error = err.Error()
+		r.Status = "fail"
+	}
+	r.Checks = append(r.Checks, check)
+	return err == nil
+}
+
+// CheckRemote - check credentials, bucket and list, put, get and delete permissions of remote storage by probe object,
+// checks after the first failed one are skipped, the probe object is removed when it was written
+func CheckRemote(ctx context.Context, config Config) RemoteCheckResult {
+	result := RemoteCheckResult{Storage: config.General.RemoteStorage, Status: "ok", Checks: []RemoteCheck{}}
+	if config.General.RemoteStorage == "none" {
+		result.run("connect", func() error {
+			return fmt.Errorf("remote storage is not configured")
+		})
+		return result
+	}
+	var bd *BackupDestination
+	if !result.run("connect", func() error {
+		var err error
+		if bd, err = NewBackupDestination(config); err != nil {
+			return err
+		}
+		return bd.Connect()
+	}) {
+		return result
+	}
+	result.Storage = bd.Kind()
+	if !result.run("bucket", func() error {
+		return bd.CheckBucket(ctx)
+	}) {
+		return result
+	}
+	probeDir := path.Join(bd.path, checkRemoteDir)
+	if !result.run("list", func() error {
+		return bd.Walk(ctx, probeDir, func(RemoteFile) {})
+	}) {
+		return result
+	}
+	hostname, _ := os.Hostname()
+	probeKey := path.Join(probeDir, hostname+"-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	probe := []byte("clickhouse-backup check-remote probe " + time.Now().UTC().Format(time.RFC3339))
+	if !result.run("put", func() error {
+		return bd.PutFile(ctx, probeKey, ioutil.NopCloser(bytes.NewReader(probe)))
+	}) {
+		return result
+	}
+	if result.run("get", func() error {
+		reader, err := bd.GetFileReader(ctx, probeKey)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(content, probe) {
+			return fmt.Errorf("content of '%s' doesn't match written one", probeKey)
+		}
+		return nil
+	}) {
+		result.run("delete", func() error {
+			return bd.DeleteFile(ctx, probeKey)
+		})
+	} else {
+		// probe object is removed anyway
+		if err := bd.DeleteFile(ctx, probeKey); err != nil {
+			result.run("delete", func() error { return err })
+		}
+	}
+	return result
+}
+
+// PrintCheckRemote - print result of CheckRemote, return error when a check is failed
+func PrintCheckRemote(ctx context.Context, config Config) error {
+	result := CheckRemote(ctx, config)
+	for _, check := range result.Checks {
+		line := fmt.Sprintf("%s\t%s\t%s", check.Name, check.Status, time.Duration(check.Duration*float64(time.Second)).Round(time.Millisecond))
+		if check.Error != "" {
+			line += "\t" + check.Error
+		}
+		fmt.Println(line)
+	}
+	if result.Status != "ok" {
+		return fmt.Errorf("%s remote storage check failed", result.Storage)
+	}
+	return nil
+}
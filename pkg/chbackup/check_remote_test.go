@@ -0,0 +1,36 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.General.RemoteStorage = "file"
+	config.File.Path = dir
+	result := CheckRemote(context.Background(), *config)
+	assert.Equal(t, "ok", result.Status)
+	names := []string{}
+	for _, check := range result.Checks {
+		names = append(names, check.Name)
+	}
+	assert.Equal(t, []string{"connect", "bucket", "list", "put", "get", "delete"}, names)
+	_, err = os.Stat(filepath.Join(dir, checkRemoteDir))
+	assert.True(t, os.IsNotExist(err))
+
+	config.File.Path = filepath.Join(dir, "missing")
+	result = CheckRemote(context.Background(), *config)
+	assert.Equal(t, "fail", result.Status)
+	require.Len(t, result.Checks, 1)
+	assert.Equal(t, "connect", result.Checks[0].Name)
+}
@@ -36,6 +36,8 @@ type Table struct {
 type BackupPartition struct {
 	Name string
 	Path string
+	// Disk - disk of part on backup server, empty for default disk
+	Disk string
 }
 
 // BackupTable - struct to store additional information on partitions
@@ -123,14 +125,9 @@ func (ch *ClickHouse) GetTables() ([]Table, error) {
 	if err := ch.conn.Select(&tables, "SELECT database, name FROM system.tables WHERE is_temporary = 0 AND engine LIKE '%MergeTree';"); err != nil {
 		return nil, err
 	}
+	skipTables := newTableFilter(*ch.Config)
 	for i, t := range tables {
-		for _, filter := range ch.Config.SkipTables {
-			if matched, _ := filepath.Match(filter, fmt.Sprintf("%s.%s", t.Database, t.Name)); matched {
-				t.Skip = true
-				tables[i] = t
-				break
-			}
-		}
+		tables[i].Skip = skipTables.skip(t.Database, t.Name)
 	}
 	return tables, nil
 }
@@ -149,40 +146,123 @@ func (ch *ClickHouse) GetVersion() (int, error) {
 	return strconv.Atoi(result[0])
 }
 
+// GetVersionString - return ClickHouse version as string, e.g. '21.8.4.51'
+func (ch *ClickHouse) GetVersionString() (string, error) {
+	var result []string
+	if err := ch.conn.Select(&result, "SELECT version();"); err != nil {
+		return "", fmt.Errorf("can't get ClickHouse version with %v", err)
+	}
+	if len(result) == 0 {
+		return "", nil
+	}
+	return result[0], nil
+}
+
+// GetMacros - return macros of server from system.macros
+func (ch *ClickHouse) GetMacros() (map[string]string, error) {
+	var result []struct {
+		Macro        string `db:"macro"`
+		Substitution string `db:"substitution"`
+	}
+	if err := ch.conn.Select(&result, "SELECT macro, substitution FROM system.macros;"); err != nil {
+		return nil, fmt.Errorf("can't get macros with %v", err)
+	}
+	macros := make(map[string]string, len(result))
+	for _, m := range result {
+		macros[m.Macro] = m.Substitution
+	}
+	return macros, nil
+}
+
 // FreezeTableOldWay - freeze all partitions in table one by one
 // This way using for ClickHouse below v19.1
 func (ch *ClickHouse) FreezeTableOldWay(table Table) error {
+	partitionIDs, err := ch.GetPartitionIDs(table)
+	if err != nil {
+		return err
+	}
+	return ch.FreezePartitions(table, partitionIDs)
+}
+
+// GetPartitionIDs - return IDs of partitions which have parts in table
+func (ch *ClickHouse) GetPartitionIDs(table Table) ([]string, error) {
 	var partitions []struct {
 		PartitionID string `db:"partition_id"`
 	}
 	q := fmt.Sprintf("SELECT DISTINCT partition_id FROM `system`.`parts` WHERE database='%s' AND table='%s'", table.Database, table.Name)
 	if err := ch.conn.Select(&partitions, q); err != nil {
-		return fmt.Errorf("can't get partitions for \"%s.%s\" with %v", table.Database, table.Name, err)
+		return nil, fmt.Errorf("can't get partitions for \"%s.%s\" with %v", table.Database, table.Name, err)
 	}
+	partitionIDs := make([]string, len(partitions))
+	for i, item := range partitions {
+		partitionIDs[i] = item.PartitionID
+	}
+	return partitionIDs, nil
+}
+
+// Part - active data part of table from system.parts
+type Part struct {
+	PartitionID string `db:"partition_id"`
+	Name        string `db:"name"`
+	BytesOnDisk uint64 `db:"bytes_on_disk"`
+}
+
+// GetParts - return active data parts of table sorted by name
+func (ch *ClickHouse) GetParts(table Table) ([]Part, error) {
+	var parts []Part
+	q := fmt.Sprintf("SELECT partition_id, name, bytes_on_disk FROM `system`.`parts` WHERE active AND database='%s' AND table='%s' ORDER BY name", table.Database, table.Name)
+	if err := ch.conn.Select(&parts, q); err != nil {
+		return nil, fmt.Errorf("can't get parts of \"%s.%s\" with %v", table.Database, table.Name, err)
+	}
+	return parts, nil
+}
+
+// FreezePartitions - freeze partitions of table one by one
+func (ch *ClickHouse) FreezePartitions(table Table, partitionIDs []string) error {
 	log.Printf("Freeze '%v.%v'", table.Database, table.Name)
-	for _, item := range partitions {
-		log.Printf("  partition '%v'", item.PartitionID)
+	for _, partitionID := range partitionIDs {
+		log.Printf("  partition '%v'", partitionID)
 		query := fmt.Sprintf(
 			"ALTER TABLE `%v`.`%v` FREEZE PARTITION ID '%v';",
 			table.Database,
 			table.Name,
-			item.PartitionID)
-		if item.PartitionID == "all" {
+			partitionID)
+		if partitionID == "all" {
 			query = fmt.Sprintf(
 				"ALTER TABLE `%v`.`%v` FREEZE PARTITION tuple();",
 				table.Database,
 				table.Name)
 		}
 		if _, err := ch.conn.Exec(query); err != nil {
-			return fmt.Errorf("can't freeze partition '%s' on '%s.%s' with: %v", item.PartitionID, table.Database, table.Name, err)
+			return fmt.Errorf("can't freeze partition '%s' on '%s.%s' with: %v", partitionID, table.Database, table.Name, err)
 		}
 	}
 	return nil
 }
 
-// FreezeTable - freeze all partitions for table
+// FreezeTable - freeze all partitions for table, only partitions with IDs from partitions when it isn't empty
 // This way available for ClickHouse sience v19.1
-func (ch *ClickHouse) FreezeTable(table Table) error {
+func (ch *ClickHouse) FreezeTable(table Table, partitions []string) error {
+	if len(partitions) > 0 {
+		existing, err := ch.GetPartitionIDs(table)
+		if err != nil {
+			return err
+		}
+		partitionIDs := []string{}
+		for _, partitionID := range existing {
+			for _, selected := range partitions {
+				if partitionID == selected {
+					partitionIDs = append(partitionIDs, partitionID)
+					break
+				}
+			}
+		}
+		if len(partitionIDs) == 0 {
+			log.Printf("Skip `%s`.`%s`, it doesn't have partitions %s", table.Database, table.Name, strings.Join(partitions, ", "))
+			return nil
+		}
+		return ch.FreezePartitions(table, partitionIDs)
+	}
 	version, err := ch.GetVersion()
 	if err != nil {
 		return err
@@ -205,6 +285,10 @@ func (ch *ClickHouse) GetBackupTables(backupName string) (map[string]BackupTable
 		return nil, err
 	}
 	backupShadowPath := filepath.Join(dataPath, "backup", backupName, "shadow")
+	partDisks, err := readPartDisks(filepath.Join(dataPath, "backup", backupName))
+	if err != nil {
+		return nil, err
+	}
 	dbNum := 0
 	tableNum := 1
 	partNum := 2
@@ -238,6 +322,7 @@ func (ch *ClickHouse) GetBackupTables(backupName string) (map[string]BackupTable
 			partition := BackupPartition{
 				Name: parts[partNum],
 				Path: filePath,
+				Disk: partDisks[path.Join(parts[dbNum], parts[tableNum], parts[partNum])],
 			}
 			tDB, _ := url.PathUnescape(parts[dbNum])
 			tName, _ := url.PathUnescape(parts[tableNum])
@@ -286,27 +371,32 @@ func (ch *ClickHouse) Chown(filename string) error {
 // CopyData - copy partitions for specific table to detached folder
 func (ch *ClickHouse) CopyData(table BackupTable) error {
 	log.Printf("Prepare data for restoring `%s`.`%s`", table.Database, table.Name)
-	dataPath, err := ch.GetDataPath()
+	tableDisks, err := ch.GetTableDisks(table.Database, table.Name)
 	if err != nil {
 		return err
 	}
-	detachedParentDir := filepath.Join(dataPath, "data", TablePathEncode(table.Database), TablePathEncode(table.Name), "detached")
-	os.MkdirAll(detachedParentDir, 0750)
-	ch.Chown(detachedParentDir)
 
 	for _, partition := range table.Partitions {
+		tableDataPath, err := partDataPath(tableDisks, ch.Config.DiskMapping, partition.Disk)
+		if err != nil {
+			return fmt.Errorf("can't find disk for part '%s' with %v", partition.Name, err)
+		}
+		detachedParentDir := filepath.Join(tableDataPath, "detached")
+		os.MkdirAll(detachedParentDir, 0750)
+		ch.Chown(detachedParentDir)
 		detachedPath := filepath.Join(detachedParentDir, partition.Name)
 		info, err := os.Stat(detachedPath)
 		if err != nil {
-			if os.IsNotExist(err) {
-				// partition dir does not exist, creating
-				os.MkdirAll(detachedPath, 0750)
-			} else {
+			if !os.IsNotExist(err) {
 				return err
 			}
 		} else if !info.IsDir() {
 			return fmt.Errorf("'%s' should be directory or absent", detachedPath)
+		} else if err := os.RemoveAll(detachedPath); err != nil {
+			// part is left by interrupted restore
+			return err
 		}
+		os.MkdirAll(detachedPath, 0750)
 		ch.Chown(detachedPath)
 
 		if err := filepath.Walk(partition.Path, func(filePath string, info os.FileInfo, err error) error {
@@ -324,7 +414,7 @@ func (ch *ClickHouse) CopyData(table BackupTable) error {
 				log.Printf("'%s' is not a regular file, skipping.", filePath)
 				return nil
 			}
-			if err := os.Link(filePath, dstFilePath); err != nil {
+			if err := linkOrCopyFile(filePath, dstFilePath); err != nil {
 				return fmt.Errorf("failed to crete hard link '%s' -> '%s' with %v", filePath, dstFilePath, err)
 			}
 			return ch.Chown(dstFilePath)
@@ -338,15 +428,21 @@ func (ch *ClickHouse) CopyData(table BackupTable) error {
 // AttachPatritions - execute ATTACH command for specific table
 func (ch *ClickHouse) AttachPatritions(table BackupTable) error {
 	for _, partition := range table.Partitions {
-		query := fmt.Sprintf("ALTER TABLE `%s`.`%s` ATTACH PART '%s'", table.Database, table.Name, partition.Name)
-		log.Println(query)
-		if _, err := ch.conn.Exec(query); err != nil {
+		if err := ch.AttachPart(table, partition.Name); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// AttachPart - execute ATTACH PART command for part in detached of table
+func (ch *ClickHouse) AttachPart(table BackupTable, part string) error {
+	query := fmt.Sprintf("ALTER TABLE `%s`.`%s` ATTACH PART '%s'", table.Database, table.Name, part)
+	log.Println(query)
+	_, err := ch.conn.Exec(query)
+	return err
+}
+
 // CreateDatabase - create ClickHouse database
 func (ch *ClickHouse) CreateDatabase(database string) error {
 	createQuery := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database)
@@ -354,6 +450,42 @@ func (ch *ClickHouse) CreateDatabase(database string) error {
 	return err
 }
 
+// CreateDatabaseOnCluster - create ClickHouse database on all hosts of cluster
+func (ch *ClickHouse) CreateDatabaseOnCluster(database, cluster string) error {
+	createQuery := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s` ON CLUSTER `%s`", database, cluster)
+	_, err := ch.conn.Exec(createQuery)
+	return err
+}
+
+// TableExists - table is in system.tables
+func (ch *ClickHouse) TableExists(database, table string) (bool, error) {
+	var count []uint64
+	q := fmt.Sprintf("SELECT count() FROM `system`.`tables` WHERE database='%s' AND name='%s'", database, table)
+	if err := ch.conn.Select(&count, q); err != nil {
+		return false, fmt.Errorf("can't check table `%s`.`%s` with %v", database, table, err)
+	}
+	return len(count) == 1 && count[0] > 0, nil
+}
+
+// DropTable - drop table or dictionary if it exists, tables of Atomic databases are dropped with SYNC,
+// so the table can be created again with the same UUID
+func (ch *ClickHouse) DropTable(table RestoreTable, onCluster string) error {
+	kind := "TABLE"
+	if strings.HasPrefix(table.Query, "CREATE DICTIONARY") {
+		kind = "DICTIONARY"
+	}
+	query := fmt.Sprintf("DROP %s IF EXISTS `%s`.`%s`", kind, table.Database, table.Table)
+	if onCluster != "" {
+		query += fmt.Sprintf(" ON CLUSTER `%s`", onCluster)
+	}
+	if engine, err := ch.GetDatabaseEngine(table.Database); err == nil && engine == "Atomic" {
+		query += " SYNC"
+	}
+	log.Println(query)
+	_, err := ch.conn.Exec(query)
+	return err
+}
+
 // CreateTable - create ClickHouse table
 func (ch *ClickHouse) CreateTable(table RestoreTable) error {
 	if _, err := ch.conn.Exec(fmt.Sprintf("USE `%s`", table.Database)); err != nil {
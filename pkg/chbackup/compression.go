@@ -0,0 +1,98 @@
+package chbackup
+
+import (
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver"
+)
+
+// compressionFormats - compression_format values by extension of archive, the longest extensions first.
+// ratio is typical size of archive relative to size of data parts, parts are already compressed by ClickHouse, so archives are slightly smaller
+var compressionFormats = []struct {
+	format    string
+	extension string
+	ratio     float64
+}{
+	{"zstd", "tar.zst", 0.8},
+	{"lz4", "tar.lz4", 0.95},
+	{"bzip2", "tar.bz2", 0.8},
+	{"gzip", "tar.gz", 0.85},
+	{"sz", "tar.sz", 0.95},
+	{"xz", "tar.xz", 0.75},
+	{"tar", "tar", 1},
+}
+
+// formatOfArchive - compression format of archive by its extension, empty when name isn't archive
+func formatOfArchive(name string) string {
+	for _, f := range compressionFormats {
+		if strings.HasSuffix(name, "."+f.extension) {
+			return f.format
+		}
+	}
+	return ""
+}
+
+// estimateArchiveSize - estimated size of archive of format with data parts of size bytes
+func estimateArchiveSize(format string, size uint64) uint64 {
+	for _, f := range compressionFormats {
+		if f.extension == getExtension(format) {
+			return uint64(float64(size) * f.ratio)
+		}
+	}
+	return size
+}
+
+// tarZstd - tar archive compressed by zstd with several threads, archiver doesn't support zstd
+type tarZstd struct {
+	*archiver.Tar
+	// level - 1 is the fastest zstd level, higher levels use default zstd level
+	level int
+	// concurrency - number of compression threads, number of CPUs when it isn't positive
+	concurrency int
+	encoder     *zstd.Encoder
+	decoder     *zstd.Decoder
+}
+
+func (t *tarZstd) Create(out io.Writer) error {
+	level := zstd.SpeedDefault
+	if t.level <= 1 {
+		level = zstd.SpeedFastest
+	}
+	concurrency := t.concurrency
+	if concurrency < 1 {
+		concurrency = runtime.NumCPU()
+	}
+	encoder, err := zstd.NewWriter(out, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(concurrency))
+	if err != nil {
+		return err
+	}
+	t.encoder = encoder
+	return t.Tar.Create(encoder)
+}
+
+func (t *tarZstd) Open(in io.Reader, size int64) error {
+	decoder, err := zstd.NewReader(in)
+	if err != nil {
+		return err
+	}
+	t.decoder = decoder
+	return t.Tar.Open(decoder, size)
+}
+
+func (t *tarZstd) Close() error {
+	err := t.Tar.Close()
+	if t.encoder != nil {
+		if closeErr := t.encoder.Close(); err == nil {
+			err = closeErr
+		}
+		t.encoder = nil
+	}
+	if t.decoder != nil {
+		t.decoder.Close()
+		t.decoder = nil
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package chbackup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/archiver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatOfArchive(t *testing.T) {
+	assert.Equal(t, "zstd", formatOfArchive("backup1.tar.zst"))
+	assert.Equal(t, "gzip", formatOfArchive("backup1/shadow/default/t1.tar.gz"))
+	assert.Equal(t, "tar", formatOfArchive("backup1.tar"))
+	assert.Equal(t, "", formatOfArchive("backup1"))
+	assert.Equal(t, "backup1", backupNameOfKey("", "backup1.tar.zst"))
+}
+
+func TestArchiveFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compression")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "data.bin")
+	require.NoError(t, ioutil.WriteFile(filePath, bytes.Repeat([]byte("part data "), 1000), 0640))
+	info, err := os.Stat(filePath)
+	require.NoError(t, err)
+	for _, format := range []string{"zstd", "lz4", "gzip", "none"} {
+		var buf bytes.Buffer
+		w, err := getArchiveWriter(format, 1, 2)
+		require.NoError(t, err)
+		require.NoError(t, w.Create(&buf))
+		f, err := os.Open(filePath)
+		require.NoError(t, err)
+		require.NoError(t, w.Write(archiver.File{
+			FileInfo:   archiver.FileInfo{FileInfo: info, CustomName: "shadow/default/t1/all_1_1_0/data.bin"},
+			ReadCloser: f,
+		}))
+		f.Close()
+		require.NoError(t, w.Close())
+
+		r, err := getArchiveReader(format)
+		require.NoError(t, err)
+		require.NoError(t, r.Open(&buf, 0))
+		file, err := r.Read()
+		require.NoError(t, err, format)
+		content, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("part data "), 1000), content, format)
+		_, err = r.Read()
+		assert.Equal(t, io.EOF, err, format)
+		require.NoError(t, r.Close())
+	}
+	_, err = getArchiveWriter("brotli", 1, 0)
+	assert.Error(t, err)
+}
+
+func TestEstimateArchiveSize(t *testing.T) {
+	assert.Equal(t, uint64(800), estimateArchiveSize("zstd", 1000))
+	assert.Equal(t, uint64(1000), estimateArchiveSize("none", 1000))
+	assert.Equal(t, uint64(750), estimateArchiveSize("xz", 1000))
+}
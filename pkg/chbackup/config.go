@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -17,7 +19,59 @@ type Config struct {
 	S3         S3Config         `yaml:"s3"`
 	GCS        GCSConfig        `yaml:"gcs"`
 	COS        COSConfig        `yaml:"cos"`
+	File       FileConfig       `yaml:"file"`
+	Plugin     PluginConfig     `yaml:"plugin"`
 	API        APIConfig        `yaml:"api"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	// Remotes - named remote storages which can be selected with '--remote' instead of general.remote_storage
+	Remotes map[string]RemoteConfig `yaml:"remotes,omitempty"`
+}
+
+// RemoteConfig - named remote storage, only section of RemoteStorage type is used
+type RemoteConfig struct {
+	RemoteStorage string       `yaml:"remote_storage"`
+	S3            S3Config     `yaml:"s3"`
+	GCS           GCSConfig    `yaml:"gcs"`
+	COS           COSConfig    `yaml:"cos"`
+	File          FileConfig   `yaml:"file"`
+	Plugin        PluginConfig `yaml:"plugin"`
+}
+
+// UnmarshalYAML - omitted settings of named remote get default values
+func (rc *RemoteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RemoteConfig
+	defaults := DefaultConfig()
+	remote := plain{
+		S3:     defaults.S3,
+		GCS:    defaults.GCS,
+		COS:    defaults.COS,
+		File:   defaults.File,
+		Plugin: defaults.Plugin,
+	}
+	if err := unmarshal(&remote); err != nil {
+		return err
+	}
+	*rc = RemoteConfig(remote)
+	return nil
+}
+
+// WithRemote - copy of config where general.remote_storage and its section are taken from named remote,
+// empty name means the default remote storage
+func (config Config) WithRemote(name string) (Config, error) {
+	if name == "" {
+		return config, nil
+	}
+	remote, ok := config.Remotes[name]
+	if !ok {
+		return config, fmt.Errorf("remote '%s' is not defined in 'remotes' config section", name)
+	}
+	config.General.RemoteStorage = remote.RemoteStorage
+	config.S3 = remote.S3
+	config.GCS = remote.GCS
+	config.COS = remote.COS
+	config.File = remote.File
+	config.Plugin = remote.Plugin
+	return config, nil
 }
 
 // GeneralConfig - general setting section
@@ -26,35 +80,89 @@ type GeneralConfig struct {
 	DisableProgressBar  bool   `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
 	BackupsToKeepLocal  int    `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
 	BackupsToKeepRemote int    `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
+	KeepDaily           int    `yaml:"keep_daily" envconfig:"KEEP_DAILY"`
+	KeepWeekly          int    `yaml:"keep_weekly" envconfig:"KEEP_WEEKLY"`
+	KeepMonthly         int    `yaml:"keep_monthly" envconfig:"KEEP_MONTHLY"`
+	RemoteMaxRetries    int    `yaml:"remote_max_retries" envconfig:"REMOTE_MAX_RETRIES"`
+	RemoteRetryBackoff  string `yaml:"remote_retry_backoff" envconfig:"REMOTE_RETRY_BACKOFF"`
+	ResumableDownload   bool   `yaml:"resumable_download" envconfig:"RESUMABLE_DOWNLOAD"`
+	UploadConcurrency   int    `yaml:"upload_concurrency" envconfig:"UPLOAD_CONCURRENCY"`
+	UploadMaxBandwidth  int64  `yaml:"upload_max_bandwidth" envconfig:"UPLOAD_MAX_BANDWIDTH"`
+	DownloadConcurrency int    `yaml:"download_concurrency" envconfig:"DOWNLOAD_CONCURRENCY"`
+	RemoteLayout        string `yaml:"remote_layout" envconfig:"REMOTE_LAYOUT"`
+	UploadFormat        string `yaml:"upload_format" envconfig:"UPLOAD_FORMAT"`
+	WatchInterval       string `yaml:"watch_interval" envconfig:"WATCH_INTERVAL"`
+	FullInterval        string `yaml:"full_interval" envconfig:"FULL_INTERVAL"`
+	// CompressionConcurrency - threads of 'zstd' compression_format, number of CPUs when it is 0
+	CompressionConcurrency int `yaml:"compression_concurrency" envconfig:"COMPRESSION_CONCURRENCY"`
+	// CreateConcurrency - tables frozen and moved from shadow simultaneously by create
+	CreateConcurrency int `yaml:"create_concurrency" envconfig:"CREATE_CONCURRENCY"`
+	// MaxFileSize - table archives bigger than this number of bytes are uploaded as several objects, 0 means no limit
+	MaxFileSize int64 `yaml:"max_file_size" envconfig:"MAX_FILE_SIZE"`
+	// DeleteLocalAfterUpload - local backup is removed by upload after uploaded backup is verified
+	DeleteLocalAfterUpload bool `yaml:"delete_local_after_upload" envconfig:"DELETE_LOCAL_AFTER_UPLOAD"`
+	// BrokenBackupMinAge - unfinished remote backups modified during this duration aren't broken, they may be uploaded by another host
+	BrokenBackupMinAge string `yaml:"broken_backup_min_age" envconfig:"BROKEN_BACKUP_MIN_AGE"`
+	// DedupLocalParts - create without --diff-from hard links unchanged parts to the newest other local backup
+	DedupLocalParts bool `yaml:"dedup_local_parts" envconfig:"DEDUP_LOCAL_PARTS"`
+	// DryRun - set by '--dry-run', create, restore, upload and delete print what they would change and change nothing
+	DryRun bool `yaml:"-" ignored:"true"`
 }
 
 // GCSConfig - GCS settings section
 type GCSConfig struct {
-	CredentialsFile   string `yaml:"credentials_file" envconfig:"GCS_CREDENTIALS_FILE"`
-	CredentialsJSON   string `yaml:"credentials_json" envconfig:"GCS_CREDENTIALS_JSON"`
-	Bucket            string `yaml:"bucket" envconfig:"GCS_BUCKET"`
-	Path              string `yaml:"path" envconfig:"GCS_PATH"`
-	CompressionLevel  int    `yaml:"compression_level" envconfig:"GCS_COMPRESSION_LEVEL"`
-	CompressionFormat string `yaml:"compression_format" envconfig:"GCS_COMPRESSION_FORMAT"`
+	CredentialsFile           string `yaml:"credentials_file" envconfig:"GCS_CREDENTIALS_FILE"`
+	CredentialsJSON           string `yaml:"credentials_json" envconfig:"GCS_CREDENTIALS_JSON"`
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account" envconfig:"GCS_IMPERSONATE_SERVICE_ACCOUNT"`
+	Bucket                    string `yaml:"bucket" envconfig:"GCS_BUCKET"`
+	AutoCreateBucket          bool   `yaml:"auto_create_bucket" envconfig:"GCS_AUTO_CREATE_BUCKET"`
+	ProjectID                 string `yaml:"project_id" envconfig:"GCS_PROJECT_ID"`
+	Path                      string `yaml:"path" envconfig:"GCS_PATH"`
+	CompressionLevel          int    `yaml:"compression_level" envconfig:"GCS_COMPRESSION_LEVEL"`
+	CompressionFormat         string `yaml:"compression_format" envconfig:"GCS_COMPRESSION_FORMAT"`
+	StorageClass              string `yaml:"storage_class" envconfig:"GCS_STORAGE_CLASS"`
+	KMSKeyName                string `yaml:"kms_key_name" envconfig:"GCS_KMS_KEY_NAME"`
+	ChunkSize                 int    `yaml:"chunk_size" envconfig:"GCS_CHUNK_SIZE"`
+	Timeout                   string `yaml:"timeout" envconfig:"GCS_TIMEOUT"`
+	MaxRetries                int    `yaml:"max_retries" envconfig:"GCS_MAX_RETRIES"`
+	RetryBackoff              string `yaml:"retry_backoff" envconfig:"GCS_RETRY_BACKOFF"`
 }
 
 // S3Config - s3 settings section
 type S3Config struct {
-	AccessKey               string `yaml:"access_key" envconfig:"S3_ACCESS_KEY"`
-	SecretKey               string `yaml:"secret_key" envconfig:"S3_SECRET_KEY"`
-	Bucket                  string `yaml:"bucket" envconfig:"S3_BUCKET"`
-	Endpoint                string `yaml:"endpoint" envconfig:"S3_ENDPOINT"`
-	Region                  string `yaml:"region" envconfig:"S3_REGION"`
-	ACL                     string `yaml:"acl" envconfig:"S3_ACL"`
-	ForcePathStyle          bool   `yaml:"force_path_style" envconfig:"S3_FORCE_PATH_STYLE"`
-	Path                    string `yaml:"path" envconfig:"S3_PATH"`
-	DisableSSL              bool   `yaml:"disable_ssl" envconfig:"S3_DISABLE_SSL"`
-	PartSize                int64  `yaml:"part_size" envconfig:"S3_PART_SIZE"`
-	CompressionLevel        int    `yaml:"compression_level" envconfig:"S3_COMPRESSION_LEVEL"`
-	CompressionFormat       string `yaml:"compression_format" envconfig:"S3_COMPRESSION_FORMAT"`
-	SSE                     string `yaml:"sse" envconfig:"S3_SSE"`
-	DisableCertVerification bool   `yaml:"disable_cert_verification" envconfig:"S3_DISABLE_CERT_VERIFICATION"`
-	Debug                   bool   `yaml:"debug" envconfig:"S3_DEBUG"`
+	AccessKey               string            `yaml:"access_key" envconfig:"S3_ACCESS_KEY"`
+	SecretKey               string            `yaml:"secret_key" envconfig:"S3_SECRET_KEY"`
+	AssumeRoleARN           string            `yaml:"assume_role_arn" envconfig:"S3_ASSUME_ROLE_ARN"`
+	ExternalID              string            `yaml:"external_id" envconfig:"S3_EXTERNAL_ID"`
+	RoleSessionName         string            `yaml:"role_session_name" envconfig:"S3_ROLE_SESSION_NAME"`
+	WebIdentityTokenFile    string            `yaml:"web_identity_token_file" envconfig:"S3_WEB_IDENTITY_TOKEN_FILE"`
+	WebIdentityRoleARN      string            `yaml:"web_identity_role_arn" envconfig:"S3_WEB_IDENTITY_ROLE_ARN"`
+	Bucket                  string            `yaml:"bucket" envconfig:"S3_BUCKET"`
+	AutoCreateBucket        bool              `yaml:"auto_create_bucket" envconfig:"S3_AUTO_CREATE_BUCKET"`
+	Endpoint                string            `yaml:"endpoint" envconfig:"S3_ENDPOINT"`
+	Region                  string            `yaml:"region" envconfig:"S3_REGION"`
+	ACL                     string            `yaml:"acl" envconfig:"S3_ACL"`
+	ForcePathStyle          bool              `yaml:"force_path_style" envconfig:"S3_FORCE_PATH_STYLE"`
+	Path                    string            `yaml:"path" envconfig:"S3_PATH"`
+	DisableSSL              bool              `yaml:"disable_ssl" envconfig:"S3_DISABLE_SSL"`
+	PartSize                int64             `yaml:"part_size" envconfig:"S3_PART_SIZE"`
+	Concurrency             int               `yaml:"concurrency" envconfig:"S3_CONCURRENCY"`
+	DownloadConcurrency     int               `yaml:"download_concurrency" envconfig:"S3_DOWNLOAD_CONCURRENCY"`
+	MaxRetries              int               `yaml:"max_retries" envconfig:"S3_MAX_RETRIES"`
+	RetryMode               string            `yaml:"retry_mode" envconfig:"S3_RETRY_MODE"`
+	CompressionLevel        int               `yaml:"compression_level" envconfig:"S3_COMPRESSION_LEVEL"`
+	CompressionFormat       string            `yaml:"compression_format" envconfig:"S3_COMPRESSION_FORMAT"`
+	SSE                     string            `yaml:"sse" envconfig:"S3_SSE"`
+	SSEKMSKeyID             string            `yaml:"sse_kms_key_id" envconfig:"S3_SSE_KMS_KEY_ID"`
+	SSECustomerKey          string            `yaml:"sse_customer_key" envconfig:"S3_SSE_CUSTOMER_KEY"`
+	SSECustomerKeyFile      string            `yaml:"sse_customer_key_file" envconfig:"S3_SSE_CUSTOMER_KEY_FILE"`
+	StorageClass            string            `yaml:"storage_class" envconfig:"S3_STORAGE_CLASS"`
+	ObjectLockMode          string            `yaml:"object_lock_mode" envconfig:"S3_OBJECT_LOCK_MODE"`
+	ObjectLockDays          int               `yaml:"object_lock_days" envconfig:"S3_OBJECT_LOCK_DAYS"`
+	ObjectLockLegalHold     bool              `yaml:"object_lock_legal_hold" envconfig:"S3_OBJECT_LOCK_LEGAL_HOLD"`
+	ObjectTags              map[string]string `yaml:"object_tags" envconfig:"S3_OBJECT_TAGS"`
+	DisableCertVerification bool              `yaml:"disable_cert_verification" envconfig:"S3_DISABLE_CERT_VERIFICATION"`
+	Debug                   bool              `yaml:"debug" envconfig:"S3_DEBUG"`
 }
 
 // COSConfig - cos settings section
@@ -69,6 +177,23 @@ type COSConfig struct {
 	Debug             bool   `yaml:"debug" envconfig:"COS_DEBUG"`
 }
 
+// FileConfig - settings of 'file' remote storage, Path is a directory usually on mounted NFS or SMB share
+type FileConfig struct {
+	Path              string `yaml:"path" envconfig:"FILE_PATH"`
+	CompressionFormat string `yaml:"compression_format" envconfig:"FILE_COMPRESSION_FORMAT"`
+	CompressionLevel  int    `yaml:"compression_level" envconfig:"FILE_COMPRESSION_LEVEL"`
+}
+
+// PluginConfig - settings of 'plugin' remote storage served by external binary over gRPC, Options are passed to plugin on connect
+type PluginConfig struct {
+	Socket            string            `yaml:"socket" envconfig:"PLUGIN_SOCKET"`
+	Path              string            `yaml:"path" envconfig:"PLUGIN_PATH"`
+	Timeout           string            `yaml:"timeout" envconfig:"PLUGIN_TIMEOUT"`
+	Options           map[string]string `yaml:"options" envconfig:"PLUGIN_OPTIONS"`
+	CompressionFormat string            `yaml:"compression_format" envconfig:"PLUGIN_COMPRESSION_FORMAT"`
+	CompressionLevel  int               `yaml:"compression_level" envconfig:"PLUGIN_COMPRESSION_LEVEL"`
+}
+
 // ClickHouseConfig - clickhouse settings section
 type ClickHouseConfig struct {
 	Username     string   `yaml:"username" envconfig:"CLICKHOUSE_USERNAME"`
@@ -79,12 +204,79 @@ type ClickHouseConfig struct {
 	SkipTables   []string `yaml:"skip_tables" envconfig:"CLICKHOUSE_SKIP_TABLES"`
 	Timeout      string   `yaml:"timeout" envconfig:"CLICKHOUSE_TIMEOUT"`
 	FreezeByPart bool     `yaml:"freeze_by_part" envconfig:"CLICKHOUSE_FREEZE_BY_PART"`
+	// SkipDatabases - globs or regular expressions of databases which create, upload and restore always skip as skip_tables
+	SkipDatabases []string `yaml:"skip_databases" envconfig:"CLICKHOUSE_SKIP_DATABASES"`
+	// DiskMapping - disk of restored parts by disk of parts on backup server, e.g. when disks of servers have different names
+	DiskMapping map[string]string `yaml:"disk_mapping" envconfig:"CLICKHOUSE_DISK_MAPPING"`
+	// UseEmbeddedBackupRestore - create backups by BACKUP query of ClickHouse to EmbeddedBackupDisk instead of FREEZE
+	UseEmbeddedBackupRestore bool   `yaml:"use_embedded_backup_restore" envconfig:"CLICKHOUSE_USE_EMBEDDED_BACKUP_RESTORE"`
+	EmbeddedBackupDisk       string `yaml:"embedded_backup_disk" envconfig:"CLICKHOUSE_EMBEDDED_BACKUP_DISK"`
+	// DefaultReplicaPath and DefaultReplicaName - ZooKeeper path and replica name of tables restored with --restore-schema-as-replicated
+	DefaultReplicaPath string `yaml:"default_replica_path" envconfig:"CLICKHOUSE_DEFAULT_REPLICA_PATH"`
+	DefaultReplicaName string `yaml:"default_replica_name" envconfig:"CLICKHOUSE_DEFAULT_REPLICA_NAME"`
+	// BackupFileEngines - engines without FREEZE whose tables are backed up by copy of their files while they're detached
+	BackupFileEngines []string `yaml:"backup_file_engines" envconfig:"CLICKHOUSE_BACKUP_FILE_ENGINES"`
 }
 
+// APIConfig - REST API settings section
 type APIConfig struct {
 	ListenAddr    string `yaml:"listen_addr" envconfig:"API_LISTEN_ADDR"`
 	EnableMetrics bool   `yaml:"enable_metrics" envconfig:"ENABLE_METRICS"`
 	EnablePprof   bool   `yaml:"enable_pprof" envconfig:"ENABLE_PPROF"`
+	// MetricsUser and MetricsPassword - basic auth for /metrics and /debug/pprof/*, separate from AuthTokens
+	MetricsUser     string   `yaml:"metrics_user" envconfig:"API_METRICS_USER"`
+	MetricsPassword string   `yaml:"metrics_password" envconfig:"API_METRICS_PASSWORD"`
+	AuthTokens      []string `yaml:"auth_tokens" envconfig:"API_AUTH_TOKENS"`
+	APIKeyHeader    string   `yaml:"api_key_header" envconfig:"API_KEY_HEADER"`
+	TLSCert         string   `yaml:"tls_cert" envconfig:"API_TLS_CERT"`
+	TLSKey          string   `yaml:"tls_key" envconfig:"API_TLS_KEY"`
+	TLSClientCA     string   `yaml:"tls_client_ca" envconfig:"API_TLS_CLIENT_CA"`
+	// AllowParallel - pairs of commands like 'create+upload' which can run at the same time, the same command never runs twice
+	AllowParallel []string `yaml:"allow_parallel" envconfig:"API_ALLOW_PARALLEL"`
+	// AuditLog - append-only file for records of API operations, empty value disables audit
+	AuditLog string `yaml:"audit_log" envconfig:"API_AUDIT_LOG"`
+	// ShutdownTimeout - how long to wait for in-flight requests and running jobs on SIGTERM before cancelling them
+	ShutdownTimeout string `yaml:"shutdown_timeout" envconfig:"API_SHUTDOWN_TIMEOUT"`
+	// CallbackURLs - URLs which receive POST with CallbackPayload when async operation is finished
+	CallbackURLs    []string `yaml:"callback_urls" envconfig:"API_CALLBACK_URLS"`
+	CallbackTimeout string   `yaml:"callback_timeout" envconfig:"API_CALLBACK_TIMEOUT"`
+	CallbackRetries int      `yaml:"callback_retries" envconfig:"API_CALLBACK_RETRIES"`
+	// HistoryFile - file for the last HistorySize finished operations, history is kept only in memory when empty
+	HistoryFile string `yaml:"history_file" envconfig:"API_HISTORY_FILE"`
+	HistorySize int    `yaml:"history_size" envconfig:"API_HISTORY_SIZE"`
+	// PersistConfig - write config updated by POST /backup/config to config file
+	PersistConfig bool `yaml:"persist_config" envconfig:"API_PERSIST_CONFIG"`
+	// ReadyTimeout - timeout of each /health/ready check, ReadyCheckRemote - check remote storage bucket in /health/ready
+	ReadyTimeout     string `yaml:"ready_timeout" envconfig:"API_READY_TIMEOUT"`
+	ReadyCheckRemote bool   `yaml:"ready_check_remote" envconfig:"API_READY_CHECK_REMOTE"`
+	// MetricsRefreshInterval - how often number_backups_* and other backup inventory metrics are refreshed
+	MetricsRefreshInterval string `yaml:"metrics_refresh_interval" envconfig:"API_METRICS_REFRESH_INTERVAL"`
+	// MetricsStateFile - file for the last values of last_* metrics, they are restored on start
+	MetricsStateFile string `yaml:"metrics_state_file" envconfig:"API_METRICS_STATE_FILE"`
+	// RateLimit and RateLimitPerIP - requests per second for all clients and for each client IP, 0 disables limit,
+	// burst 0 means one second of rate
+	RateLimit           float64 `yaml:"rate_limit" envconfig:"API_RATE_LIMIT"`
+	RateLimitBurst      int     `yaml:"rate_limit_burst" envconfig:"API_RATE_LIMIT_BURST"`
+	RateLimitPerIP      float64 `yaml:"rate_limit_per_ip" envconfig:"API_RATE_LIMIT_PER_IP"`
+	RateLimitPerIPBurst int     `yaml:"rate_limit_per_ip_burst" envconfig:"API_RATE_LIMIT_PER_IP_BURST"`
+	// MaxConcurrentRequests - requests served at the same time, 0 disables limit,
+	// up to MaxQueuedRequests requests wait QueueTimeout for free slot
+	MaxConcurrentRequests int    `yaml:"max_concurrent_requests" envconfig:"API_MAX_CONCURRENT_REQUESTS"`
+	MaxQueuedRequests     int    `yaml:"max_queued_requests" envconfig:"API_MAX_QUEUED_REQUESTS"`
+	QueueTimeout          string `yaml:"queue_timeout" envconfig:"API_QUEUE_TIMEOUT"`
+	// LegacyREST - allow GET for mutating routes and return 500/503 instead of 4xx status codes
+	LegacyREST bool `yaml:"legacy_rest" envconfig:"API_LEGACY_REST"`
+}
+
+// EncryptionConfig - encryption settings section
+type EncryptionConfig struct {
+	Algorithm       string `yaml:"algorithm" envconfig:"ENCRYPTION_ALGORITHM"`
+	Key             string `yaml:"key" envconfig:"ENCRYPTION_KEY"`
+	KeyFile         string `yaml:"key_file" envconfig:"ENCRYPTION_KEY_FILE"`
+	KMSEncryptedKey string `yaml:"kms_encrypted_key" envconfig:"ENCRYPTION_KMS_ENCRYPTED_KEY"`
+	KMSProvider     string `yaml:"kms_provider" envconfig:"ENCRYPTION_KMS_PROVIDER"`
+	KMSKeyID        string `yaml:"kms_key_id" envconfig:"ENCRYPTION_KMS_KEY_ID"`
+	KMSRegion       string `yaml:"kms_region" envconfig:"ENCRYPTION_KMS_REGION"`
 }
 
 // LoadConfig - load config from file
@@ -108,10 +300,118 @@ func LoadConfig(configLocation string) (*Config, error) {
 }
 
 func validateConfig(config *Config) error {
-	if _, err := getArchiveWriter(config.S3.CompressionFormat, config.S3.CompressionLevel); err != nil {
+	if config.General.BackupsToKeepLocal < 0 || config.General.BackupsToKeepRemote < 0 {
+		return fmt.Errorf("general.backups_to_keep_local and general.backups_to_keep_remote can't be negative")
+	}
+	if config.General.KeepDaily < 0 || config.General.KeepWeekly < 0 || config.General.KeepMonthly < 0 {
+		return fmt.Errorf("general.keep_daily, general.keep_weekly and general.keep_monthly can't be negative")
+	}
+	if config.General.CompressionConcurrency < 0 {
+		return fmt.Errorf("general.compression_concurrency can't be negative")
+	}
+	if _, err := getArchiveWriter(config.S3.CompressionFormat, config.S3.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if err := validatePatterns("clickhouse.skip_tables", config.ClickHouse.SkipTables); err != nil {
+		return err
+	}
+	if err := validatePatterns("clickhouse.skip_databases", config.ClickHouse.SkipDatabases); err != nil {
+		return err
+	}
+	for _, engine := range config.ClickHouse.BackupFileEngines {
+		if !isFileEngine(engine) {
+			return fmt.Errorf("clickhouse.backup_file_engines doesn't support '%s', supported engines are %s", engine, strings.Join(fileEngines, ", "))
+		}
+	}
+	if config.ClickHouse.UseEmbeddedBackupRestore && config.ClickHouse.EmbeddedBackupDisk == "" {
+		return fmt.Errorf("clickhouse.embedded_backup_disk is required with clickhouse.use_embedded_backup_restore")
+	}
+	if config.S3.RetryMode != "standard" && config.S3.RetryMode != "adaptive" {
+		return fmt.Errorf("s3.retry_mode '%s' not supported", config.S3.RetryMode)
+	}
+	if config.S3.Concurrency < 1 {
+		return fmt.Errorf("s3.concurrency must be positive")
+	}
+	if (config.S3.SSECustomerKey != "" || config.S3.SSECustomerKeyFile != "") && config.S3.SSE != "" {
+		return fmt.Errorf("s3.sse can't be used with SSE-C key")
+	}
+	if config.S3.SSEKMSKeyID != "" && config.S3.SSE != "aws:kms" {
+		return fmt.Errorf("s3.sse_kms_key_id requires s3.sse 'aws:kms'")
+	}
+	if len(config.S3.ObjectTags) > 10 {
+		return fmt.Errorf("s3.object_tags can't contain more than 10 tags")
+	}
+	switch config.S3.ObjectLockMode {
+	case "":
+	case "GOVERNANCE", "COMPLIANCE":
+		if config.S3.ObjectLockDays < 1 {
+			return fmt.Errorf("s3.object_lock_days must be positive with s3.object_lock_mode")
+		}
+	default:
+		return fmt.Errorf("s3.object_lock_mode '%s' not supported", config.S3.ObjectLockMode)
+	}
+	if !s3StorageClasses[config.S3.StorageClass] {
+		return fmt.Errorf("s3.storage_class '%s' not supported", config.S3.StorageClass)
+	}
+	if _, err := getArchiveWriter(config.GCS.CompressionFormat, config.GCS.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.GCS.Timeout); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.GCS.RetryBackoff); err != nil {
+		return err
+	}
+	if config.GCS.AutoCreateBucket && config.GCS.ProjectID == "" {
+		return fmt.Errorf("gcs.project_id must be set for gcs.auto_create_bucket")
+	}
+	switch config.GCS.StorageClass {
+	case "", "STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE":
+	default:
+		return fmt.Errorf("gcs.storage_class '%s' not supported", config.GCS.StorageClass)
+	}
+	if _, err := getArchiveWriter(config.File.CompressionFormat, config.File.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := getArchiveWriter(config.Plugin.CompressionFormat, config.Plugin.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.General.RemoteRetryBackoff); err != nil {
 		return err
 	}
-	if _, err := getArchiveWriter(config.GCS.CompressionFormat, config.GCS.CompressionLevel); err != nil {
+	if _, err := time.ParseDuration(config.General.BrokenBackupMinAge); err != nil {
+		return fmt.Errorf("general.broken_backup_min_age: %v", err)
+	}
+	if config.General.UploadConcurrency < 1 {
+		return fmt.Errorf("general.upload_concurrency must be positive")
+	}
+	if config.General.MaxFileSize < 0 {
+		return fmt.Errorf("general.max_file_size must be non-negative")
+	}
+	if config.General.DownloadConcurrency < 1 {
+		return fmt.Errorf("general.download_concurrency must be positive")
+	}
+	if config.General.CreateConcurrency < 1 {
+		return fmt.Errorf("general.create_concurrency must be positive")
+	}
+	switch config.General.RemoteLayout {
+	case "archive", casLayout:
+	default:
+		return fmt.Errorf("general.remote_layout '%s' not supported", config.General.RemoteLayout)
+	}
+	switch config.General.UploadFormat {
+	case "archive":
+	case directoryLayout:
+		if config.General.RemoteLayout == casLayout {
+			return fmt.Errorf("general.upload_format '%s' can't be used with general.remote_layout '%s'", directoryLayout, casLayout)
+		}
+	default:
+		return fmt.Errorf("general.upload_format '%s' not supported", config.General.UploadFormat)
+	}
+	if _, _, err := parseWatchIntervals(config.General.WatchInterval, config.General.FullInterval); err != nil {
+		return fmt.Errorf("general.watch_interval and general.full_interval: %v", err)
+	}
+	if _, err := time.ParseDuration(config.Plugin.Timeout); err != nil {
 		return err
 	}
 	if _, err := time.ParseDuration(config.ClickHouse.Timeout); err != nil {
@@ -120,9 +420,102 @@ func validateConfig(config *Config) error {
 	if _, err := time.ParseDuration(config.COS.Timeout); err != nil {
 		return err
 	}
+	if _, err := setupTLS(config.API); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.API.ShutdownTimeout); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.API.CallbackTimeout); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.API.ReadyTimeout); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.API.MetricsRefreshInterval); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.API.QueueTimeout); err != nil {
+		return err
+	}
+	if config.API.RateLimit < 0 || config.API.RateLimitPerIP < 0 {
+		return fmt.Errorf("api.rate_limit and api.rate_limit_per_ip must be non-negative")
+	}
+	if _, err := parseAllowParallel(config.API.AllowParallel); err != nil {
+		return err
+	}
+	switch config.Encryption.Algorithm {
+	case "":
+	case "aes-256-gcm":
+		if config.Encryption.Key == "" && config.Encryption.KeyFile == "" && config.Encryption.KMSEncryptedKey == "" && config.Encryption.KMSKeyID == "" {
+			return fmt.Errorf("encryption.key, encryption.key_file, encryption.kms_encrypted_key or encryption.kms_key_id must be set for encryption")
+		}
+		switch config.Encryption.KMSProvider {
+		case "aws":
+		case "gcp":
+			if config.Encryption.KMSEncryptedKey != "" && config.Encryption.KMSKeyID == "" {
+				return fmt.Errorf("encryption.kms_key_id must be set to decrypt encryption.kms_encrypted_key by gcp")
+			}
+		default:
+			return fmt.Errorf("encryption.kms_provider '%s' not supported", config.Encryption.KMSProvider)
+		}
+	default:
+		return fmt.Errorf("encryption.algorithm '%s' not supported", config.Encryption.Algorithm)
+	}
+	for name, remote := range config.Remotes {
+		switch remote.RemoteStorage {
+		case "s3", "gcs", "cos", "file", "plugin":
+		default:
+			return fmt.Errorf("remotes.%s: storage type '%s' not supported", name, remote.RemoteStorage)
+		}
+		remoteConfig, _ := config.WithRemote(name)
+		remoteConfig.Remotes = nil
+		if err := validateConfig(&remoteConfig); err != nil {
+			return fmt.Errorf("remotes.%s: %v", name, err)
+		}
+	}
 	return nil
 }
 
+// SaveConfig - atomically write config to configLocation, the previous version is kept with '.bak' suffix
+func SaveConfig(configLocation string, config *Config) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("can't marshal config with %v", err)
+	}
+	mode := os.FileMode(0640)
+	if info, err := os.Stat(configLocation); err == nil {
+		mode = info.Mode().Perm()
+		previous, err := ioutil.ReadFile(configLocation)
+		if err != nil {
+			return fmt.Errorf("can't read current config with %v", err)
+		}
+		if err := ioutil.WriteFile(configLocation+".bak", previous, mode); err != nil {
+			return fmt.Errorf("can't backup current config with %v", err)
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(configLocation), filepath.Base(configLocation)+".tmp")
+	if err != nil {
+		return fmt.Errorf("can't create temporary config with %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't write temporary config with %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't write temporary config with %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can't write temporary config with %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return fmt.Errorf("can't chmod temporary config with %v", err)
+	}
+	return os.Rename(tmp.Name(), configLocation)
+}
+
 // PrintDefaultConfig - print default config to stdout
 func PrintDefaultConfig() {
 	c := DefaultConfig()
@@ -136,6 +529,16 @@ func DefaultConfig() *Config {
 			RemoteStorage:       "s3",
 			BackupsToKeepLocal:  0,
 			BackupsToKeepRemote: 0,
+			RemoteMaxRetries:    3,
+			RemoteRetryBackoff:  "1s",
+			UploadConcurrency:   1,
+			DownloadConcurrency: 1,
+			RemoteLayout:        "archive",
+			UploadFormat:        "archive",
+			WatchInterval:       "1h",
+			FullInterval:        "24h",
+			CreateConcurrency:   1,
+			BrokenBackupMinAge:  "24h",
 		},
 		ClickHouse: ClickHouseConfig{
 			Username: "default",
@@ -145,20 +548,35 @@ func DefaultConfig() *Config {
 			SkipTables: []string{
 				"system.*",
 			},
-			Timeout: "5m",
+			SkipDatabases: []string{
+				"information_schema",
+				"INFORMATION_SCHEMA",
+			},
+			Timeout:            "5m",
+			DefaultReplicaPath: "/clickhouse/tables/{shard}/{database}/{table}",
+			DefaultReplicaName: "{replica}",
 		},
 		S3: S3Config{
 			Region:                  "us-east-1",
 			DisableSSL:              false,
 			ACL:                     "private",
 			PartSize:                100 * 1024 * 1024,
+			RoleSessionName:         "clickhouse-backup",
+			Concurrency:             10,
+			DownloadConcurrency:     1,
+			MaxRetries:              30,
+			RetryMode:               "standard",
 			CompressionLevel:        1,
-			CompressionFormat:       "gzip",
+			CompressionFormat:       "zstd",
 			DisableCertVerification: false,
 		},
 		GCS: GCSConfig{
 			CompressionLevel:  1,
-			CompressionFormat: "gzip",
+			CompressionFormat: "zstd",
+			ChunkSize:         16 * 1024 * 1024,
+			Timeout:           "1m",
+			MaxRetries:        3,
+			RetryBackoff:      "1s",
 		},
 		COS: COSConfig{
 			RowURL:            "",
@@ -166,12 +584,34 @@ func DefaultConfig() *Config {
 			SecretID:          "",
 			SecretKey:         "",
 			Path:              "",
-			CompressionFormat: "gzip",
+			CompressionFormat: "zstd",
 			CompressionLevel:  1,
 			Debug:             false,
 		},
+		File: FileConfig{
+			CompressionFormat: "zstd",
+			CompressionLevel:  1,
+		},
+		Plugin: PluginConfig{
+			Timeout:           "5m",
+			CompressionFormat: "zstd",
+			CompressionLevel:  1,
+		},
 		API: APIConfig{
-			ListenAddr: "localhost:7171",
+			ListenAddr:             "localhost:7171",
+			APIKeyHeader:           "X-API-Key",
+			AllowParallel:          []string{"create+upload", "create+download", "upload+download"},
+			ShutdownTimeout:        "5m",
+			CallbackTimeout:        "30s",
+			CallbackRetries:        3,
+			HistorySize:            100,
+			ReadyTimeout:           "5s",
+			MetricsRefreshInterval: "5m",
+			MaxQueuedRequests:      100,
+			QueueTimeout:           "30s",
+		},
+		Encryption: EncryptionConfig{
+			KMSProvider: "aws",
 		},
 	}
 }
@@ -0,0 +1,80 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configPath := path.Join(dir, "config.yml")
+
+	config := DefaultConfig()
+	config.General.BackupsToKeepLocal = 1
+	require.NoError(t, SaveConfig(configPath, config))
+	_, err = os.Stat(configPath + ".bak")
+	assert.True(t, os.IsNotExist(err))
+
+	config.General.BackupsToKeepLocal = 2
+	require.NoError(t, SaveConfig(configPath, config))
+	loaded, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, loaded.General.BackupsToKeepLocal)
+	previous, err := LoadConfig(configPath + ".bak")
+	require.NoError(t, err)
+	assert.Equal(t, 1, previous.General.BackupsToKeepLocal)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+func TestConfigWithRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configPath := path.Join(dir, "config.yml")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(`
+general:
+  remote_storage: s3
+s3:
+  bucket: primary
+remotes:
+  dr:
+    remote_storage: gcs
+    gcs:
+      bucket: backups-dr
+`), 0640))
+
+	config, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	defaultRemote, err := config.WithRemote("")
+	require.NoError(t, err)
+	assert.Equal(t, "s3", defaultRemote.General.RemoteStorage)
+	assert.Equal(t, "primary", defaultRemote.S3.Bucket)
+
+	dr, err := config.WithRemote("dr")
+	require.NoError(t, err)
+	assert.Equal(t, "gcs", dr.General.RemoteStorage)
+	assert.Equal(t, "backups-dr", dr.GCS.Bucket)
+	assert.Equal(t, "zstd", dr.GCS.CompressionFormat)
+	assert.Equal(t, "s3", config.General.RemoteStorage)
+
+	_, err = config.WithRemote("missing")
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(`
+remotes:
+  dr:
+    remote_storage: ftp
+`), 0640))
+	_, err = LoadConfig(configPath)
+	assert.Error(t, err)
+}
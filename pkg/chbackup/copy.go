@@ -0,0 +1,191 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// backupFiles - files of backup on remote storage, both archive 'name.tar.*' and files under 'name/' are matched
+func (bd *BackupDestination) backupFiles(ctx context.Context, backupName string) ([]RemoteFile, error) {
+	prefix := path.Join(bd.path, backupName)
+	files := []RemoteFile{}
+	err := bd.Walk(ctx, bd.path, func(f RemoteFile) {
+		name := f.Name()
+		if strings.HasPrefix(name, prefix+"/") || strings.HasPrefix(name, prefix+".tar") {
+			files = append(files, f)
+		}
+	})
+	return files, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// CopyBackup - copy backup from one remote storage to another file by file, data is streamed without local disk,
+// empty remote name means general.remote_storage. Backups required by incremental backup which aren't found on destination
+// are copied before it, so the copied backup can be restored. Partially copied backup is removed on error.
+func CopyBackup(ctx context.Context, config Config, backupName, from, to string) error {
+	if backupName == "" {
+		return fmt.Errorf("backup name is required")
+	}
+	if from == to {
+		return fmt.Errorf("source and destination remote storages are the same")
+	}
+	src, err := connectRemote(config, from)
+	if err != nil {
+		return err
+	}
+	dst, err := connectRemote(config, to)
+	if err != nil {
+		return err
+	}
+	dstBackups, err := dst.BackupList(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list backups on %s with %v", dst.Kind(), err)
+	}
+	existing := map[string]bool{}
+	for _, backup := range dstBackups {
+		existing[backupNameOfKey("", backup.Name)] = true
+	}
+	if existing[backupName] {
+		return fmt.Errorf("backup '%s' already exists on %s", backupName, dst.Kind())
+	}
+	required, err := src.requiredBackups(ctx)
+	if err != nil {
+		return fmt.Errorf("can't read dependencies of backups on %s with %v", src.Kind(), err)
+	}
+	for _, name := range copyChain(required, existing, backupName) {
+		if name != backupName {
+			log.Printf("Backup '%s' requires '%s' which isn't found on %s", backupName, name, dst.Kind())
+		}
+		if err := copyBackupFiles(ctx, config, src, dst, name); err != nil {
+			return err
+		}
+	}
+	if err := dst.RemoveOldBackups(ctx, dst.Retention()); err != nil {
+		return fmt.Errorf("can't remove old backups: %v", err)
+	}
+	log.Println("  Done.")
+	return nil
+}
+
+// copyChain - backupName and backups it requires directly or through other backups which don't exist on destination,
+// required backups go first. Chain stops at the first existing backup, it has its own required backups already
+func copyChain(required map[string]string, existing map[string]bool, backupName string) []string {
+	chain := []string{backupName}
+	visited := map[string]bool{backupName: true}
+	for name := required[backupName]; name != "" && !existing[name] && !visited[name]; name = required[name] {
+		visited[name] = true
+		chain = append([]string{name}, chain...)
+	}
+	return chain
+}
+
+// copyBackupFiles - copy files of one backup from src to dst, meta.json and manifest.json are copied the last
+func copyBackupFiles(ctx context.Context, config Config, src, dst *BackupDestination, backupName string) error {
+	files, err := src.backupFiles(ctx, backupName)
+	if err != nil {
+		return fmt.Errorf("can't list files on %s with %v", src.Kind(), err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%w: '%s' on %s", ErrBackupNotFound, backupName, src.Kind())
+	}
+	manifest, err := src.readRemoteManifest(ctx, backupName)
+	if err != nil {
+		return err
+	}
+	if manifest != nil && manifest.State == manifestUploading {
+		return fmt.Errorf("%w: upload of '%s' to %s isn't finished", ErrBackupNotFound, backupName, src.Kind())
+	}
+	for _, f := range files {
+		if f.Name() != path.Join(src.path, backupName, MetaFileName) {
+			continue
+		}
+		metafile, err := src.readMetaFile(ctx, f.Name())
+		if err != nil {
+			return err
+		}
+		if metafile.Layout == casLayout {
+			// files of pool are copied before meta.json, so backup isn't listed until it is complete
+			poolFiles, err := src.casMissingFiles(ctx, metafile, dst)
+			if err != nil {
+				return fmt.Errorf("can't list %s on %s with %v", casDir, src.Kind(), err)
+			}
+			files = append(poolFiles, files...)
+		}
+	}
+	// meta.json and manifest.json are copied the last, so backup isn't listed until it is complete
+	metaName, manifestName := path.Join(src.path, backupName, MetaFileName), path.Join(src.path, backupName, ManifestFileName)
+	copyOrder := func(f RemoteFile) int {
+		switch f.Name() {
+		case metaName:
+			return 1
+		case manifestName:
+			return 2
+		}
+		return 0
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return copyOrder(files[i]) < copyOrder(files[j])
+	})
+	var totalSize int64
+	for _, f := range files {
+		totalSize += f.Size()
+	}
+
+	log.Printf("Copy backup '%s' from %s to %s", backupName, src.Kind(), dst.Kind())
+	bar := StartNewByteBar(!config.General.DisableProgressBar, totalSize)
+	trackProgress(ctx, backupName, bar)
+	defer untrackProgress(ctx, backupName)
+	defer bar.Finish()
+	copied := []string{}
+	for _, f := range files {
+		key := path.Join(dst.path, strings.TrimPrefix(strings.TrimPrefix(f.Name(), src.path), "/"))
+		copied = append(copied, key)
+		if err := copyRemoteFile(ctx, src, dst, f.Name(), key, bar); err != nil {
+			log.Printf("Copy of '%s' failed, removing copied files from %s", backupName, dst.Kind())
+			for _, key := range copied {
+				if err := dst.DeleteFile(context.Background(), key); err != nil && !errors.Is(err, ErrNotFound) {
+					log.Printf("can't remove '%s' with %v", key, err)
+				}
+			}
+			return fmt.Errorf("can't copy '%s' with %v", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// connectRemote - connect to remote storage selected by name
+func connectRemote(config Config, remote string) (*BackupDestination, error) {
+	remoteConfig, err := config.WithRemote(remote)
+	if err != nil {
+		return nil, err
+	}
+	if remoteConfig.General.RemoteStorage == "none" {
+		return nil, fmt.Errorf("remote storage is not configured")
+	}
+	bd, err := NewBackupDestination(remoteConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to %s with: %v", bd.Kind(), err)
+	}
+	return bd, nil
+}
+
+func copyRemoteFile(ctx context.Context, src, dst *BackupDestination, srcKey, dstKey string, bar *Bar) error {
+	reader, err := src.GetFileReader(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	return dst.PutFile(ctx, dstKey, &readCloser{Reader: bar.NewProxyReader(newContextReader(ctx, reader)), Closer: reader})
+}
@@ -0,0 +1,64 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyChain(t *testing.T) {
+	required := map[string]string{"incr2": "incr1", "incr1": "full", "loop1": "loop2", "loop2": "loop1"}
+	assert.Equal(t, []string{"full"}, copyChain(required, map[string]bool{}, "full"))
+	assert.Equal(t, []string{"full", "incr1", "incr2"}, copyChain(required, map[string]bool{}, "incr2"))
+	assert.Equal(t, []string{"incr1", "incr2"}, copyChain(required, map[string]bool{"full": true}, "incr2"))
+	assert.Equal(t, []string{"incr2"}, copyChain(required, map[string]bool{"incr1": true}, "incr2"))
+	assert.Equal(t, []string{"loop2", "loop1"}, copyChain(required, map[string]bool{}, "loop1"))
+}
+
+func TestCopyBackup(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "copy_src")
+	require.NoError(t, err)
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "copy_dst")
+	require.NoError(t, err)
+	defer os.RemoveAll(dstDir)
+	for name, content := range map[string]string{
+		"full/meta.json":        `{"archives":["default.t1.tar"]}`,
+		"full/default.t1.tar":   "archive",
+		"incr1/meta.json":       `{"required_backup":"full","archives":["default.t1.tar"]}`,
+		"incr1/default.t1.tar":  "archive",
+		"incr2/meta.json":       `{"required_backup":"incr1","archives":["default.t1.tar"]}`,
+		"incr2/default.t1.tar":  "archive",
+		"orphan/meta.json":      `{"required_backup":"missing","archives":["default.t1.tar"]}`,
+		"orphan/default.t1.tar": "archive",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(srcDir, name)), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0640))
+	}
+	config := *DefaultConfig()
+	config.General.RemoteStorage = "file"
+	config.General.DisableProgressBar = true
+	config.File.Path = srcDir
+	config.Remotes = map[string]RemoteConfig{"dst": {RemoteStorage: "file", File: FileConfig{Path: dstDir}}}
+	ctx := context.Background()
+
+	// required backups are copied before incremental backup
+	require.NoError(t, CopyBackup(ctx, config, "incr2", "", "dst"))
+	for _, name := range []string{"full", "incr1", "incr2"} {
+		assert.FileExists(t, filepath.Join(dstDir, name, MetaFileName))
+		assert.FileExists(t, filepath.Join(dstDir, name, "default.t1.tar"))
+	}
+	assert.Error(t, CopyBackup(ctx, config, "incr2", "", "dst"))
+
+	// backup can't be copied without its required backup
+	err = CopyBackup(ctx, config, "orphan", "", "dst")
+	assert.True(t, errors.Is(err, ErrBackupNotFound))
+	_, err = os.Stat(filepath.Join(dstDir, "orphan", MetaFileName))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,6 +2,7 @@ package chbackup
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -50,9 +51,14 @@ func (c *COS) Kind() string {
 	return "COS"
 }
 
-func (c *COS) GetFile(key string) (RemoteFile, error) {
+func (c *COS) CheckBucket(ctx context.Context) error {
+	_, err := c.client.Bucket.Head(ctx)
+	return err
+}
+
+func (c *COS) GetFile(ctx context.Context, key string) (RemoteFile, error) {
 	// file max size is 5Gb
-	resp, err := c.client.Object.Get(context.Background(), key, nil)
+	resp, err := c.client.Object.Get(ctx, key, nil)
 	if err != nil {
 		cosErr, ok := err.(*cos.ErrorResponse)
 		if ok && cosErr.Code == "NoSuchKey" {
@@ -68,39 +74,84 @@ func (c *COS) GetFile(key string) (RemoteFile, error) {
 	}, nil
 }
 
-func (c *COS) DeleteFile(key string) error {
-	_, err := c.client.Object.Delete(context.Background(), key)
+func (c *COS) DeleteFile(ctx context.Context, key string) error {
+	_, err := c.client.Object.Delete(ctx, key)
 	return err
 }
 
-func (c *COS) Walk(path string, process func(RemoteFile)) error {
-	res, _, err := c.client.Bucket.Get(context.Background(), &cos.BucketGetOptions{
-		Prefix: c.Config.Path,
+// DeleteFiles - delete up to 1000 objects by one DeleteMulti request
+func (c *COS) DeleteFiles(ctx context.Context, keys []string) error {
+	objects := make([]cos.Object, len(keys))
+	for i, key := range keys {
+		objects[i] = cos.Object{Key: key}
+	}
+	res, _, err := c.client.Object.DeleteMulti(ctx, &cos.ObjectDeleteMultiOptions{
+		Objects: objects,
+		Quiet:   true,
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("can't delete %d objects with %v", len(keys), err)
 	}
-	for _, v := range res.Contents {
-		modifiedTime, _ := parseTime(v.LastModified)
-		process(&cosFile{
-			name:         v.Key,
-			lastModified: modifiedTime,
-			size:         int64(v.Size),
-		})
+	if len(res.Errors) > 0 {
+		e := res.Errors[0]
+		return fmt.Errorf("can't delete '%s' and %d other objects with %s: %s", e.Key, len(res.Errors)-1, e.Code, e.Message)
 	}
 	return nil
 }
 
-func (c *COS) GetFileReader(key string) (io.ReadCloser, error) {
-	resp, err := c.client.Object.Get(context.Background(), key, nil)
+// Walk - list objects under path page by page, each page contains up to 1000 objects
+func (c *COS) Walk(ctx context.Context, path string, process func(RemoteFile)) error {
+	opt := &cos.BucketGetOptions{
+		Prefix:  path,
+		MaxKeys: 1000,
+	}
+	for {
+		res, _, err := c.client.Bucket.Get(ctx, opt)
+		if err != nil {
+			return err
+		}
+		for _, v := range res.Contents {
+			modifiedTime, _ := parseTime(v.LastModified)
+			process(&cosFile{
+				name:         v.Key,
+				lastModified: modifiedTime,
+				size:         int64(v.Size),
+			})
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			return nil
+		}
+		// NextMarker may be omitted, the next page starts after the last key then
+		opt.Marker = res.NextMarker
+		if opt.Marker == "" {
+			opt.Marker = res.Contents[len(res.Contents)-1].Key
+		}
+	}
+}
+
+func (c *COS) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return c.GetFileReaderWithOffset(ctx, key, 0)
+}
+
+// GetFileReaderWithOffset - read object from offset by ranged GET, used to resume interrupted download
+func (c *COS) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	var opt *cos.ObjectGetOptions
+	if offset > 0 {
+		opt = &cos.ObjectGetOptions{Range: fmt.Sprintf("bytes=%d-", offset)}
+	}
+	resp, err := c.client.Object.Get(ctx, key, opt)
 	if err != nil {
+		cosErr, ok := err.(*cos.ErrorResponse)
+		if ok && cosErr.Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
 	return resp.Body, nil
 }
 
-func (c *COS) PutFile(key string, r io.ReadCloser) error {
-	_, err := c.client.Object.Put(context.Background(), key, r, nil)
+func (c *COS) PutFile(ctx context.Context, key string, r io.ReadCloser) error {
+	_, err := c.client.Object.Put(ctx, key, r, nil)
 	return err
 }
 
@@ -0,0 +1,80 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tencentyun/cos-go-sdk-v5"
+)
+
+type fakeCOSObject struct {
+	Key          string
+	Size         int
+	LastModified string
+}
+
+type fakeCOSListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Prefix      string
+	Marker      string
+	NextMarker  string `xml:",omitempty"`
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []fakeCOSObject
+}
+
+// fakeCOSServer - serve GET Bucket with pages of pageSize keys, NextMarker is returned only with withNextMarker
+func fakeCOSServer(t *testing.T, keys []string, pageSize int, withNextMarker bool) *httptest.Server {
+	sort.Strings(keys)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		prefix, marker := query.Get("prefix"), query.Get("marker")
+		result := fakeCOSListResult{Prefix: prefix, Marker: marker, MaxKeys: pageSize}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) || key <= marker {
+				continue
+			}
+			if len(result.Contents) == pageSize {
+				result.IsTruncated = true
+				break
+			}
+			result.Contents = append(result.Contents, fakeCOSObject{Key: key, Size: 7, LastModified: "2020-07-01T00:00:00.000Z"})
+		}
+		if result.IsTruncated && withNextMarker {
+			result.NextMarker = result.Contents[len(result.Contents)-1].Key
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		require.NoError(t, xml.NewEncoder(w).Encode(result))
+	}))
+}
+
+func TestCOSWalk(t *testing.T) {
+	keys := []string{"other/backup.tar.gz"}
+	for i := 0; i < 25; i++ {
+		keys = append(keys, fmt.Sprintf("backups/backup%02d.tar.gz", i))
+	}
+	for _, withNextMarker := range []bool{true, false} {
+		server := fakeCOSServer(t, keys, 10, withNextMarker)
+		u, err := url.Parse(server.URL)
+		require.NoError(t, err)
+		c := &COS{client: cos.NewClient(&cos.BaseURL{BucketURL: u}, http.DefaultClient), Config: &COSConfig{Path: "backups/"}}
+		names := []string{}
+		require.NoError(t, c.Walk(context.Background(), "backups/", func(f RemoteFile) {
+			names = append(names, f.Name())
+		}))
+		server.Close()
+		require.Len(t, names, 25, "withNextMarker="+strconv.FormatBool(withNextMarker))
+		assert.Equal(t, "backups/backup00.tar.gz", names[0])
+		assert.Equal(t, "backups/backup24.tar.gz", names[24])
+	}
+}
@@ -0,0 +1,238 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Remote backup is described by its metadata objects without downloading archives: manifest.json uploaded next to backup,
+// meta.json of backup uploaded as archive per table or with cas layout and dependencies of backups
+
+// BackupDescription - response of describe-remote and GET /backup/remote/{name}, environment is empty for backups without manifest.json
+type BackupDescription struct {
+	Name              string             `json:"name"`
+	Size              int64              `json:"size"`
+	Date              time.Time          `json:"date"`
+	Layout            string             `json:"layout"`
+	Manifest          bool               `json:"manifest"`
+	CompressionFormat string             `json:"compression_format,omitempty"`
+	ClickHouseVersion string             `json:"clickhouse_version,omitempty"`
+	BackupVersion     string             `json:"clickhouse_backup_version,omitempty"`
+	Host              string             `json:"host,omitempty"`
+	Shard             string             `json:"shard,omitempty"`
+	RequiredBackups   []string           `json:"required_backups"`
+	DependentBackups  []string           `json:"dependent_backups"`
+	Tables            []TableDescription `json:"tables"`
+}
+
+// TableDescription - table of described backup, Size is unknown for backups without manifest.json
+type TableDescription struct {
+	Database   string   `json:"database"`
+	Name       string   `json:"name"`
+	Engine     string   `json:"engine,omitempty"`
+	Size       int64    `json:"size"`
+	Parts      int      `json:"parts"`
+	Partitions []string `json:"partitions"`
+}
+
+// describeTables - tables of backup by manifest
+func describeTables(manifest *Manifest) []TableDescription {
+	tables := []TableDescription{}
+	for _, table := range manifest.Tables {
+		description := TableDescription{Database: table.Database, Name: table.Name, Engine: table.Engine, Parts: len(table.Parts)}
+		partitions := map[string]bool{}
+		for _, part := range table.Parts {
+			description.Size += part.Size
+			partitions[partitionIDOfPart(part.Name)] = true
+		}
+		description.Partitions = sortedKeys(partitions)
+		tables = append(tables, description)
+	}
+	return tables
+}
+
+// describeMetaFileTables - tables of backup by names of files in meta.json, for backups without manifest.json
+func describeMetaFileTables(metafile MetaFile) []TableDescription {
+	names := append([]string{}, metafile.Hardlinks...)
+	for name := range metafile.Checksums {
+		names = append(names, name)
+	}
+	tables := map[string]*TableDescription{}
+	parts := map[string]map[string]bool{}
+	getTable := func(database, table string) *TableDescription {
+		key := fmt.Sprintf("%s.%s", database, table)
+		if _, ok := tables[key]; !ok {
+			tables[key] = &TableDescription{Database: database, Name: table}
+			parts[key] = map[string]bool{}
+		}
+		return tables[key]
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "metadata/") && strings.HasSuffix(name, ".sql") {
+			if p := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "metadata/"), ".sql"), "/"); len(p) == 2 {
+				database, _ := url.PathUnescape(p[0])
+				table, _ := url.PathUnescape(p[1])
+				getTable(database, table)
+			}
+			continue
+		}
+		if database, table, part, ok := shadowPart(name); ok {
+			getTable(database, table)
+			parts[fmt.Sprintf("%s.%s", database, table)][path.Base(part)] = true
+		}
+	}
+	result := []TableDescription{}
+	for key, table := range tables {
+		partitions := map[string]bool{}
+		for part := range parts[key] {
+			partitions[partitionIDOfPart(part)] = true
+		}
+		table.Parts = len(parts[key])
+		table.Partitions = sortedKeys(partitions)
+		result = append(result, *table)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Database != result[j].Database {
+			return result[i].Database < result[j].Database
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DescribeRemote - describe remote backup by its metadata objects, archives aren't downloaded
+func DescribeRemote(ctx context.Context, config Config, backupName string) (BackupDescription, error) {
+	backup, err := GetRemoteBackup(ctx, config, backupName)
+	if err != nil {
+		return BackupDescription{}, err
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return BackupDescription{}, err
+	}
+	if err := bd.Connect(); err != nil {
+		return BackupDescription{}, err
+	}
+	// backup uploaded as single archive is listed with extension
+	remotePath := backupNameOfKey("", backup.Name)
+	description := BackupDescription{
+		Name:             backup.Name,
+		Size:             backup.Size,
+		Date:             backup.Date,
+		RequiredBackups:  []string{},
+		DependentBackups: []string{},
+		Tables:           []TableDescription{},
+	}
+	var metafile MetaFile
+	archiveName, _, err := bd.getBackupArchive(ctx, remotePath)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if metafile, err = bd.readMetaFile(ctx, path.Join(bd.path, remotePath, MetaFileName)); err != nil {
+			return description, err
+		}
+		description.Layout = "tables"
+		if metafile.Layout == casLayout || metafile.Layout == directoryLayout {
+			description.Layout = metafile.Layout
+		}
+		description.CompressionFormat = metafile.CompressionFormat
+	case err == nil:
+		description.Layout = "archive"
+		description.CompressionFormat = formatOfArchive(archiveName)
+	default:
+		return description, err
+	}
+	manifest, err := bd.readRemoteManifest(ctx, remotePath)
+	if err != nil {
+		return description, err
+	}
+	switch {
+	case manifest != nil:
+		description.Manifest = true
+		description.ClickHouseVersion = manifest.ClickHouseVersion
+		description.BackupVersion = manifest.BackupVersion
+		description.Host = manifest.Host
+		description.Shard = manifest.Shard
+		description.Tables = describeTables(manifest)
+	case description.Layout != "archive":
+		description.Tables = describeMetaFileTables(metafile)
+	}
+	required, err := bd.requiredBackups(ctx)
+	if err != nil {
+		return description, fmt.Errorf("can't read dependencies of backups with %v", err)
+	}
+	visited := map[string]bool{remotePath: true}
+	for name := required[remotePath]; name != "" && !visited[name]; name = required[name] {
+		visited[name] = true
+		description.RequiredBackups = append(description.RequiredBackups, name)
+	}
+	description.DependentBackups = dependentBackups(required, remotePath)
+	return description, nil
+}
+
+// PrintDescribeRemote - print description of remote backup
+func PrintDescribeRemote(ctx context.Context, config Config, backupName string) error {
+	if config.General.RemoteStorage == "none" {
+		return fmt.Errorf("describe-remote requires general.remote_storage")
+	}
+	d, err := DescribeRemote(ctx, config, backupName)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", d.Name)
+	fmt.Fprintf(w, "Size:\t%s\n", FormatBytes(d.Size))
+	fmt.Fprintf(w, "Created at:\t%s\n", d.Date.Format("02-01-2006 15:04:05"))
+	fmt.Fprintf(w, "Layout:\t%s\n", d.Layout)
+	if d.CompressionFormat != "" {
+		fmt.Fprintf(w, "Compression:\t%s\n", d.CompressionFormat)
+	}
+	if d.Manifest {
+		fmt.Fprintf(w, "ClickHouse:\t%s\n", d.ClickHouseVersion)
+		fmt.Fprintf(w, "clickhouse-backup:\t%s\n", d.BackupVersion)
+		fmt.Fprintf(w, "Host:\t%s\n", d.Host)
+	}
+	if d.Shard != "" {
+		fmt.Fprintf(w, "Shard:\t%s\n", d.Shard)
+	}
+	if len(d.RequiredBackups) > 0 {
+		fmt.Fprintf(w, "Requires:\t%s\n", strings.Join(d.RequiredBackups, " -> "))
+	}
+	if len(d.DependentBackups) > 0 {
+		fmt.Fprintf(w, "Required by:\t%s\n", strings.Join(d.DependentBackups, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if d.Layout == "archive" && !d.Manifest {
+		fmt.Println("Tables of backup uploaded as single archive without manifest.json are unknown")
+		return nil
+	}
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tENGINE\tSIZE\tPARTS\tPARTITIONS")
+	for _, table := range d.Tables {
+		size := "-"
+		if d.Manifest {
+			size = FormatBytes(table.Size)
+		}
+		fmt.Fprintf(w, "%s.%s\t%s\t%s\t%d\t%s\n", table.Database, table.Name, table.Engine, size, table.Parts, strings.Join(table.Partitions, ","))
+	}
+	return w.Flush()
+}
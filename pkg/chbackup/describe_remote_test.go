@@ -0,0 +1,36 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeTables(t *testing.T) {
+	manifest := &Manifest{Tables: []ManifestTable{
+		{Database: "default", Name: "events", Engine: "MergeTree", Parts: []ManifestPart{
+			{Name: "202107_1_1_0", Size: 10},
+			{Name: "202108_2_2_0", Size: 20},
+			{Name: "202108_3_3_0", Size: 30},
+		}},
+		{Database: "default", Name: "events_view", Engine: "View"},
+	}}
+	assert.Equal(t, []TableDescription{
+		{Database: "default", Name: "events", Engine: "MergeTree", Size: 60, Parts: 3, Partitions: []string{"202107", "202108"}},
+		{Database: "default", Name: "events_view", Engine: "View", Partitions: []string{}},
+	}, describeTables(manifest))
+
+	metafile := MetaFile{
+		Checksums: map[string]string{
+			"metadata/default/events.sql":                      "1",
+			"metadata/default/events_view.sql":                 "2",
+			"shadow/default/events/202108_2_2_0/data.bin":      "3",
+			"shadow/default/events/202108_2_2_0/checksums.txt": "4",
+		},
+		Hardlinks: []string{"shadow/default/events/202107_1_1_0/data.bin"},
+	}
+	assert.Equal(t, []TableDescription{
+		{Database: "default", Name: "events", Parts: 2, Partitions: []string{"202107", "202108"}},
+		{Database: "default", Name: "events_view", Partitions: []string{}},
+	}, describeMetaFileTables(metafile))
+}
@@ -0,0 +1,75 @@
+package chbackup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dictionariesDir - directory of backup with configs of dictionaries defined in XML, configs are placed
+// under their absolute path on the server, e.g. 'dictionaries/etc/clickhouse-server/geo_dictionary.xml'
+const dictionariesDir = "dictionaries"
+
+// GetDictionaryConfigs - return paths of XML configs of loaded dictionaries,
+// dictionaries created by CREATE DICTIONARY are saved with metadata of their database
+func (ch *ClickHouse) GetDictionaryConfigs() ([]string, error) {
+	var result []string
+	q := "SELECT DISTINCT origin FROM `system`.`dictionaries` WHERE endsWith(origin, '.xml')"
+	if err := ch.conn.Select(&result, q); err != nil {
+		return nil, fmt.Errorf("can't get dictionaries with %v", err)
+	}
+	return result, nil
+}
+
+// backupDictionaryConfigs - copy XML configs of dictionaries to backup, configs which can't be read
+// are skipped with message because clickhouse-backup may run without access to config directory of server
+func backupDictionaryConfigs(config Config, backupPath string) error {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	configs, err := ch.GetDictionaryConfigs()
+	if err != nil {
+		return err
+	}
+	for _, configPath := range configs {
+		if _, err := os.Stat(configPath); err != nil {
+			log.Printf("Skip dictionaries config '%s' with %v", configPath, err)
+			continue
+		}
+		log.Printf("Copy dictionaries config '%s'", configPath)
+		if err := copyFile(configPath, filepath.Join(backupPath, dictionariesDir, configPath)); err != nil {
+			return fmt.Errorf("can't backup '%s' with %v", configPath, err)
+		}
+	}
+	return nil
+}
+
+// restoreDictionaryConfigs - copy XML configs of dictionaries from backup to their paths, existing configs aren't overwritten,
+// ClickHouse loads new configs from dictionaries_config by itself
+func restoreDictionaryConfigs(backupPath string) error {
+	configsPath := filepath.Join(backupPath, dictionariesDir)
+	if _, err := os.Stat(configsPath); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(configsPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		configPath := string(filepath.Separator) + strings.Trim(strings.TrimPrefix(filePath, configsPath), string(filepath.Separator))
+		if _, err := os.Stat(configPath); err == nil {
+			log.Printf("Skip dictionaries config '%s', it already exists", configPath)
+			return nil
+		}
+		log.Printf("Restore dictionaries config '%s'", configPath)
+		if err := copyFile(filePath, configPath); err != nil {
+			return fmt.Errorf("can't restore '%s' with %v", configPath, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,33 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchemaPatternDictionariesFirst(t *testing.T) {
+	metadataPath, err := ioutil.TempDir("", "metadata")
+	require.NoError(t, err)
+	defer os.RemoveAll(metadataPath)
+	schemas := map[string]string{
+		"default/events.sql":   "ATTACH TABLE events (`id` UInt64, `country` String DEFAULT dictGet('default.geo', 'name', id)) ENGINE = MergeTree() ORDER BY id",
+		"default/geo.sql":      "ATTACH DICTIONARY geo (`id` UInt64, `name` String) PRIMARY KEY id SOURCE(CLICKHOUSE(TABLE 'geo_source')) LAYOUT(FLAT()) LIFETIME(300)",
+		"default/geo_view.sql": "ATTACH VIEW geo_view AS SELECT * FROM default.events",
+	}
+	for name, query := range schemas {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(metadataPath, name)), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(metadataPath, name), []byte(query), 0640))
+	}
+	tables, err := parseSchemaPattern(metadataPath, "")
+	require.NoError(t, err)
+	names := []string{}
+	for _, table := range tables {
+		names = append(names, table.Table)
+	}
+	assert.Equal(t, []string{"geo", "events", "geo_view"}, names)
+}
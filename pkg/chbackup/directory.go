@@ -0,0 +1,150 @@
+package chbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// directoryLayout - MetaFile.Layout of backup uploaded with general.upload_format 'directory',
+// each file of backup is stored without compression as object '<backup>/<relative path>'
+const directoryLayout = "directory"
+
+// directoryKey - object of file of backup with directory layout
+func (bd *BackupDestination) directoryKey(remotePath, name string) string {
+	return path.Join(bd.path, remotePath, name)
+}
+
+// DirectoryUpload - upload files of backup as objects with the same relative paths by general.upload_concurrency workers.
+// Files which are the same as in diffFromPath aren't uploaded, they are hard linked on download.
+// meta.json is uploaded the last, uploaded objects are removed when upload fails
+func (bd *BackupDestination) DirectoryUpload(ctx context.Context, localPath, remotePath, diffFromPath string) error {
+	metaName := path.Join(bd.path, remotePath, MetaFileName)
+	if _, err := bd.GetFile(ctx, metaName); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	files, totalBytes, err := bd.uploadFiles(localPath)
+	if err != nil {
+		return err
+	}
+	if err := checkDiffFromPath(diffFromPath); err != nil {
+		return err
+	}
+	// backup with 'metadata' and 'shadow' is listed even without meta.json, so metadata is uploaded after data
+	sort.SliceStable(files, func(i, j int) bool {
+		return !strings.HasPrefix(files[i], "metadata/") && strings.HasPrefix(files[j], "metadata/")
+	})
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	result := newArchiveResult()
+	started, err := runArchiveWorkers(ctx, bd.uploadConcurrency, "upload", files, func(relativePath string) error {
+		return bd.putDirectoryFile(ctx, localPath, remotePath, diffFromPath, relativePath, bar, result)
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		metafile := result.metaFile(diffFromPath)
+		metafile.Layout = directoryLayout
+		var content []byte
+		if content, err = json.MarshalIndent(metafile, "", "\t"); err != nil {
+			return fmt.Errorf("can't marshal json with %v", err)
+		}
+		if err = bd.PutFile(ctx, metaName, ioutil.NopCloser(bytes.NewReader(content))); err == nil {
+			bar.Finish()
+			log.Printf("Backup '%s': %d files uploaded, %d unchanged files of required backup aren't uploaded", remotePath, len(metafile.Checksums), len(metafile.Hardlinks))
+			return nil
+		}
+	}
+	log.Printf("Upload of '%s' failed, removing uploaded files", remotePath)
+	for _, relativePath := range files[:started] {
+		key := bd.directoryKey(remotePath, relativePath)
+		if err := bd.DeleteFile(context.Background(), key); err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("can't remove '%s' with %v", key, err)
+		}
+	}
+	return err
+}
+
+// putDirectoryFile - upload file of backup as object, file which is the same as in diffFromPath is collected as hardlink
+func (bd *BackupDestination) putDirectoryFile(ctx context.Context, localPath, remotePath, diffFromPath, relativePath string, bar *Bar, result *archiveResult) error {
+	filePath := filepath.Join(localPath, relativePath)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if diffFromPath != "" {
+		if diffFromFile, err := os.Stat(filepath.Join(diffFromPath, relativePath)); err == nil && os.SameFile(info, diffFromFile) {
+			bar.Add64(info.Size())
+			result.Lock()
+			result.hardlinks = append(result.hardlinks, relativePath)
+			result.Unlock()
+			return nil
+		}
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	publishFileEvent("upload", remotePath, relativePath, info.Size())
+	body := &hashingReader{ReadCloser: &readCloser{Reader: bar.NewProxyReader(newContextReader(ctx, file)), Closer: file}, hash: sha256.New()}
+	if err := bd.PutFile(ctx, bd.directoryKey(remotePath, relativePath), bd.uploadLimiter.reader(ctx, body)); err != nil {
+		return err
+	}
+	result.Lock()
+	result.checksums[relativePath] = hex.EncodeToString(body.hash.Sum(nil))
+	result.Unlock()
+	return nil
+}
+
+// directoryDownload - download files of backup with directory layout by general.download_concurrency workers,
+// only files of tables selected by skipTables are read
+func (bd *BackupDestination) directoryDownload(ctx context.Context, metafile MetaFile, remotePath, localPath string) error {
+	objects, err := bd.backupObjects(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	prefix := path.Join(bd.path, remotePath) + "/"
+	sizes := map[string]int64{}
+	for _, object := range objects {
+		sizes[strings.TrimPrefix(object.Name(), prefix)] = object.Size()
+	}
+	names := make([]string, 0, len(metafile.Checksums))
+	var totalBytes int64
+	for name := range metafile.Checksums {
+		if bd.skipTables.skipFile(name) {
+			continue
+		}
+		size, ok := sizes[name]
+		if !ok {
+			return fmt.Errorf("file '%s' of '%s' isn't found", name, remotePath)
+		}
+		names = append(names, name)
+		totalBytes += size
+	}
+	sort.Strings(names)
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	_, err = runArchiveWorkers(ctx, bd.downloadConcurrency, "download", names, func(name string) error {
+		return bd.downloadVerifiedFile(ctx, bd.directoryKey(remotePath, name), remotePath, localPath, name, metafile.Checksums[name], bar)
+	})
+	if err != nil {
+		return err
+	}
+	bar.Finish()
+	return nil
+}
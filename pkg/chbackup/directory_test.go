@@ -0,0 +1,91 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files1 := map[string]string{
+		"metadata/default/t1.sql":              "CREATE TABLE t1",
+		"metadata/default/t2.sql":              "CREATE TABLE t2",
+		"shadow/default/t1/all_1_1_0/data.bin": "part 1",
+		"shadow/default/t2/all_1_1_0/data.bin": "t2 part 1",
+	}
+	localPath1 := filepath.Join(dir, "backup", "backup1")
+	for file, content := range files1 {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(localPath1, file)), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(localPath1, file), []byte(content), 0640))
+	}
+	// backup2 is created with --diff-from backup1, its unchanged part is hard linked
+	localPath2 := filepath.Join(dir, "backup", "backup2")
+	require.NoError(t, os.MkdirAll(filepath.Join(localPath2, "shadow/default/t1/all_1_1_0"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(localPath2, "shadow/default/t1/all_2_2_0"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(localPath2, "metadata/default"), 0750))
+	require.NoError(t, os.Link(filepath.Join(localPath1, "shadow/default/t1/all_1_1_0/data.bin"), filepath.Join(localPath2, "shadow/default/t1/all_1_1_0/data.bin")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(localPath2, "shadow/default/t1/all_2_2_0/data.bin"), []byte("part 2"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(localPath2, "metadata/default/t1.sql"), []byte("CREATE TABLE t1"), 0640))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "remote"), 0750))
+	bd := &BackupDestination{
+		RemoteStorage:       &FileStorage{Config: &FileConfig{Path: filepath.Join(dir, "remote")}},
+		path:                "backups",
+		disableProgressBar:  true,
+		uploadConcurrency:   2,
+		downloadConcurrency: 2,
+		uploadFormat:        directoryLayout,
+	}
+	ctx := context.Background()
+	require.NoError(t, bd.DirectoryUpload(ctx, localPath1, "backup1", ""))
+	require.NoError(t, bd.DirectoryUpload(ctx, localPath2, "backup2", localPath1))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "remote", "backups", "backup1", "shadow/default/t1/all_1_1_0/data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "part 1", string(b))
+	_, err = os.Stat(filepath.Join(dir, "remote", "backups", "backup2", "shadow/default/t1/all_1_1_0/data.bin"))
+	assert.True(t, os.IsNotExist(err))
+	backups, err := bd.BackupList(ctx)
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+
+	downloadPath := filepath.Join(dir, "download", "backup2")
+	require.NoError(t, bd.CompressedStreamDownload(ctx, "backup2", downloadPath))
+	for name, content := range map[string]string{
+		"metadata/default/t1.sql":              "CREATE TABLE t1",
+		"shadow/default/t1/all_1_1_0/data.bin": "part 1",
+		"shadow/default/t1/all_2_2_0/data.bin": "part 2",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(downloadPath, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	}
+
+	// only files of selected table are downloaded
+	bd.skipTables = tableFilter{}.withTablePattern("default.t2")
+	downloadPath = filepath.Join(dir, "download_t2", "backup1")
+	require.NoError(t, bd.CompressedStreamDownload(ctx, "backup1", downloadPath))
+	_, err = os.Stat(filepath.Join(downloadPath, "shadow/default/t1/all_1_1_0/data.bin"))
+	assert.True(t, os.IsNotExist(err))
+	b, err = ioutil.ReadFile(filepath.Join(downloadPath, "shadow/default/t2/all_1_1_0/data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "t2 part 1", string(b))
+
+	// required backup is downloaded with all tables
+	bd.skipTables = tableFilter{}.withTablePattern("default.t1")
+	downloadPath = filepath.Join(dir, "download_t1", "backup2")
+	require.NoError(t, bd.CompressedStreamDownload(ctx, "backup2", downloadPath))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "download_t1", "backup1", "shadow/default/t2/all_1_1_0/data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "t2 part 1", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(downloadPath, "shadow/default/t1/all_1_1_0/data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "part 1", string(b))
+}
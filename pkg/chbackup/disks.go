@@ -0,0 +1,184 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Tables with storage policy keep data parts on several disks, FREEZE puts parts of each disk into 'shadow' of the disk.
+// Parts of all disks are moved into backup on default disk, disk of each part is saved to disks.json of backup,
+// on restore parts are placed into 'detached' of the table on the same disk, or on disk from clickhouse.disk_mapping
+
+// defaultDisk - name of disk at data path of ClickHouse
+const defaultDisk = "default"
+
+// partDisksFileName - file of backup with disk of each data part by '<db>/<table>/<part>' of shadow of backup,
+// parts of default disk aren't listed
+const partDisksFileName = "disks.json"
+
+// Disk - disk of ClickHouse from system.disks
+type Disk struct {
+	Name string `db:"name"`
+	Path string `db:"path"`
+}
+
+// GetDisks - return disks of ClickHouse, only default disk for ClickHouse without system.disks,
+// path of default disk is clickhouse.data_path when it is set
+func (ch *ClickHouse) GetDisks() ([]Disk, error) {
+	dataPath, err := ch.GetDataPath()
+	if err != nil {
+		return nil, err
+	}
+	var disks []Disk
+	if err := ch.conn.Select(&disks, "SELECT name, path FROM `system`.`disks`"); err != nil {
+		return []Disk{{Name: defaultDisk, Path: dataPath}}, nil
+	}
+	for i := range disks {
+		disks[i].Path = strings.TrimSuffix(disks[i].Path, "/")
+		if disks[i].Name == defaultDisk {
+			disks[i].Path = dataPath
+		}
+	}
+	return disks, nil
+}
+
+// GetTableDisks - return data path of table on each disk of its storage policy by disk name
+func (ch *ClickHouse) GetTableDisks(database, table string) (map[string]string, error) {
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return nil, err
+	}
+	var dataPaths [][]string
+	q := fmt.Sprintf("SELECT data_paths FROM `system`.`tables` WHERE database='%s' AND name='%s'", database, table)
+	if err := ch.conn.Select(&dataPaths, q); err != nil || len(dataPaths) != 1 {
+		dataPath, err := ch.GetTableDataPath(database, table)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{defaultDisk: dataPath}, nil
+	}
+	result := map[string]string{}
+	for _, dataPath := range dataPaths[0] {
+		for _, disk := range disks {
+			if strings.HasPrefix(dataPath, disk.Path+"/") {
+				result[disk.Name] = strings.TrimSuffix(dataPath, "/")
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// getDisks - disks of ClickHouse for functions without connection
+func getDisks(config Config) ([]Disk, error) {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	return ch.GetDisks()
+}
+
+// moveDisksShadow - move frozen parts of all disks into backupShadowDir, return disk of each part which isn't on default disk
+func moveDisksShadow(ctx context.Context, disks []Disk, backupShadowDir string, storePaths map[string]string, concurrency int) (map[string]string, error) {
+	partDisks := map[string]string{}
+	for _, disk := range disks {
+		shadowDir := filepath.Join(disk.Path, "shadow")
+		if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
+			continue
+		}
+		parts, err := moveShadow(ctx, shadowDir, backupShadowDir, storePaths, concurrency)
+		if err != nil {
+			return nil, err
+		}
+		if disk.Name == defaultDisk {
+			continue
+		}
+		for _, part := range parts {
+			partDisks[part] = disk.Name
+		}
+	}
+	return partDisks, nil
+}
+
+// writePartDisks - save disks of parts to backup
+func writePartDisks(backupPath string, partDisks map[string]string) error {
+	if len(partDisks) == 0 {
+		return nil
+	}
+	content, err := json.MarshalIndent(partDisks, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(backupPath, partDisksFileName), content, 0640)
+}
+
+// readPartDisks - disks of parts of backup, empty when all parts are on default disk
+func readPartDisks(backupPath string) (map[string]string, error) {
+	partDisks := map[string]string{}
+	content, err := ioutil.ReadFile(filepath.Join(backupPath, partDisksFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return partDisks, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &partDisks); err != nil {
+		return nil, fmt.Errorf("can't parse %s with %v", partDisksFileName, err)
+	}
+	return partDisks, nil
+}
+
+// partDataPath - data path of table on disk of part, disk is mapped by clickhouse.disk_mapping,
+// part is placed on default disk, or on other disk of table, when the table doesn't have this disk
+func partDataPath(tableDisks map[string]string, diskMapping map[string]string, disk string) (string, error) {
+	if disk == "" {
+		disk = defaultDisk
+	}
+	if mapped, ok := diskMapping[disk]; ok {
+		disk = mapped
+	}
+	if dataPath, ok := tableDisks[disk]; ok {
+		return dataPath, nil
+	}
+	if dataPath, ok := tableDisks[defaultDisk]; ok {
+		log.Printf("Disk '%s' isn't found for table, part is restored on '%s'", disk, defaultDisk)
+		return dataPath, nil
+	}
+	for name, dataPath := range tableDisks {
+		log.Printf("Disk '%s' isn't found for table, part is restored on '%s'", disk, name)
+		return dataPath, nil
+	}
+	return "", fmt.Errorf("table doesn't have data paths")
+}
+
+// moveFile - rename file, file is copied when it is moved to other filesystem
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// linkOrCopyFile - hard link file, file is copied when it is linked to other filesystem
+func linkOrCopyFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return copyFile(src, dst)
+}
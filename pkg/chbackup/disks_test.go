@@ -0,0 +1,37 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartDisks(t *testing.T) {
+	backupPath, err := ioutil.TempDir("", "disks")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPath)
+	partDisks, err := readPartDisks(backupPath)
+	require.NoError(t, err)
+	assert.Empty(t, partDisks)
+	require.NoError(t, writePartDisks(backupPath, map[string]string{"default/events/all_1_1_0": "hdd"}))
+	partDisks, err = readPartDisks(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"default/events/all_1_1_0": "hdd"}, partDisks)
+
+	tableDisks := map[string]string{"default": "/var/lib/clickhouse/data/default/events", "hdd": "/mnt/hdd/data/default/events"}
+	dataPath, err := partDataPath(tableDisks, nil, "hdd")
+	require.NoError(t, err)
+	assert.Equal(t, "/mnt/hdd/data/default/events", dataPath)
+	dataPath, err = partDataPath(tableDisks, nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/clickhouse/data/default/events", dataPath)
+	dataPath, err = partDataPath(tableDisks, map[string]string{"ssd": "hdd"}, "ssd")
+	require.NoError(t, err)
+	assert.Equal(t, "/mnt/hdd/data/default/events", dataPath)
+	dataPath, err = partDataPath(tableDisks, nil, "cold")
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/clickhouse/data/default/events", dataPath)
+}
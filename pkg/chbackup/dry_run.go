@@ -0,0 +1,527 @@
+package chbackup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// Dry run of create, restore, upload and delete prints tables, partitions, parts, local backups and remote keys
+// which the command would change, sizes are estimated before compression. ClickHouse, local backups and remote storage are only read
+
+// dryRunItem - object which command would change
+type dryRunItem struct {
+	// Action - 'freeze', 'link', 'copy', 'skip', 'drop', 'create', 'attach', 'put' or 'remove'
+	Action string
+	// Table, Partition - table and partition ID of data part, empty for other objects
+	Table     string
+	Partition string
+	// Object - data part, local backup or remote key
+	Object string
+	// Size - estimated size in bytes, -1 when it's unknown
+	Size int64
+}
+
+// printDryRun - print items in table and total number and size of items of each action
+func printDryRun(command, backupName string, items []dryRunItem) {
+	fmt.Printf("Dry run of %s '%s', nothing is changed\n", command, backupName)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tTABLE\tPARTITION\tOBJECT\tSIZE")
+	actions := []string{}
+	counts := map[string]int{}
+	sizes := map[string]int64{}
+	for _, item := range items {
+		size := ""
+		if item.Size >= 0 {
+			size = FormatBytes(item.Size)
+			sizes[item.Action] += item.Size
+		}
+		if counts[item.Action] == 0 {
+			actions = append(actions, item.Action)
+		}
+		counts[item.Action]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", item.Action, item.Table, item.Partition, item.Object, size)
+	}
+	w.Flush()
+	for _, action := range actions {
+		fmt.Printf("%s: %d, %s\n", action, counts[action], FormatBytes(sizes[action]))
+	}
+}
+
+// dryRunTable - name of table in dry run
+func dryRunTable(database, table string) string {
+	return fmt.Sprintf("`%s`.`%s`", database, table)
+}
+
+// localBackupItems - items of local backups removed by general.backups_to_keep_local when backupName is created
+func localBackupItems(config Config, backupName string) ([]dryRunItem, error) {
+	items := []dryRunItem{}
+	if config.General.BackupsToKeepLocal < 1 {
+		return items, nil
+	}
+	backupList, err := ListLocalBackups(config)
+	if err != nil {
+		return nil, err
+	}
+	backupList = append(backupList, Backup{Name: backupName, Date: time.Now()})
+	for _, backup := range GetBackupsToDelete(backupList, config.General.BackupsToKeepLocal) {
+		backupPath := path.Join(getDataPath(config), "backup", backup.Name)
+		_, size, err := listBackupFiles(backupPath)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, dryRunItem{Action: "remove", Object: backupPath, Size: size})
+	}
+	return items, nil
+}
+
+// dryRunCreate - print tables and parts which would be frozen by CreateBackup
+func dryRunCreate(config Config, backupName, tablePattern, partitions, diffFrom string, rbac bool) error {
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
+	if diffFrom != "" {
+		if err := GetLocalBackup(config, diffFrom); err != nil {
+			return fmt.Errorf("can't create backup with %v", err)
+		}
+	}
+	backupPath := path.Join(dataPath, "backup", backupName)
+	if _, err := os.Stat(backupPath); err == nil || !os.IsNotExist(err) {
+		return fmt.Errorf("can't create backup with '%s' already exists", backupPath)
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with: %v", err)
+	}
+	defer ch.Close()
+	allTables, err := ch.GetTables()
+	if err != nil {
+		return fmt.Errorf("can't get Clickhouse tables with: %v", err)
+	}
+	tables := parseTablePatternForFreeze(allTables, tablePattern)
+	if len(tables) == 0 {
+		return fmt.Errorf("there are no tables in Clickhouse, create something to backup")
+	}
+	// parts with the same name as parts of diffFrom are hard linked to them
+	diffFromTables := map[string]BackupTable{}
+	if diffFrom != "" && !config.ClickHouse.UseEmbeddedBackupRestore {
+		if diffFromTables, err = ch.GetBackupTables(diffFrom); err != nil {
+			return err
+		}
+	}
+	action := "freeze"
+	if config.ClickHouse.UseEmbeddedBackupRestore {
+		action = "backup"
+	}
+	partitionIDs := map[string]bool{}
+	for _, id := range parsePartitions(partitions) {
+		partitionIDs[id] = true
+	}
+	items := []dryRunItem{}
+	for _, table := range tables {
+		name := dryRunTable(table.Database, table.Name)
+		if table.Skip {
+			items = append(items, dryRunItem{Action: "skip", Table: name, Size: -1})
+			continue
+		}
+		parts, err := ch.GetParts(table)
+		if err != nil {
+			return err
+		}
+		diffFromParts := map[string]bool{}
+		for _, part := range diffFromTables[fmt.Sprintf("%s.%s", table.Database, table.Name)].Partitions {
+			diffFromParts[part.Name] = true
+		}
+		for _, part := range parts {
+			if len(partitionIDs) > 0 && !partitionIDs[part.PartitionID] {
+				continue
+			}
+			item := dryRunItem{Action: action, Table: name, Partition: part.PartitionID, Object: part.Name, Size: int64(part.BytesOnDisk)}
+			if diffFromParts[part.Name] {
+				item.Action = "link"
+			}
+			items = append(items, item)
+		}
+	}
+	fileTables, err := ch.GetFileTables()
+	if err != nil {
+		return err
+	}
+	filter := newTableFilter(config.ClickHouse).withTablePattern(tablePattern)
+	for _, table := range fileTables {
+		if !table.Copy || table.Skip || filter.skip(table.Database, table.Name) || len(table.DataPaths) == 0 || partitions != "" || config.ClickHouse.UseEmbeddedBackupRestore {
+			continue
+		}
+		_, size, err := listBackupFiles(table.DataPaths[0])
+		if err != nil {
+			return err
+		}
+		items = append(items, dryRunItem{Action: "copy", Table: dryRunTable(table.Database, table.Name), Object: table.DataPaths[0], Size: size})
+	}
+	if rbac {
+		items = append(items, dryRunItem{Action: "create", Object: path.Join(backupPath, "metadata", rbacFileName), Size: -1})
+	}
+	removed, err := localBackupItems(config, backupName)
+	if err != nil {
+		return err
+	}
+	printDryRun("create", backupName, append(items, removed...))
+	return nil
+}
+
+// dryRunRestore - print tables which would be created and parts which would be attached by Restore
+func dryRunRestore(config Config, backupName, tablePattern string, schemaOnly, dataOnly bool, opts RestoreOptions) error {
+	if err := GetLocalBackup(config, backupName); err != nil {
+		return err
+	}
+	mapping, err := parseRestoreMapping(opts.DatabaseMapping, opts.TableMapping)
+	if err != nil {
+		return err
+	}
+	backupPath := path.Join(getDataPath(config), "backup", backupName)
+	items := []dryRunItem{}
+	if opts.RBAC {
+		items = append(items, dryRunItem{Action: "create", Object: path.Join(backupPath, "metadata", rbacFileName), Size: -1})
+	}
+	if schemaOnly || (schemaOnly == dataOnly) || isEmbeddedBackup(backupPath) {
+		schemas, err := parseSchemaPattern(path.Join(backupPath, "metadata"), tablePattern)
+		if err != nil {
+			return err
+		}
+		schemas = newTableFilter(config.ClickHouse).restoreTables(schemas)
+		var ch *ClickHouse
+		if opts.DropIfExists {
+			ch = &ClickHouse{
+				Config: &config.ClickHouse,
+			}
+			if err := ch.Connect(); err != nil {
+				return fmt.Errorf("can't connect to clickouse with: %v", err)
+			}
+			defer ch.Close()
+		}
+		for _, schema := range schemas {
+			if isInnerTable(schema.Table) {
+				continue
+			}
+			schema = mapping.restoreTable(schema)
+			if ch != nil {
+				exists, err := ch.TableExists(schema.Database, schema.Table)
+				if err != nil {
+					return err
+				}
+				if exists {
+					items = append(items, dryRunItem{Action: "drop", Table: dryRunTable(schema.Database, schema.Table), Size: -1})
+				}
+			}
+			items = append(items, dryRunItem{Action: "create", Table: dryRunTable(schema.Database, schema.Table), Size: -1})
+		}
+	}
+	if (dataOnly || (schemaOnly == dataOnly)) && !isEmbeddedBackup(backupPath) {
+		ch := &ClickHouse{
+			Config: &config.ClickHouse,
+		}
+		if err := ch.Connect(); err != nil {
+			return fmt.Errorf("can't connect to clickouse with: %v", err)
+		}
+		allBackupTables, err := ch.GetBackupTables(backupName)
+		ch.Close()
+		if err != nil {
+			return err
+		}
+		journal, err := loadRestoreJournal(getDataPath(config), backupName)
+		if err != nil {
+			return err
+		}
+		partitionIDs := parsePartitions(opts.Partitions)
+		restoreTables := newTableFilter(config.ClickHouse).backupTables(parseTablePatternForRestoreData(allBackupTables, tablePattern))
+		for _, table := range restoreTables {
+			if len(partitionIDs) > 0 {
+				table = filterPartitions(table, partitionIDs)
+			}
+			table = mapping.backupTable(table)
+			for _, part := range table.Partitions {
+				_, size, err := listBackupFiles(part.Path)
+				if err != nil {
+					return err
+				}
+				action := "attach"
+				if journal.isAttached(table.Database, table.Name, part.Name) {
+					action = "skip"
+				}
+				items = append(items, dryRunItem{
+					Action:    action,
+					Table:     dryRunTable(table.Database, table.Name),
+					Partition: partitionIDOfPart(part.Name),
+					Object:    part.Name,
+					Size:      size,
+				})
+			}
+		}
+		fileTables, err := listFileTables(backupPath, newTableFilter(config.ClickHouse).withTablePattern(tablePattern))
+		if err != nil {
+			return err
+		}
+		if len(partitionIDs) > 0 {
+			// tables of files don't have partitions
+			fileTables = nil
+		}
+		for _, table := range fileTables {
+			src := path.Join(backupPath, tableFilesDir, TablePathEncode(table.Database), TablePathEncode(table.Name))
+			_, size, err := listBackupFiles(src)
+			if err != nil {
+				return err
+			}
+			database, name := mapping.database(table.Database), mapping.table(table.Name)
+			action := "copy"
+			if journal.isCopied(database, name) {
+				action = "skip"
+			}
+			items = append(items, dryRunItem{Action: action, Table: dryRunTable(database, name), Object: src, Size: size})
+		}
+	}
+	printDryRun("restore", backupName, items)
+	return nil
+}
+
+// dryRunUpload - print remote keys which would be put by Upload and backups removed by retention of remote storage
+func dryRunUpload(ctx context.Context, config Config, backupName, diffFrom, tablePattern string) error {
+	items, err := uploadItems(ctx, config, backupName, diffFrom, tablePattern)
+	if err != nil {
+		return err
+	}
+	printDryRun("upload", backupName, items)
+	return nil
+}
+
+// uploadItems - remote keys which would be put by Upload, local backup removed by general.delete_local_after_upload
+// and backups removed by retention of remote storage
+func uploadItems(ctx context.Context, config Config, backupName, diffFrom, tablePattern string) ([]dryRunItem, error) {
+	if err := GetLocalBackup(config, backupName); err != nil {
+		return nil, fmt.Errorf("can't upload with %s", err)
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	bd.skipTables = bd.skipTables.withTablePattern(tablePattern)
+	if err := bd.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to %s with : %v", bd.Kind(), err)
+	}
+	if err := bd.checkTablesUpload(ctx, backupName, tablePattern); err != nil {
+		return nil, err
+	}
+	dataPath := getDataPath(config)
+	backupPath := path.Join(dataPath, "backup", backupName)
+	files, _, err := bd.uploadFiles(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	diffFromPath := ""
+	if diffFrom != "" {
+		diffFromPath = path.Join(dataPath, "backup", diffFrom)
+		if err := checkDiffFromPath(diffFromPath); err != nil {
+			return nil, err
+		}
+	}
+	// files hard linked to diffFrom aren't uploaded
+	sizes := map[string]int64{}
+	hardlinks := 0
+	for _, relativePath := range files {
+		info, err := os.Stat(filepath.Join(backupPath, relativePath))
+		if err != nil {
+			return nil, err
+		}
+		if diffFromPath != "" && bd.remoteLayout != casLayout {
+			if diffFromFile, err := os.Stat(filepath.Join(diffFromPath, relativePath)); err == nil && os.SameFile(info, diffFromFile) {
+				hardlinks++
+				continue
+			}
+		}
+		sizes[relativePath] = info.Size()
+	}
+	items := []dryRunItem{}
+	switch {
+	case bd.remoteLayout == casLayout:
+		pool, err := bd.casPool(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("can't list %s with %v", casDir, err)
+		}
+		for _, relativePath := range files {
+			checksum, err := fileChecksum(ctx, filepath.Join(backupPath, relativePath))
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := pool[checksum]; !exists {
+				pool[checksum] = nil
+				items = append(items, dryRunItem{Action: "put", Object: bd.casKey(checksum), Size: sizes[relativePath]})
+			}
+		}
+		items = append(items, dryRunItem{Action: "put", Object: path.Join(bd.path, backupName, MetaFileName), Size: -1})
+	case bd.uploadFormat == directoryLayout:
+		for _, relativePath := range files {
+			if size, ok := sizes[relativePath]; ok {
+				items = append(items, dryRunItem{Action: "put", Object: bd.directoryKey(backupName, relativePath), Size: size})
+			}
+		}
+		items = append(items, dryRunItem{Action: "put", Object: path.Join(bd.path, backupName, MetaFileName), Size: -1})
+	case bd.uploadConcurrency > 1 || bd.maxFileSize > 0:
+		archives, groups := groupByArchive(files, getExtension(bd.compressionFormat))
+		for _, archive := range archives {
+			var size int64
+			for _, file := range groups[archive] {
+				size += sizes[file]
+			}
+			items = append(items, dryRunItem{Action: "put", Object: path.Join(bd.path, backupName, archive), Size: size})
+		}
+		items = append(items, dryRunItem{Action: "put", Object: path.Join(bd.path, backupName, MetaFileName), Size: -1})
+	default:
+		var size int64
+		for _, fileSize := range sizes {
+			size += fileSize
+		}
+		items = append(items, dryRunItem{Action: "put", Object: path.Join(bd.path, fmt.Sprintf("%s.%s", backupName, getExtension(bd.compressionFormat))), Size: size})
+		if hardlinks > 0 {
+			items = append(items, dryRunItem{Action: "put", Object: path.Join(bd.path, backupName, requiredBackupFileName), Size: int64(len(diffFrom))})
+		}
+	}
+	if config.General.DeleteLocalAfterUpload && tablePattern == "" {
+		_, size, err := listBackupFiles(backupPath)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, dryRunItem{Action: "remove", Object: backupPath, Size: size})
+	}
+	if bd.Retention().Enabled() {
+		backupList, err := bd.BackupList(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if backupList, err = bd.withManifests(ctx, backupList); err != nil {
+			return nil, err
+		}
+		backupList = append(backupList, Backup{Name: backupName, Date: time.Now()})
+		oldBackups, err := bd.oldBackups(ctx, backupList, bd.Retention())
+		if err != nil {
+			return nil, err
+		}
+		removed := map[string]bool{}
+		names := []string{}
+		for _, backup := range oldBackups {
+			removed[backupNameOfKey("", backup.Name)] = true
+			names = append(names, backup.Name)
+		}
+		removedItems, err := bd.removeBackupItems(ctx, names, removed)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, removedItems...)
+	}
+	return items, nil
+}
+
+// dryRunRemoveLocal - print local backup which would be removed by RemoveBackupLocal
+func dryRunRemoveLocal(config Config, backupName string) error {
+	if err := GetLocalBackup(config, backupName); err != nil {
+		return err
+	}
+	backupPath := path.Join(getDataPath(config), "backup", backupName)
+	_, size, err := listBackupFiles(backupPath)
+	if err != nil {
+		return err
+	}
+	printDryRun("delete", backupName, []dryRunItem{{Action: "remove", Object: backupPath, Size: size}})
+	return nil
+}
+
+// dryRunRemoveRemote - print remote keys which would be removed by RemoveBackupRemote
+func dryRunRemoveRemote(ctx context.Context, config Config, backupName string, force bool) error {
+	items, err := removeRemoteItems(ctx, config, backupName, force)
+	if err != nil {
+		return err
+	}
+	printDryRun("delete", backupName, items)
+	return nil
+}
+
+// removeRemoteItems - remote keys of backup and backups which require it, they are removed only with force
+func removeRemoteItems(ctx context.Context, config Config, backupName string, force bool) ([]dryRunItem, error) {
+	if _, err := GetRemoteBackup(ctx, config, backupName); err != nil {
+		return nil, err
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to remote storage with: %v", err)
+	}
+	required, err := bd.requiredBackups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't read dependencies of backups with %v", err)
+	}
+	dependents := dependentBackups(required, backupNameOfKey("", backupName))
+	if len(dependents) > 0 && !force {
+		return nil, errBackupRequired(backupName, dependents)
+	}
+	names := append(dependents, backupName)
+	removed := map[string]bool{}
+	for _, name := range names {
+		removed[backupNameOfKey("", name)] = true
+	}
+	return bd.removeBackupItems(ctx, names, removed)
+}
+
+// removeBackupItems - items of files of backups and files of pool which aren't referenced by backups except removed ones
+func (bd *BackupDestination) removeBackupItems(ctx context.Context, backupNames []string, removed map[string]bool) ([]dryRunItem, error) {
+	items := []dryRunItem{}
+	checksums := map[string]string{}
+	for _, backupName := range backupNames {
+		backupName = backupNameOfKey("", backupName)
+		objects, err := bd.backupObjects(ctx, backupName)
+		if err != nil {
+			return nil, err
+		}
+		metaName := path.Join(bd.path, backupName, MetaFileName)
+		for _, object := range objects {
+			items = append(items, dryRunItem{Action: "remove", Object: object.Name(), Size: object.Size()})
+			if object.Name() != metaName {
+				continue
+			}
+			metafile, err := bd.readMetaFile(ctx, metaName)
+			if err != nil {
+				return nil, err
+			}
+			if metafile.Layout == casLayout {
+				for name, checksum := range metafile.Checksums {
+					checksums[backupName+"/"+name] = checksum
+				}
+			}
+		}
+	}
+	if len(checksums) == 0 {
+		return items, nil
+	}
+	keys, err := bd.casUnreferenced(ctx, checksums, removed)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := bd.casPool(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't list %s with %v", casDir, err)
+	}
+	for _, key := range keys {
+		var size int64 = -1
+		if f, ok := pool[path.Base(key)]; ok && f != nil {
+			size = f.Size()
+		}
+		items = append(items, dryRunItem{Action: "remove", Object: key, Size: size})
+	}
+	return items, nil
+}
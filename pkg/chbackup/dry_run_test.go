@@ -0,0 +1,103 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0640))
+	}
+}
+
+func dryRunObjects(items []dryRunItem) []string {
+	objects := []string{}
+	for _, item := range items {
+		objects = append(objects, item.Action+" "+item.Object)
+	}
+	return objects
+}
+
+func TestUploadItems(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "dry_run_data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	remoteDir, err := ioutil.TempDir("", "dry_run_remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(remoteDir)
+	writeTestFiles(t, filepath.Join(dataDir, "backup", "backup1"), map[string]string{
+		"metadata/default/t1.sql":                    "CREATE",
+		"shadow/default/t1/all_1_1_0/data.bin":       "data",
+		"shadow/default/t1/all_2_2_0/data.bin":       "data",
+		"shadow/system/query_log/all_1_1_0/data.bin": "data",
+	})
+	config := *DefaultConfig()
+	config.ClickHouse.DataPath = dataDir
+	config.General.RemoteStorage = "file"
+	config.File.Path = remoteDir
+	ctx := context.Background()
+
+	items, err := uploadItems(ctx, config, "backup1", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, []dryRunItem{{Action: "put", Object: "backup1.tar.zst", Size: 14}}, items)
+
+	config.General.UploadFormat = directoryLayout
+	items, err = uploadItems(ctx, config, "backup1", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, []dryRunItem{
+		{Action: "put", Object: "backup1/metadata/default/t1.sql", Size: 6},
+		{Action: "put", Object: "backup1/shadow/default/t1/all_1_1_0/data.bin", Size: 4},
+		{Action: "put", Object: "backup1/shadow/default/t1/all_2_2_0/data.bin", Size: 4},
+		{Action: "put", Object: "backup1/meta.json", Size: -1},
+	}, items)
+
+	// nothing is put to remote storage
+	_, err = os.Stat(filepath.Join(remoteDir, "backup1"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = uploadItems(ctx, config, "missing", "", "")
+	assert.Error(t, err)
+}
+
+func TestRemoveRemoteItems(t *testing.T) {
+	remoteDir, err := ioutil.TempDir("", "dry_run_remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(remoteDir)
+	writeTestFiles(t, remoteDir, map[string]string{
+		"full/meta.json": `{}`,
+		"full/shadow/default/t1/all_1_1_0/data.bin": "data",
+		"incr/meta.json": `{"required_backup":"full"}`,
+		"incr/shadow/default/t1/all_2_2_0/data.bin": "data",
+		"other/meta.json": `{}`,
+	})
+	config := *DefaultConfig()
+	config.General.RemoteStorage = "file"
+	config.File.Path = remoteDir
+	ctx := context.Background()
+
+	items, err := removeRemoteItems(ctx, config, "incr", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"remove incr/meta.json", "remove incr/shadow/default/t1/all_2_2_0/data.bin"}, dryRunObjects(items))
+	assert.Equal(t, int64(4), items[1].Size)
+
+	// backup required by other backup is removed only with force
+	_, err = removeRemoteItems(ctx, config, "full", false)
+	assert.True(t, errors.Is(err, ErrBackupRequired))
+	items, err = removeRemoteItems(ctx, config, "full", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"remove incr/meta.json",
+		"remove incr/shadow/default/t1/all_2_2_0/data.bin",
+		"remove full/meta.json",
+		"remove full/shadow/default/t1/all_1_1_0/data.bin",
+	}, dryRunObjects(items))
+	assert.FileExists(t, filepath.Join(remoteDir, "full", MetaFileName))
+}
@@ -0,0 +1,187 @@
+package chbackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Embedded backups are created by BACKUP and restored by RESTORE queries of ClickHouse to the disk from clickhouse.embedded_backup_disk,
+// path of the disk is '<data_path>/backup/', so embedded backups are listed, uploaded, downloaded and removed as other local backups
+
+// embeddedBackupFile - file which ClickHouse writes into root of its backup
+const embeddedBackupFile = ".backup"
+
+// embeddedStatusPollInterval - interval of polling status of BACKUP and RESTORE queries in system.backups
+var embeddedStatusPollInterval = time.Second
+
+// isEmbeddedBackup - local backup is created by BACKUP query of ClickHouse
+func isEmbeddedBackup(backupPath string) bool {
+	_, err := os.Stat(path.Join(backupPath, embeddedBackupFile))
+	return err == nil
+}
+
+// CheckEmbeddedBackupDisk - check that disk for BACKUP queries is placed at '<data_path>/backup/'
+func (ch *ClickHouse) CheckEmbeddedBackupDisk(disk string) error {
+	if disk == "" {
+		return fmt.Errorf("clickhouse.embedded_backup_disk is required for embedded backups")
+	}
+	dataPath, err := ch.GetDataPath()
+	if err != nil {
+		return err
+	}
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	for _, d := range disks {
+		if d.Name != disk {
+			continue
+		}
+		if filepath.Clean(d.Path) != filepath.Join(dataPath, "backup") {
+			return fmt.Errorf("path of disk '%s' is '%s', it should be '%s/' to manage embedded backups", disk, d.Path, filepath.Join(dataPath, "backup"))
+		}
+		return nil
+	}
+	return fmt.Errorf("disk '%s' isn't found in system.disks", disk)
+}
+
+// RunEmbeddedBackupQuery - run BACKUP or RESTORE query with ASYNC and wait until system.backups shows that it is finished,
+// ClickHouse continues the operation when ctx is cancelled
+func (ch *ClickHouse) RunEmbeddedBackupQuery(ctx context.Context, query string) error {
+	log.Println(query)
+	var started []struct {
+		ID     string `db:"id"`
+		Status string `db:"status"`
+	}
+	if err := ch.conn.Select(&started, query+" ASYNC"); err != nil {
+		return err
+	}
+	if len(started) != 1 {
+		return fmt.Errorf("unexpected result of '%s'", query)
+	}
+	id := started[0].ID
+	lastStatus := started[0].Status
+	for {
+		var status []struct {
+			Status   string `db:"status"`
+			Error    string `db:"error"`
+			NumFiles uint64 `db:"num_files"`
+		}
+		q := fmt.Sprintf("SELECT status, error, num_files FROM `system`.`backups` WHERE id='%s'", id)
+		if err := ch.conn.Select(&status, q); err != nil {
+			return fmt.Errorf("can't get status of '%s' with %v", id, err)
+		}
+		if len(status) != 1 {
+			return fmt.Errorf("'%s' isn't found in system.backups", id)
+		}
+		if status[0].Status != lastStatus {
+			lastStatus = status[0].Status
+			log.Printf("  %s, %d files", lastStatus, status[0].NumFiles)
+		}
+		switch lastStatus {
+		case "BACKUP_CREATED", "RESTORED":
+			return nil
+		case "BACKUP_FAILED", "RESTORE_FAILED":
+			return fmt.Errorf("%s with %s", lastStatus, status[0].Error)
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("'%s' is still running in ClickHouse", id)
+			return ctx.Err()
+		case <-time.After(embeddedStatusPollInterval):
+		}
+	}
+}
+
+// embeddedTables - 'TABLE `db`.`name`' clauses of tables, inner tables of materialized views are backed up with their views
+func embeddedTables(tables []Table) []string {
+	result := []string{}
+	for _, t := range tables {
+		if t.Skip || isInnerTable(t.Name) {
+			continue
+		}
+		result = append(result, fmt.Sprintf("TABLE `%s`.`%s`", t.Database, t.Name))
+	}
+	return result
+}
+
+// createEmbeddedBackup - create backup by BACKUP query, diffFrom is used as base_backup
+func createEmbeddedBackup(ctx context.Context, config Config, backupName, tablePattern, diffFrom string) error {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	disk := config.ClickHouse.EmbeddedBackupDisk
+	if err := ch.CheckEmbeddedBackupDisk(disk); err != nil {
+		return err
+	}
+	var allTables []Table
+	if err := ch.conn.Select(&allTables, "SELECT database, name FROM `system`.`tables` WHERE is_temporary = 0 AND database != 'system'"); err != nil {
+		return fmt.Errorf("can't get Clickhouse tables with: %v", err)
+	}
+	skipTables := newTableFilter(config.ClickHouse)
+	for i, t := range allTables {
+		allTables[i].Skip = skipTables.skip(t.Database, t.Name)
+	}
+	tables := embeddedTables(parseTablePatternForFreeze(allTables, tablePattern))
+	if len(tables) == 0 {
+		return fmt.Errorf("there are no tables in Clickhouse, create something to backup")
+	}
+	query := fmt.Sprintf("BACKUP %s TO Disk('%s', '%s/')", strings.Join(tables, ", "), disk, backupName)
+	if diffFrom != "" {
+		query += fmt.Sprintf(" SETTINGS base_backup = Disk('%s', '%s/')", disk, diffFrom)
+	}
+	return ch.RunEmbeddedBackupQuery(ctx, query)
+}
+
+// restoreEmbeddedBackup - restore tables matched by tablePattern by RESTORE query
+func restoreEmbeddedBackup(ctx context.Context, config Config, backupName, tablePattern string, schemaOnly, dataOnly bool, opts RestoreOptions) error {
+	if opts != (RestoreOptions{}) {
+		return fmt.Errorf("partitions, mappings, --on-cluster, --rbac, --rm, --restore-schema-as-* and --restore-uuid aren't supported for embedded backups")
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
+	schemas, err := parseSchemaPattern(path.Join(dataPath, "backup", backupName, "metadata"), tablePattern)
+	if err != nil {
+		return err
+	}
+	schemas = newTableFilter(config.ClickHouse).restoreTables(schemas)
+	tables := []string{}
+	for _, schema := range schemas {
+		if !isInnerTable(schema.Table) {
+			tables = append(tables, fmt.Sprintf("TABLE `%s`.`%s`", schema.Database, schema.Table))
+		}
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	disk := config.ClickHouse.EmbeddedBackupDisk
+	if err := ch.CheckEmbeddedBackupDisk(disk); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("RESTORE %s FROM Disk('%s', '%s/')", strings.Join(tables, ", "), disk, backupName)
+	if schemaOnly && !dataOnly {
+		query += " SETTINGS structure_only = 1"
+	} else if dataOnly && !schemaOnly {
+		query += " SETTINGS allow_non_empty_tables = 1"
+	}
+	return ch.RunEmbeddedBackupQuery(ctx, query)
+}
@@ -0,0 +1,28 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedBackup(t *testing.T) {
+	backupPath, err := ioutil.TempDir("", "embedded")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPath)
+	assert.False(t, isEmbeddedBackup(backupPath))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, embeddedBackupFile), []byte("<config/>"), 0640))
+	assert.True(t, isEmbeddedBackup(backupPath))
+
+	tables := []Table{
+		{Database: "default", Name: "events"},
+		{Database: "default", Name: "mv"},
+		{Database: "default", Name: ".inner.mv"},
+		{Database: "default", Name: "tmp", Skip: true},
+	}
+	assert.Equal(t, []string{"TABLE `default`.`events`", "TABLE `default`.`mv`"}, embeddedTables(tables))
+}
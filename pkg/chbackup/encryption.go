@@ -0,0 +1,467 @@
+package chbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var (
+	// encryptionMagic - the first bytes of file encrypted by static key, followed by random prefix of chunk nonces
+	encryptionMagic = []byte("CHBENC01")
+	// envelopeEncryptionMagic - the first bytes of file encrypted by data key of backup, followed by ID of KMS key,
+	// data key wrapped by it and random prefix of chunk nonces, ID and wrapped key are prefixed by 2 bytes length
+	envelopeEncryptionMagic = []byte("CHBENC02")
+)
+
+const (
+	// encryptionChunkSize - plain bytes sealed together, encrypted file can be read from offset by chunks
+	encryptionChunkSize = 64 * 1024
+	// encryptionPrefixSize - random part of nonce of all chunks of file, the rest is number of chunk
+	encryptionPrefixSize = 8
+	// encryptionHeaderMaxSize - header is read by one ranged request of this size before file is read from offset,
+	// ID of KMS key and wrapped data key must fit in it
+	encryptionHeaderMaxSize = 4096
+)
+
+// encryptionHeader - header of encrypted file, KeyID and WrappedKey are empty for static key
+type encryptionHeader struct {
+	KeyID      string
+	WrappedKey []byte
+	Prefix     []byte
+	Size       int64
+}
+
+// encryptedStorage - files are encrypted by AES-256-GCM before upload and decrypted on download.
+// File is a header and chunks of encryptionChunkSize plain bytes sealed separately, the last chunk is always shorter,
+// it is sealed with different additional data, so truncated file can't be decrypted.
+// Sizes of files are sizes of encrypted files, they are 16 bytes per chunk bigger than plain files.
+// With KMS files of each backup are encrypted by data key of backup generated by KMS, wrapped data key is kept
+// in header of each file, so files can be decrypted alone and after KMS key is rotated
+type encryptedStorage struct {
+	RemoteStorage
+	aead     cipher.AEAD
+	kms      kmsKeyProvider
+	basePath string
+	// dataKeys - data keys of backups by backup name, unwrapped keys by ID of KMS key and wrapped key
+	dataKeys  map[string]*dataKey
+	unwrapped map[string]cipher.AEAD
+	sync.Mutex
+}
+
+type dataKey struct {
+	aead    cipher.AEAD
+	keyID   string
+	wrapped []byte
+}
+
+// encryptedBatchStorage - encryptedStorage of remote storage which supports DeleteFiles
+type encryptedBatchStorage struct {
+	*encryptedStorage
+}
+
+// newEncryptedStorage - key is static key used without KMS and for files encrypted by it, kms generates data keys of backups when it isn't nil
+func newEncryptedStorage(storage RemoteStorage, key []byte, kms kmsKeyProvider, basePath string) (RemoteStorage, error) {
+	s := &encryptedStorage{
+		RemoteStorage: storage,
+		kms:           kms,
+		basePath:      basePath,
+		dataKeys:      map[string]*dataKey{},
+		unwrapped:     map[string]cipher.AEAD{},
+	}
+	if key != nil {
+		var err error
+		if s.aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := storage.(BatchDeleter); ok {
+		return &encryptedBatchStorage{s}, nil
+	}
+	return s, nil
+}
+
+// encryptStorage - storage encrypted by keys from encryption section, basePath is path of backups on storage
+func encryptStorage(storage RemoteStorage, config EncryptionConfig, basePath string) (RemoteStorage, error) {
+	var kms kmsKeyProvider
+	if config.KMSKeyID != "" || config.KMSEncryptedKey != "" {
+		var err error
+		if kms, err = newKMSKeyProvider(config); err != nil {
+			return nil, err
+		}
+	}
+	var key []byte
+	if config.Key != "" || config.KeyFile != "" || config.KMSEncryptedKey != "" {
+		var err error
+		if key, err = loadEncryptionKey(config, kms); err != nil {
+			return nil, err
+		}
+	}
+	if config.KMSKeyID == "" {
+		kms = nil
+	}
+	return newEncryptedStorage(storage, key, kms, basePath)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't create cipher with %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("can't create cipher with %v", err)
+	}
+	return aead, nil
+}
+
+func (s *encryptedStorage) PutFile(ctx context.Context, key string, r io.ReadCloser) error {
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return fmt.Errorf("can't generate nonce with %v", err)
+	}
+	aead := s.aead
+	header := bytes.NewBuffer(nil)
+	if s.kms == nil {
+		header.Write(encryptionMagic)
+	} else {
+		dk, err := s.backupDataKey(ctx, backupNameOfKey(s.basePath, key))
+		if err != nil {
+			return err
+		}
+		aead = dk.aead
+		header.Write(envelopeEncryptionMagic)
+		writeHeaderField(header, []byte(dk.keyID))
+		writeHeaderField(header, dk.wrapped)
+	}
+	header.Write(prefix)
+	if header.Len() > encryptionHeaderMaxSize {
+		return fmt.Errorf("header of '%s' is %d bytes, ID of KMS key and wrapped data key must fit in %d bytes", key, header.Len(), encryptionHeaderMaxSize)
+	}
+	return s.RemoteStorage.PutFile(ctx, key, &encryptingReader{
+		source: r,
+		aead:   aead,
+		prefix: prefix,
+		plain:  make([]byte, encryptionChunkSize),
+		out:    header.Bytes(),
+	})
+}
+
+// backupDataKey - data key of backup is generated by KMS once for all files of backup
+func (s *encryptedStorage) backupDataKey(ctx context.Context, backupName string) (*dataKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	if dk, ok := s.dataKeys[backupName]; ok {
+		return dk, nil
+	}
+	plain, keyID, wrapped, err := s.kms.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	dk := &dataKey{aead: aead, keyID: keyID, wrapped: wrapped}
+	s.dataKeys[backupName] = dk
+	s.unwrapped[keyID+"/"+string(wrapped)] = aead
+	return dk, nil
+}
+
+// headerAEAD - static key or data key unwrapped by KMS for file with header h
+func (s *encryptedStorage) headerAEAD(ctx context.Context, key string, h encryptionHeader) (cipher.AEAD, error) {
+	if h.WrappedKey == nil {
+		if s.aead == nil {
+			return nil, fmt.Errorf("'%s' is encrypted by static key, encryption.key isn't set", key)
+		}
+		return s.aead, nil
+	}
+	if s.kms == nil {
+		return nil, fmt.Errorf("'%s' is encrypted by data key of KMS key '%s', encryption.kms_key_id isn't set", key, h.KeyID)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if aead, ok := s.unwrapped[h.KeyID+"/"+string(h.WrappedKey)]; ok {
+		return aead, nil
+	}
+	plain, err := s.kms.Decrypt(ctx, h.KeyID, h.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt key of '%s' with %v", key, err)
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	s.unwrapped[h.KeyID+"/"+string(h.WrappedKey)] = aead
+	return aead, nil
+}
+
+func (s *encryptedStorage) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := s.RemoteStorage.GetFileReader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	h, err := readEncryptionHeader(reader, key)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	aead, err := s.headerAEAD(ctx, key, h)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return newDecryptingReader(reader, aead, h.Prefix, 0, 0), nil
+}
+
+// GetFileReaderWithOffset - header is read by separate small ranged request, then file is read from the chunk which contains offset
+func (s *encryptedStorage) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return s.GetFileReader(ctx, key)
+	}
+	reader, err := getFileRange(ctx, s.RemoteStorage, key, 0, encryptionHeaderMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	h, err := readEncryptionHeader(reader, key)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := s.headerAEAD(ctx, key, h)
+	if err != nil {
+		return nil, err
+	}
+	chunk := offset / encryptionChunkSize
+	sealedChunkSize := int64(encryptionChunkSize + aead.Overhead())
+	if reader, err = s.RemoteStorage.GetFileReaderWithOffset(ctx, key, h.Size+chunk*sealedChunkSize); err != nil {
+		return nil, err
+	}
+	return newDecryptingReader(reader, aead, h.Prefix, uint32(chunk), int(offset%encryptionChunkSize)), nil
+}
+
+func (s *encryptedBatchStorage) DeleteFiles(ctx context.Context, keys []string) error {
+	return s.RemoteStorage.(BatchDeleter).DeleteFiles(ctx, keys)
+}
+
+func writeHeaderField(w *bytes.Buffer, field []byte) {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(field)))
+	w.Write(length[:])
+	w.Write(field)
+}
+
+func readHeaderField(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	field := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// readEncryptionHeader - read header of encrypted file from r
+func readEncryptionHeader(r io.Reader, key string) (encryptionHeader, error) {
+	h := encryptionHeader{}
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return h, err
+	}
+	h.Size = int64(len(magic))
+	switch {
+	case bytes.Equal(magic, encryptionMagic):
+	case bytes.Equal(magic, envelopeEncryptionMagic):
+		keyID, err := readHeaderField(r)
+		if err != nil {
+			return h, fmt.Errorf("can't read header of '%s' with %v", key, err)
+		}
+		if h.WrappedKey, err = readHeaderField(r); err != nil {
+			return h, fmt.Errorf("can't read header of '%s' with %v", key, err)
+		}
+		h.KeyID = string(keyID)
+		h.Size += int64(4 + len(keyID) + len(h.WrappedKey))
+	default:
+		return h, fmt.Errorf("'%s' is not encrypted", key)
+	}
+	h.Prefix = make([]byte, encryptionPrefixSize)
+	if _, err := io.ReadFull(r, h.Prefix); err != nil {
+		return h, fmt.Errorf("can't read header of '%s' with %v", key, err)
+	}
+	h.Size += encryptionPrefixSize
+	return h, nil
+}
+
+// chunkNonce - nonce of chunk is random prefix of file and number of chunk
+func chunkNonce(prefix []byte, chunk uint32) []byte {
+	nonce := make([]byte, encryptionPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], chunk)
+	return nonce
+}
+
+// chunkAdditionalData - the last chunk is sealed with different additional data
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingReader - header and sealed chunks of source
+type encryptingReader struct {
+	source io.ReadCloser
+	aead   cipher.AEAD
+	prefix []byte
+	chunk  uint32
+	plain  []byte
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) sealNext() error {
+	n, err := io.ReadFull(r.source, r.plain)
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+	r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.prefix, r.chunk), r.plain[:n], chunkAdditionalData(last))
+	r.out = r.sealed
+	r.chunk++
+	r.done = last
+	return nil
+}
+
+func (r *encryptingReader) Close() error {
+	return r.source.Close()
+}
+
+// decryptingReader - plain bytes of sealed chunks of source, skip bytes of the first chunk are skipped
+type decryptingReader struct {
+	source io.ReadCloser
+	aead   cipher.AEAD
+	prefix []byte
+	chunk  uint32
+	skip   int
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func newDecryptingReader(source io.ReadCloser, aead cipher.AEAD, prefix []byte, chunk uint32, skip int) *decryptingReader {
+	return &decryptingReader{
+		source: source,
+		aead:   aead,
+		prefix: prefix,
+		chunk:  chunk,
+		skip:   skip,
+		sealed: make([]byte, encryptionChunkSize+aead.Overhead()),
+	}
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) openNext() error {
+	n, err := io.ReadFull(r.source, r.sealed)
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+	if last && n < r.aead.Overhead() {
+		return fmt.Errorf("encrypted file is truncated")
+	}
+	plain, err := r.aead.Open(r.sealed[:0], chunkNonce(r.prefix, r.chunk), r.sealed[:n], chunkAdditionalData(last))
+	if err != nil {
+		return fmt.Errorf("can't decrypt chunk %d with %v, encryption key is wrong or file is damaged", r.chunk, err)
+	}
+	if r.skip > len(plain) {
+		r.skip = len(plain)
+	}
+	r.out = plain[r.skip:]
+	r.skip = 0
+	r.chunk++
+	r.done = last
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.source.Close()
+}
+
+// loadEncryptionKey - static 256-bit key from encryption.key, file encryption.key_file or encryption.kms_encrypted_key decrypted by kms
+func loadEncryptionKey(config EncryptionConfig, kms kmsKeyProvider) ([]byte, error) {
+	var raw []byte
+	switch {
+	case config.KMSEncryptedKey != "":
+		blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(config.KMSEncryptedKey))
+		if err != nil {
+			return nil, fmt.Errorf("can't decode encryption.kms_encrypted_key with %v", err)
+		}
+		if raw, err = kms.Decrypt(context.Background(), config.KMSKeyID, blob); err != nil {
+			return nil, fmt.Errorf("can't decrypt encryption.kms_encrypted_key with %v", err)
+		}
+	case config.KeyFile != "":
+		data, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read encryption.key_file with %v", err)
+		}
+		if raw, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err != nil {
+			return nil, fmt.Errorf("can't decode encryption key with %v", err)
+		}
+	default:
+		var err error
+		if raw, err = base64.StdEncoding.DecodeString(strings.TrimSpace(config.Key)); err != nil {
+			return nil, fmt.Errorf("can't decode encryption key with %v", err)
+		}
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(raw))
+	}
+	return raw, nil
+}
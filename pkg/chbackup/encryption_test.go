@@ -0,0 +1,178 @@
+package chbackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := &FileStorage{Config: &FileConfig{Path: dir}}
+	key := bytes.Repeat([]byte{1}, 32)
+	storage, err := newEncryptedStorage(file, key, nil, "")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	for _, size := range []int{0, 10, encryptionChunkSize, 3*encryptionChunkSize + 100} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i % 251)
+		}
+		require.NoError(t, storage.PutFile(ctx, "data", ioutil.NopCloser(bytes.NewReader(plain))))
+		stored, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+		require.NoError(t, err)
+		assert.False(t, size > 0 && bytes.Contains(stored, plain))
+
+		reader, err := storage.GetFileReader(ctx, "data")
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, plain, content)
+		reader.Close()
+
+		for _, offset := range []int{1, encryptionChunkSize, encryptionChunkSize + 7} {
+			if offset > size {
+				continue
+			}
+			reader, err := storage.GetFileReaderWithOffset(ctx, "data", int64(offset))
+			require.NoError(t, err)
+			content, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, plain[offset:], content)
+			reader.Close()
+		}
+	}
+
+	// the last chunk is removed
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+	require.NoError(t, err)
+	truncated := stored[:len(encryptionMagic)+encryptionPrefixSize+encryptionChunkSize+16]
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data"), truncated, 0640))
+	reader, err := storage.GetFileReader(ctx, "data")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	reader.Close()
+
+	require.NoError(t, storage.PutFile(ctx, "data", ioutil.NopCloser(bytes.NewReader([]byte("secret")))))
+	wrongKey, err := newEncryptedStorage(file, bytes.Repeat([]byte{2}, 32), nil, "")
+	require.NoError(t, err)
+	reader, err = wrongKey.GetFileReader(ctx, "data")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	reader.Close()
+
+	require.NoError(t, file.PutFile(ctx, "plain", ioutil.NopCloser(bytes.NewReader([]byte("plain")))))
+	_, err = storage.GetFileReader(ctx, "plain")
+	assert.EqualError(t, err, "'plain' is not encrypted")
+}
+
+// fakeKMS - data key is wrapped as ID of key and plain key
+type fakeKMS struct {
+	keyID     string
+	generated int
+}
+
+func (k *fakeKMS) GenerateDataKey(ctx context.Context) ([]byte, string, []byte, error) {
+	k.generated++
+	plain := bytes.Repeat([]byte{byte(k.generated)}, 32)
+	return plain, k.keyID, append([]byte(k.keyID+":"), plain...), nil
+}
+
+func (k *fakeKMS) Decrypt(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if !bytes.HasPrefix(wrapped, []byte(keyID+":")) {
+		return nil, fmt.Errorf("wrong key '%s'", keyID)
+	}
+	return wrapped[len(keyID)+1:], nil
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := &FileStorage{Config: &FileConfig{Path: dir}}
+	kms := &fakeKMS{keyID: "key1"}
+	storage, err := newEncryptedStorage(file, nil, kms, "backups")
+	require.NoError(t, err)
+	ctx := context.Background()
+	for _, key := range []string{"backups/b1/metadata.tar", "backups/b1/shadow/default/t1.tar", "backups/b2.tar"} {
+		require.NoError(t, storage.PutFile(ctx, key, ioutil.NopCloser(bytes.NewReader([]byte(key)))))
+	}
+	assert.Equal(t, 2, kms.generated)
+
+	// files encrypted by data keys of the previous KMS key are decrypted after rotation
+	rotated, err := newEncryptedStorage(file, nil, &fakeKMS{keyID: "key2"}, "backups")
+	require.NoError(t, err)
+	for _, key := range []string{"backups/b1/shadow/default/t1.tar", "backups/b2.tar"} {
+		reader, err := rotated.GetFileReaderWithOffset(ctx, key, 8)
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, key[8:], string(content))
+		reader.Close()
+	}
+
+	static, err := newEncryptedStorage(file, bytes.Repeat([]byte{1}, 32), nil, "backups")
+	require.NoError(t, err)
+	_, err = static.GetFileReader(ctx, "backups/b2.tar")
+	assert.EqualError(t, err, "'backups/b2.tar' is encrypted by data key of KMS key 'key1', encryption.kms_key_id isn't set")
+}
+
+// rangeStorage - FileStorage which records ranges read by GetFileRange
+type rangeStorage struct {
+	*FileStorage
+	ranges [][2]int64
+}
+
+func (s *rangeStorage) GetFileRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	s.ranges = append(s.ranges, [2]int64{offset, length})
+	reader, err := s.FileStorage.GetFileReaderWithOffset(ctx, key, offset)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(reader, length), reader}, nil
+}
+
+func TestEncryptionHeaderRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := &rangeStorage{FileStorage: &FileStorage{Config: &FileConfig{Path: dir}}}
+	storage, err := newEncryptedStorage(file, nil, &fakeKMS{keyID: "key1"}, "backups")
+	require.NoError(t, err)
+	ctx := context.Background()
+	plain := bytes.Repeat([]byte("data"), encryptionChunkSize)
+	require.NoError(t, storage.PutFile(ctx, "backups/b1.tar", ioutil.NopCloser(bytes.NewReader(plain))))
+
+	// header is read by small ranged request before file is read from offset
+	reader, err := storage.GetFileReaderWithOffset(ctx, "backups/b1.tar", encryptionChunkSize+1)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, plain[encryptionChunkSize+1:], content)
+	reader.Close()
+	assert.Equal(t, [][2]int64{{0, encryptionHeaderMaxSize}}, file.ranges)
+
+	// header which doesn't fit in the range isn't written
+	long, err := newEncryptedStorage(file, nil, &fakeKMS{keyID: strings.Repeat("k", encryptionHeaderMaxSize)}, "backups")
+	require.NoError(t, err)
+	assert.Error(t, long.PutFile(ctx, "backups/b2.tar", ioutil.NopCloser(bytes.NewReader(plain))))
+	_, err = os.Stat(filepath.Join(dir, "backups/b2.tar"))
+	assert.True(t, os.IsNotExist(err))
+}
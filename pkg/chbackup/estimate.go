@@ -0,0 +1,72 @@
+package chbackup
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// remoteCompressionFormat - compression_format of general.remote_storage, 'tar' without remote storage
+func remoteCompressionFormat(config Config) string {
+	switch config.General.RemoteStorage {
+	case "s3":
+		return config.S3.CompressionFormat
+	case "gcs":
+		return config.GCS.CompressionFormat
+	case "cos":
+		return config.COS.CompressionFormat
+	case "file":
+		return config.File.CompressionFormat
+	case "plugin":
+		return config.Plugin.CompressionFormat
+	}
+	return "tar"
+}
+
+// Estimate - print size of active parts of tables matched by tablePattern from system.parts and estimated size
+// of their archives in compression_format of remote storage, nothing is frozen
+func Estimate(config Config, tablePattern string) error {
+	if err := validatePatterns("--tables", splitTablePattern(tablePattern)); err != nil {
+		return err
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with: %v", err)
+	}
+	defer ch.Close()
+	allTables, err := ch.GetTables()
+	if err != nil {
+		return fmt.Errorf("can't get Clickhouse tables with: %v", err)
+	}
+	tables := parseTablePatternForFreeze(allTables, tablePattern)
+	if len(tables) == 0 {
+		return fmt.Errorf("there are no tables in Clickhouse, create something to backup")
+	}
+	format := remoteCompressionFormat(config)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TABLE\tPARTS\tSIZE\tESTIMATED %s\n", format)
+	var totalParts int
+	var totalSize, totalEstimated uint64
+	for _, table := range tables {
+		if table.Skip {
+			continue
+		}
+		parts, err := ch.GetParts(table)
+		if err != nil {
+			return err
+		}
+		var size uint64
+		for _, part := range parts {
+			size += part.BytesOnDisk
+		}
+		estimated := estimateArchiveSize(format, size)
+		totalParts += len(parts)
+		totalSize += size
+		totalEstimated += estimated
+		fmt.Fprintf(w, "%s.%s\t%d\t%s\t%s\n", table.Database, table.Name, len(parts), FormatBytes(int64(size)), FormatBytes(int64(estimated)))
+	}
+	fmt.Fprintf(w, "total\t%d\t%s\t%s\n", totalParts, FormatBytes(int64(totalSize)), FormatBytes(int64(totalEstimated)))
+	return w.Flush()
+}
@@ -0,0 +1,81 @@
+package chbackup
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// eventsBufferSize - how many events may wait for slow subscriber before they are dropped
+	eventsBufferSize = 1000
+)
+
+// Event - progress of running create, upload, download or restore
+type Event struct {
+	Time      int64
+	Operation string
+	Backup    string
+	// Type - 'table' or 'file', 'start', 'finish'
+	Type     string
+	Table    string    `json:",omitempty"`
+	File     string    `json:",omitempty"`
+	Size     int64     `json:",omitempty"`
+	Progress *Progress `json:",omitempty"`
+	Error    string    `json:",omitempty"`
+}
+
+var eventSubscribers = struct {
+	channels map[chan Event]struct{}
+	sync.RWMutex
+}{channels: map[chan Event]struct{}{}}
+
+// SubscribeEvents - receive all progress events until unsubscribe is called
+func SubscribeEvents() (events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, eventsBufferSize)
+	eventSubscribers.Lock()
+	eventSubscribers.channels[ch] = struct{}{}
+	eventSubscribers.Unlock()
+	return ch, func() {
+		eventSubscribers.Lock()
+		delete(eventSubscribers.channels, ch)
+		eventSubscribers.Unlock()
+	}
+}
+
+// publishEvent - send event to all subscribers, it never blocks
+func publishEvent(e Event) {
+	eventSubscribers.RLock()
+	defer eventSubscribers.RUnlock()
+	if len(eventSubscribers.channels) == 0 {
+		return
+	}
+	e.Time = time.Now().Unix()
+	if progress, ok := GetProgress(e.Backup); ok && e.Progress == nil {
+		e.Progress = &progress
+	}
+	for ch := range eventSubscribers.channels {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func publishTableEvent(operation, backupName, database, table string) {
+	publishEvent(Event{
+		Operation: operation,
+		Backup:    backupName,
+		Type:      "table",
+		Table:     database + "." + table,
+	})
+}
+
+func publishFileEvent(operation, backupName, file string, size int64) {
+	publishEvent(Event{
+		Operation: operation,
+		Backup:    backupName,
+		Type:      "file",
+		File:      file,
+		Size:      size,
+	})
+}
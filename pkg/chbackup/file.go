@@ -0,0 +1,165 @@
+package chbackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStorage - presents methods for manipulate files in local directory, usually mounted NFS or SMB share
+type FileStorage struct {
+	Config *FileConfig
+}
+
+// Connect - check that root directory exists
+func (f *FileStorage) Connect() error {
+	return f.CheckBucket(context.Background())
+}
+
+func (f *FileStorage) Kind() string {
+	return "file"
+}
+
+// CheckBucket - check root directory exists and is a directory
+func (f *FileStorage) CheckBucket(ctx context.Context) error {
+	info, err := os.Stat(f.Config.Path)
+	if err != nil {
+		return fmt.Errorf("can't stat file.path with %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("file.path '%s' is not a directory", f.Config.Path)
+	}
+	return nil
+}
+
+// fullPath - keys are slash-separated paths relative to file.path
+func (f *FileStorage) fullPath(key string) string {
+	return filepath.Join(f.Config.Path, filepath.FromSlash(key))
+}
+
+// isTempFile - files being written by PutFile are not visible until they are renamed
+func isTempFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".tmp")
+}
+
+func (f *FileStorage) GetFile(ctx context.Context, key string) (RemoteFile, error) {
+	info, err := os.Stat(f.fullPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &localFile{name: key, info: info}, nil
+}
+
+// DeleteFile - remove file and parent directories which become empty, file.path itself is never removed
+func (f *FileStorage) DeleteFile(ctx context.Context, key string) error {
+	if err := os.Remove(f.fullPath(key)); err != nil {
+		return err
+	}
+	for dir := path.Dir(key); dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		if err := os.Remove(f.fullPath(dir)); err != nil {
+			// directory isn't empty
+			break
+		}
+	}
+	return nil
+}
+
+func (f *FileStorage) Walk(ctx context.Context, prefix string, process func(RemoteFile)) error {
+	root := f.fullPath(prefix)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || isTempFile(filePath) {
+			return nil
+		}
+		key, err := filepath.Rel(f.Config.Path, filePath)
+		if err != nil {
+			return err
+		}
+		process(&localFile{name: filepath.ToSlash(key), info: info})
+		return nil
+	})
+}
+
+func (f *FileStorage) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return f.GetFileReaderWithOffset(ctx, key, 0)
+}
+
+func (f *FileStorage) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(f.fullPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// PutFile - write file to temporary file and rename it, so partially written files are never listed
+func (f *FileStorage) PutFile(ctx context.Context, key string, r io.ReadCloser) error {
+	defer r.Close()
+	filePath := f.fullPath(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0750); err != nil {
+		return fmt.Errorf("can't create directory with %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("can't create temporary file with %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, newContextReader(ctx, r)); err != nil {
+		tmp.Close()
+		return err
+	}
+	// data must be on the share before rename, NFS client may cache writes
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+type localFile struct {
+	name string
+	info os.FileInfo
+}
+
+func (f *localFile) Size() int64 {
+	return f.info.Size()
+}
+
+func (f *localFile) Name() string {
+	return f.name
+}
+
+func (f *localFile) LastModified() time.Time {
+	return f.info.ModTime()
+}
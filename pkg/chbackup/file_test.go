@@ -0,0 +1,90 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f := &FileStorage{Config: &FileConfig{Path: dir}}
+	require.NoError(t, f.Connect())
+
+	require.NoError(t, f.PutFile(context.Background(), "backup1.tar.gz", ioutil.NopCloser(strings.NewReader("archive"))))
+	require.NoError(t, f.PutFile(context.Background(), "backup2/metadata/default/t1.sql", ioutil.NopCloser(strings.NewReader("CREATE TABLE"))))
+	// file which is still being written
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".backup3.tar.gz.123.tmp"), []byte("partial"), 0640))
+
+	names := []string{}
+	require.NoError(t, f.Walk(context.Background(), "", func(file RemoteFile) {
+		names = append(names, file.Name())
+	}))
+	assert.ElementsMatch(t, []string{"backup1.tar.gz", "backup2/metadata/default/t1.sql"}, names)
+
+	file, err := f.GetFile(context.Background(), "backup1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), file.Size())
+	_, err = f.GetFile(context.Background(), "missing.tar.gz")
+	assert.Equal(t, ErrNotFound, err)
+
+	reader, err := f.GetFileReader(context.Background(), "backup1.tar.gz")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "archive", string(data))
+
+	require.NoError(t, f.DeleteFile(context.Background(), "backup2/metadata/default/t1.sql"))
+	_, err = os.Stat(filepath.Join(dir, "backup2"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir)
+	assert.NoError(t, err)
+
+	assert.Error(t, (&FileStorage{Config: &FileConfig{Path: filepath.Join(dir, "missing")}}).Connect())
+}
+
+// batchFileStorage - FileStorage with DeleteFiles for testing of batch deletes
+type batchFileStorage struct {
+	*FileStorage
+	batches [][]string
+}
+
+func (f *batchFileStorage) DeleteFiles(ctx context.Context, keys []string) error {
+	f.batches = append(f.batches, keys)
+	for _, key := range keys {
+		if err := f.DeleteFile(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRemoveBackupBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storage := &batchFileStorage{FileStorage: &FileStorage{Config: &FileConfig{Path: dir}}}
+	for i := 0; i < deleteBatchSize+5; i++ {
+		require.NoError(t, storage.PutFile(context.Background(), filepath.Join("backup1/shadow/default/t1", strconv.Itoa(i)), ioutil.NopCloser(strings.NewReader("data"))))
+	}
+	require.NoError(t, storage.PutFile(context.Background(), "backup2.tar.gz", ioutil.NopCloser(strings.NewReader("archive"))))
+	bd := &BackupDestination{RemoteStorage: storage, disableProgressBar: true}
+	require.NoError(t, bd.RemoveBackup(context.Background(), "backup1"))
+	require.Len(t, storage.batches, 2)
+	assert.Len(t, storage.batches[0], deleteBatchSize)
+	assert.Len(t, storage.batches[1], 5)
+	backups, err := bd.BackupList(context.Background())
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "backup2.tar.gz", backups[0].Name)
+}
@@ -2,47 +2,134 @@ package chbackup
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"log"
+	"net/http"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iamcredentials/v1"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 // GCS - presents methods for manipulate data on GCS
 type GCS struct {
-	client *storage.Client
-	Config *GCSConfig
+	client       *storage.Client
+	timeout      time.Duration
+	retryBackoff time.Duration
+	Config       *GCSConfig
 }
 
 // Connect - connect to GCS
 func (gcs *GCS) Connect() error {
 	var err error
-	var clientOption option.ClientOption
+	var clientOptions []option.ClientOption
 
 	ctx := context.Background()
+	if gcs.timeout, err = time.ParseDuration(gcs.Config.Timeout); err != nil {
+		return err
+	}
+	if gcs.retryBackoff, err = time.ParseDuration(gcs.Config.RetryBackoff); err != nil {
+		return err
+	}
 
+	// without credentials Application Default Credentials are used, on GKE with Workload Identity
+	// they are credentials of Google service account bound to Kubernetes service account of pod
 	if gcs.Config.CredentialsJSON != "" {
-		clientOption = option.WithCredentialsJSON([]byte(gcs.Config.CredentialsJSON))
-		gcs.client, err = storage.NewClient(ctx, clientOption)
+		clientOptions = append(clientOptions, option.WithCredentialsJSON([]byte(gcs.Config.CredentialsJSON)))
 	} else if gcs.Config.CredentialsFile != "" {
-		clientOption = option.WithCredentialsFile(gcs.Config.CredentialsFile)
-		gcs.client, err = storage.NewClient(ctx, clientOption)
-	} else {
-		gcs.client, err = storage.NewClient(ctx)
+		clientOptions = append(clientOptions, option.WithCredentialsFile(gcs.Config.CredentialsFile))
 	}
-	return err
+	if gcs.Config.ImpersonateServiceAccount != "" {
+		iam, err := iamcredentials.NewService(ctx, append(clientOptions, option.WithScopes(iamcredentials.CloudPlatformScope))...)
+		if err != nil {
+			return fmt.Errorf("can't create IAM credentials client with %v", err)
+		}
+		source := &impersonatedTokenSource{
+			service: iam,
+			name:    "projects/-/serviceAccounts/" + gcs.Config.ImpersonateServiceAccount,
+		}
+		clientOptions = []option.ClientOption{option.WithTokenSource(oauth2.ReuseTokenSource(nil, source))}
+	}
+	if gcs.client, err = storage.NewClient(ctx, clientOptions...); err != nil {
+		return err
+	}
+	if gcs.Config.AutoCreateBucket {
+		return gcs.createBucket(ctx)
+	}
+	return nil
 }
 
-func (gcs *GCS) Walk(gcsPath string, process func(r RemoteFile)) error {
-	ctx := context.Background()
-	it := gcs.client.Bucket(gcs.Config.Bucket).Objects(ctx, nil)
+// createBucket - create gcs.bucket in gcs.project_id when it doesn't exist
+func (gcs *GCS) createBucket(ctx context.Context) error {
+	bucket := gcs.client.Bucket(gcs.Config.Bucket)
+	_, err := bucket.Attrs(ctx)
+	if err == nil {
+		return nil
+	}
+	if err != storage.ErrBucketNotExist {
+		return fmt.Errorf("can't check bucket '%s' with %v", gcs.Config.Bucket, err)
+	}
+	if err := bucket.Create(ctx, gcs.Config.ProjectID, &storage.BucketAttrs{StorageClass: gcs.Config.StorageClass}); err != nil {
+		// bucket is created by another host at the same time
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusConflict {
+			return nil
+		}
+		return fmt.Errorf("can't create bucket '%s' with %v", gcs.Config.Bucket, err)
+	}
+	log.Printf("Bucket '%s' is created", gcs.Config.Bucket)
+	return nil
+}
+
+// impersonatedTokenSource - short-lived access tokens of gcs.impersonate_service_account generated with source credentials,
+// source account needs roles/iam.serviceAccountTokenCreator on impersonated account
+type impersonatedTokenSource struct {
+	service *iamcredentials.Service
+	name    string
+}
+
+func (ts *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	resp, err := ts.service.Projects.ServiceAccounts.GenerateAccessToken(ts.name, &iamcredentials.GenerateAccessTokenRequest{
+		Scope:    []string{storage.ScopeFullControl},
+		Lifetime: "3600s",
+	}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("can't impersonate %s with %v", ts.name, err)
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse expire time of token with %v", err)
+	}
+	return &oauth2.Token{AccessToken: resp.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// Walk - list objects under gcsPath, empty path or '/' means whole bucket
+func (gcs *GCS) Walk(ctx context.Context, gcsPath string, process func(r RemoteFile)) error {
+	return gcs.list(ctx, gcsPath, false, func(object *storage.ObjectAttrs) {
+		process(&gcsFile{object})
+	})
+}
+
+// list - list objects with prefix, with delim objects in 'subdirectories' are returned as attrs with Prefix only
+func (gcs *GCS) list(ctx context.Context, gcsPath string, delim bool, process func(*storage.ObjectAttrs)) error {
+	query := &storage.Query{}
+	if gcsPath != "" && gcsPath != "/" {
+		query.Prefix = gcsPath
+	}
+	if delim {
+		query.Delimiter = "/"
+	}
+	it := gcs.client.Bucket(gcs.Config.Bucket).Objects(ctx, query)
 	for {
 		object, err := it.Next()
 		switch err {
 		case nil:
-			process(&gcsFile{object})
+			process(object)
 		case iterator.Done:
 			return nil
 		default:
@@ -55,14 +142,58 @@ func (gcs *GCS) Kind() string {
 	return "GCS"
 }
 
-func (gcs *GCS) GetFileReader(key string) (io.ReadCloser, error) {
-	ctx := context.Background()
+func (gcs *GCS) CheckBucket(ctx context.Context) error {
+	_, err := gcs.client.Bucket(gcs.Config.Bucket).Attrs(ctx)
+	return err
+}
+
+// retry - call op with gcs.timeout up to gcs.max_retries times while it fails with transient error
+func (gcs *GCS) retry(ctx context.Context, op func(ctx context.Context) error) error {
+	policy := retryPolicy{maxRetries: gcs.Config.MaxRetries, backoff: gcs.retryBackoff}
+	return policy.do(ctx, gcs.Kind(), "request", func() error {
+		opCtx, cancel := context.WithCancel(ctx)
+		if gcs.timeout > 0 {
+			opCtx, cancel = context.WithTimeout(ctx, gcs.timeout)
+		}
+		defer cancel()
+		return op(opCtx)
+	})
+}
+
+// GetFileReader - open object for reading, gcs.timeout isn't applied to transfers, download is cancelled by Close
+func (gcs *GCS) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return gcs.GetFileReaderWithOffset(ctx, key, 0)
+}
+
+// GetFileReaderWithOffset - read object from offset, used to resume interrupted download
+func (gcs *GCS) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	readerCtx, cancel := context.WithCancel(ctx)
 	obj := gcs.client.Bucket(gcs.Config.Bucket).Object(key)
-	reader, err := obj.NewReader(ctx)
+	var reader *storage.Reader
+	err := gcs.retry(ctx, func(context.Context) error {
+		var err error
+		reader, err = obj.NewRangeReader(readerCtx, offset, -1)
+		return err
+	})
 	if err != nil {
+		cancel()
+		if err == storage.ErrObjectNotExist {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
-	return reader, nil
+	return &gcsReader{Reader: reader, cancel: cancel}, nil
+}
+
+// gcsReader - cancel download when reader is closed
+type gcsReader struct {
+	*storage.Reader
+	cancel context.CancelFunc
+}
+
+func (r *gcsReader) Close() error {
+	defer r.cancel()
+	return r.Reader.Close()
 }
 
 func (gcs *GCS) GetFileWriter(key string) io.WriteCloser {
@@ -71,19 +202,32 @@ func (gcs *GCS) GetFileWriter(key string) io.WriteCloser {
 	return obj.NewWriter(ctx)
 }
 
-func (gcs *GCS) PutFile(key string, r io.ReadCloser) error {
-	ctx := context.Background()
+// PutFile - upload object by gcs.chunk_size chunks, each chunk is retried by client library
+func (gcs *GCS) PutFile(ctx context.Context, key string, r io.ReadCloser) error {
+	defer r.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	obj := gcs.client.Bucket(gcs.Config.Bucket).Object(key)
 	writer := obj.NewWriter(ctx)
+	writer.ChunkSize = gcs.Config.ChunkSize
+	writer.StorageClass = gcs.Config.StorageClass
+	writer.KMSKeyName = gcs.Config.KMSKeyName
 	if _, err := io.Copy(writer, r); err != nil {
+		// cancel before Close, otherwise partial content is committed as complete object
+		cancel()
+		writer.Close()
 		return err
 	}
 	return writer.Close()
 }
 
-func (gcs *GCS) GetFile(key string) (RemoteFile, error) {
-	ctx := context.Background()
-	objAttr, err := gcs.client.Bucket(gcs.Config.Bucket).Object(key).Attrs(ctx)
+func (gcs *GCS) GetFile(ctx context.Context, key string) (RemoteFile, error) {
+	var objAttr *storage.ObjectAttrs
+	err := gcs.retry(ctx, func(ctx context.Context) error {
+		var err error
+		objAttr, err = gcs.client.Bucket(gcs.Config.Bucket).Object(key).Attrs(ctx)
+		return err
+	})
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
 			return nil, ErrNotFound
@@ -93,10 +237,50 @@ func (gcs *GCS) GetFile(key string) (RemoteFile, error) {
 	return &gcsFile{objAttr}, nil
 }
 
-func (gcs *GCS) DeleteFile(key string) error {
-	ctx := context.Background()
+func (gcs *GCS) DeleteFile(ctx context.Context, key string) error {
 	object := gcs.client.Bucket(gcs.Config.Bucket).Object(key)
-	return object.Delete(ctx)
+	return gcs.retry(ctx, func(ctx context.Context) error {
+		return object.Delete(ctx)
+	})
+}
+
+// gcsDeleteConcurrency - GCS JSON API has no bulk delete, objects are deleted by parallel requests
+const gcsDeleteConcurrency = 16
+
+// DeleteFiles - delete objects by gcsDeleteConcurrency parallel requests, already deleted objects are skipped
+func (gcs *GCS) DeleteFiles(ctx context.Context, keys []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	bucket := gcs.client.Bucket(gcs.Config.Bucket)
+	jobs := make(chan string)
+	errs := make(chan error, len(keys))
+	var wg sync.WaitGroup
+	for i := 0; i < gcsDeleteConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				object := bucket.Object(key)
+				err := gcs.retry(ctx, func(opCtx context.Context) error {
+					return object.Delete(opCtx)
+				})
+				if err != nil && err != storage.ErrObjectNotExist {
+					errs <- fmt.Errorf("can't delete '%s' with %v", key, err)
+					cancel()
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	return <-errs
 }
 
 type gcsFile struct {
@@ -0,0 +1,83 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// fakeGCSServer - serve objects.list of JSON API for bucket 'test' with objects named by keys
+func fakeGCSServer(t *testing.T, keys []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/b/test/o") {
+			http.NotFound(w, r)
+			return
+		}
+		prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+		items := []map[string]string{}
+		prefixes := map[string]bool{}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				prefixes[key[:len(prefix)+i+1]] = true
+				continue
+			}
+			items = append(items, map[string]string{"name": key, "bucket": "test", "size": "7", "updated": "2020-07-01T00:00:00Z"})
+		}
+		resp := map[string]interface{}{"kind": "storage#objects", "items": items}
+		if len(prefixes) > 0 {
+			list := []string{}
+			for p := range prefixes {
+				list = append(list, p)
+			}
+			sort.Strings(list)
+			resp["prefixes"] = list
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+}
+
+func TestGCSWalk(t *testing.T) {
+	server := fakeGCSServer(t, []string{
+		"backups/backup1.tar.gz",
+		"backups/backup2/metadata/default/t1.sql",
+		"other/backup3.tar.gz",
+	})
+	defer server.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+	gcs := &GCS{client: client, Config: &GCSConfig{Bucket: "test", Path: "backups"}}
+
+	names := []string{}
+	require.NoError(t, gcs.Walk(context.Background(), "backups", func(f RemoteFile) {
+		names = append(names, f.Name())
+		assert.Equal(t, int64(7), f.Size())
+	}))
+	assert.Equal(t, []string{"backups/backup1.tar.gz", "backups/backup2/metadata/default/t1.sql"}, names)
+
+	names = []string{}
+	require.NoError(t, gcs.Walk(context.Background(), "", func(f RemoteFile) {
+		names = append(names, f.Name())
+	}))
+	assert.Len(t, names, 3)
+
+	prefixes := []string{}
+	require.NoError(t, gcs.list(context.Background(), "backups/", true, func(object *storage.ObjectAttrs) {
+		if object.Prefix != "" {
+			prefixes = append(prefixes, object.Prefix)
+		}
+	}))
+	assert.Equal(t, []string{"backups/backup2/"}, prefixes)
+}
@@ -0,0 +1,179 @@
+package chbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// partChecksumsFile - file of data part with checksums of all its files, parts with the same name and checksums are the same
+const partChecksumsFile = "checksums.txt"
+
+// linkUnchangedParts - replace files of data parts of backup which are unchanged since diffFromPath by hard links to files of diffFromPath,
+// so both backups share them on disk and 'upload --diff-from' uploads only changed parts. Return numbers of linked and all parts
+func linkUnchangedParts(backupPath, diffFromPath string) (int, int, error) {
+	shadowPath := filepath.Join(backupPath, "shadow")
+	linked, total := 0, 0
+	err := filepath.Walk(shadowPath, func(partPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(shadowPath, partPath)
+		if err != nil {
+			return err
+		}
+		// part is 'shadow/<database>/<table>/<part>'
+		if strings.Count(filepath.ToSlash(relativePath), "/") != 2 {
+			return nil
+		}
+		total++
+		diffFromPart := filepath.Join(diffFromPath, "shadow", relativePath)
+		same, err := samePart(partPath, diffFromPart)
+		if err != nil || !same {
+			return filepath.SkipDir
+		}
+		if err := linkPartFiles(partPath, diffFromPart); err != nil {
+			return fmt.Errorf("can't link part '%s' with %v", relativePath, err)
+		}
+		linked++
+		return filepath.SkipDir
+	})
+	return linked, total, err
+}
+
+// samePart - parts have the same checksums.txt, parts without it are never the same
+func samePart(partPath, diffFromPart string) (bool, error) {
+	checksums, err := ioutil.ReadFile(filepath.Join(partPath, partChecksumsFile))
+	if err != nil {
+		return false, err
+	}
+	diffFromChecksums, err := ioutil.ReadFile(filepath.Join(diffFromPart, partChecksumsFile))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(checksums, diffFromChecksums), nil
+}
+
+// linkPartFiles - replace files of part by hard links to files of the same part in diffFromPart, files are replaced atomically
+func linkPartFiles(partPath, diffFromPart string) error {
+	return filepath.Walk(partPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(partPath, filePath)
+		if err != nil {
+			return err
+		}
+		diffFromFile := filepath.Join(diffFromPart, relativePath)
+		diffFromInfo, err := os.Stat(diffFromFile)
+		if err != nil || os.SameFile(info, diffFromInfo) || diffFromInfo.Size() != info.Size() {
+			return nil
+		}
+		tmpPath := filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".link")
+		if err := os.Link(diffFromFile, tmpPath); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, filePath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		return nil
+	})
+}
+
+// partChecksumKeys - '<database>/<table>/<SHA256 of checksums.txt>' of parts of backup by their directories,
+// parts without checksums.txt aren't listed
+func partChecksumKeys(backupPath string) (map[string]string, error) {
+	shadowPath := filepath.Join(backupPath, "shadow")
+	partDirs, err := filepath.Glob(filepath.Join(shadowPath, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	for _, partDir := range partDirs {
+		content, err := ioutil.ReadFile(filepath.Join(partDir, partChecksumsFile))
+		if err != nil {
+			continue
+		}
+		relativePath, err := filepath.Rel(shadowPath, partDir)
+		if err != nil {
+			return nil, err
+		}
+		keys[partDir] = path.Join(path.Dir(filepath.ToSlash(relativePath)), partChecksumsHash(content))
+	}
+	return keys, nil
+}
+
+// dedupParts - replace files of data parts of backup by hard links to files of parts of the same table in previousPath
+// with the same checksums.txt, so parts are found even when their names are changed, e.g. by mutation which didn't change them.
+// Backup doesn't require previousPath, hard linked files stay on disk while any of backups has them. Return numbers of linked and all parts
+func dedupParts(backupPath, previousPath string) (int, int, error) {
+	previousKeys, err := partChecksumKeys(previousPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	previous := map[string]string{}
+	for partDir, key := range previousKeys {
+		previous[key] = partDir
+	}
+	current, err := partChecksumKeys(backupPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	linked := 0
+	for partDir, key := range current {
+		previousPart, ok := previous[key]
+		if !ok {
+			continue
+		}
+		if err := linkPartFiles(partDir, previousPart); err != nil {
+			return linked, len(current), fmt.Errorf("can't link part '%s' with %v", partDir, err)
+		}
+		linked++
+	}
+	return linked, len(current), nil
+}
+
+// dedupPreviousBackup - hard link parts of new backup to the same parts of the newest other local backup,
+// failed deduplication only leaves more files on disk, so it is logged as warning
+func dedupPreviousBackup(config Config, backupName, backupPath string) {
+	previousPath, err := previousLocalBackup(config, backupName)
+	if err != nil {
+		log.Printf("Warning: can't find previous local backup with %v", err)
+		return
+	}
+	if previousPath == "" {
+		return
+	}
+	linked, total, err := dedupParts(backupPath, previousPath)
+	if err != nil {
+		log.Printf("Warning: can't deduplicate parts with '%s', only %d of %d parts are hard linked: %v", filepath.Base(previousPath), linked, total, err)
+		return
+	}
+	log.Printf("%d of %d parts are hard linked to the same parts of '%s'", linked, total, filepath.Base(previousPath))
+}
+
+// previousLocalBackup - path of the newest local backup except backupName, empty when there are no other backups
+func previousLocalBackup(config Config, backupName string) (string, error) {
+	backups, err := ListLocalBackups(config)
+	if err != nil {
+		return "", err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].Name != backupName {
+			return filepath.Join(getDataPath(config), "backup", backups[i].Name), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,107 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePart(t *testing.T, partPath, checksums, data string) {
+	require.NoError(t, os.MkdirAll(partPath, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, partChecksumsFile), []byte(checksums), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "data.bin"), []byte(data), 0644))
+}
+
+func TestLinkUnchangedParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incremental")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	diffFromPath := filepath.Join(dir, "base")
+	backupPath := filepath.Join(dir, "incremental")
+	writePart(t, filepath.Join(diffFromPath, "shadow", "default", "t", "all_1_1_0"), "a", "one")
+	writePart(t, filepath.Join(diffFromPath, "shadow", "default", "t", "all_2_2_0"), "b", "two")
+	writePart(t, filepath.Join(backupPath, "shadow", "default", "t", "all_1_1_0"), "a", "one")
+	writePart(t, filepath.Join(backupPath, "shadow", "default", "t", "all_2_2_0"), "c", "TWO")
+	writePart(t, filepath.Join(backupPath, "shadow", "default", "t", "all_3_3_0"), "d", "three")
+
+	linked, total, err := linkUnchangedParts(backupPath, diffFromPath)
+	require.NoError(t, err)
+	assert.Equal(t, 1, linked)
+	assert.Equal(t, 3, total)
+
+	sameFile := func(part string) bool {
+		info, err := os.Stat(filepath.Join(backupPath, "shadow", "default", "t", part, "data.bin"))
+		require.NoError(t, err)
+		diffFromInfo, err := os.Stat(filepath.Join(diffFromPath, "shadow", "default", "t", part, "data.bin"))
+		require.NoError(t, err)
+		return os.SameFile(info, diffFromInfo)
+	}
+	assert.True(t, sameFile("all_1_1_0"))
+	assert.False(t, sameFile("all_2_2_0"))
+	content, err := ioutil.ReadFile(filepath.Join(backupPath, "shadow", "default", "t", "all_2_2_0", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "TWO", string(content))
+
+	linked, _, err = linkUnchangedParts(backupPath, diffFromPath)
+	require.NoError(t, err)
+	assert.Equal(t, 1, linked)
+}
+
+func TestDedupParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	previousPath := filepath.Join(dir, "previous")
+	backupPath := filepath.Join(dir, "backup")
+	writePart(t, filepath.Join(previousPath, "shadow", "default", "t", "all_1_1_0"), "a", "one")
+	writePart(t, filepath.Join(previousPath, "shadow", "default", "t", "all_2_2_0"), "b", "two")
+	writePart(t, filepath.Join(previousPath, "shadow", "default", "other", "all_3_3_0"), "c", "three")
+	// part renamed by mutation which didn't change it
+	writePart(t, filepath.Join(backupPath, "shadow", "default", "t", "all_1_1_0_4"), "a", "one")
+	writePart(t, filepath.Join(backupPath, "shadow", "default", "t", "all_2_2_0"), "B", "TWO")
+	// the same checksums in other table
+	writePart(t, filepath.Join(backupPath, "shadow", "default", "t", "all_3_3_0"), "c", "three")
+
+	linked, total, err := dedupParts(backupPath, previousPath)
+	require.NoError(t, err)
+	assert.Equal(t, 1, linked)
+	assert.Equal(t, 3, total)
+
+	sameFile := func(part, previousPart string) bool {
+		info, err := os.Stat(filepath.Join(backupPath, "shadow", "default", "t", part, "data.bin"))
+		require.NoError(t, err)
+		previousInfo, err := os.Stat(filepath.Join(previousPath, "shadow", "default", previousPart, "data.bin"))
+		require.NoError(t, err)
+		return os.SameFile(info, previousInfo)
+	}
+	assert.True(t, sameFile("all_1_1_0_4", "t/all_1_1_0"))
+	assert.False(t, sameFile("all_2_2_0", "t/all_2_2_0"))
+	assert.False(t, sameFile("all_3_3_0", "other/all_3_3_0"))
+}
+
+func TestLinkUnchangedPartsWithProjection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incremental")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	diffFromPart := filepath.Join(dir, "base", "shadow", "default", "t", "all_1_1_0")
+	part := filepath.Join(dir, "incremental", "shadow", "default", "t", "all_1_1_0")
+	writePart(t, diffFromPart, "a", "one")
+	writePart(t, filepath.Join(diffFromPart, "daily.proj"), "p", "projection")
+	writePart(t, part, "a", "one")
+	writePart(t, filepath.Join(part, "daily.proj"), "p", "projection")
+
+	// projection isn't counted as part, its files are linked with files of its part
+	linked, total, err := linkUnchangedParts(filepath.Join(dir, "incremental"), filepath.Join(dir, "base"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, linked)
+	assert.Equal(t, 1, total)
+	info, err := os.Stat(filepath.Join(part, "daily.proj", "data.bin"))
+	require.NoError(t, err)
+	diffFromInfo, err := os.Stat(filepath.Join(diffFromPart, "daily.proj", "data.bin"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(info, diffFromInfo))
+}
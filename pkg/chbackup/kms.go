@@ -0,0 +1,112 @@
+package chbackup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// kmsKeyProvider - 256-bit data keys wrapped by key of cloud KMS, keyID of wrapped key is kept with it,
+// so data keys can be unwrapped after encryption.kms_key_id is changed
+type kmsKeyProvider interface {
+	GenerateDataKey(ctx context.Context) (plain []byte, keyID string, wrapped []byte, err error)
+	Decrypt(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+func newKMSKeyProvider(config EncryptionConfig) (kmsKeyProvider, error) {
+	switch config.KMSProvider {
+	case "aws":
+		awsConfig := aws.NewConfig()
+		if config.KMSRegion != "" {
+			awsConfig = awsConfig.WithRegion(config.KMSRegion)
+		}
+		sess, err := session.NewSessionWithOptions(session.Options{Config: *awsConfig, SharedConfigState: session.SharedConfigEnable})
+		if err != nil {
+			return nil, err
+		}
+		return &awsKMS{client: kms.New(sess), keyID: config.KMSKeyID}, nil
+	case "gcp":
+		service, err := cloudkms.NewService(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("can't create Cloud KMS client with %v", err)
+		}
+		return &gcpKMS{service: service, keyName: config.KMSKeyID}, nil
+	}
+	return nil, fmt.Errorf("encryption.kms_provider '%s' not supported", config.KMSProvider)
+}
+
+// awsKMS - data keys generated by AWS KMS, keyID is ARN of key
+type awsKMS struct {
+	client *kms.KMS
+	keyID  string
+}
+
+func (k *awsKMS) GenerateDataKey(ctx context.Context) ([]byte, string, []byte, error) {
+	output, err := k.client.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("can't generate data key with %v", err)
+	}
+	return output.Plaintext, aws.StringValue(output.KeyId), output.CiphertextBlob, nil
+}
+
+// Decrypt - wrapped key contains reference to the key, keyID is checked when it is set
+func (k *awsKMS) Decrypt(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	input := &kms.DecryptInput{CiphertextBlob: wrapped}
+	if keyID != "" {
+		input.KeyId = aws.String(keyID)
+	}
+	output, err := k.client.DecryptWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt data key with %v", err)
+	}
+	return output.Plaintext, nil
+}
+
+// gcpKMS - data keys generated locally and encrypted by Cloud KMS, keyID is name of crypto key
+// 'projects/P/locations/L/keyRings/R/cryptoKeys/K', Cloud KMS finds version of key used for encryption itself
+type gcpKMS struct {
+	service *cloudkms.Service
+	keyName string
+}
+
+func (k *gcpKMS) GenerateDataKey(ctx context.Context) ([]byte, string, []byte, error) {
+	plain := make([]byte, 32)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, "", nil, fmt.Errorf("can't generate data key with %v", err)
+	}
+	request := &cloudkms.EncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(plain)}
+	response, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Encrypt(k.keyName, request).Context(ctx).Do()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("can't encrypt data key with %v", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(response.Ciphertext)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("can't decode encrypted data key with %v", err)
+	}
+	return plain, k.keyName, wrapped, nil
+}
+
+func (k *gcpKMS) Decrypt(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID == "" {
+		keyID = k.keyName
+	}
+	request := &cloudkms.DecryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(wrapped)}
+	response, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyID, request).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt data key with %v", err)
+	}
+	plain, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode data key with %v", err)
+	}
+	return plain, nil
+}
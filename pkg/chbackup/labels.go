@@ -0,0 +1,124 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Labels are 'key=value' pairs set by 'create --label', they are saved to manifest.json of backup,
+// so local and remote backups are listed and removed by them
+
+var labelKeyRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// ParseLabels - labels from 'key=value' arguments of --label, nil when there are no arguments
+func ParseLabels(args []string) (map[string]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || !labelKeyRe.MatchString(kv[0]) {
+			return nil, fmt.Errorf("can't parse label '%s', 'key=value' is expected, key can contain letters, digits, '_', '.' and '-'", arg)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// matchLabels - backup has all labels with the same values
+func matchLabels(backupLabels, labels map[string]string) bool {
+	for key, value := range labels {
+		if v, ok := backupLabels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// formatLabels - labels sorted by key as 'key=value' pairs separated by comma
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// labelArgs - values of repeated --label of actions
+type labelArgs []string
+
+func (a *labelArgs) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *labelArgs) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// withManifests - remote backups with details from manifest.json uploaded next to them, backups whose manifest
+// is in state 'uploading' or 'partial' aren't complete and are skipped, so they aren't listed and aren't counted by retention.
+// Backups uploaded by older versions have no state and are kept
+func (bd *BackupDestination) withManifests(ctx context.Context, backups []Backup) ([]Backup, error) {
+	result := make([]Backup, 0, len(backups))
+	for _, backup := range backups {
+		manifest, err := bd.readRemoteManifest(ctx, backupNameOfKey("", backup.Name))
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil && (manifest.State == manifestUploading || manifest.State == manifestPartial) {
+			continue
+		}
+		backup.setManifest(manifest)
+		result = append(result, backup)
+	}
+	return result, nil
+}
+
+// RemoveBackupsByLabels - remove local or remote backups which have all labels, force works the same as for RemoveBackupRemote
+func RemoveBackupsByLabels(ctx context.Context, config Config, location string, labels map[string]string, force bool) error {
+	if len(labels) == 0 {
+		return fmt.Errorf("labels are required")
+	}
+	var backups []Backup
+	var err error
+	switch location {
+	case "local":
+		backups, err = ListLocalBackups(config)
+	case "remote":
+		backups, err = getRemoteBackups(ctx, config)
+	default:
+		return fmt.Errorf("backup location must be 'local' or 'remote'")
+	}
+	if err != nil {
+		return err
+	}
+	backups = FilterBackups(backups, BackupFilter{Labels: labels})
+	if len(backups) == 0 {
+		log.Printf("No %s backups with labels %s", location, formatLabels(labels))
+		return nil
+	}
+	for _, backup := range backups {
+		log.Printf("Remove %s backup '%s' with labels %s", location, backup.Name, formatLabels(backup.Labels))
+		if location == "local" {
+			err = RemoveBackupLocal(config, backup.Name)
+		} else {
+			err = RemoveBackupRemote(ctx, config, backup.Name, force)
+		}
+		if errors.Is(err, ErrBackupNotFound) {
+			// backup is already removed by force together with backup it requires
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
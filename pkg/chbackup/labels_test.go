@@ -0,0 +1,34 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	labels, err := ParseLabels([]string{"ticket=INC-1234", "reason=pre-migration", "empty="})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"ticket": "INC-1234", "reason": "pre-migration", "empty": ""}, labels)
+	assert.Equal(t, "empty=,reason=pre-migration,ticket=INC-1234", formatLabels(labels))
+
+	labels, err = ParseLabels(nil)
+	require.NoError(t, err)
+	assert.Nil(t, labels)
+	for _, arg := range []string{"ticket", "=value", "bad key=value"} {
+		_, err = ParseLabels([]string{arg})
+		assert.Error(t, err, arg)
+	}
+
+	backups := []Backup{
+		{Name: "before_migration", Labels: map[string]string{"ticket": "INC-1234", "reason": "pre-migration"}},
+		{Name: "daily", Labels: map[string]string{"reason": "daily"}},
+		{Name: "old"},
+	}
+	assert.Equal(t, backups[:1], FilterBackups(backups, BackupFilter{Labels: map[string]string{"reason": "pre-migration"}}))
+	assert.Empty(t, FilterBackups(backups, BackupFilter{Labels: map[string]string{"reason": "pre-migration", "ticket": "INC-1"}}))
+	assert.Equal(t, backups, FilterBackups(backups, BackupFilter{}))
+	assert.Equal(t, "\t2 tables, ClickHouse 21.8.4.51, labels reason=daily",
+		backupDetails(Backup{Tables: 2, ClickHouseVersion: "21.8.4.51", Labels: map[string]string{"reason": "daily"}}))
+}
@@ -0,0 +1,84 @@
+package chbackup
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var pathMacroRe = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// remotePathOf - path setting of selected remote storage
+func remotePathOf(config *Config) *string {
+	switch config.General.RemoteStorage {
+	case "s3":
+		return &config.S3.Path
+	case "gcs":
+		return &config.GCS.Path
+	case "cos":
+		return &config.COS.Path
+	case "file":
+		return &config.File.Path
+	case "plugin":
+		return &config.Plugin.Path
+	}
+	return nil
+}
+
+// applyMacros - replace {name} in s with value of macro, unknown macros are error
+func applyMacros(s string, macros map[string]string) (string, error) {
+	var unknown []string
+	result := pathMacroRe.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[1 : len(m)-1]
+		value, ok := macros[name]
+		if !ok {
+			unknown = append(unknown, m)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown macros %v in '%s'", unknown, s)
+	}
+	return result, nil
+}
+
+// resolvePathMacros - replace macros like {shard} and {replica} in path of remote storage with ClickHouse macros from system.macros,
+// {hostname} is hostname of server when it isn't defined in ClickHouse. ClickHouse is queried only when path contains other macros
+func resolvePathMacros(config *Config) error {
+	remotePath := remotePathOf(config)
+	if remotePath == nil {
+		return nil
+	}
+	matches := pathMacroRe.FindAllStringSubmatch(*remotePath, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	macros := map[string]string{}
+	if hostname, err := os.Hostname(); err == nil {
+		macros["hostname"] = hostname
+	}
+	needClickHouse := false
+	for _, match := range matches {
+		needClickHouse = needClickHouse || match[1] != "hostname"
+	}
+	if needClickHouse {
+		ch := &ClickHouse{Config: &config.ClickHouse}
+		if err := ch.Connect(); err != nil {
+			return fmt.Errorf("can't connect to clickhouse to resolve macros with %v", err)
+		}
+		defer ch.Close()
+		chMacros, err := ch.GetMacros()
+		if err != nil {
+			return err
+		}
+		for name, value := range chMacros {
+			macros[name] = value
+		}
+	}
+	resolved, err := applyMacros(*remotePath, macros)
+	if err != nil {
+		return fmt.Errorf("can't resolve %s.path with %v", config.General.RemoteStorage, err)
+	}
+	*remotePath = resolved
+	return nil
+}
@@ -0,0 +1,28 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyMacros(t *testing.T) {
+	macros := map[string]string{"shard": "01", "replica": "replica-1", "hostname": "host"}
+	p, err := applyMacros("backups/{shard}/{replica}", macros)
+	require.NoError(t, err)
+	assert.Equal(t, "backups/01/replica-1", p)
+	p, err = applyMacros("backups", macros)
+	require.NoError(t, err)
+	assert.Equal(t, "backups", p)
+	_, err = applyMacros("backups/{cluster}/{shard}", macros)
+	assert.EqualError(t, err, "unknown macros [{cluster}] in 'backups/{cluster}/{shard}'")
+}
+
+func TestResolvePathMacrosHostname(t *testing.T) {
+	config := DefaultConfig()
+	config.General.RemoteStorage = "s3"
+	config.S3.Path = "backups/{hostname}"
+	require.NoError(t, resolvePathMacros(config))
+	assert.NotContains(t, config.S3.Path, "{hostname}")
+}
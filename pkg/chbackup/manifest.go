@@ -0,0 +1,353 @@
+package chbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manifest is saved to backup on create, it's uploaded next to backup, so it can be read without downloading archives.
+// It describes environment where backup was created, engines of tables and checksums of data parts,
+// verify compares parts of backup with it, list shows its details and retention keeps backups required by kept ones
+
+// ManifestFileName - file of backup with manifest
+const ManifestFileName = "manifest.json"
+
+// manifestVersion - version of manifest format, meta.json of remote backup is the first version
+const manifestVersion = 2
+
+// manifestUploading, manifestCompleted, manifestPartial - State of manifest.json of remote backup, upload puts manifest with 'uploading'
+// before files of backup and with 'completed' after all of them, upload with --tables which skipped some tables puts 'partial' instead.
+// Manifests uploaded by older versions have no state
+const (
+	manifestUploading = "uploading"
+	manifestCompleted = "completed"
+	manifestPartial   = "partial"
+)
+
+// Version - version of clickhouse-backup saved to manifest, it is set by main
+var Version = "unknown"
+
+var engineRe = regexp.MustCompile(`ENGINE = (\w+)`)
+
+// Manifest - description of backup
+type Manifest struct {
+	Version           int       `json:"version"`
+	Name              string    `json:"name"`
+	CreationDate      time.Time `json:"creation_date"`
+	BackupVersion     string    `json:"clickhouse_backup_version"`
+	ClickHouseVersion string    `json:"clickhouse_version"`
+	Host              string    `json:"host"`
+	Shard             string    `json:"shard,omitempty"`
+	// RequiredBackup - backup created with --diff-from has unchanged parts of it
+	RequiredBackup string `json:"required_backup,omitempty"`
+	// CompressionFormat - format of archives of the last upload, empty until backup is uploaded
+	CompressionFormat string `json:"compression_format,omitempty"`
+	// Labels - 'key=value' pairs of 'create --label'
+	Labels map[string]string `json:"labels,omitempty"`
+	// State - state of upload of remote backup, empty in local backup
+	State  string          `json:"state,omitempty"`
+	Tables []ManifestTable `json:"tables"`
+}
+
+// ManifestTable - table of backup, tables without data like views don't have parts
+type ManifestTable struct {
+	Database string         `json:"database"`
+	Name     string         `json:"name"`
+	Engine   string         `json:"engine"`
+	Parts    []ManifestPart `json:"parts,omitempty"`
+}
+
+// ManifestPart - data part of table, Checksum is SHA256 of checksums.txt of part which has checksums of all files of part
+type ManifestPart struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Disk     string `json:"disk,omitempty"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// tableEngine - engine of table by its create query
+func tableEngine(query string) string {
+	switch {
+	case strings.HasPrefix(query, "CREATE MATERIALIZED VIEW"):
+		return "MaterializedView"
+	case strings.HasPrefix(query, "CREATE LIVE VIEW"):
+		return "LiveView"
+	case strings.HasPrefix(query, "CREATE VIEW"):
+		return "View"
+	case strings.HasPrefix(query, "CREATE DICTIONARY"):
+		return "Dictionary"
+	}
+	if match := engineRe.FindStringSubmatch(query); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// buildManifest - tables of backup with engines from metadata and parts from shadow, disk of each part is taken from partDisks
+func buildManifest(backupPath string, partDisks map[string]string) (*Manifest, error) {
+	manifest := &Manifest{Version: manifestVersion, Name: filepath.Base(backupPath)}
+	tables := map[string]*ManifestTable{}
+	getTable := func(database, name string) *ManifestTable {
+		key := fmt.Sprintf("%s.%s", database, name)
+		if _, ok := tables[key]; !ok {
+			tables[key] = &ManifestTable{Database: database, Name: name}
+		}
+		return tables[key]
+	}
+	schemas, err := parseSchemaPattern(path.Join(backupPath, "metadata"), "")
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range schemas {
+		getTable(schema.Database, schema.Table).Engine = tableEngine(schema.Query)
+	}
+	shadowPath := path.Join(backupPath, "shadow")
+	partDirs, err := filepath.Glob(path.Join(shadowPath, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, partDir := range partDirs {
+		if info, err := os.Stat(partDir); err != nil || !info.IsDir() {
+			continue
+		}
+		relativePath := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(partDir, shadowPath)), "/")
+		p := strings.Split(relativePath, "/")
+		database, _ := url.PathUnescape(p[0])
+		name, _ := url.PathUnescape(p[1])
+		part, err := manifestPart(partDir)
+		if err != nil {
+			return nil, fmt.Errorf("can't read part '%s' with %v", relativePath, err)
+		}
+		part.Name = p[2]
+		part.Path = path.Join("shadow", relativePath)
+		part.Disk = partDisks[relativePath]
+		table := getTable(database, name)
+		table.Parts = append(table.Parts, part)
+	}
+	for _, table := range tables {
+		sort.Slice(table.Parts, func(i, j int) bool { return table.Parts[i].Name < table.Parts[j].Name })
+		manifest.Tables = append(manifest.Tables, *table)
+	}
+	sort.Slice(manifest.Tables, func(i, j int) bool {
+		if manifest.Tables[i].Database != manifest.Tables[j].Database {
+			return manifest.Tables[i].Database < manifest.Tables[j].Database
+		}
+		return manifest.Tables[i].Name < manifest.Tables[j].Name
+	})
+	return manifest, nil
+}
+
+// manifestPart - size of files of part and SHA256 of its checksums.txt, checksum is empty for part without checksums.txt
+func manifestPart(partDir string) (ManifestPart, error) {
+	var part ManifestPart
+	err := filepath.Walk(partDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		part.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return part, err
+	}
+	content, err := ioutil.ReadFile(path.Join(partDir, partChecksumsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return part, nil
+		}
+		return part, err
+	}
+	part.Checksum = partChecksumsHash(content)
+	return part, nil
+}
+
+// partChecksumsHash - SHA256 of content of checksums.txt of part
+func partChecksumsHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// writeManifest - build manifest of created backup and save it to backup, version of ClickHouse and shard are queried from ClickHouse
+func writeManifest(config Config, backupPath, diffFromPath string, partDisks, labels map[string]string) error {
+	manifest, err := buildManifest(backupPath, partDisks)
+	if err != nil {
+		return err
+	}
+	manifest.Labels = labels
+	manifest.CreationDate = time.Now().UTC()
+	manifest.BackupVersion = Version
+	if diffFromPath != "" {
+		manifest.RequiredBackup = filepath.Base(diffFromPath)
+	}
+	if manifest.Host, err = os.Hostname(); err != nil {
+		return fmt.Errorf("can't get hostname with %v", err)
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse with %v", err)
+	}
+	defer ch.Close()
+	if manifest.ClickHouseVersion, err = ch.GetVersionString(); err != nil {
+		return err
+	}
+	macros, err := ch.GetMacros()
+	if err != nil {
+		return err
+	}
+	manifest.Shard = macros["shard"]
+	return saveManifest(backupPath, manifest)
+}
+
+func saveManifest(backupPath string, manifest *Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(backupPath, ManifestFileName), content, 0640)
+}
+
+// readManifest - manifest of local backup, nil for backups created before manifest was introduced
+func readManifest(backupPath string) (*Manifest, error) {
+	content, err := ioutil.ReadFile(filepath.Join(backupPath, ManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseManifest(content)
+}
+
+func parseManifest(content []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("can't parse %s with %v", ManifestFileName, err)
+	}
+	return manifest, nil
+}
+
+// backupDetails - details of backup from manifest for list, empty for backups without manifest
+func backupDetails(backup Backup) string {
+	if backup.ClickHouseVersion == "" {
+		return ""
+	}
+	details := fmt.Sprintf("\t%d tables, ClickHouse %s", backup.Tables, backup.ClickHouseVersion)
+	if backup.RequiredBackup != "" {
+		details += fmt.Sprintf(", requires '%s'", backup.RequiredBackup)
+	}
+	if len(backup.Labels) > 0 {
+		details += fmt.Sprintf(", labels %s", formatLabels(backup.Labels))
+	}
+	return details
+}
+
+// setManifestCompression - save compression format of upload to manifest of local backup before its files are uploaded
+func setManifestCompression(backupPath, compressionFormat string) error {
+	manifest, err := readManifest(backupPath)
+	if err != nil || manifest == nil {
+		return err
+	}
+	if manifest.CompressionFormat == compressionFormat {
+		return nil
+	}
+	manifest.CompressionFormat = compressionFormat
+	return saveManifest(backupPath, manifest)
+}
+
+// putManifest - upload manifest.json of local backup with state next to uploaded backup, so it can be read without downloading archives,
+// tables which aren't uploaded are removed from it and completed backup without tables skipped by --tables is partial
+func (bd *BackupDestination) putManifest(ctx context.Context, localPath, remotePath, state string) error {
+	manifest, err := readManifest(localPath)
+	if err != nil || manifest == nil {
+		return err
+	}
+	uploaded := manifest.filter(bd.skipTables)
+	if state == manifestCompleted && len(uploaded.Tables) < len(manifest.filter(bd.skipTables.withoutTablePattern()).Tables) {
+		state = manifestPartial
+	}
+	uploaded.State = state
+	content, err := json.MarshalIndent(uploaded, "", "\t")
+	if err != nil {
+		return err
+	}
+	key := path.Join(bd.path, remotePath, ManifestFileName)
+	return bd.PutFile(ctx, key, ioutil.NopCloser(bytes.NewReader(content)))
+}
+
+// readRemoteManifest - manifest.json uploaded next to backup, nil for backups uploaded before manifest was introduced
+func (bd *BackupDestination) readRemoteManifest(ctx context.Context, remotePath string) (*Manifest, error) {
+	key := path.Join(bd.path, remotePath, ManifestFileName)
+	reader, err := bd.GetFileReader(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read '%s' with %v", key, err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't read '%s' with %v", key, err)
+	}
+	return parseManifest(content)
+}
+
+// downloadManifest - save manifest.json uploaded next to backup to downloaded backup, tables which aren't downloaded are removed from it
+func (bd *BackupDestination) downloadManifest(ctx context.Context, remotePath, localPath string) error {
+	manifest, err := bd.readRemoteManifest(ctx, remotePath)
+	if err != nil || manifest == nil {
+		return err
+	}
+	return saveManifest(localPath, manifest.filter(bd.skipTables))
+}
+
+// filter - manifest without tables skipped by filter
+func (m *Manifest) filter(f tableFilter) *Manifest {
+	result := *m
+	result.Tables = []ManifestTable{}
+	for _, table := range m.Tables {
+		if !f.skip(table.Database, table.Name) {
+			result.Tables = append(result.Tables, table)
+		}
+	}
+	return &result
+}
+
+// verifyManifest - check that parts of manifest are in backup and SHA256 of their checksums.txt match manifest,
+// checksums.txt hard linked to required backup isn't read and isn't compared
+func verifyManifest(manifest *Manifest, files *verifyFiles, parts map[string]bool) []string {
+	problems := []string{}
+	if manifest == nil {
+		return problems
+	}
+	for _, table := range manifest.Tables {
+		for _, part := range table.Parts {
+			if !parts[part.Path] {
+				problems = append(problems, fmt.Sprintf("part '%s' of %s isn't in backup", part.Path, ManifestFileName))
+				continue
+			}
+			content, ok := files.partChecksums[part.Path]
+			if ok && part.Checksum != "" && partChecksumsHash(content) != part.Checksum {
+				problems = append(problems, fmt.Sprintf("%s of part '%s' doesn't match %s", partChecksumsFile, part.Path, ManifestFileName))
+			}
+		}
+	}
+	return problems
+}
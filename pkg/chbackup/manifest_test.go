@@ -0,0 +1,103 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	backupPath, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPath)
+	writeFile := func(name, content string) {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(backupPath, name)), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(path.Join(backupPath, name), []byte(content), 0640))
+	}
+	writeFile("metadata/default/events.sql", "ATTACH TABLE _ (id UInt64) ENGINE = MergeTree ORDER BY id")
+	writeFile("metadata/default/events_view.sql", "ATTACH VIEW _ AS SELECT id FROM default.events")
+	writeFile("shadow/default/events/all_1_1_0/checksums.txt", "checksums")
+	writeFile("shadow/default/events/all_1_1_0/data.bin", "data")
+
+	manifest, err := buildManifest(backupPath, map[string]string{"default/events/all_1_1_0": "hdd"})
+	require.NoError(t, err)
+	assert.Equal(t, manifestVersion, manifest.Version)
+	assert.Equal(t, []ManifestTable{
+		{Database: "default", Name: "events", Engine: "MergeTree", Parts: []ManifestPart{{
+			Name:     "all_1_1_0",
+			Path:     "shadow/default/events/all_1_1_0",
+			Disk:     "hdd",
+			Size:     13,
+			Checksum: partChecksumsHash([]byte("checksums")),
+		}}},
+		{Database: "default", Name: "events_view", Engine: "View"},
+	}, manifest.Tables)
+
+	require.NoError(t, saveManifest(backupPath, manifest))
+	require.NoError(t, setManifestCompression(backupPath, "zstd"))
+	saved, err := readManifest(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, "zstd", saved.CompressionFormat)
+	assert.Equal(t, manifest.Tables, saved.Tables)
+
+	files := newVerifyFiles()
+	files.add("metadata/default/events.sql", 10, nil)
+	assert.Equal(t, []string{"part 'shadow/default/events/all_1_1_0' of manifest.json isn't in backup"}, verifyManifest(saved, files, map[string]bool{}))
+	files.add("shadow/default/events/all_1_1_0/checksums.txt", 9, []byte("changed"))
+	assert.Equal(t, []string{"checksums.txt of part 'shadow/default/events/all_1_1_0' doesn't match manifest.json"},
+		verifyManifest(saved, files, map[string]bool{"shadow/default/events/all_1_1_0": true}))
+	assert.Empty(t, verifyManifest(saved.filter(tableFilter{tables: []string{"default.events"}}), files, map[string]bool{}))
+}
+
+func TestRemoteManifestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	localPath := path.Join(dir, "backup", "backup1")
+	require.NoError(t, os.MkdirAll(localPath, os.ModePerm))
+	require.NoError(t, saveManifest(localPath, &Manifest{Version: manifestVersion, Name: "backup1", Tables: []ManifestTable{
+		{Database: "default", Name: "t1"},
+		{Database: "default", Name: "t2"},
+	}}))
+	bd := &BackupDestination{
+		RemoteStorage: &FileStorage{Config: &FileConfig{Path: path.Join(dir, "remote")}},
+		path:          "backups",
+	}
+	ctx := context.Background()
+	backups := []Backup{{Name: "backup1"}, {Name: "old"}}
+	require.NoError(t, bd.putManifest(ctx, localPath, "backup1", manifestUploading))
+	listed, err := bd.withManifests(ctx, append([]Backup{}, backups...))
+	require.NoError(t, err)
+	assert.Equal(t, []Backup{{Name: "old"}}, listed)
+
+	require.NoError(t, bd.putManifest(ctx, localPath, "backup1", manifestCompleted))
+	listed, err = bd.withManifests(ctx, append([]Backup{}, backups...))
+	require.NoError(t, err)
+	assert.Len(t, listed, 2)
+	// state is saved only to remote manifest
+	manifest, err := readManifest(localPath)
+	require.NoError(t, err)
+	assert.Empty(t, manifest.State)
+
+	// backup uploaded with --tables which skipped some tables isn't listed
+	bd.skipTables = tableFilter{}.withTablePattern("default.t1")
+	require.NoError(t, bd.putManifest(ctx, localPath, "backup1", manifestCompleted))
+	manifest, err = bd.readRemoteManifest(ctx, "backup1")
+	require.NoError(t, err)
+	assert.Equal(t, manifestPartial, manifest.State)
+	assert.Len(t, manifest.Tables, 1)
+	listed, err = bd.withManifests(ctx, append([]Backup{}, backups...))
+	require.NoError(t, err)
+	assert.Equal(t, []Backup{{Name: "old"}}, listed)
+
+	bd.skipTables = tableFilter{}.withTablePattern("default.*")
+	require.NoError(t, bd.putManifest(ctx, localPath, "backup1", manifestCompleted))
+	listed, err = bd.withManifests(ctx, append([]Backup{}, backups...))
+	require.NoError(t, err)
+	assert.Len(t, listed, 2)
+}
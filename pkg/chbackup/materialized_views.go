@@ -0,0 +1,74 @@
+package chbackup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// innerTablePrefix - prefix of name of table which keeps data of materialized view created without TO,
+// the table is created by CREATE MATERIALIZED VIEW, so only its data is restored
+const innerTablePrefix = ".inner."
+
+// innerIDTablePrefix - prefix of inner table of materialized view of Atomic database, it is followed by UUID of view
+const innerIDTablePrefix = ".inner_id."
+
+func isInnerTable(name string) bool {
+	return strings.HasPrefix(name, innerTablePrefix) || strings.HasPrefix(name, innerIDTablePrefix)
+}
+
+// withInnerTablePatterns - add pattern of inner table for each pattern of table, so materialized view
+// and its data are matched together, e.g. 'db.mv' matches 'db..inner.mv' too
+func withInnerTablePatterns(patterns []string) []string {
+	result := append([]string{}, patterns...)
+	for _, pattern := range patterns {
+		if isRegexPattern(pattern) {
+			parts := strings.SplitN(pattern, `\.`, 2)
+			if len(parts) != 2 || strings.HasPrefix(parts[1], regexp.QuoteMeta(innerTablePrefix)) || strings.HasPrefix(parts[1], regexp.QuoteMeta(innerIDTablePrefix)) {
+				continue
+			}
+			result = append(result, parts[0]+`\.`+regexp.QuoteMeta(innerTablePrefix)+parts[1])
+			continue
+		}
+		parts := strings.SplitN(pattern, ".", 2)
+		if len(parts) != 2 || isInnerTable(parts[1]) {
+			continue
+		}
+		result = append(result, parts[0]+"."+innerTablePrefix+parts[1])
+	}
+	return result
+}
+
+// sortViews - views ordered so that views are created after views which they refer to by 'db.name',
+// order of independent views is kept
+func sortViews(views RestoreTables) RestoreTables {
+	refersTo := func(view, other RestoreTable) bool {
+		query := view.Query
+		if i := strings.Index(query, " AS SELECT"); i != -1 {
+			query = query[i:]
+		}
+		return strings.Contains(query, fmt.Sprintf("%s.%s", other.Database, other.Table)) ||
+			strings.Contains(query, fmt.Sprintf("`%s`.`%s`", other.Database, other.Table))
+	}
+	result := RestoreTables{}
+	added := map[int]bool{}
+	visiting := map[int]bool{}
+	var visit func(i int)
+	visit = func(i int) {
+		if added[i] || visiting[i] {
+			return
+		}
+		visiting[i] = true
+		for j := range views {
+			if j != i && refersTo(views[i], views[j]) {
+				visit(j)
+			}
+		}
+		added[i] = true
+		result = append(result, views[i])
+	}
+	for i := range views {
+		visit(i)
+	}
+	return result
+}
@@ -0,0 +1,28 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaterializedViews(t *testing.T) {
+	assert.Equal(t, []string{"default.mv", "db.*", "default..inner.mv", "db..inner.*"}, withInnerTablePatterns([]string{"default.mv", "db.*"}))
+	assert.Equal(t, []string{"default..inner.mv"}, withInnerTablePatterns([]string{"default..inner.mv"}))
+	assert.Equal(t, []string{`^db\.mv_.*$`, `^db\.\.inner\.mv_.*$`}, withInnerTablePatterns([]string{`^db\.mv_.*$`}))
+
+	views := sortViews(RestoreTables{
+		{Database: "default", Table: "a_view", Query: "CREATE VIEW a_view AS SELECT * FROM default.mv"},
+		{Database: "default", Table: "mv", Query: "CREATE MATERIALIZED VIEW mv ENGINE = MergeTree() ORDER BY id AS SELECT * FROM default.events"},
+		{Database: "default", Table: "z_view", Query: "CREATE VIEW z_view AS SELECT * FROM default.events"},
+	})
+	names := []string{}
+	for _, view := range views {
+		names = append(names, view.Table)
+	}
+	assert.Equal(t, []string{"mv", "a_view", "z_view"}, names)
+
+	mapping, err := parseRestoreMapping("", "mv:mv_restored")
+	assert.NoError(t, err)
+	assert.Equal(t, ".inner.mv_restored", mapping.table(".inner.mv"))
+}
@@ -0,0 +1,38 @@
+package chbackup
+
+import (
+	"strings"
+)
+
+// parsePartitions - partition IDs from comma separated list, empty list means all partitions
+func parsePartitions(partitions string) []string {
+	result := []string{}
+	for _, id := range strings.Split(partitions, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// partitionIDOfPart - partition ID of data part '<partition_id>_<min_block>_<max_block>_<level>[_<mutation>]',
+// partition ID is 'all' for table without partition key
+func partitionIDOfPart(part string) string {
+	return strings.SplitN(part, "_", 2)[0]
+}
+
+// filterPartitions - table with parts which belong to one of partitions
+func filterPartitions(table BackupTable, partitions []string) BackupTable {
+	ids := map[string]bool{}
+	for _, id := range partitions {
+		ids[id] = true
+	}
+	parts := []BackupPartition{}
+	for _, part := range table.Partitions {
+		if ids[partitionIDOfPart(part.Name)] {
+			parts = append(parts, part)
+		}
+	}
+	table.Partitions = parts
+	return table
+}
@@ -0,0 +1,26 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterPartitions(t *testing.T) {
+	assert.Equal(t, []string{"202401", "202402"}, parsePartitions(" 202401, 202402,,"))
+	assert.Equal(t, []string{}, parsePartitions(""))
+	table := BackupTable{
+		Database: "default",
+		Name:     "events",
+		Partitions: []BackupPartition{
+			{Name: "202312_1_10_2"},
+			{Name: "202401_11_11_0"},
+			{Name: "202401_12_20_1_25"},
+			{Name: "202402_21_21_0"},
+		},
+	}
+	filtered := filterPartitions(table, []string{"202401"})
+	assert.Equal(t, []BackupPartition{{Name: "202401_11_11_0"}, {Name: "202401_12_20_1_25"}}, filtered.Partitions)
+	assert.Len(t, table.Partitions, 4)
+	assert.Empty(t, filterPartitions(table, []string{"2024"}).Partitions)
+}
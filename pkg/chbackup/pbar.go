@@ -1,37 +1,96 @@
 package chbackup
 
 import (
+	"context"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	progressbar "gopkg.in/cheggaaa/pb.v1"
 )
 
 type Bar struct {
-	pb   *progressbar.ProgressBar
-	show bool
+	pb          *progressbar.ProgressBar
+	show        bool
+	current     int64
+	total       int64
+	resumedFrom int64
+}
+
+// Progress - snapshot of Bar state, ResumedFrom is bytes downloaded before the resumed download was interrupted
+type Progress struct {
+	Current     int64
+	Total       int64
+	ResumedFrom int64 `json:",omitempty"`
+}
+
+var progressRegistry = struct {
+	bars map[string]*Bar
+	sync.RWMutex
+}{bars: map[string]*Bar{}}
+
+type jobIDKey struct{}
+
+// withJobID - attach ID of API job to context, progress of the job is tracked by this ID too
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, id)
+}
+
+// trackProgress - make bar state available by name and by job ID of ctx until untrackProgress is called
+func trackProgress(ctx context.Context, name string, bar *Bar) {
+	progressRegistry.Lock()
+	defer progressRegistry.Unlock()
+	progressRegistry.bars[name] = bar
+	if id, ok := ctx.Value(jobIDKey{}).(string); ok {
+		progressRegistry.bars[id] = bar
+	}
+}
+
+func untrackProgress(ctx context.Context, name string) {
+	progressRegistry.Lock()
+	defer progressRegistry.Unlock()
+	delete(progressRegistry.bars, name)
+	if id, ok := ctx.Value(jobIDKey{}).(string); ok {
+		delete(progressRegistry.bars, id)
+	}
+}
+
+// GetProgress - return progress of running upload or download by backup name, remote path or API job ID
+func GetProgress(name string) (Progress, bool) {
+	progressRegistry.RLock()
+	defer progressRegistry.RUnlock()
+	bar, ok := progressRegistry.bars[name]
+	if !ok {
+		return Progress{}, false
+	}
+	return bar.Progress(), true
 }
 
 func StartNewByteBar(show bool, total int64) *Bar {
 	if show {
 		return &Bar{
-			show: true,
-			pb:   progressbar.StartNew(int(total)).SetUnits(progressbar.U_BYTES),
+			show:  true,
+			pb:    progressbar.StartNew(int(total)).SetUnits(progressbar.U_BYTES),
+			total: total,
 		}
 	}
 	return &Bar{
-		show: false,
+		show:  false,
+		total: total,
 	}
 }
 
 func StartNewBar(show bool, total int) *Bar {
 	if show {
 		return &Bar{
-			show: true,
-			pb:   progressbar.StartNew(total),
+			show:  true,
+			pb:    progressbar.StartNew(total),
+			total: int64(total),
 		}
 	}
 	return &Bar{
-		show: false,
+		show:  false,
+		total: int64(total),
 	}
 }
 
@@ -42,26 +101,54 @@ func (b *Bar) Finish() {
 }
 
 func (b *Bar) Add64(add int64) {
+	atomic.AddInt64(&b.current, add)
 	if b.show {
 		b.pb.Add64(add)
 	}
 }
 
 func (b *Bar) Set(current int) {
+	atomic.StoreInt64(&b.current, int64(current))
 	if b.show {
 		b.pb.Set(current)
 	}
 }
 
+// Resume - start from bytes transferred by the previous attempt
+func (b *Bar) Resume(offset int64) {
+	atomic.StoreInt64(&b.resumedFrom, offset)
+	b.Add64(offset)
+}
+
 func (b *Bar) Increment() {
+	atomic.AddInt64(&b.current, 1)
 	if b.show {
 		b.pb.Increment()
 	}
 }
 
+func (b *Bar) Progress() Progress {
+	return Progress{
+		Current:     atomic.LoadInt64(&b.current),
+		Total:       b.total,
+		ResumedFrom: atomic.LoadInt64(&b.resumedFrom),
+	}
+}
+
 func (b *Bar) NewProxyReader(r io.Reader) io.Reader {
 	if b.show {
-		return b.pb.NewProxyReader(r)
+		r = b.pb.NewProxyReader(r)
 	}
-	return r
+	return &progressReader{r, b}
+}
+
+type progressReader struct {
+	io.Reader
+	bar *Bar
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.bar.current, int64(n))
+	return n, err
 }
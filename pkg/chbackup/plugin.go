@@ -0,0 +1,279 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// Plugin protocol is gRPC service 'chbackup.plugin.RemoteStorage' over unix socket, messages are encoded as JSON,
+// so plugins don't need generated code. Go plugins can use ServePlugin with own RemoteStorage implementation.
+const (
+	pluginServiceName = "chbackup.plugin.RemoteStorage"
+	// pluginChunkSize - size of data in each PluginChunk message
+	pluginChunkSize = 1024 * 1024
+)
+
+// PluginConnectRequest - options from plugin.options config section
+type PluginConnectRequest struct {
+	Options map[string]string `json:"options"`
+}
+
+// PluginKeyRequest - key of file or prefix for Walk
+type PluginKeyRequest struct {
+	Key string `json:"key"`
+	// Offset - first byte of GetFileReader stream
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// PluginKindResponse - name of storage shown in logs
+type PluginKindResponse struct {
+	Kind string `json:"kind"`
+}
+
+// PluginFileInfo - file on remote storage
+type PluginFileInfo struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// PluginChunk - part of file content, the first message of PutFile contains only Key
+type PluginChunk struct {
+	Key  string `json:"key,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// PluginEmpty - empty request or response
+type PluginEmpty struct{}
+
+// jsonCodec - gRPC codec for plugin messages, selected by 'application/grpc+json' content type
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// Plugin - presents methods for manipulate data on external storage served by plugin over gRPC
+type Plugin struct {
+	conn   *grpc.ClientConn
+	Config *PluginConfig
+}
+
+// Connect - connect to plugin socket and pass plugin.options to plugin
+func (p *Plugin) Connect() error {
+	if p.conn == nil {
+		conn, err := grpc.Dial(p.Config.Socket,
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+			}),
+			grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())),
+		)
+		if err != nil {
+			return fmt.Errorf("can't connect to plugin with %v", err)
+		}
+		p.conn = conn
+	}
+	ctx, cancel := p.timeoutContext(context.Background())
+	defer cancel()
+	return pluginError(p.conn.Invoke(ctx, pluginMethod("Connect"), &PluginConnectRequest{Options: p.Config.Options}, &PluginEmpty{}))
+}
+
+func (p *Plugin) timeoutContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout, err := time.ParseDuration(p.Config.Timeout)
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func pluginMethod(name string) string {
+	return fmt.Sprintf("/%s/%s", pluginServiceName, name)
+}
+
+// pluginError - convert NotFound status returned by plugin to ErrNotFound
+func pluginError(err error) error {
+	if err != nil && status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (p *Plugin) Kind() string {
+	ctx, cancel := p.timeoutContext(context.Background())
+	defer cancel()
+	var resp PluginKindResponse
+	if err := p.conn.Invoke(ctx, pluginMethod("Kind"), &PluginEmpty{}, &resp); err != nil || resp.Kind == "" {
+		return "plugin"
+	}
+	return resp.Kind
+}
+
+func (p *Plugin) CheckBucket(ctx context.Context) error {
+	return pluginError(p.conn.Invoke(ctx, pluginMethod("CheckBucket"), &PluginEmpty{}, &PluginEmpty{}))
+}
+
+func (p *Plugin) GetFile(ctx context.Context, key string) (RemoteFile, error) {
+	ctx, cancel := p.timeoutContext(ctx)
+	defer cancel()
+	var info PluginFileInfo
+	if err := p.conn.Invoke(ctx, pluginMethod("GetFile"), &PluginKeyRequest{Key: key}, &info); err != nil {
+		return nil, pluginError(err)
+	}
+	return &pluginFile{info}, nil
+}
+
+func (p *Plugin) DeleteFile(ctx context.Context, key string) error {
+	ctx, cancel := p.timeoutContext(ctx)
+	defer cancel()
+	return pluginError(p.conn.Invoke(ctx, pluginMethod("DeleteFile"), &PluginKeyRequest{Key: key}, &PluginEmpty{}))
+}
+
+// openStream - start server-streaming call with single request
+func (p *Plugin) openStream(ctx context.Context, method string, req interface{}) (grpc.ClientStream, error) {
+	stream, err := p.conn.NewStream(ctx, &grpc.StreamDesc{StreamName: method, ServerStreams: true}, pluginMethod(method))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	return stream, stream.CloseSend()
+}
+
+func (p *Plugin) Walk(ctx context.Context, prefix string, process func(RemoteFile)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := p.openStream(ctx, "Walk", &PluginKeyRequest{Key: prefix})
+	if err != nil {
+		return pluginError(err)
+	}
+	for {
+		var info PluginFileInfo
+		err := stream.RecvMsg(&info)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return pluginError(err)
+		}
+		process(&pluginFile{info})
+	}
+}
+
+func (p *Plugin) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return p.GetFileReaderWithOffset(ctx, key, 0)
+}
+
+func (p *Plugin) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := p.openStream(ctx, "GetFileReader", &PluginKeyRequest{Key: key, Offset: offset})
+	if err != nil {
+		cancel()
+		return nil, pluginError(err)
+	}
+	// status of call is received with first chunk, so missing file is returned as ErrNotFound here and not on first Read
+	var chunk PluginChunk
+	if err := stream.RecvMsg(&chunk); err != nil && err != io.EOF {
+		cancel()
+		return nil, pluginError(err)
+	}
+	return &pluginReader{stream: stream, cancel: cancel, buf: chunk.Data}, nil
+}
+
+func (p *Plugin) PutFile(ctx context.Context, key string, r io.ReadCloser) error {
+	defer r.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := p.conn.NewStream(ctx, &grpc.StreamDesc{StreamName: "PutFile", ClientStreams: true}, pluginMethod("PutFile"))
+	if err != nil {
+		return pluginError(err)
+	}
+	if err := stream.SendMsg(&PluginChunk{Key: key}); err != nil {
+		return pluginError(err)
+	}
+	buf := make([]byte, pluginChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.SendMsg(&PluginChunk{Data: buf[:n]}); err != nil {
+				return pluginError(err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return pluginError(err)
+	}
+	return pluginError(stream.RecvMsg(&PluginEmpty{}))
+}
+
+// pluginReader - read file content from GetFileReader stream
+type pluginReader struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *pluginReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		var chunk PluginChunk
+		if err := r.stream.RecvMsg(&chunk); err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, pluginError(err)
+		}
+		r.buf = chunk.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *pluginReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+type pluginFile struct {
+	info PluginFileInfo
+}
+
+func (f *pluginFile) Size() int64 {
+	return f.info.Size
+}
+
+func (f *pluginFile) Name() string {
+	return f.info.Name
+}
+
+func (f *pluginFile) LastModified() time.Time {
+	return f.info.LastModified
+}
@@ -0,0 +1,259 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PluginFactory - create storage with options from plugin.options config section
+type PluginFactory func(options map[string]string) (RemoteStorage, error)
+
+// pluginHandler - HandlerType of plugin service
+type pluginHandler interface {
+	getStorage() (RemoteStorage, error)
+}
+
+// pluginServer - serve RemoteStorage created on Connect call
+type pluginServer struct {
+	factory PluginFactory
+	storage RemoteStorage
+	sync.RWMutex
+}
+
+// ServePlugin - serve storage created by factory as plugin on unix socket, stale socket file is removed
+func ServePlugin(socketPath string, factory PluginFactory) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove socket with %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("can't listen socket with %v", err)
+	}
+	return servePlugin(listener, factory)
+}
+
+func servePlugin(listener net.Listener, factory PluginFactory) error {
+	server := grpc.NewServer()
+	server.RegisterService(&pluginServiceDesc, &pluginServer{factory: factory})
+	return server.Serve(listener)
+}
+
+func (s *pluginServer) getStorage() (RemoteStorage, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.storage == nil {
+		return nil, status.Error(codes.FailedPrecondition, "Connect must be called first")
+	}
+	return s.storage, nil
+}
+
+// pluginStatus - convert error of storage to gRPC status
+func pluginStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// pluginUnary - unary method handler which decodes request created by newRequest and calls call
+func pluginUnary(method string, newRequest func() interface{}, call func(s *pluginServer, ctx context.Context, req interface{}) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			resp, err := call(srv.(*pluginServer), ctx, req)
+			return resp, pluginStatus(err)
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: pluginMethod(method)}, handler)
+	}
+}
+
+var pluginServiceDesc = grpc.ServiceDesc{
+	ServiceName: pluginServiceName,
+	HandlerType: (*pluginHandler)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Connect",
+			Handler: pluginUnary("Connect", func() interface{} { return &PluginConnectRequest{} },
+				func(s *pluginServer, ctx context.Context, req interface{}) (interface{}, error) {
+					storage, err := s.factory(req.(*PluginConnectRequest).Options)
+					if err != nil {
+						return nil, err
+					}
+					if err := storage.Connect(); err != nil {
+						return nil, err
+					}
+					s.Lock()
+					s.storage = storage
+					s.Unlock()
+					return &PluginEmpty{}, nil
+				}),
+		},
+		{
+			MethodName: "Kind",
+			Handler: pluginUnary("Kind", func() interface{} { return &PluginEmpty{} },
+				func(s *pluginServer, ctx context.Context, req interface{}) (interface{}, error) {
+					storage, err := s.getStorage()
+					if err != nil {
+						return nil, err
+					}
+					return &PluginKindResponse{Kind: storage.Kind()}, nil
+				}),
+		},
+		{
+			MethodName: "CheckBucket",
+			Handler: pluginUnary("CheckBucket", func() interface{} { return &PluginEmpty{} },
+				func(s *pluginServer, ctx context.Context, req interface{}) (interface{}, error) {
+					storage, err := s.getStorage()
+					if err != nil {
+						return nil, err
+					}
+					return &PluginEmpty{}, storage.CheckBucket(ctx)
+				}),
+		},
+		{
+			MethodName: "GetFile",
+			Handler: pluginUnary("GetFile", func() interface{} { return &PluginKeyRequest{} },
+				func(s *pluginServer, ctx context.Context, req interface{}) (interface{}, error) {
+					storage, err := s.getStorage()
+					if err != nil {
+						return nil, err
+					}
+					file, err := storage.GetFile(ctx, req.(*PluginKeyRequest).Key)
+					if err != nil {
+						return nil, err
+					}
+					return &PluginFileInfo{Name: file.Name(), Size: file.Size(), LastModified: file.LastModified()}, nil
+				}),
+		},
+		{
+			MethodName: "DeleteFile",
+			Handler: pluginUnary("DeleteFile", func() interface{} { return &PluginKeyRequest{} },
+				func(s *pluginServer, ctx context.Context, req interface{}) (interface{}, error) {
+					storage, err := s.getStorage()
+					if err != nil {
+						return nil, err
+					}
+					return &PluginEmpty{}, storage.DeleteFile(ctx, req.(*PluginKeyRequest).Key)
+				}),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Walk",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				storage, err := srv.(*pluginServer).getStorage()
+				if err != nil {
+					return err
+				}
+				var req PluginKeyRequest
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+				var sendErr error
+				err = storage.Walk(stream.Context(), req.Key, func(file RemoteFile) {
+					if sendErr == nil {
+						sendErr = stream.SendMsg(&PluginFileInfo{Name: file.Name(), Size: file.Size(), LastModified: file.LastModified()})
+					}
+				})
+				if sendErr != nil {
+					return sendErr
+				}
+				return pluginStatus(err)
+			},
+		},
+		{
+			StreamName:    "GetFileReader",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				storage, err := srv.(*pluginServer).getStorage()
+				if err != nil {
+					return err
+				}
+				var req PluginKeyRequest
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+				reader, err := storage.GetFileReaderWithOffset(stream.Context(), req.Key, req.Offset)
+				if err != nil {
+					return pluginStatus(err)
+				}
+				defer reader.Close()
+				buf := make([]byte, pluginChunkSize)
+				for {
+					n, err := io.ReadFull(reader, buf)
+					if n > 0 {
+						if err := stream.SendMsg(&PluginChunk{Data: buf[:n]}); err != nil {
+							return err
+						}
+					}
+					if err == io.EOF || err == io.ErrUnexpectedEOF {
+						return nil
+					}
+					if err != nil {
+						return pluginStatus(err)
+					}
+				}
+			},
+		},
+		{
+			StreamName:    "PutFile",
+			ClientStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				storage, err := srv.(*pluginServer).getStorage()
+				if err != nil {
+					return err
+				}
+				var header PluginChunk
+				if err := stream.RecvMsg(&header); err != nil {
+					return err
+				}
+				reader, writer := io.Pipe()
+				go func() {
+					for {
+						var chunk PluginChunk
+						err := stream.RecvMsg(&chunk)
+						if err == io.EOF {
+							writer.Close()
+							return
+						}
+						if err != nil {
+							writer.CloseWithError(err)
+							return
+						}
+						if _, err := writer.Write(chunk.Data); err != nil {
+							return
+						}
+					}
+				}()
+				if err := storage.PutFile(stream.Context(), header.Key, reader); err != nil {
+					reader.CloseWithError(err)
+					return pluginStatus(err)
+				}
+				return stream.SendMsg(&PluginEmpty{})
+			},
+		},
+	},
+	Metadata: "plugin.go",
+}
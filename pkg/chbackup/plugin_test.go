@@ -0,0 +1,70 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storageDir := filepath.Join(dir, "storage")
+	require.NoError(t, os.Mkdir(storageDir, 0750))
+	socket := filepath.Join(dir, "plugin.sock")
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	go servePlugin(listener, func(options map[string]string) (RemoteStorage, error) {
+		return &FileStorage{Config: &FileConfig{Path: options["path"]}}, nil
+	})
+
+	p := &Plugin{Config: &PluginConfig{Socket: socket, Timeout: "10s", Options: map[string]string{"path": storageDir}}}
+	require.NoError(t, p.Connect())
+	assert.Equal(t, "file", p.Kind())
+
+	content := strings.Repeat("0123456789", pluginChunkSize/5)
+	require.NoError(t, p.PutFile(context.Background(), "backup1.tar.gz", ioutil.NopCloser(strings.NewReader(content))))
+	file, err := p.GetFile(context.Background(), "backup1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), file.Size())
+	_, err = p.GetFile(context.Background(), "missing.tar.gz")
+	assert.Equal(t, ErrNotFound, err)
+
+	names := []string{}
+	require.NoError(t, p.Walk(context.Background(), "", func(file RemoteFile) {
+		names = append(names, file.Name())
+	}))
+	assert.Equal(t, []string{"backup1.tar.gz"}, names)
+
+	reader, err := p.GetFileReader(context.Background(), "backup1.tar.gz")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	_, err = p.GetFileReader(context.Background(), "missing.tar.gz")
+	assert.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, p.PutFile(context.Background(), "empty.tar.gz", ioutil.NopCloser(strings.NewReader(""))))
+	reader, err = p.GetFileReader(context.Background(), "empty.tar.gz")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Empty(t, data)
+	require.NoError(t, p.DeleteFile(context.Background(), "empty.tar.gz"))
+
+	require.NoError(t, p.DeleteFile(context.Background(), "backup1.tar.gz"))
+	_, err = p.GetFile(context.Background(), "backup1.tar.gz")
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,146 @@
+package chbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// rbacFileName - file with CREATE and GRANT statements of access entities in metadata of backup,
+// it is skipped by restore of schema because it isn't placed in directory of database
+const rbacFileName = "access.sql"
+
+// rbacKinds - kinds of access entities in order of restore, entities may refer to entities of previous kinds
+var rbacKinds = []struct {
+	kind      string
+	table     string
+	hasGrants bool
+}{
+	{kind: "SETTINGS PROFILE", table: "settings_profiles"},
+	{kind: "ROLE", table: "roles", hasGrants: true},
+	{kind: "USER", table: "users", hasGrants: true},
+	{kind: "QUOTA", table: "quotas"},
+	{kind: "ROW POLICY", table: "row_policies"},
+}
+
+// GetAccessStatements - return CREATE statements of users, roles, quotas, settings profiles and row policies
+// followed by GRANT statements of users and roles, entities defined in users.xml are skipped
+func (ch *ClickHouse) GetAccessStatements() ([]string, error) {
+	creates := []string{}
+	grants := []string{}
+	for _, k := range rbacKinds {
+		var entities []struct {
+			Name     string `db:"name"`
+			Database string `db:"database"`
+			Table    string `db:"table"`
+		}
+		q := fmt.Sprintf("SELECT name, '' AS database, '' AS table FROM `system`.`%s` WHERE storage != 'users.xml'", k.table)
+		if k.kind == "ROW POLICY" {
+			q = "SELECT short_name AS name, database, table FROM `system`.`row_policies` WHERE storage != 'users.xml'"
+		}
+		if err := ch.conn.Select(&entities, q); err != nil {
+			return nil, fmt.Errorf("can't get %s list with %v", strings.ToLower(k.kind), err)
+		}
+		for _, entity := range entities {
+			name := fmt.Sprintf("`%s`", entity.Name)
+			if k.kind == "ROW POLICY" {
+				name = fmt.Sprintf("`%s` ON `%s`.`%s`", entity.Name, entity.Database, entity.Table)
+			}
+			var statements []string
+			if err := ch.conn.Select(&statements, fmt.Sprintf("SHOW CREATE %s %s", k.kind, name)); err != nil {
+				return nil, fmt.Errorf("can't get definition of %s %s with %v", strings.ToLower(k.kind), name, err)
+			}
+			creates = append(creates, statements...)
+			if !k.hasGrants {
+				continue
+			}
+			statements = nil
+			if err := ch.conn.Select(&statements, fmt.Sprintf("SHOW GRANTS FOR %s", name)); err != nil {
+				return nil, fmt.Errorf("can't get grants of %s %s with %v", strings.ToLower(k.kind), name, err)
+			}
+			grants = append(grants, statements...)
+		}
+	}
+	return append(creates, grants...), nil
+}
+
+// ApplyAccessStatements - execute statements of GetAccessStatements, existing entities are replaced
+func (ch *ClickHouse) ApplyAccessStatements(statements []string) error {
+	for _, statement := range statements {
+		for _, k := range rbacKinds {
+			prefix := "CREATE " + k.kind + " "
+			if strings.HasPrefix(statement, prefix) && !strings.HasPrefix(statement, prefix+"OR REPLACE ") {
+				statement = prefix + "OR REPLACE " + strings.TrimPrefix(statement, prefix)
+				break
+			}
+		}
+		log.Println(statement)
+		if _, err := ch.conn.Exec(statement); err != nil {
+			return fmt.Errorf("can't execute '%s' with %v", statement, err)
+		}
+	}
+	return nil
+}
+
+// createBackupRBAC - save access entities to metadata of backup
+func createBackupRBAC(config Config, backupPath string) error {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	log.Println("Backup RBAC")
+	statements, err := ch.GetAccessStatements()
+	if err != nil {
+		return err
+	}
+	content := ""
+	for _, statement := range statements {
+		content += statement + ";\n"
+	}
+	rbacPath := path.Join(backupPath, "metadata", rbacFileName)
+	if err := os.MkdirAll(path.Dir(rbacPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(rbacPath, []byte(content), 0640); err != nil {
+		return fmt.Errorf("can't write '%s' with %v", rbacPath, err)
+	}
+	log.Printf("  %d statements", len(statements))
+	return nil
+}
+
+// restoreRBAC - re-create access entities saved by create --rbac
+func restoreRBAC(config Config, backupName string) error {
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
+	rbacPath := path.Join(dataPath, "backup", backupName, "metadata", rbacFileName)
+	content, err := ioutil.ReadFile(rbacPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("backup '%s' doesn't have RBAC objects, create it with --rbac", backupName)
+		}
+		return err
+	}
+	statements := []string{}
+	for _, statement := range strings.Split(string(content), ";\n") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	log.Println("Restore RBAC")
+	return ch.ApplyAccessStatements(statements)
+}
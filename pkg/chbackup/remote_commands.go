@@ -0,0 +1,79 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// CreateRemote - create backup, upload it and remove local backup after successful upload unless keepLocal is set,
+// local backup is kept when upload fails, so upload can be repeated
+func CreateRemote(ctx context.Context, config Config, backupName, tablePattern, partitions, diffFrom string, rbac bool, labels map[string]string, keepLocal bool) error {
+	if config.General.RemoteStorage == "none" {
+		return fmt.Errorf("create_remote requires general.remote_storage")
+	}
+	if backupName == "" {
+		backupName = NewBackupName()
+	}
+	if err := CreateBackup(ctx, config, backupName, tablePattern, partitions, diffFrom, rbac, labels); err != nil {
+		return err
+	}
+	// local backup is removed below unless keepLocal is set
+	uploadConfig := config
+	uploadConfig.General.DeleteLocalAfterUpload = false
+	if err := Upload(ctx, uploadConfig, backupName, diffFrom, ""); err != nil {
+		log.Printf("Local backup '%s' is kept, upload it again with 'upload'", backupName)
+		return err
+	}
+	if keepLocal {
+		return nil
+	}
+	log.Printf("Remove local backup '%s'", backupName)
+	return RemoveBackupLocal(config, backupName)
+}
+
+// removeUploadedBackup - remove local backup after upload when general.delete_local_after_upload is set,
+// local backup is kept when only some tables were uploaded or uploaded backup isn't verified
+func (bd *BackupDestination) removeUploadedBackup(ctx context.Context, config Config, backupName, tablePattern string) error {
+	if tablePattern != "" {
+		log.Printf("Local backup '%s' is kept, only tables '%s' were uploaded", backupName, tablePattern)
+		return nil
+	}
+	log.Printf("Verify uploaded backup '%s'", backupName)
+	problems, err := bd.verifyBackup(ctx, backupName)
+	if err != nil {
+		return fmt.Errorf("can't verify uploaded backup, local backup '%s' is kept: %v", backupName, err)
+	}
+	for _, problem := range problems {
+		log.Printf("  %s", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("uploaded backup '%s' is broken, %d problems found, local backup is kept", backupName, len(problems))
+	}
+	log.Printf("Remove local backup '%s'", backupName)
+	if err := RemoveBackupLocal(config, backupName); err != nil {
+		return fmt.Errorf("can't remove local backup '%s' with %v", backupName, err)
+	}
+	return nil
+}
+
+// RestoreRemote - download backup and restore it, download is skipped when local backup with the same name exists,
+// e.g. when previous restore_remote was interrupted after download
+func RestoreRemote(ctx context.Context, config Config, backupName, tablePattern string, schemaOnly, dataOnly bool, opts RestoreOptions) error {
+	if config.General.RemoteStorage == "none" {
+		return fmt.Errorf("restore_remote requires general.remote_storage")
+	}
+	err := GetLocalBackup(config, backupName)
+	switch {
+	case err == nil:
+		log.Printf("Backup '%s' is already downloaded", backupName)
+	case errors.Is(err, ErrBackupNotFound):
+		if err := Download(ctx, config, backupName, ""); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return Restore(ctx, config, backupName, tablePattern, schemaOnly, dataOnly, opts)
+}
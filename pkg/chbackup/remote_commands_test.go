@@ -0,0 +1,112 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveUploadedBackup(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "delete_local_data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	remoteDir, err := ioutil.TempDir("", "delete_local_remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(remoteDir)
+	backupPath := filepath.Join(dataDir, "backup", "backup1")
+	files := map[string]string{
+		"metadata/default/t1.sql":                   "CREATE TABLE t1",
+		"shadow/default/t1/all_1_1_0/checksums.txt": "checksums format version: 3\n" + string(partChecksumsV3(map[string]uint64{"data.bin": 4})),
+		"shadow/default/t1/all_1_1_0/data.bin":      "data",
+	}
+	var size int64
+	for _, content := range files {
+		size += int64(len(content))
+	}
+	writeTestFiles(t, backupPath, files)
+	config := *DefaultConfig()
+	config.ClickHouse.DataPath = dataDir
+	config.General.RemoteStorage = "file"
+	config.General.UploadFormat = directoryLayout
+	config.General.DisableProgressBar = true
+	config.General.DeleteLocalAfterUpload = true
+	config.File.Path = remoteDir
+	ctx := context.Background()
+	bd, err := NewBackupDestination(config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	require.NoError(t, bd.DirectoryUpload(ctx, backupPath, "backup1", ""))
+
+	// dry run of upload shows local backup which would be removed
+	items, err := uploadItems(ctx, config, "backup1", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, dryRunItem{Action: "remove", Object: backupPath, Size: size}, items[len(items)-1])
+
+	// local backup is kept when only some tables are uploaded
+	require.NoError(t, bd.removeUploadedBackup(ctx, config, "backup1", "default.t1"))
+	assert.DirExists(t, backupPath)
+
+	// local backup is kept when uploaded backup is broken
+	remoteFile := filepath.Join(remoteDir, "backup1", "shadow/default/t1/all_1_1_0/data.bin")
+	require.NoError(t, ioutil.WriteFile(remoteFile, []byte("bad!"), 0640))
+	assert.Error(t, bd.removeUploadedBackup(ctx, config, "backup1", ""))
+	assert.DirExists(t, backupPath)
+	require.NoError(t, os.Remove(remoteFile))
+	assert.Error(t, bd.removeUploadedBackup(ctx, config, "backup1", ""))
+	assert.DirExists(t, backupPath)
+
+	require.NoError(t, ioutil.WriteFile(remoteFile, []byte("data"), 0640))
+	require.NoError(t, bd.removeUploadedBackup(ctx, config, "backup1", ""))
+	_, err = os.Stat(backupPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUploadTablesOfUploadedBackup(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "upload_tables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	files := map[string]string{
+		"metadata/default/t1.sql":              "CREATE TABLE t1",
+		"metadata/default/t2.sql":              "CREATE TABLE t2",
+		"shadow/default/t1/all_1_1_0/data.bin": "t1 data",
+		"shadow/default/t2/all_1_1_0/data.bin": "t2 data",
+	}
+	writeTestFiles(t, filepath.Join(dataDir, "local", "backup", "backup1"), files)
+	for name, setLayout := range map[string]func(*GeneralConfig){
+		"single archive":    func(*GeneralConfig) {},
+		"archive per table": func(c *GeneralConfig) { c.UploadConcurrency = 2 },
+		"directory":         func(c *GeneralConfig) { c.UploadFormat = directoryLayout },
+		"cas":               func(c *GeneralConfig) { c.RemoteLayout = casLayout },
+	} {
+		t.Run(name, func(t *testing.T) {
+			remoteDir := filepath.Join(dataDir, name, "remote")
+			require.NoError(t, os.MkdirAll(remoteDir, 0750))
+			config := *DefaultConfig()
+			config.ClickHouse.DataPath = filepath.Join(dataDir, "local")
+			config.General.RemoteStorage = "file"
+			config.General.DisableProgressBar = true
+			config.File.Path = remoteDir
+			setLayout(&config.General)
+			ctx := context.Background()
+			require.NoError(t, Upload(ctx, config, "backup1", "", ""))
+
+			// upload of one table doesn't replace uploaded backup
+			assert.Error(t, Upload(ctx, config, "backup1", "", "default.t1"))
+			_, err := uploadItems(ctx, config, "backup1", "", "default.t1")
+			assert.Error(t, err)
+
+			config.ClickHouse.DataPath = filepath.Join(dataDir, name, "download")
+			require.NoError(t, Download(ctx, config, "backup1", ""))
+			for file, content := range files {
+				b, err := ioutil.ReadFile(filepath.Join(config.ClickHouse.DataPath, "backup", "backup1", file))
+				require.NoError(t, err)
+				assert.Equal(t, content, string(b))
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package chbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// restoreJournal - tables created and parts attached by restore of backup, saved after each table and part to hidden file
+// next to backup directory, so it isn't listed as local backup and isn't uploaded. Restore of the same backup after failure
+// or cancellation skips them, journal is removed when restore is finished
+type restoreJournal struct {
+	path string
+	// Created - tables created by restore of schema, '<db>.<table>' with restore mappings applied
+	Created map[string]bool `json:"created"`
+	// Attached - attached parts by '<db>.<table>' with restore mappings applied
+	Attached map[string]map[string]bool `json:"attached"`
+	// Copied - tables whose files are restored from 'files' of backup, '<db>.<table>' with restore mappings applied
+	Copied map[string]bool `json:"copied,omitempty"`
+}
+
+// restoreJournalPath - journal of restore of local backup
+func restoreJournalPath(dataPath, backupName string) string {
+	return filepath.Join(dataPath, "backup", "."+backupName+".restore.json")
+}
+
+// loadRestoreJournal - journal of interrupted restore of backup, empty journal when restore wasn't interrupted
+func loadRestoreJournal(dataPath, backupName string) (*restoreJournal, error) {
+	journal := &restoreJournal{
+		path:     restoreJournalPath(dataPath, backupName),
+		Created:  map[string]bool{},
+		Attached: map[string]map[string]bool{},
+		Copied:   map[string]bool{},
+	}
+	content, err := ioutil.ReadFile(journal.path)
+	if os.IsNotExist(err) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, journal); err != nil {
+		return nil, fmt.Errorf("can't parse '%s' with %v, remove it to restore from the beginning", journal.path, err)
+	}
+	log.Printf("Resume restore of '%s', %d tables are created and parts of %d tables are attached before", backupName, len(journal.Created), len(journal.Attached))
+	return journal, nil
+}
+
+// save - write journal to temporary file and rename it, so journal isn't corrupted by crash
+func (j *restoreJournal) save() error {
+	content, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmpPath := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0640); err != nil {
+		return fmt.Errorf("can't write '%s' with %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, j.path)
+}
+
+func (j *restoreJournal) isCreated(database, table string) bool {
+	return j.Created[fmt.Sprintf("%s.%s", database, table)]
+}
+
+func (j *restoreJournal) created(database, table string) error {
+	j.Created[fmt.Sprintf("%s.%s", database, table)] = true
+	return j.save()
+}
+
+func (j *restoreJournal) isAttached(database, table, part string) bool {
+	return j.Attached[fmt.Sprintf("%s.%s", database, table)][part]
+}
+
+func (j *restoreJournal) attached(database, table, part string) error {
+	name := fmt.Sprintf("%s.%s", database, table)
+	if j.Attached[name] == nil {
+		j.Attached[name] = map[string]bool{}
+	}
+	j.Attached[name][part] = true
+	return j.save()
+}
+
+func (j *restoreJournal) isCopied(database, table string) bool {
+	return j.Copied[fmt.Sprintf("%s.%s", database, table)]
+}
+
+func (j *restoreJournal) copied(database, table string) error {
+	j.Copied[fmt.Sprintf("%s.%s", database, table)] = true
+	return j.save()
+}
+
+// pendingParts - table with parts which aren't attached yet
+func (j *restoreJournal) pendingParts(table BackupTable) BackupTable {
+	parts := []BackupPartition{}
+	for _, part := range table.Partitions {
+		if !j.isAttached(table.Database, table.Name, part.Name) {
+			parts = append(parts, part)
+		}
+	}
+	table.Partitions = parts
+	return table
+}
+
+// removeRestoreJournal - remove journal of finished restore
+func removeRestoreJournal(dataPath, backupName string) {
+	journalPath := restoreJournalPath(dataPath, backupName)
+	if err := os.Remove(journalPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("can't remove '%s' with %v", journalPath, err)
+	}
+}
@@ -0,0 +1,39 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreJournal(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "restore_journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	require.NoError(t, os.MkdirAll(filepath.Join(dataPath, "backup"), 0750))
+
+	journal, err := loadRestoreJournal(dataPath, "backup1")
+	require.NoError(t, err)
+	require.NoError(t, journal.created("default", "t1"))
+	require.NoError(t, journal.attached("default", "t1", "all_1_1_0"))
+
+	journal, err = loadRestoreJournal(dataPath, "backup1")
+	require.NoError(t, err)
+	assert.True(t, journal.isCreated("default", "t1"))
+	assert.False(t, journal.isCreated("default", "t2"))
+	table := journal.pendingParts(BackupTable{
+		Database:   "default",
+		Name:       "t1",
+		Partitions: []BackupPartition{{Name: "all_1_1_0"}, {Name: "all_2_2_0"}},
+	})
+	assert.Equal(t, []BackupPartition{{Name: "all_2_2_0"}}, table.Partitions)
+
+	removeRestoreJournal(dataPath, "backup1")
+	journal, err = loadRestoreJournal(dataPath, "backup1")
+	require.NoError(t, err)
+	assert.False(t, journal.isCreated("default", "t1"))
+}
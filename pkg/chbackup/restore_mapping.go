@@ -0,0 +1,237 @@
+package chbackup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RestoreMapping - new names of databases and tables on restore, set by --restore-database-mapping and --restore-table-mapping
+type RestoreMapping struct {
+	Databases map[string]string
+	Tables    map[string]string
+	// KeepUUID - renamed tables keep UUID of backup, set by --restore-uuid=keep
+	KeepUUID bool
+}
+
+var (
+	createQueryNameRE   = regexp.MustCompile("^(CREATE\\s+(?:TABLE|VIEW|MATERIALIZED\\s+VIEW|LIVE\\s+VIEW|DICTIONARY)\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?)((?:`[^`]+`|\\w+)\\.)?(`[^`]+`|\\w+)")
+	distributedEngineRE = regexp.MustCompile(`Distributed\(([^,]+),\s*([^,]+),\s*([^,)]+)`)
+	createQueryUUIDRE   = regexp.MustCompile(`^\s+UUID\s+'([^']+)'`)
+	innerUUIDRE         = regexp.MustCompile(`\s+TO\s+INNER\s+UUID\s+'[^']+'`)
+	mergeTreeEngineRE   = regexp.MustCompile(`(ENGINE\s*=\s*)(\w*MergeTree)\b(\s*\()?`)
+	replicaArgQuoter    = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+)
+
+// parseRestoreMapping - parse comma separated 'src:dst' pairs of databases and tables
+func parseRestoreMapping(databaseMapping, tableMapping string) (RestoreMapping, error) {
+	databases, err := parseNameMapping(databaseMapping)
+	if err != nil {
+		return RestoreMapping{}, fmt.Errorf("invalid database mapping with %v", err)
+	}
+	tables, err := parseNameMapping(tableMapping)
+	if err != nil {
+		return RestoreMapping{}, fmt.Errorf("invalid table mapping with %v", err)
+	}
+	return RestoreMapping{Databases: databases, Tables: tables}, nil
+}
+
+func parseNameMapping(mapping string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, pair := range strings.Split(mapping, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		names := strings.Split(pair, ":")
+		if len(names) != 2 || strings.TrimSpace(names[0]) == "" || strings.TrimSpace(names[1]) == "" {
+			return nil, fmt.Errorf("'%s' should be 'src:dst'", pair)
+		}
+		result[strings.TrimSpace(names[0])] = strings.TrimSpace(names[1])
+	}
+	return result, nil
+}
+
+func (m RestoreMapping) database(name string) string {
+	if mapped, ok := m.Databases[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+// table - new name of table, inner table of materialized view is renamed with its view
+func (m RestoreMapping) table(name string) string {
+	if mapped, ok := m.Tables[name]; ok {
+		return mapped
+	}
+	if isInnerTable(name) {
+		if mapped, ok := m.Tables[strings.TrimPrefix(name, innerTablePrefix)]; ok {
+			return innerTablePrefix + mapped
+		}
+	}
+	return name
+}
+
+// backupTable - table of backup with new database and table names, parts are attached to the new table
+func (m RestoreMapping) backupTable(table BackupTable) BackupTable {
+	table.Database = m.database(table.Database)
+	table.Name = m.table(table.Name)
+	return table
+}
+
+// restoreTable - schema of table with new database and table names, references to renamed databases and tables
+// in the query are rewritten too, e.g. tables of SELECT of views and tables of Distributed engine
+func (m RestoreMapping) restoreTable(table RestoreTable) RestoreTable {
+	if len(m.Databases) == 0 && len(m.Tables) == 0 {
+		return table
+	}
+	renamed := m.database(table.Database) != table.Database || m.table(table.Table) != table.Table
+	table.Database = m.database(table.Database)
+	table.Table = m.table(table.Table)
+	header := ""
+	query := table.Query
+	if match := createQueryNameRE.FindStringSubmatchIndex(query); match != nil {
+		header = query[match[2]:match[3]]
+		if match[4] != -1 {
+			header += fmt.Sprintf("`%s`.", table.Database)
+		}
+		header += fmt.Sprintf("`%s`", m.table(unquoteName(query[match[6]:match[7]])))
+		query = query[match[1]:]
+		// renamed table gets new UUID, otherwise it conflicts with the original table
+		if renamed && !m.KeepUUID {
+			query = innerUUIDRE.ReplaceAllString(createQueryUUIDRE.ReplaceAllString(query, ""), "")
+		}
+	}
+	for src, dst := range m.Databases {
+		re := regexp.MustCompile("(^|[^\\w.`])(`" + regexp.QuoteMeta(src) + "`|" + regexp.QuoteMeta(src) + ")\\.")
+		query = re.ReplaceAllString(query, "${1}`"+strings.ReplaceAll(dst, "$", "$$")+"`.")
+	}
+	for src, dst := range m.Tables {
+		dst = strings.ReplaceAll(dst, "$", "$$")
+		re := regexp.MustCompile("((?:`[^`]+`|\\w+)\\.)`" + regexp.QuoteMeta(src) + "`")
+		query = re.ReplaceAllString(query, "${1}`"+dst+"`")
+		re = regexp.MustCompile("((?:`[^`]+`|\\w+)\\.)" + regexp.QuoteMeta(src) + "\\b")
+		query = re.ReplaceAllString(query, "${1}`"+dst+"`")
+	}
+	query = distributedEngineRE.ReplaceAllStringFunc(query, func(engine string) string {
+		args := distributedEngineRE.FindStringSubmatch(engine)
+		return fmt.Sprintf("Distributed(%s, '%s', '%s'", args[1], m.database(unquoteName(args[2])), m.table(unquoteName(args[3])))
+	})
+	table.Query = header + query
+	return table
+}
+
+// onClusterQuery - CREATE query of table with ON CLUSTER clause, table name is qualified by database
+// because distributed DDL is executed on other hosts without USE of database
+func onClusterQuery(table RestoreTable, cluster string) string {
+	match := createQueryNameRE.FindStringSubmatchIndex(table.Query)
+	if match == nil {
+		return table.Query
+	}
+	query := table.Query[match[1]:]
+	uuid := ""
+	if m := createQueryUUIDRE.FindStringIndex(query); m != nil {
+		uuid, query = query[:m[1]], query[m[1]:]
+	}
+	return fmt.Sprintf("%s`%s`.`%s`%s ON CLUSTER `%s`%s", table.Query[match[2]:match[3]], table.Database, table.Table, uuid, cluster, query)
+}
+
+// nonReplicatedQuery - CREATE query with Replicated*MergeTree engine replaced by *MergeTree,
+// ZooKeeper path and replica name are removed from engine arguments, other arguments are kept
+func nonReplicatedQuery(query string) string {
+	return rewriteMergeTreeEngine(query, func(engine string, args []string) string {
+		if !strings.HasPrefix(engine, "Replicated") {
+			return ""
+		}
+		return mergeTreeEngine(strings.TrimPrefix(engine, "Replicated"), withoutReplicaArgs(args))
+	})
+}
+
+// replicatedQuery - CREATE query with *MergeTree engine replaced by Replicated*MergeTree with zkPath and replica,
+// ZooKeeper path and replica name of Replicated*MergeTree engine are replaced too
+func replicatedQuery(query, zkPath, replica string) string {
+	return rewriteMergeTreeEngine(query, func(engine string, args []string) string {
+		if !strings.HasPrefix(engine, "Replicated") {
+			engine = "Replicated" + engine
+		}
+		replicaArgs := []string{"'" + replicaArgQuoter.Replace(zkPath) + "'", "'" + replicaArgQuoter.Replace(replica) + "'"}
+		return mergeTreeEngine(engine, append(replicaArgs, withoutReplicaArgs(args)...))
+	})
+}
+
+// rewriteMergeTreeEngine - replace ENGINE clause of *MergeTree table by result of rewrite, empty result keeps the engine
+func rewriteMergeTreeEngine(query string, rewrite func(engine string, args []string) string) string {
+	match := mergeTreeEngineRE.FindStringSubmatchIndex(query)
+	if match == nil {
+		return query
+	}
+	end := match[5]
+	args := []string{}
+	if match[6] != -1 {
+		var ok bool
+		if args, end, ok = splitEngineArgs(query, match[7]); !ok {
+			return query
+		}
+	}
+	engine := rewrite(query[match[4]:match[5]], args)
+	if engine == "" {
+		return query
+	}
+	return query[:match[4]] + engine + query[end:]
+}
+
+// splitEngineArgs - top level arguments of engine which start at position after opening parenthesis
+// and position after closing parenthesis, commas in string literals and nested parentheses don't split arguments
+func splitEngineArgs(query string, start int) ([]string, int, bool) {
+	args := []string{}
+	depth := 0
+	argStart := start
+	for i := start; i < len(query); i++ {
+		switch query[i] {
+		case '\'':
+			for i++; i < len(query) && query[i] != '\''; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			depth++
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(query[argStart:i]))
+				argStart = i + 1
+			}
+		case ')':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if arg := strings.TrimSpace(query[argStart:i]); arg != "" || len(args) > 0 {
+				args = append(args, arg)
+			}
+			return args, i + 1, true
+		}
+	}
+	return nil, 0, false
+}
+
+// withoutReplicaArgs - engine arguments without ZooKeeper path and replica name, they're string literals
+// which precede other arguments, Replicated*MergeTree without them uses default_replica_path of server
+func withoutReplicaArgs(args []string) []string {
+	for i := 0; i < 2 && len(args) > 0 && strings.HasPrefix(args[0], "'"); i++ {
+		args = args[1:]
+	}
+	return args
+}
+
+func mergeTreeEngine(engine string, args []string) string {
+	return fmt.Sprintf("%s(%s)", engine, strings.Join(args, ", "))
+}
+
+// unquoteName - name without quotes of identifier or string literal
+func unquoteName(name string) string {
+	name = strings.TrimSpace(name)
+	if len(name) > 1 && (name[0] == '`' || name[0] == '\'' || name[0] == '"') && name[len(name)-1] == name[0] {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
@@ -0,0 +1,66 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreMapping(t *testing.T) {
+	mapping, err := parseRestoreMapping("prod:staging", "events:events_restored")
+	require.NoError(t, err)
+	table := mapping.restoreTable(RestoreTable{
+		Database: "prod",
+		Table:    "events",
+		Query:    "CREATE TABLE events (`date` Date) ENGINE = MergeTree() ORDER BY date",
+	})
+	assert.Equal(t, "staging", table.Database)
+	assert.Equal(t, "events_restored", table.Table)
+	assert.Equal(t, "CREATE TABLE `events_restored` (`date` Date) ENGINE = MergeTree() ORDER BY date", table.Query)
+
+	view := mapping.restoreTable(RestoreTable{
+		Database: "prod",
+		Table:    "mv",
+		Query:    "CREATE MATERIALIZED VIEW mv TO prod.events_agg AS SELECT date FROM `prod`.`events`",
+	})
+	assert.Equal(t, "CREATE MATERIALIZED VIEW `mv` TO `staging`.events_agg AS SELECT date FROM `staging`.`events_restored`", view.Query)
+
+	distributed := mapping.restoreTable(RestoreTable{
+		Database: "prod",
+		Table:    "events_dist",
+		Query:    "CREATE TABLE events_dist (`date` Date) ENGINE = Distributed('cluster', 'prod', 'events', rand())",
+	})
+	assert.Equal(t, "CREATE TABLE `events_dist` (`date` Date) ENGINE = Distributed('cluster', 'staging', 'events_restored', rand())", distributed.Query)
+
+	assert.Equal(t, BackupTable{Database: "staging", Name: "events_restored"}, mapping.backupTable(BackupTable{Database: "prod", Name: "events"}))
+
+	_, err = parseRestoreMapping("prod", "")
+	assert.Error(t, err)
+}
+
+func TestOnClusterQuery(t *testing.T) {
+	assert.Equal(t, "CREATE TABLE `prod`.`events` ON CLUSTER `main` (`date` Date) ENGINE = MergeTree() ORDER BY date", onClusterQuery(RestoreTable{
+		Database: "prod",
+		Table:    "events",
+		Query:    "CREATE TABLE events (`date` Date) ENGINE = MergeTree() ORDER BY date",
+	}, "main"))
+	assert.Equal(t, "CREATE TABLE `prod`.`events` UUID 'f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c' ON CLUSTER `main` (`date` Date) ENGINE = Log", onClusterQuery(RestoreTable{
+		Database: "prod",
+		Table:    "events",
+		Query:    "CREATE TABLE `events` UUID 'f5b3a0d6-0a6c-4a4d-9e4e-3e1c2f3a4b5c' (`date` Date) ENGINE = Log",
+	}, "main"))
+}
+
+func TestReplicatedQuery(t *testing.T) {
+	replicated := "CREATE TABLE events (`date` Date, `ver` UInt32) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/prod/events', '{replica}', ver) ORDER BY date"
+	assert.Equal(t, "CREATE TABLE events (`date` Date, `ver` UInt32) ENGINE = ReplacingMergeTree(ver) ORDER BY date", nonReplicatedQuery(replicated))
+	assert.Equal(t, "CREATE TABLE events (`date` Date) ENGINE = MergeTree() ORDER BY date", nonReplicatedQuery("CREATE TABLE events (`date` Date) ENGINE = ReplicatedMergeTree ORDER BY date"))
+	assert.Equal(t, "CREATE TABLE events (`date` Date) ENGINE = Log", nonReplicatedQuery("CREATE TABLE events (`date` Date) ENGINE = Log"))
+
+	path, replica := "/clickhouse/tables/{shard}/{database}/{table}", "{replica}"
+	assert.Equal(t, "CREATE TABLE events (`date` Date, `ver` UInt32) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}', ver) ORDER BY date", replicatedQuery(replicated, path, replica))
+	assert.Equal(t, "CREATE TABLE events (`date` Date) ENGINE = ReplicatedSummingMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}', (a, b)) ORDER BY date", replicatedQuery("CREATE TABLE events (`date` Date) ENGINE = SummingMergeTree((a, b)) ORDER BY date", path, replica))
+	assert.Equal(t, "CREATE TABLE events (`date` Date) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}') ORDER BY date", replicatedQuery("CREATE TABLE events (`date` Date) ENGINE = MergeTree ORDER BY date", path, replica))
+	assert.Equal(t, "CREATE VIEW v AS SELECT 1", replicatedQuery("CREATE VIEW v AS SELECT 1", path, replica))
+}
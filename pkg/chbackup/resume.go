@@ -0,0 +1,120 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// partialState - remote archive which .partial file belongs to, saved next to .partial file
+type partialState struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// partialPath - archive is downloaded to hidden file next to backup directory,
+// so it isn't listed as local backup and isn't removed with partially extracted backup
+func partialPath(localPath, archiveName string) string {
+	return filepath.Join(filepath.Dir(localPath), "."+path.Base(archiveName)+".partial")
+}
+
+func removePartial(partialFile string) {
+	for _, name := range []string{partialFile, partialFile + ".json"} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Printf("can't remove '%s' with %v", name, err)
+		}
+	}
+}
+
+// loadPartialOffset - size of .partial file when it belongs to the same remote archive, otherwise 0
+func loadPartialOffset(partialFile string, state partialState) int64 {
+	info, err := os.Stat(partialFile)
+	if err != nil {
+		return 0
+	}
+	b, err := ioutil.ReadFile(partialFile + ".json")
+	if err != nil {
+		return 0
+	}
+	var saved partialState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return 0
+	}
+	if saved.Key != state.Key || saved.Size != state.Size || !saved.LastModified.Equal(state.LastModified) || info.Size() > state.Size {
+		log.Printf("'%s' was changed since download was interrupted, downloading it again", state.Key)
+		return 0
+	}
+	return info.Size()
+}
+
+// downloadPartial - download archive to .partial file continuing from its size by ranged read,
+// .partial file is kept when download is interrupted, returns complete archive opened for reading
+func (bd *BackupDestination) downloadPartial(ctx context.Context, archiveName string, file RemoteFile, partialFile string, bar *Bar) (*os.File, error) {
+	state := partialState{Key: archiveName, Size: file.Size(), LastModified: file.LastModified().UTC()}
+	offset := loadPartialOffset(partialFile, state)
+	if offset == 0 {
+		b, err := json.Marshal(state)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(partialFile+".json", b, 0640); err != nil {
+			return nil, fmt.Errorf("can't write '%s.json' with %v", partialFile, err)
+		}
+	}
+	f, err := os.OpenFile(partialFile, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("can't open '%s' with %v", partialFile, err)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset > 0 {
+		log.Printf("Resume download of '%s' from %d of %d bytes", archiveName, offset, state.Size)
+		bar.Resume(offset)
+	}
+	if offset < state.Size {
+		reader, err := bd.GetFileReaderWithOffset(ctx, archiveName, offset)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		_, err = io.Copy(f, bar.NewProxyReader(newContextReader(ctx, reader)))
+		reader.Close()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() != state.Size {
+		f.Close()
+		removePartial(partialFile)
+		return nil, fmt.Errorf("size of downloaded '%s' is %d, expected %d", archiveName, info.Size(), state.Size)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,58 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storage := &FileStorage{Config: &FileConfig{Path: filepath.Join(dir, "remote")}}
+	require.NoError(t, os.MkdirAll(storage.Config.Path, 0750))
+	content := strings.Repeat("archive data ", 100)
+	require.NoError(t, storage.PutFile(context.Background(), "backup1.tar", ioutil.NopCloser(strings.NewReader(content))))
+	bd := &BackupDestination{RemoteStorage: storage, disableProgressBar: true}
+	file, err := storage.GetFile(context.Background(), "backup1.tar")
+	require.NoError(t, err)
+
+	partialFile := partialPath(filepath.Join(dir, "backup", "backup1"), "backup1.tar")
+	assert.Equal(t, filepath.Join(dir, "backup", ".backup1.tar.partial"), partialFile)
+	require.NoError(t, os.MkdirAll(filepath.Dir(partialFile), 0750))
+	state, err := json.Marshal(partialState{Key: "backup1.tar", Size: file.Size(), LastModified: file.LastModified().UTC()})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(partialFile+".json", state, 0640))
+	require.NoError(t, ioutil.WriteFile(partialFile, []byte(content[:100]), 0640))
+
+	bar := StartNewByteBar(false, file.Size())
+	f, err := bd.downloadPartial(context.Background(), "backup1.tar", file, partialFile, bar)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, content, string(b))
+	assert.Equal(t, Progress{Current: file.Size(), Total: file.Size(), ResumedFrom: 100}, bar.Progress())
+
+	// .partial file of other archive is discarded
+	require.NoError(t, ioutil.WriteFile(partialFile, []byte("other data"), 0640))
+	state, err = json.Marshal(partialState{Key: "backup1.tar", Size: file.Size() + 1, LastModified: file.LastModified().UTC()})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(partialFile+".json", state, 0640))
+	bar = StartNewByteBar(false, file.Size())
+	f, err = bd.downloadPartial(context.Background(), "backup1.tar", file, partialFile, bar)
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, content, string(b))
+	assert.Equal(t, int64(0), bar.Progress().ResumedFrom)
+}
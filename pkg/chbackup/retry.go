@@ -0,0 +1,244 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxRetryBackoff - limit of exponential backoff between retries
+const maxRetryBackoff = 30 * time.Second
+
+// retryCounters - retries of remote storage operations, exported as metrics by server
+type retryCounters struct {
+	retries  int64
+	failures int64
+}
+
+var remoteRetries = &retryCounters{}
+
+// Retries - number of retried operations
+func (c *retryCounters) Retries() int64 {
+	return atomic.LoadInt64(&c.retries)
+}
+
+// Failures - number of operations failed with transient error after all retries
+func (c *retryCounters) Failures() int64 {
+	return atomic.LoadInt64(&c.failures)
+}
+
+// retryPolicy - retry operations failed with transient errors with exponential backoff and jitter
+type retryPolicy struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+func newRetryPolicy(config GeneralConfig) retryPolicy {
+	backoff, err := time.ParseDuration(config.RemoteRetryBackoff)
+	if err != nil {
+		backoff = time.Second
+	}
+	return retryPolicy{maxRetries: config.RemoteMaxRetries, backoff: backoff}
+}
+
+// do - call op until it succeeds, fails with not transient error, maxRetries retries are made or ctx is done
+func (p retryPolicy) do(ctx context.Context, kind, operation string, op func() error) error {
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !isTransientError(err) {
+			return err
+		}
+		if attempt >= p.maxRetries || ctx.Err() != nil {
+			if p.maxRetries > 0 {
+				atomic.AddInt64(&remoteRetries.failures, 1)
+			}
+			return err
+		}
+		atomic.AddInt64(&remoteRetries.retries, 1)
+		wait := withJitter(backoff)
+		log.Printf("%s %s failed with %v, retry %d/%d in %s", kind, operation, err, attempt+1, p.maxRetries, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// withJitter - random duration between d/2 and d, so clients failed at the same time don't retry at the same time
+func withJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isTransientError - rate limits, server errors, timeouts and network errors of all remote storages
+func isTransientError(err error) bool {
+	switch {
+	case err == nil, errors.Is(err, ErrNotFound), errors.Is(err, ErrObjectLocked), errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && isTransientStatus(reqErr.StatusCode()) {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "RequestError", "RequestTimeout", "RequestTimeoutException", "SlowDown", "Throttling", "ThrottlingException",
+			"InternalError", "ServiceUnavailable":
+			return true
+		}
+		return awsErr.OrigErr() != nil && isTransientError(awsErr.OrigErr())
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return isTransientStatus(apiErr.Code)
+	}
+	if cosErr, ok := err.(*cos.ErrorResponse); ok && cosErr.Response != nil {
+		return isTransientStatus(cosErr.Response.StatusCode)
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+			return true
+		}
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryStorage - retry operations of remote storage by general.remote_max_retries,
+// PutFile is not retried because its reader can't be read again
+type retryStorage struct {
+	RemoteStorage
+	policy retryPolicy
+}
+
+// retryBatchStorage - retryStorage of remote storage which supports DeleteFiles
+type retryBatchStorage struct {
+	*retryStorage
+}
+
+func newRetryStorage(storage RemoteStorage, policy retryPolicy) RemoteStorage {
+	s := &retryStorage{RemoteStorage: storage, policy: policy}
+	if _, ok := storage.(BatchDeleter); ok {
+		return &retryBatchStorage{s}
+	}
+	return s
+}
+
+func (s *retryStorage) Connect() error {
+	return s.policy.do(context.Background(), s.Kind(), "connect", s.RemoteStorage.Connect)
+}
+
+func (s *retryStorage) CheckBucket(ctx context.Context) error {
+	return s.policy.do(ctx, s.Kind(), "check bucket", func() error {
+		return s.RemoteStorage.CheckBucket(ctx)
+	})
+}
+
+func (s *retryStorage) GetFile(ctx context.Context, key string) (RemoteFile, error) {
+	var file RemoteFile
+	err := s.policy.do(ctx, s.Kind(), "stat of '"+key+"'", func() error {
+		var err error
+		file, err = s.RemoteStorage.GetFile(ctx, key)
+		return err
+	})
+	return file, err
+}
+
+// DeleteFile - file deleted by failed attempt is not found by the next one
+func (s *retryStorage) DeleteFile(ctx context.Context, key string) error {
+	attempt := 0
+	return s.policy.do(ctx, s.Kind(), "delete of '"+key+"'", func() error {
+		err := s.RemoteStorage.DeleteFile(ctx, key)
+		if attempt++; attempt > 1 && errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// Walk - listing is retried only when it fails before the first file, otherwise files would be processed twice
+func (s *retryStorage) Walk(ctx context.Context, prefix string, process func(RemoteFile)) error {
+	processed := false
+	var walkErr error
+	err := s.policy.do(ctx, s.Kind(), "listing of '"+prefix+"'", func() error {
+		err := s.RemoteStorage.Walk(ctx, prefix, func(f RemoteFile) {
+			processed = true
+			process(f)
+		})
+		if err != nil && processed {
+			walkErr = err
+			return nil
+		}
+		return err
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+func (s *retryStorage) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := s.policy.do(ctx, s.Kind(), "download of '"+key+"'", func() error {
+		var err error
+		reader, err = s.RemoteStorage.GetFileReader(ctx, key)
+		return err
+	})
+	return reader, err
+}
+
+func (s *retryStorage) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := s.policy.do(ctx, s.Kind(), "download of '"+key+"'", func() error {
+		var err error
+		reader, err = s.RemoteStorage.GetFileReaderWithOffset(ctx, key, offset)
+		return err
+	})
+	return reader, err
+}
+
+// GetFileRange - range is read by one request when wrapped storage is RangeReader
+func (s *retryStorage) GetFileRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := s.policy.do(ctx, s.Kind(), "download of '"+key+"'", func() error {
+		var err error
+		reader, err = getFileRange(ctx, s.RemoteStorage, key, offset, length)
+		return err
+	})
+	return reader, err
+}
+
+func (s *retryBatchStorage) DeleteFiles(ctx context.Context, keys []string) error {
+	return s.policy.do(ctx, s.Kind(), "delete of files", func() error {
+		return s.RemoteStorage.(BatchDeleter).DeleteFiles(ctx, keys)
+	})
+}
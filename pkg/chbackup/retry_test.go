@@ -0,0 +1,75 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsTransientError(t *testing.T) {
+	assert.False(t, isTransientError(nil))
+	assert.False(t, isTransientError(ErrNotFound))
+	assert.False(t, isTransientError(fmt.Errorf("%w until tomorrow", ErrObjectLocked)))
+	assert.False(t, isTransientError(errors.New("access denied")))
+	assert.True(t, isTransientError(io.ErrUnexpectedEOF))
+	assert.True(t, isTransientError(awserr.New("SlowDown", "reduce request rate", nil)))
+	assert.True(t, isTransientError(awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "id")))
+	assert.False(t, isTransientError(awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "id")))
+	assert.True(t, isTransientError(&googleapi.Error{Code: 429}))
+	assert.False(t, isTransientError(&googleapi.Error{Code: 404}))
+	assert.True(t, isTransientError(status.Error(codes.Unavailable, "plugin restarts")))
+	assert.False(t, isTransientError(status.Error(codes.InvalidArgument, "bad key")))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := retryPolicy{maxRetries: 2, backoff: time.Millisecond}
+	calls := 0
+	retries := remoteRetries.Retries()
+	assert.NoError(t, policy.do(context.Background(), "test", "op", func() error {
+		if calls++; calls < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, retries+2, remoteRetries.Retries())
+
+	calls = 0
+	failures := remoteRetries.Failures()
+	assert.Equal(t, io.ErrUnexpectedEOF, policy.do(context.Background(), "test", "op", func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	}))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, failures+1, remoteRetries.Failures())
+
+	calls = 0
+	assert.Equal(t, ErrNotFound, policy.do(context.Background(), "test", "op", func() error {
+		calls++
+		return ErrNotFound
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryPolicyCancel(t *testing.T) {
+	policy := retryPolicy{maxRetries: 5, backoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	assert.Equal(t, io.ErrUnexpectedEOF, policy.do(ctx, "test", "op", func() error {
+		calls++
+		cancel()
+		return io.ErrUnexpectedEOF
+	}))
+	assert.Equal(t, 1, calls)
+	assert.True(t, time.Since(start) < time.Minute)
+}
@@ -1,27 +1,49 @@
 package chbackup
 
 import (
+	"context"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/pkg/errors"
 )
 
 // S3 - presents methods for manipulate data on s3
 type S3 struct {
 	session *session.Session
-	Config  *S3Config
+	client  *s3.S3
+	// sseCustomerKey - raw SSE-C key, empty when SSE-C is not used
+	sseCustomerKey string
+	Config         *S3Config
 }
 
+// s3CredentialsExpiryWindow - temporary STS credentials are refreshed this long before they expire,
+// credentials rejected as expired are refreshed by SDK before retry
+const s3CredentialsExpiryWindow = 5 * time.Minute
+
 // Connect - connect to s3
 func (s *S3) Connect() error {
 	var err error
@@ -36,7 +58,15 @@ func (s *S3) Connect() error {
 	}}
 
 	// Append static creds to the defaults
-	customCredProviders := append([]credentials.Provider{staticCreds}, defaultCredProviders...)
+	customCredProviders := []credentials.Provider{staticCreds}
+	webIdentity, err := s.webIdentityProvider()
+	if err != nil {
+		return err
+	}
+	if webIdentity != nil {
+		customCredProviders = append(customCredProviders, webIdentity)
+	}
+	customCredProviders = append(customCredProviders, defaultCredProviders...)
 	creds := credentials.NewChainCredentials(customCredProviders)
 
 	var awsConfig = &aws.Config{
@@ -45,7 +75,27 @@ func (s *S3) Connect() error {
 		Endpoint:         aws.String(s.Config.Endpoint),
 		DisableSSL:       aws.Bool(s.Config.DisableSSL),
 		S3ForcePathStyle: aws.Bool(s.Config.ForcePathStyle),
-		MaxRetries:       aws.Int(30),
+	}
+	awsConfig = request.WithRetryer(awsConfig, s.retryer())
+
+	if s.Config.AssumeRoleARN != "" {
+		// credentials above are used only to call STS, STS endpoint is resolved by region, not by s3.endpoint
+		stsSession, err := session.NewSession(&aws.Config{
+			Credentials: creds,
+			Region:      aws.String(s.Config.Region),
+		})
+		if err != nil {
+			return fmt.Errorf("can't create STS session with %v", err)
+		}
+		awsConfig.Credentials = stscreds.NewCredentials(stsSession, s.Config.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.ExpiryWindow = s3CredentialsExpiryWindow
+			if s.Config.ExternalID != "" {
+				p.ExternalID = aws.String(s.Config.ExternalID)
+			}
+			if s.Config.RoleSessionName != "" {
+				p.RoleSessionName = s.Config.RoleSessionName
+			}
+		})
 	}
 
 	if s.Config.DisableCertVerification {
@@ -59,65 +109,485 @@ func (s *S3) Connect() error {
 		awsConfig.LogLevel = aws.LogLevel(aws.LogDebugWithRequestErrors)
 	}
 
+	// session and client are shared by all requests, so credentials are resolved once and connections are reused
 	if s.session, err = session.NewSession(awsConfig); err != nil {
 		return err
 	}
+	s.client = s3.New(s.session)
+	if s.sseCustomerKey, err = loadSSECustomerKey(s.Config.SSECustomerKey, s.Config.SSECustomerKeyFile); err != nil {
+		return err
+	}
+	if s.Config.AutoCreateBucket {
+		return s.createBucket(context.Background())
+	}
+	return nil
+}
+
+// createBucket - create s3.bucket when it doesn't exist, with object lock enabled when s3.object_lock_mode is set
+func (s *S3) createBucket(ctx context.Context) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.Config.Bucket)})
+	if err == nil {
+		return nil
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != http.StatusNotFound {
+		return fmt.Errorf("can't check bucket '%s' with %v", s.Config.Bucket, err)
+	}
+	input := &s3.CreateBucketInput{Bucket: aws.String(s.Config.Bucket)}
+	// us-east-1 is default location and can't be passed as location constraint
+	if s.Config.Region != "" && s.Config.Region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(s.Config.Region)}
+	}
+	if s.Config.ObjectLockMode != "" {
+		input.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	if _, err := s.client.CreateBucketWithContext(ctx, input); err != nil {
+		// bucket is created by another host at the same time
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+			return nil
+		}
+		return fmt.Errorf("can't create bucket '%s' with %v", s.Config.Bucket, err)
+	}
+	log.Printf("Bucket '%s' is created", s.Config.Bucket)
 	return nil
 }
 
+// loadSSECustomerKey - base64 encoded 256-bit key from s3.sse_customer_key or file s3.sse_customer_key_file
+func loadSSECustomerKey(key, keyFile string) (string, error) {
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("can't read s3.sse_customer_key_file with %v", err)
+		}
+		key = string(data)
+	}
+	if key == "" {
+		return "", nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return "", fmt.Errorf("can't decode SSE-C key with %v", err)
+	}
+	if len(raw) != 32 {
+		return "", fmt.Errorf("SSE-C key must be 32 bytes, got %d", len(raw))
+	}
+	return string(raw), nil
+}
+
+// sseCustomerAlgorithm - SSE-C headers are required for every read of objects uploaded with SSE-C
+func (s *S3) sseCustomerAlgorithm() (*string, *string) {
+	if s.sseCustomerKey == "" {
+		return nil, nil
+	}
+	return aws.String("AES256"), aws.String(s.sseCustomerKey)
+}
+
+func (s *S3) getObjectInput(key string) *s3.GetObjectInput {
+	algorithm, customerKey := s.sseCustomerAlgorithm()
+	return &s3.GetObjectInput{
+		Bucket:               aws.String(s.Config.Bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+	}
+}
+
+// retryer - SDK backoff with s3.max_retries attempts, 'adaptive' s3.retry_mode waits longer after throttling errors like SlowDown
+func (s *S3) retryer() client.DefaultRetryer {
+	retryer := client.DefaultRetryer{NumMaxRetries: s.Config.MaxRetries}
+	if s.Config.RetryMode == "adaptive" {
+		retryer.MinThrottleDelay = time.Second
+		retryer.MaxThrottleDelay = time.Minute
+	}
+	return retryer
+}
+
+// webIdentityProvider - exchange token from s3.web_identity_token_file for credentials of s3.web_identity_role_arn,
+// AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN set by EKS for IRSA are used by default, nil means web identity isn't configured
+func (s *S3) webIdentityProvider() (credentials.Provider, error) {
+	tokenFile, roleARN := s.Config.WebIdentityTokenFile, s.Config.WebIdentityRoleARN
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if tokenFile == "" || roleARN == "" {
+		return nil, nil
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = s.Config.RoleSessionName
+	}
+	// AssumeRoleWithWebIdentity is authorized by the token, request is not signed
+	stsSession, err := session.NewSession(&aws.Config{
+		Credentials: credentials.AnonymousCredentials,
+		Region:      aws.String(s.Config.Region),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't create STS session with %v", err)
+	}
+	provider := stscreds.NewWebIdentityRoleProvider(sts.New(stsSession), roleARN, sessionName, tokenFile)
+	provider.ExpiryWindow = s3CredentialsExpiryWindow
+	return provider, nil
+}
+
 func (s *S3) Kind() string {
 	return "S3"
 }
 
-func (s *S3) GetFileReader(key string) (io.ReadCloser, error) {
-	svc := s3.New(s.session)
-	req, resp := svc.GetObjectRequest(&s3.GetObjectInput{
+func (s *S3) CheckBucket(ctx context.Context) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(s.Config.Bucket),
-		Key:    aws.String(key),
 	})
+	return err
+}
+
+// s3ArchiveStorageClasses - objects in these classes can't be read before they are restored
+var s3ArchiveStorageClasses = map[string]bool{
+	s3.StorageClassGlacier:     true,
+	s3.StorageClassDeepArchive: true,
+}
+
+// s3StorageClasses - allowed values of s3.storage_class, empty means default class of bucket
+var s3StorageClasses = map[string]bool{
+	"":                                true,
+	s3.StorageClassStandard:           true,
+	s3.StorageClassStandardIa:         true,
+	s3.StorageClassOnezoneIa:          true,
+	s3.StorageClassGlacier:            true,
+	"GLACIER_IR":                      true,
+	s3.StorageClassDeepArchive:        true,
+	s3.StorageClassIntelligentTiering: true,
+}
+
+// checkArchiveTier - refuse to read object from archive storage class until it is restored by 'restore-object',
+// restore is the x-amz-restore header of object
+func checkArchiveTier(key string, storageClass, restore *string) error {
+	class := aws.StringValue(storageClass)
+	if !s3ArchiveStorageClasses[class] {
+		return nil
+	}
+	switch {
+	case strings.Contains(aws.StringValue(restore), `ongoing-request="false"`):
+		return nil
+	case strings.Contains(aws.StringValue(restore), `ongoing-request="true"`):
+		return fmt.Errorf("'%s' is in %s storage class and its restore is not finished yet", key, class)
+	}
+	return fmt.Errorf("'%s' is in %s storage class, restore it with 'aws s3api restore-object' before download", key, class)
+}
+
+// objectTagging - URL-encoded s3.object_tags of object, {backup}, {date} and {hostname} in values are replaced
+// with name of backup which object belongs to, current UTC date and hostname, $VAR and ${VAR} with environment variables
+func objectTagging(tags map[string]string, basePath, key string, now time.Time) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	replacer := strings.NewReplacer("{backup}", backupNameOfKey(basePath, key), "{date}", now.UTC().Format("2006-01-02"), "{hostname}", hostname)
+	values := url.Values{}
+	for name, value := range tags {
+		values.Set(name, os.ExpandEnv(replacer.Replace(value)))
+	}
+	return aws.String(values.Encode())
+}
+
+// checkObjectLock - ErrObjectLocked when retention is not expired or legal hold is set
+func checkObjectLock(retainUntil *time.Time, legalHold *string, now time.Time) error {
+	if aws.StringValue(legalHold) == s3.ObjectLockLegalHoldStatusOn {
+		return fmt.Errorf("%w by legal hold", ErrObjectLocked)
+	}
+	if retainUntil != nil && retainUntil.After(now) {
+		return fmt.Errorf("%w until %s", ErrObjectLocked, retainUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// GetFileReader - stream object, objects bigger than part_size are downloaded by download_concurrency parallel range requests
+func (s *S3) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	head, err := s.headObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArchiveTier(key, head.StorageClass, head.Restore); err != nil {
+		return nil, err
+	}
+	if size := aws.Int64Value(head.ContentLength); s.Config.DownloadConcurrency > 1 && s.Config.PartSize > 0 && size > s.Config.PartSize {
+		getPart := func(ctx context.Context, offset, end int64) s3Part {
+			return s.getPart(ctx, key, offset, end)
+		}
+		return newParallelReader(ctx, partRanges(size, s.Config.PartSize), s.Config.DownloadConcurrency, getPart), nil
+	}
+	req, resp := s.client.GetObjectRequest(s.getObjectInput(key))
+	req.SetContext(ctx)
 	if err := req.Send(); err != nil {
 		return nil, err
 	}
+	// ETag is MD5 of content only for objects uploaded by single request without SSE-KMS and SSE-C
+	etag := strings.Trim(aws.StringValue(resp.ETag), `"`)
+	if len(etag) == md5.Size*2 && aws.StringValue(resp.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms && resp.SSECustomerAlgorithm == nil {
+		return &md5VerifyingReader{ReadCloser: resp.Body, hash: md5.New(), expected: etag, key: key}, nil
+	}
+	return resp.Body, nil
+}
+
+// GetFileReaderWithOffset - read object from offset by ranged GET, used to resume interrupted download
+func (s *S3) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return s.GetFileReader(ctx, key)
+	}
+	return s.getRange(ctx, key, fmt.Sprintf("bytes=%d-", offset))
+}
+
+// GetFileRange - read length bytes from offset by one ranged GET, object is never downloaded by parallel requests
+func (s *S3) GetFileRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.getRange(ctx, key, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+}
 
+func (s *S3) getRange(ctx context.Context, key, byteRange string) (io.ReadCloser, error) {
+	head, err := s.headObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArchiveTier(key, head.StorageClass, head.Restore); err != nil {
+		return nil, err
+	}
+	input := s.getObjectInput(key)
+	input.Range = aws.String(byteRange)
+	req, resp := s.client.GetObjectRequest(input)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
 	return resp.Body, nil
 }
 
-func (s *S3) PutFile(key string, r io.ReadCloser) error {
-	uploader := s3manager.NewUploader(s.session)
-	uploader.Concurrency = 10
+// md5VerifyingReader - return error instead of EOF when MD5 of content doesn't match ETag
+type md5VerifyingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+	key      string
+}
+
+func (r *md5VerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(r.hash.Sum(nil)); actual != r.expected {
+			return n, fmt.Errorf("MD5 of '%s' is %s, but ETag is %s", r.key, actual, r.expected)
+		}
+	}
+	return n, err
+}
+
+// s3Part - downloaded range of object
+type s3Part struct {
+	data []byte
+	err  error
+}
+
+// s3ParallelReader - read object parts in order while next download_concurrency parts are being downloaded,
+// memory usage is limited by (download_concurrency + 1) * part_size
+type s3ParallelReader struct {
+	order  chan chan s3Part
+	cancel context.CancelFunc
+	buf    []byte
+	err    error
+}
+
+// partRanges - inclusive byte ranges of parts of object, the last part can be smaller than partSize
+func partRanges(size, partSize int64) [][2]int64 {
+	ranges := [][2]int64{}
+	for offset := int64(0); offset < size; offset += partSize {
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, [2]int64{offset, end})
+	}
+	return ranges
+}
+
+func newParallelReader(ctx context.Context, ranges [][2]int64, concurrency int, getPart func(ctx context.Context, offset, end int64) s3Part) *s3ParallelReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &s3ParallelReader{
+		order:  make(chan chan s3Part, concurrency),
+		cancel: cancel,
+	}
+	go func() {
+		defer close(r.order)
+		for _, part := range ranges {
+			result := make(chan s3Part, 1)
+			select {
+			case r.order <- result:
+			case <-ctx.Done():
+				return
+			}
+			go func(offset, end int64) {
+				result <- getPart(ctx, offset, end)
+			}(part[0], part[1])
+		}
+	}()
+	return r
+}
+
+func (s *S3) getPart(ctx context.Context, key string, offset, end int64) s3Part {
+	input := s.getObjectInput(key)
+	input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, end))
+	resp, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return s3Part{err: err}
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil && int64(len(data)) != end-offset+1 {
+		err = fmt.Errorf("got %d bytes of range %d-%d of '%s'", len(data), offset, end, key)
+	}
+	return s3Part{data: data, err: err}
+}
+
+func (r *s3ParallelReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		result, ok := <-r.order
+		if !ok {
+			return 0, io.EOF
+		}
+		part := <-result
+		if part.err != nil {
+			r.err = part.err
+			return 0, r.err
+		}
+		r.buf = part.data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *s3ParallelReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (s *S3) PutFile(ctx context.Context, key string, r io.ReadCloser) error {
+	uploader := s3manager.NewUploaderWithClient(s.client)
+	uploader.Concurrency = s.Config.Concurrency
 	uploader.PartSize = s.Config.PartSize
-	var sse *string
+	algorithm, customerKey := s.sseCustomerAlgorithm()
+	var sse, sseKMSKeyID, storageClass *string
 	if s.Config.SSE != "" {
 		sse = aws.String(s.Config.SSE)
 	}
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		ACL:                  aws.String(s.Config.ACL),
-		Bucket:               aws.String(s.Config.Bucket),
-		Key:                  aws.String(key),
-		Body:                 r,
-		ServerSideEncryption: sse,
+	if s.Config.SSEKMSKeyID != "" {
+		sseKMSKeyID = aws.String(s.Config.SSEKMSKeyID)
+	}
+	if s.Config.StorageClass != "" {
+		storageClass = aws.String(s.Config.StorageClass)
+	}
+	// Content-MD5 required by Object Lock is computed by SDK for each part, so corrupted parts are rejected by S3
+	var lockMode, legalHold *string
+	var retainUntil *time.Time
+	if s.Config.ObjectLockMode != "" {
+		lockMode = aws.String(s.Config.ObjectLockMode)
+		retainUntil = aws.Time(time.Now().AddDate(0, 0, s.Config.ObjectLockDays))
+	}
+	if s.Config.ObjectLockLegalHold {
+		legalHold = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		ACL:                       aws.String(s.Config.ACL),
+		Bucket:                    aws.String(s.Config.Bucket),
+		Key:                       aws.String(key),
+		Body:                      r,
+		ServerSideEncryption:      sse,
+		SSEKMSKeyId:               sseKMSKeyID,
+		SSECustomerAlgorithm:      algorithm,
+		SSECustomerKey:            customerKey,
+		StorageClass:              storageClass,
+		ObjectLockMode:            lockMode,
+		ObjectLockRetainUntilDate: retainUntil,
+		ObjectLockLegalHoldStatus: legalHold,
+		Tagging:                   objectTagging(s.Config.ObjectTags, s.Config.Path, key, time.Now()),
 	})
 	return err
 }
 
-func (s *S3) DeleteFile(key string) error {
+// DeleteFile - delete object, objects uploaded with s3.object_lock_* settings are checked first and ErrObjectLocked is returned
+// while they are protected, because in versioned bucket deleting them would only hide locked versions behind delete marker
+func (s *S3) DeleteFile(ctx context.Context, key string) error {
+	if s.Config.ObjectLockMode != "" || s.Config.ObjectLockLegalHold {
+		head, err := s.headObject(ctx, key)
+		if err != nil {
+			return err
+		}
+		if err := checkObjectLock(head.ObjectLockRetainUntilDate, head.ObjectLockLegalHoldStatus, time.Now()); err != nil {
+			return err
+		}
+	}
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.Config.Bucket),
 		Key:    aws.String(key),
 	}
 
-	_, err := s3.New(s.session).DeleteObject(params)
+	_, err := s.client.DeleteObjectWithContext(ctx, params)
 	if err != nil {
 		return errors.Wrapf(err, "DeleteFile, deleting object %+v", params)
 	}
 	return nil
 }
 
-func (s *S3) GetFile(key string) (RemoteFile, error) {
-	svc := s3.New(s.session)
-	head, err := svc.HeadObject(&s3.HeadObjectInput{
+// DeleteFiles - delete up to 1000 objects by one DeleteObjects request, lock of the first object is checked like in DeleteFile
+func (s *S3) DeleteFiles(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if s.Config.ObjectLockMode != "" || s.Config.ObjectLockLegalHold {
+		head, err := s.headObject(ctx, keys[0])
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			if err := checkObjectLock(head.ObjectLockRetainUntilDate, head.ObjectLockLegalHoldStatus, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+	resp, err := s.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
 		Bucket: aws.String(s.Config.Bucket),
-		Key:    aws.String(key),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("can't delete %d objects with %v", len(keys), err)
+	}
+	if len(resp.Errors) > 0 {
+		e := resp.Errors[0]
+		return fmt.Errorf("can't delete '%s' and %d other objects with %s: %s", aws.StringValue(e.Key), len(resp.Errors)-1, aws.StringValue(e.Code), aws.StringValue(e.Message))
+	}
+	return nil
+}
+
+func (s *S3) GetFile(ctx context.Context, key string) (RemoteFile, error) {
+	head, err := s.headObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{*head.ContentLength, *head.LastModified, key}, nil
+}
+
+func (s *S3) headObject(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	algorithm, customerKey := s.sseCustomerAlgorithm()
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(s.Config.Bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
 	})
 	if err != nil {
 		aerr, ok := err.(awserr.Error)
@@ -126,18 +596,18 @@ func (s *S3) GetFile(key string) (RemoteFile, error) {
 		}
 		return nil, err
 	}
-	return &s3File{*head.ContentLength, *head.LastModified, key}, nil
+	return head, nil
 }
 
-func (s *S3) Walk(s3Path string, process func(r RemoteFile)) error {
-	return s.remotePager(s.Config.Path, false, func(page *s3.ListObjectsV2Output) {
+func (s *S3) Walk(ctx context.Context, s3Path string, process func(r RemoteFile)) error {
+	return s.remotePager(ctx, s3Path, false, func(page *s3.ListObjectsV2Output) {
 		for _, c := range page.Contents {
 			process(&s3File{*c.Size, *c.LastModified, *c.Key})
 		}
 	})
 }
 
-func (s *S3) remotePager(s3Path string, delim bool, pager func(page *s3.ListObjectsV2Output)) error {
+func (s *S3) remotePager(ctx context.Context, s3Path string, delim bool, pager func(page *s3.ListObjectsV2Output)) error {
 	params := &s3.ListObjectsV2Input{
 		Bucket:  aws.String(s.Config.Bucket), // Required
 		MaxKeys: aws.Int64(1000),
@@ -152,7 +622,7 @@ func (s *S3) remotePager(s3Path string, delim bool, pager func(page *s3.ListObje
 		pager(page)
 		return true
 	}
-	return s3.New(s.session).ListObjectsV2Pages(params, wrapper)
+	return s.client.ListObjectsV2PagesWithContext(ctx, params, wrapper)
 }
 
 type s3File struct {
@@ -0,0 +1,187 @@
+package chbackup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckArchiveTier(t *testing.T) {
+	assert.NoError(t, checkArchiveTier("backup.tar.gz", nil, nil))
+	assert.NoError(t, checkArchiveTier("backup.tar.gz", aws.String("STANDARD_IA"), nil))
+	assert.NoError(t, checkArchiveTier("backup.tar.gz", aws.String("GLACIER_IR"), nil))
+	assert.Error(t, checkArchiveTier("backup.tar.gz", aws.String("GLACIER"), nil))
+	assert.Error(t, checkArchiveTier("backup.tar.gz", aws.String("DEEP_ARCHIVE"), aws.String(`ongoing-request="true"`)))
+	assert.NoError(t, checkArchiveTier("backup.tar.gz", aws.String("DEEP_ARCHIVE"),
+		aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)))
+}
+
+func TestLoadSSECustomerKey(t *testing.T) {
+	key, err := loadSSECustomerKey("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", key)
+	key, err = loadSSECustomerKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", key)
+	_, err = loadSSECustomerKey("c2hvcnQ=", "")
+	assert.Error(t, err)
+}
+
+func TestCheckObjectLock(t *testing.T) {
+	now := time.Now()
+	assert.NoError(t, checkObjectLock(nil, nil, now))
+	assert.NoError(t, checkObjectLock(aws.Time(now.Add(-time.Hour)), aws.String("OFF"), now))
+	assert.True(t, errors.Is(checkObjectLock(aws.Time(now.Add(time.Hour)), nil, now), ErrObjectLocked))
+	assert.True(t, errors.Is(checkObjectLock(nil, aws.String("ON"), now), ErrObjectLocked))
+}
+
+func TestObjectTagging(t *testing.T) {
+	now := time.Date(2020, 7, 1, 23, 0, 0, 0, time.UTC)
+	assert.Nil(t, objectTagging(nil, "backups", "backups/b1.tar.gz", now))
+	tagging := objectTagging(map[string]string{"backup": "{backup}", "date": "{date}"}, "backups", "backups/b1.tar.gz", now)
+	assert.Equal(t, "backup=b1&date=2020-07-01", aws.StringValue(tagging))
+	tagging = objectTagging(map[string]string{"backup": "{backup}"}, "", "b2/shadow/default/t1/all_1_1_0.tar", now)
+	assert.Equal(t, "backup=b2", aws.StringValue(tagging))
+}
+
+func TestMD5VerifyingReader(t *testing.T) {
+	reader := &md5VerifyingReader{ReadCloser: ioutil.NopCloser(strings.NewReader("hello")), hash: md5.New(), expected: "5d41402abc4b2a76b9719d911017c592"}
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	reader = &md5VerifyingReader{ReadCloser: ioutil.NopCloser(strings.NewReader("hellO")), hash: md5.New(), expected: "5d41402abc4b2a76b9719d911017c592"}
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+}
+
+func TestPartRanges(t *testing.T) {
+	assert.Equal(t, [][2]int64{{0, 3}, {4, 7}, {8, 9}}, partRanges(10, 4))
+	assert.Equal(t, [][2]int64{{0, 3}, {4, 7}}, partRanges(8, 4))
+	assert.Equal(t, [][2]int64{{0, 2}}, partRanges(3, 4))
+	assert.Empty(t, partRanges(0, 4))
+}
+
+func TestParallelReader(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	var running, maxRunning int32
+	getPart := func(ctx context.Context, offset, end int64) s3Part {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		// the first parts are downloaded the last, but they are read in order
+		time.Sleep(time.Duration(len(data)-int(offset)) * time.Millisecond)
+		return s3Part{data: data[offset : end+1]}
+	}
+	r := newParallelReader(context.Background(), partRanges(int64(len(data)), 3), 2, getPart)
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.NoError(t, r.Close())
+	assert.True(t, atomic.LoadInt32(&maxRunning) <= 3)
+
+	// error of part is returned after previous parts are read
+	getPart = func(ctx context.Context, offset, end int64) s3Part {
+		if offset >= 6 {
+			return s3Part{err: errors.New("part failed")}
+		}
+		return s3Part{data: data[offset : end+1]}
+	}
+	out, err = ioutil.ReadAll(newParallelReader(context.Background(), partRanges(int64(len(data)), 3), 2, getPart))
+	assert.EqualError(t, err, "part failed")
+	assert.Equal(t, data[:6], out)
+
+	// Close cancels downloads of parts which aren't read yet
+	started := make(chan struct{}, len(data))
+	getPart = func(ctx context.Context, offset, end int64) s3Part {
+		started <- struct{}{}
+		<-ctx.Done()
+		return s3Part{err: ctx.Err()}
+	}
+	r = newParallelReader(context.Background(), partRanges(int64(len(data)), 3), 2, getPart)
+	<-started
+	assert.NoError(t, r.Close())
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, context.Canceled, err)
+}
+
+type s3TestObject struct {
+	Key          string
+	LastModified string
+	Size         int64
+}
+
+// fakeS3Server - serve ListObjectsV2 for path style bucket 'test' with objects named by keys
+func fakeS3Server(t *testing.T, keys []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test" || r.URL.Query().Get("list-type") != "2" {
+			http.NotFound(w, r)
+			return
+		}
+		prefix := r.URL.Query().Get("prefix")
+		contents := []s3TestObject{}
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				contents = append(contents, s3TestObject{Key: key, LastModified: "2020-07-01T00:00:00.000Z", Size: 7})
+			}
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		require.NoError(t, xml.NewEncoder(w).Encode(struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			IsTruncated bool
+			Contents    []s3TestObject
+		}{Name: "test", Prefix: prefix, KeyCount: len(contents), Contents: contents}))
+	}))
+}
+
+func TestS3Walk(t *testing.T) {
+	server := fakeS3Server(t, []string{
+		"backups/backup1.tar.gz",
+		"backups/cas/objects/ab/abcd",
+		"other/backup3.tar.gz",
+	})
+	defer server.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	require.NoError(t, err)
+	s := &S3{client: s3.New(sess), Config: &S3Config{Bucket: "test", Path: "backups"}}
+
+	names := []string{}
+	require.NoError(t, s.Walk(context.Background(), "backups/cas/", func(f RemoteFile) {
+		names = append(names, f.Name())
+		assert.Equal(t, int64(7), f.Size())
+	}))
+	assert.Equal(t, []string{"backups/cas/objects/ab/abcd"}, names)
+
+	names = []string{}
+	require.NoError(t, s.Walk(context.Background(), "", func(f RemoteFile) {
+		names = append(names, f.Name())
+	}))
+	assert.Len(t, names, 3)
+}
@@ -1,6 +1,7 @@
 package chbackup
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,60 +9,190 @@ import (
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/sync/semaphore"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type APIServer struct {
-	config  Config
-	lock    *semaphore.Weighted
-	server  *http.Server
-	restart chan bool
-	status  AsyncStatus
-	metrics Metrics
+	config     Config
+	configPath string
+	locks      *commandLocks
+	server     *http.Server
+	routes     *routesSwitch
+	restart    chan *Config
+	status     AsyncStatus
+	metrics    Metrics
+	audit      *auditLog
+	history    *operationHistory
+	limits     *requestLimits
+	watch      watchSlot
+	// settings - guards config, audit and history which are replaced by config reload
+	settings sync.RWMutex
+	// running - async jobs which must be finished or cancelled before exit
+	running sync.WaitGroup
+	// draining - set during shutdown, new jobs are refused
+	draining int32
 }
 
+const (
+	// apiV1Prefix - versioned prefix for /backup/* routes
+	apiV1Prefix = "/api/v1"
+
+	// asyncJobsLimit - how many finished jobs are kept for /backup/status
+	asyncJobsLimit = 100
+
+	JobInProgress = "in progress"
+	JobSuccess    = "success"
+	JobError      = "error"
+	JobCancelled  = "cancelled"
+)
+
 type AsyncStatus struct {
-	active map[string]AsyncInfo
+	jobs  map[string]*AsyncJob
+	order []string
 	sync.RWMutex
 }
 
-type AsyncInfo struct {
-	Command string
-	Name    string
-	Started int64
+// AsyncJob - state of operation started by API in background
+type AsyncJob struct {
+	ID        string
+	RequestID string
+	Command   string
+	Name      string
+	Status    string
+	Progress  *Progress `json:",omitempty"`
+	// BytesTransferred and Speed in bytes per second - for upload and download, Speed is average when job is finished
+	BytesTransferred int64   `json:",omitempty"`
+	Speed            float64 `json:",omitempty"`
+	Started          int64
+	Finished         int64  `json:",omitempty"`
+	Error            string `json:",omitempty"`
+	cancel           context.CancelFunc
+	meter            *transferMeter
+	meterStart       int64
 }
 
-func (status *AsyncStatus) start(command, name string) string {
+func (status *AsyncStatus) start(requestID, command, name string, cancel context.CancelFunc) string {
 	status.Lock()
 	defer status.Unlock()
 	id := uuid.New().String()
-	status.active[id] = AsyncInfo{
-		Command: command,
-		Name:    name,
-		Started: time.Now().Unix(),
+	status.jobs[id] = &AsyncJob{
+		ID:        id,
+		RequestID: requestID,
+		Command:   command,
+		Name:      name,
+		Status:    JobInProgress,
+		Started:   time.Now().Unix(),
+		cancel:    cancel,
+	}
+	if meter := transferMeterFor(command); meter != nil {
+		status.jobs[id].meter, status.jobs[id].meterStart = meter, meter.Total()
+	}
+	status.order = append(status.order, id)
+	if len(status.order) > asyncJobsLimit {
+		for i, jobID := range status.order {
+			if status.jobs[jobID].Status != JobInProgress {
+				delete(status.jobs, jobID)
+				status.order = append(status.order[:i], status.order[i+1:]...)
+				break
+			}
+		}
 	}
 	return id
 }
 
-func (status *AsyncStatus) stop(id string) {
+func (status *AsyncStatus) stop(id string, err error) {
 	status.Lock()
 	defer status.Unlock()
-	delete(status.active, id)
+	job, ok := status.jobs[id]
+	if !ok {
+		return
+	}
+	job.Finished = time.Now().Unix()
+	job.Status = JobSuccess
+	job.cancel()
+	if job.meter != nil {
+		job.BytesTransferred = job.meter.Total() - job.meterStart
+		job.Speed = 0
+		if duration := job.Finished - job.Started; duration > 0 {
+			job.Speed = float64(job.BytesTransferred) / float64(duration)
+		}
+	}
+	switch {
+	case err == context.Canceled:
+		job.Status = JobCancelled
+	case err != nil:
+		job.Status = JobError
+		job.Error = err.Error()
+	}
 }
 
-func (status *AsyncStatus) status() map[string]AsyncInfo {
+// cancelJob - cancel context of running job
+func (status *AsyncStatus) cancelJob(id string) error {
+	status.Lock()
+	defer status.Unlock()
+	job, ok := status.jobs[id]
+	if !ok {
+		return fmt.Errorf("%w: '%s'", ErrJobNotFound, id)
+	}
+	if job.Status != JobInProgress {
+		return fmt.Errorf("%w: job '%s' is already finished", ErrBadRequest, id)
+	}
+	job.cancel()
+	return nil
+}
+
+// cancelAll - cancel all running jobs
+func (status *AsyncStatus) cancelAll() {
+	status.Lock()
+	defer status.Unlock()
+	for _, job := range status.jobs {
+		if job.Status == JobInProgress {
+			job.cancel()
+		}
+	}
+}
+
+// get - return copy of job with actual progress, empty id means the latest job
+func (status *AsyncStatus) get(id string) (AsyncJob, bool) {
 	status.RLock()
 	defer status.RUnlock()
-	return status.active
+	if id == "" {
+		if len(status.order) == 0 {
+			return AsyncJob{}, false
+		}
+		id = status.order[len(status.order)-1]
+	}
+	job, ok := status.jobs[id]
+	if !ok {
+		return AsyncJob{}, false
+	}
+	result := *job
+	if result.Status == JobInProgress {
+		if progress, ok := GetProgress(result.ID); ok {
+			result.Progress = &progress
+		}
+		if result.meter != nil {
+			result.BytesTransferred = result.meter.Total() - result.meterStart
+			result.Speed = result.meter.Speed()
+		}
+	}
+	return result, true
 }
 
 type APIResult struct {
@@ -69,6 +200,11 @@ type APIResult struct {
 	Message string
 }
 
+type APIAsyncResult struct {
+	Type  string
+	JobID string
+}
+
 type APIGenericResult struct {
 	Type   string
 	Result interface{}
@@ -86,89 +222,551 @@ type APITablesResult struct {
 
 var (
 	ErrAPILocked = errors.New("Another operation is currently running")
+	// ErrBadRequest - wrapped by errors caused by invalid request parameters
+	ErrBadRequest  = errors.New("bad request")
+	ErrJobNotFound = errors.New("job not found")
+	// ErrAPIShutdown - returned when API server is shutting down
+	ErrAPIShutdown = errors.New("API server is shutting down")
 )
 
-// Server - expose CLI commands as REST API
-func Server(config Config) error {
+// Server - expose CLI commands as REST API, config is reloaded from configPath on SIGHUP,
+// watch cycles are started with server when watch is set
+func Server(config Config, configPath string, watch bool) error {
+	locks, err := newCommandLocks(config.API.AllowParallel)
+	if err != nil {
+		return err
+	}
 	api := APIServer{
-		config:  config,
-		lock:    semaphore.NewWeighted(1),
-		restart: make(chan bool),
+		config:     config,
+		configPath: configPath,
+		locks:      locks,
+		restart:    make(chan *Config),
 		status: AsyncStatus{
-			map[string]AsyncInfo{},
-			sync.RWMutex{},
+			jobs: map[string]*AsyncJob{},
 		},
 	}
 	api.metrics = setupMetrics()
+	if api.metrics.state, err = loadMetricsState(config.API.MetricsStateFile); err != nil {
+		return err
+	}
+	api.metrics.restoreState()
+	api.audit = newAuditLog(api.config.API.AuditLog)
+	api.limits = newRequestLimits(api.config.API)
+	if api.history, err = loadOperationHistory(config.API.HistoryFile, config.API.HistorySize); err != nil {
+		return err
+	}
 
+	inventoryDone := make(chan struct{})
+	defer close(inventoryDone)
+	go api.refreshInventoryMetrics(inventoryDone)
+	if watch {
+		if err := api.startServerWatch(config); err != nil {
+			return fmt.Errorf("can't start watch with %v", err)
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	server, err := api.newServer(api.config)
+	if err != nil {
+		return err
+	}
+	api.serve(server)
 	for {
-		api.server = api.setupAPIServer(api.config)
-		go func() {
-			log.Printf("Starting API server on %s", api.config.API.ListenAddr)
-			if err := api.server.ListenAndServe(); err != http.ErrServerClosed {
-				log.Printf("Error starting API server: %v", err)
-				os.Exit(1)
+		previous := api.snapshot().config.API
+		restart := false
+		select {
+		case newConfig := <-api.restart:
+			restart = api.applyConfig(newConfig)
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading config from %s", configPath)
+			newConfig, err := LoadConfig(configPath)
+			if err != nil {
+				log.Printf("Can't reload config, the current config is kept: %v", err)
+				continue
 			}
-		}()
-		_ = <-api.restart
-		api.server.Close()
-		log.Printf("Reloading config and restarting API server.")
+			restart = api.applyConfig(newConfig)
+		case sig := <-stop:
+			log.Printf("Received %s, shutting down API server", sig)
+			return api.shutdown(server)
+		}
+		if !restart {
+			continue
+		}
+		next, err := api.newServer(api.snapshot().config)
+		if err != nil {
+			log.Printf("Can't restart API server, the previous listener is kept: %v", err)
+			api.keepListener(previous)
+			continue
+		}
+		api.shutdownServer(server)
+		log.Printf("Restarting API server.")
+		server = next
+		api.serve(server)
 	}
-	return nil
 }
 
-// setupAPIServer - resister API routes
+// newServer - create HTTP server for config, TLS is set up first so a broken certificate doesn't replace routes of running server
+func (api *APIServer) newServer(config Config) (*http.Server, error) {
+	tlsConfig, err := setupTLS(config.API)
+	if err != nil {
+		return nil, fmt.Errorf("can't setup TLS for API server with %v", err)
+	}
+	server := api.setupAPIServer(config)
+	server.TLSConfig = tlsConfig
+	api.server = server
+	return server, nil
+}
+
+// serve - start listener in background, process exits when listener can't be started
+func (api *APIServer) serve(server *http.Server) {
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("Starting API server on %s with TLS", server.Addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting API server on %s", server.Addr)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Printf("Error starting API server: %v", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// keepListener - restore listener settings of running server after failed restart,
+// so the next reload with the same settings tries to restart it again
+func (api *APIServer) keepListener(previous APIConfig) {
+	api.settings.Lock()
+	defer api.settings.Unlock()
+	api.config.API.ListenAddr = previous.ListenAddr
+	api.config.API.TLSCert = previous.TLSCert
+	api.config.API.TLSKey = previous.TLSKey
+	api.config.API.TLSClientCA = previous.TLSClientCA
+}
+
+// apiSnapshot - reloadable state of API server taken under one lock
+type apiSnapshot struct {
+	config  Config
+	audit   *auditLog
+	history *operationHistory
+}
+
+// snapshot - current config, audit log and history, safe to use while config is reloaded
+func (api *APIServer) snapshot() apiSnapshot {
+	api.settings.RLock()
+	defer api.settings.RUnlock()
+	return apiSnapshot{config: api.config, audit: api.audit, history: api.history}
+}
+
+// listenerChanged - check if new config requires restart of listener
+func listenerChanged(current, updated APIConfig) bool {
+	return current.ListenAddr != updated.ListenAddr ||
+		current.TLSCert != updated.TLSCert ||
+		current.TLSKey != updated.TLSKey ||
+		current.TLSClientCA != updated.TLSClientCA
+}
+
+// applyConfig - apply validated config, routes are replaced in place,
+// returns true when listener must be restarted
+func (api *APIServer) applyConfig(newConfig *Config) bool {
+	current := api.snapshot()
+	restart := listenerChanged(current.config.API, newConfig.API)
+	history := current.history
+	if current.config.API.HistoryFile != newConfig.API.HistoryFile || current.config.API.HistorySize != newConfig.API.HistorySize {
+		if loaded, err := loadOperationHistory(newConfig.API.HistoryFile, newConfig.API.HistorySize); err != nil {
+			log.Printf("Can't apply api.history_file: %v", err)
+		} else {
+			history = loaded
+		}
+	}
+	if current.config.API.MetricsStateFile != newConfig.API.MetricsStateFile {
+		if state, err := loadMetricsState(newConfig.API.MetricsStateFile); err != nil {
+			log.Printf("Can't apply api.metrics_state_file: %v", err)
+		} else {
+			api.metrics.state.replace(state)
+		}
+	}
+	api.settings.Lock()
+	api.config = *newConfig
+	api.audit = newAuditLog(newConfig.API.AuditLog)
+	api.history = history
+	api.settings.Unlock()
+	api.limits.set(newConfig.API)
+	if err := api.locks.setPolicy(newConfig.API.AllowParallel); err != nil {
+		log.Printf("Can't apply api.allow_parallel: %v", err)
+	}
+	if !restart {
+		api.routes.set(api.setupRouter(*newConfig, api.routes.done))
+		log.Printf("Config is applied without restarting API server.")
+	}
+	return restart
+}
+
+// shutdownTimeout - how long to wait for in-flight requests and running jobs
+func (api *APIServer) shutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(api.snapshot().config.API.ShutdownTimeout)
+	if err != nil {
+		return 0
+	}
+	return timeout
+}
+
+// shutdownServer - stop accepting connections and wait for in-flight requests
+func (api *APIServer) shutdownServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), api.shutdownTimeout())
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Can't gracefully shutdown API server: %v", err)
+		server.Close()
+	}
+}
+
+// shutdown - refuse new jobs, drain in-flight requests and wait for running jobs,
+// jobs which don't finish in api.shutdown_timeout are cancelled and rolled back
+func (api *APIServer) shutdown(server *http.Server) error {
+	atomic.StoreInt32(&api.draining, 1)
+	api.stopWatch()
+	timeout := api.shutdownTimeout()
+	deadline := time.After(timeout)
+	api.shutdownServer(server)
+
+	finished := make(chan struct{})
+	go func() {
+		api.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		log.Printf("All jobs are finished")
+		return nil
+	case <-deadline:
+	}
+	log.Printf("Jobs are not finished in %s, cancelling", timeout)
+	api.status.cancelAll()
+	<-finished
+	return ErrAPIShutdown
+}
+
+// routesSwitch - allow to replace routes without restarting listener
+type routesSwitch struct {
+	router *mux.Router
+	// done - closed on shutdown to finish long-lived /backup/events streams
+	done chan struct{}
+	sync.RWMutex
+}
+
+func (rs *routesSwitch) set(router *mux.Router) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.router = router
+}
+
+func (rs *routesSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.RLock()
+	router := rs.router
+	rs.RUnlock()
+	router.ServeHTTP(w, r)
+}
+
+// setupAPIServer - create HTTP server with API routes
 func (api *APIServer) setupAPIServer(config Config) *http.Server {
+	api.routes = &routesSwitch{done: make(chan struct{})}
+	api.routes.set(api.setupRouter(config, api.routes.done))
+	srv := &http.Server{
+		Addr:    config.API.ListenAddr,
+		Handler: accessLogMiddleware(api.limits.middleware(api.routes)),
+	}
+	done := api.routes.done
+	srv.RegisterOnShutdown(func() {
+		close(done)
+	})
+	return srv
+}
+
+// setupRouter - resister API routes
+func (api *APIServer) setupRouter(config Config, done <-chan struct{}) *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpRootHandler).Methods("GET")
 
+	api.registerBackupRoutes(r, config, done)
+	api.registerBackupRoutes(r.PathPrefix(apiV1Prefix).Subrouter(), config, done)
+
+	registerMetricsHandlers(r, config.API)
+	r.HandleFunc("/health/live", httpLiveHandler).Methods("GET")
+	r.HandleFunc("/health/ready", func(w http.ResponseWriter, r *http.Request) {
+		httpReadyHandler(w, r, config)
+	}).Methods("GET")
+	r.HandleFunc("/openapi.json", func(w http.ResponseWriter, req *http.Request) {
+		httpOpenAPIHandler(w, req, r)
+	}).Methods("GET")
+	return r
+}
+
+// registerBackupRoutes - register /backup/* routes, used for both legacy and /api/v1 prefixes
+func (api *APIServer) registerBackupRoutes(r *mux.Router, config Config, done <-chan struct{}) {
+	// NOTE: api.legacy_rest allows GET for mutating routes to support access from ClickHouse itself
+	mutatingMethods := []string{"POST"}
+	if config.API.LegacyREST {
+		mutatingMethods = append(mutatingMethods, "GET")
+	}
+
 	r.HandleFunc("/backup/tables", func(w http.ResponseWriter, r *http.Request) {
 		httpTablesHandler(w, r, config)
 	}).Methods("GET")
 	r.HandleFunc("/backup/list", func(w http.ResponseWriter, r *http.Request) {
 		httpListHandler(w, r, config)
 	}).Methods("GET")
-	r.HandleFunc("/backup/create", func(w http.ResponseWriter, r *http.Request) {
+	// check puts and removes probe object, so it's mutating
+	r.HandleFunc("/backup/check", requireAuth(config.API, func(w http.ResponseWriter, r *http.Request) {
+		httpCheckHandler(w, r, config)
+	})).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/remote/{name}", func(w http.ResponseWriter, r *http.Request) {
+		httpDescribeRemoteHandler(w, r, config)
+	}).Methods("GET")
+	r.HandleFunc("/backup/broken", func(w http.ResponseWriter, r *http.Request) {
+		httpBrokenHandler(w, r, config)
+	}).Methods("GET")
+	r.HandleFunc("/backup/create", requireAuth(config.API, api.audited(config.API, "create", func(w http.ResponseWriter, r *http.Request) {
 		api.httpCreateHandler(w, r, config)
-	}).Methods("POST", "GET") // NOTE: these routes allow GET to support access from ClickHouse itself
-	r.HandleFunc("/backup/clean", func(w http.ResponseWriter, r *http.Request) {
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/clean", requireAuth(config.API, api.audited(config.API, "clean", func(w http.ResponseWriter, r *http.Request) {
 		api.httpCleanHandler(w, r, config)
-	}).Methods("POST", "GET")
-	r.HandleFunc("/backup/freeze", func(w http.ResponseWriter, r *http.Request) {
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/clean/remote_broken", requireAuth(config.API, api.audited(config.API, "clean_remote_broken", func(w http.ResponseWriter, r *http.Request) {
+		api.httpCleanRemoteBrokenHandler(w, r, config)
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/freeze", requireAuth(config.API, api.audited(config.API, "freeze", func(w http.ResponseWriter, r *http.Request) {
 		api.httpFreezeHandler(w, r, config)
-	}).Methods("POST", "GET")
-	r.HandleFunc("/backup/upload/{name}", func(w http.ResponseWriter, r *http.Request) {
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/upload/{name}", requireAuth(config.API, api.audited(config.API, "upload", func(w http.ResponseWriter, r *http.Request) {
 		api.httpUploadHandler(w, r, config)
-	}).Methods("POST", "GET")
-	r.HandleFunc("/backup/download/{name}", func(w http.ResponseWriter, r *http.Request) {
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/download/{name}", requireAuth(config.API, api.audited(config.API, "download", func(w http.ResponseWriter, r *http.Request) {
 		api.httpDownloadHandler(w, r, config)
-	}).Methods("POST", "GET")
-	r.HandleFunc("/backup/restore/{name}", func(w http.ResponseWriter, r *http.Request) {
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/copy/{name}", requireAuth(config.API, api.audited(config.API, "copy", func(w http.ResponseWriter, r *http.Request) {
+		api.httpCopyHandler(w, r, config)
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/restore/{name}", requireAuth(config.API, api.audited(config.API, "restore", func(w http.ResponseWriter, r *http.Request) {
 		api.httpRestoreHandler(w, r, config)
-	}).Methods("POST", "GET")
-	r.HandleFunc("/backup/delete/{where}/{name}", func(w http.ResponseWriter, r *http.Request) {
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/delete/{where}/{name}", requireAuth(config.API, api.audited(config.API, "delete", func(w http.ResponseWriter, r *http.Request) {
 		api.httpDeleteHandler(w, r, config)
-	}).Methods("POST", "GET")
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/create_remote", requireAuth(config.API, api.audited(config.API, "create_remote", func(w http.ResponseWriter, r *http.Request) {
+		api.httpCreateRemoteHandler(w, r, config)
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/restore_remote/{name}", requireAuth(config.API, api.audited(config.API, "restore_remote", func(w http.ResponseWriter, r *http.Request) {
+		api.httpRestoreRemoteHandler(w, r, config)
+	}))).Methods(mutatingMethods...)
+	r.HandleFunc("/backup/verify/{where}/{name}", requireAuth(config.API, api.audited(config.API, "verify", func(w http.ResponseWriter, r *http.Request) {
+		api.httpVerifyHandler(w, r, config)
+	}))).Methods("GET", "POST")
 	r.HandleFunc("/backup/config/default", func(w http.ResponseWriter, r *http.Request) {
 		httpConfigDefaultHandler(w, r, config)
 	}).Methods("GET")
-	r.HandleFunc("/backup/config", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/backup/config", requireAuth(config.API, func(w http.ResponseWriter, r *http.Request) {
 		httpConfigHandler(w, r, config)
-	}).Methods("GET")
-	r.HandleFunc("/backup/config", func(w http.ResponseWriter, r *http.Request) {
+	})).Methods("GET")
+	r.HandleFunc("/backup/config", requireAuth(config.API, api.audited(config.API, "config", func(w http.ResponseWriter, r *http.Request) {
 		api.httpConfigUpdateHandler(w, r, config)
-	}).Methods("POST", "GET")
+	}))).Methods("POST")
+	r.HandleFunc("/backup/config/reload", requireAuth(config.API, api.audited(config.API, "config", func(w http.ResponseWriter, r *http.Request) {
+		api.httpConfigReloadHandler(w, r, config)
+	}))).Methods("POST")
 	r.HandleFunc("/backup/status", func(w http.ResponseWriter, r *http.Request) {
 		api.httpBackupStatusHandler(w, r, config)
 	}).Methods("GET")
+	r.HandleFunc("/backup/status/{job_id}", func(w http.ResponseWriter, r *http.Request) {
+		api.httpBackupStatusHandler(w, r, config)
+	}).Methods("GET")
+	r.HandleFunc("/backup/events", func(w http.ResponseWriter, r *http.Request) {
+		httpEventsHandler(w, r, config, done)
+	}).Methods("GET")
+	r.HandleFunc("/backup/cancel/{job_id}", requireAuth(config.API, api.audited(config.API, "cancel", func(w http.ResponseWriter, r *http.Request) {
+		api.httpCancelHandler(w, r, config)
+	}))).Methods("POST")
+	r.HandleFunc("/backup/actions", requireAuth(config.API, api.audited(config.API, "actions", func(w http.ResponseWriter, r *http.Request) {
+		api.httpActionsHandler(w, r, config)
+	}))).Methods("POST")
+	r.HandleFunc("/backup/watch", requireAuth(config.API, api.audited(config.API, "watch", func(w http.ResponseWriter, r *http.Request) {
+		api.httpWatchHandler(w, r, config)
+	}))).Methods("POST")
+	r.HandleFunc("/backup/watch", func(w http.ResponseWriter, r *http.Request) {
+		api.httpWatchStateHandler(w, r, config)
+	}).Methods("GET")
+	r.HandleFunc("/backup/history", func(w http.ResponseWriter, r *http.Request) {
+		api.httpHistoryHandler(w, r, config)
+	}).Methods("GET")
+	r.HandleFunc("/backup/audit", requireAuth(config.API, func(w http.ResponseWriter, r *http.Request) {
+		api.httpAuditHandler(w, r, config)
+	})).Methods("GET")
+}
 
-	registerMetricsHandlers(r, config.API.EnableMetrics, config.API.EnablePprof)
+// APIError - error response of /api/v1 routes, Code is stable and machine-readable, Message is for humans
+type APIError struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
 
-	srv := &http.Server{
-		Addr:    config.API.ListenAddr,
-		Handler: r,
+// Error codes of APIError
+const (
+	ErrorCodeLocked         = "locked"
+	ErrorCodeShuttingDown   = "shutting_down"
+	ErrorCodeBackupNotFound = "backup_not_found"
+	ErrorCodeJobNotFound    = "job_not_found"
+	ErrorCodeBadRequest     = "bad_request"
+	ErrorCodeUnauthorized   = "unauthorized"
+	ErrorCodeRateLimited    = "rate_limited"
+	ErrorCodeOverloaded     = "overloaded"
+	ErrorCodeObjectLocked   = "object_locked"
+	ErrorCodeBackupRequired = "backup_required"
+	ErrorCodeInternal       = "internal_error"
+)
+
+// remoteConfig - config with remote storage selected by 'remote' query argument
+func remoteConfig(r *http.Request, c Config) (Config, error) {
+	config, err := c.WithRemote(r.URL.Query().Get("remote"))
+	if err != nil {
+		return c, fmt.Errorf("%w: %v", ErrBadRequest, err)
 	}
-	return srv
+	return config, nil
+}
+
+// isAPIv1 - request is made to versioned /api/v1 route
+func isAPIv1(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiV1Prefix+"/")
+}
+
+// errorCode - machine-readable code of error
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrAPILocked):
+		return ErrorCodeLocked
+	case errors.Is(err, ErrAPIShutdown):
+		return ErrorCodeShuttingDown
+	case errors.Is(err, ErrBackupNotFound):
+		return ErrorCodeBackupNotFound
+	case errors.Is(err, ErrJobNotFound):
+		return ErrorCodeJobNotFound
+	case errors.Is(err, ErrBadRequest):
+		return ErrorCodeBadRequest
+	case errors.Is(err, ErrAPIUnauthorized):
+		return ErrorCodeUnauthorized
+	case errors.Is(err, ErrAPIRateLimited):
+		return ErrorCodeRateLimited
+	case errors.Is(err, ErrAPIOverloaded):
+		return ErrorCodeOverloaded
+	case errors.Is(err, ErrObjectLocked):
+		return ErrorCodeObjectLocked
+	case errors.Is(err, ErrBackupRequired):
+		return ErrorCodeBackupRequired
+	}
+	return ErrorCodeInternal
+}
+
+// errorStatusCode - choose HTTP status code for error, legacy is api.legacy_rest for legacy routes
+func errorStatusCode(legacy bool, err error) int {
+	switch {
+	case errors.Is(err, ErrAPILocked) && legacy, errors.Is(err, ErrAPIShutdown), errors.Is(err, ErrAPIOverloaded):
+		return http.StatusServiceUnavailable
+	case legacy:
+		return http.StatusInternalServerError
+	case errors.Is(err, ErrAPILocked):
+		return http.StatusLocked
+	case errors.Is(err, ErrBackupNotFound), errors.Is(err, ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrAPIUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrAPIRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrObjectLocked), errors.Is(err, ErrBackupRequired):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError - write error with suitable HTTP status code, as APIError for /api/v1 and as APIResult for legacy routes
+func writeError(w http.ResponseWriter, r *http.Request, c Config, err error) {
+	if isAPIv1(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatusCode(false, err))
+		out, _ := json.Marshal(APIError{Type: "error", Code: errorCode(err), Message: err.Error()})
+		fmt.Fprintln(w, string(out))
+		return
+	}
+	w.WriteHeader(errorStatusCode(c.API.LegacyREST, err))
+	out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
+	fmt.Fprintln(w, string(out))
+}
+
+// writeResult - write v as JSON
+func writeResult(w http.ResponseWriter, r *http.Request, c Config, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		e := fmt.Errorf("marshal error: %v", err)
+		log.Println(e)
+		writeError(w, r, c, e)
+		return
+	}
+	if isAPIv1(r) {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	fmt.Fprintln(w, string(out))
+}
+
+// listFormat - format of list responses, JSON array is default for /api/v1 and NDJSON for legacy routes
+func listFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	if isAPIv1(r) {
+		return "json"
+	}
+	return "ndjson"
+}
+
+// writeList - write items as JSON array or as newline-delimited JSON objects depends on 'format' query argument
+func writeList(w http.ResponseWriter, r *http.Request, c Config, items []interface{}) {
+	switch format := listFormat(r); format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		writeResult(w, r, c, items)
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, item := range items {
+			out, err := json.Marshal(item)
+			if err != nil {
+				writeError(w, r, c, err)
+				return
+			}
+			fmt.Fprintln(w, string(out))
+		}
+	default:
+		writeError(w, r, c, fmt.Errorf("%w: unknown format '%s', 'json' or 'ndjson' is expected", ErrBadRequest, format))
+	}
+}
+
+// validateBackupName - backup name is used as part of local path and remote key
+func validateBackupName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: backup name is required", ErrBadRequest)
+	}
+	if strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return fmt.Errorf("%w: invalid backup name '%s'", ErrBadRequest, name)
+	}
+	return nil
 }
 
 // httpRootHandler - display API index
@@ -180,405 +778,882 @@ func httpRootHandler(w http.ResponseWriter, r *http.Request) {
 func httpConfigDefaultHandler(w http.ResponseWriter, r *http.Request, c Config) {
 	defaultConfig := DefaultConfig()
 	d, _ := yaml.Marshal(&defaultConfig)
-	out, err := json.Marshal(APIGenericResult{Type: "success", Result: string(d)})
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-		fmt.Fprintf(w, string(out))
-		return
-	}
-	fmt.Fprintln(w, string(out))
+	writeResult(w, r, c, APIGenericResult{Type: "success", Result: string(d)})
 }
 
 // httpConfigDefaultHandler - display the currently running config
 func httpConfigHandler(w http.ResponseWriter, r *http.Request, c Config) {
 	cfg, _ := yaml.Marshal(&c)
-	out, err := json.Marshal(APIGenericResult{Type: "success", Result: string(cfg)})
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-		fmt.Fprintf(w, string(out))
-		return
-	}
-	fmt.Fprintln(w, string(out))
+	writeResult(w, r, c, APIGenericResult{Type: "success", Result: string(cfg)})
 }
 
 // httpConfigDefaultHandler - update the currently running config
 func (api *APIServer) httpConfigUpdateHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	if locked := api.lock.TryAcquire(1); !locked {
-		log.Println(ErrAPILocked)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: ErrAPILocked.Error()})
-		fmt.Fprintf(w, string(out))
+	if !api.tryLock(w, r, c, "config") {
 		return
 	}
-	defer api.lock.Release(1)
+	defer api.locks.release("config")
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: fmt.Sprintf("Error parsing POST form: %v", err.Error())})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, fmt.Errorf("%w: Error parsing POST form: %v", ErrBadRequest, err))
 		return
 	}
 
 	newConfig := DefaultConfig()
 	if err := yaml.Unmarshal(body, &newConfig); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: fmt.Sprintf("Error parsing new config: %v", err.Error())})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, fmt.Errorf("%w: Error parsing new config: %v", ErrBadRequest, err))
 		return
 	}
 
 	if err := validateConfig(newConfig); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: fmt.Sprintf("Error validating new config: %v", err.Error())})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, fmt.Errorf("%w: Error validating new config: %v", ErrBadRequest, err))
 		return
 	}
+	if c.API.PersistConfig {
+		if err := SaveConfig(api.configPath, newConfig); err != nil {
+			writeError(w, r, c, fmt.Errorf("can't save new config to %s: %v", api.configPath, err))
+			return
+		}
+		log.Printf("New config is saved to %s, the previous one is kept in %s.bak", api.configPath, api.configPath)
+	}
 	log.Printf("Applying new valid config.")
-	api.config = *newConfig
-	api.restart <- true
-	return
+	api.restart <- newConfig
+	writeResult(w, r, c, APIResult{Type: "success"})
+}
+
+// httpConfigReloadHandler - reload config from file the same way as SIGHUP does
+func (api *APIServer) httpConfigReloadHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	if !api.tryLock(w, r, c, "config") {
+		return
+	}
+	defer api.locks.release("config")
+
+	newConfig, err := LoadConfig(api.configPath)
+	if err != nil {
+		writeError(w, r, c, fmt.Errorf("can't reload config from %s: %v", api.configPath, err))
+		return
+	}
+	log.Printf("Applying config reloaded from %s.", api.configPath)
+	api.restart <- newConfig
+	writeResult(w, r, c, APIResult{Type: "success"})
 }
 
 // httpTablesHandler - displaylist of tables
 func httpTablesHandler(w http.ResponseWriter, r *http.Request, c Config) {
 	tables, err := getTables(c)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, err)
 		return
 	}
+	items := []interface{}{}
 	for _, table := range tables {
-		out, err := json.Marshal(APITablesResult{"table", table})
+		items = append(items, APITablesResult{"table", table})
+	}
+	writeList(w, r, c, items)
+}
+
+// httpCheckHandler - check remote storage by probe object, 503 when a check is failed
+func httpCheckHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	result := CheckRemote(r.Context(), c)
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeResult(w, r, c, result)
+}
+
+// httpDescribeRemoteHandler - describe remote backup by its metadata objects without downloading it
+func httpDescribeRemoteHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	if c.General.RemoteStorage == "none" {
+		writeError(w, r, c, fmt.Errorf("%w: remote storage is not configured", ErrBadRequest))
+		return
+	}
+	description, err := DescribeRemote(r.Context(), c, mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeResult(w, r, c, description)
+}
+
+// httpBrokenHandler - list remote backups which can't be downloaded
+func httpBrokenHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	if c.General.RemoteStorage == "none" {
+		writeError(w, r, c, fmt.Errorf("%w: remote storage is not configured", ErrBadRequest))
+		return
+	}
+	broken, err := GetRemoteBrokenBackups(r.Context(), c)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeResult(w, r, c, broken)
+}
+
+// listQuery - parameters of /backup/list
+type listQuery struct {
+	Location string
+	Filter   BackupFilter
+	Sort     string
+	Limit    int
+	Offset   int
+}
+
+// parseListTime - accept RFC3339 or backup name time format
+func parseListTime(text string) (time.Time, error) {
+	if t, err := time.Parse(BackupTimeFormat, text); err == nil {
+		return t, nil
+	}
+	return parseTime(text)
+}
+
+// parseListQuery - parse and validate query arguments of /backup/list
+func parseListQuery(r *http.Request) (listQuery, error) {
+	query := r.URL.Query()
+	q := listQuery{Location: query.Get("location"), Sort: query.Get("sort")}
+	switch q.Location {
+	case "", "all", "local", "remote":
+	default:
+		return q, fmt.Errorf("%w: location must be 'local' or 'remote'", ErrBadRequest)
+	}
+	if nameRegex := query.Get("name_regex"); nameRegex != "" {
+		re, err := regexp.Compile(nameRegex)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-			fmt.Fprintf(w, string(out))
-			return
+			return q, fmt.Errorf("%w: invalid name_regex: %v", ErrBadRequest, err)
 		}
-		fmt.Fprintln(w, string(out))
+		q.Filter.NameRegex = re
+	}
+	labels, err := ParseLabels(query["label"])
+	if err != nil {
+		return q, fmt.Errorf("%w: %v", ErrBadRequest, err)
 	}
+	q.Filter.Labels = labels
+	for arg, t := range map[string]*time.Time{"since": &q.Filter.Since, "until": &q.Filter.Until} {
+		if value := query.Get(arg); value != "" {
+			parsed, err := parseListTime(value)
+			if err != nil {
+				return q, fmt.Errorf("%w: invalid %s: %v", ErrBadRequest, arg, err)
+			}
+			*t = parsed
+		}
+	}
+	switch strings.TrimPrefix(q.Sort, "-") {
+	case "", "name", "date", "size":
+	default:
+		return q, fmt.Errorf("%w: sort must be one of 'name', 'date', 'size' with optional '-' prefix for descending order", ErrBadRequest)
+	}
+	for arg, n := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if value := query.Get(arg); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return q, fmt.Errorf("%w: %s must be non-negative integer", ErrBadRequest, arg)
+			}
+			*n = parsed
+		}
+	}
+	return q, nil
 }
 
-// httpTablesHandler - display list of all backups stored locally and remotely
+// sortListResults - sort backups by 'name', 'date' or 'size', '-' prefix means descending order
+func sortListResults(backups []APIListResult, order string) {
+	if order == "" {
+		return
+	}
+	desc := strings.HasPrefix(order, "-")
+	less := func(i, j int) bool {
+		switch strings.TrimPrefix(order, "-") {
+		case "name":
+			return backups[i].Name < backups[j].Name
+		case "size":
+			return backups[i].Size < backups[j].Size
+		}
+		return backups[i].Date.Before(backups[j].Date)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if desc {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
+// paginateListResults - apply offset and limit, zero limit means no limit
+func paginateListResults(backups []APIListResult, offset, limit int) []APIListResult {
+	if offset >= len(backups) {
+		return []APIListResult{}
+	}
+	backups = backups[offset:]
+	if limit > 0 && limit < len(backups) {
+		backups = backups[:limit]
+	}
+	return backups
+}
+
+// httpListHandler - display list of all backups stored locally and remotely
 func httpListHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	localBackups, err := ListLocalBackups(c)
-	if err != nil && !os.IsNotExist(err) {
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-		fmt.Fprintf(w, string(out))
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
 		return
 	}
-	backups := []APIListResult{}
-	for _, backup := range localBackups {
-		backups = append(backups, APIListResult{"local", backup})
+	q, err := parseListQuery(r)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
 	}
-	if c.General.RemoteStorage != "none" {
-		remoteBackups, err := getRemoteBackups(c)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-			fmt.Fprintf(w, string(out))
+	backups := []APIListResult{}
+	if q.Location != "remote" {
+		localBackups, err := ListLocalBackups(c)
+		if err != nil && !os.IsNotExist(err) {
+			writeError(w, r, c, err)
 			return
 		}
-		for _, backup := range remoteBackups {
-			backups = append(backups, APIListResult{"remote", backup})
+		for _, backup := range FilterBackups(localBackups, q.Filter) {
+			backups = append(backups, APIListResult{"local", backup})
 		}
 	}
-
-	for _, backup := range backups {
-		out, err := json.Marshal(backup)
+	if q.Location != "local" && c.General.RemoteStorage != "none" {
+		remoteBackups, err := getRemoteBackups(r.Context(), c)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-			fmt.Fprintf(w, string(out))
+			writeError(w, r, c, err)
 			return
 		}
-		fmt.Fprintln(w, string(out))
+		for _, backup := range FilterBackups(remoteBackups, q.Filter) {
+			backups = append(backups, APIListResult{"remote", backup})
+		}
+	}
+	sortListResults(backups, q.Sort)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(backups)))
+	items := []interface{}{}
+	for _, backup := range paginateListResults(backups, q.Offset, q.Limit) {
+		items = append(items, backup)
 	}
+	writeList(w, r, c, items)
 }
 
 // httpCreateHandler - create a backup
 func (api *APIServer) httpCreateHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	if locked := api.lock.TryAcquire(1); !locked {
-		log.Println(ErrAPILocked)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: ErrAPILocked.Error()})
-		fmt.Fprintf(w, string(out))
-		return
-	}
-	defer api.lock.Release(1)
-	start := time.Now()
-	api.metrics.LastBackupStart.Set(float64(start.Unix()))
-	defer api.metrics.LastBackupDuration.Set(float64(time.Now().Sub(start).Nanoseconds()))
-	defer api.metrics.LastBackupEnd.Set(float64(time.Now().Unix()))
-
 	tablePattern := ""
-	desiredName := ""
+	desiredName := NewBackupName()
 
 	query := r.URL.Query()
 	if tp, exist := query["table"]; exist {
 		tablePattern = tp[0]
 	}
-	if dn, exist := query["name"]; exist {
+	if dn, exist := query["name"]; exist && dn[0] != "" {
 		desiredName = dn[0]
 	}
-
-	go func() {
-		id := api.status.start("create", desiredName)
-		defer api.status.stop(id)
-		if err := CreateBackup(c, desiredName, tablePattern); err != nil {
-			api.metrics.FailedBackups.Inc()
-			api.metrics.LastBackupSuccess.Set(0)
-			log.Printf("CreateBackup error: %v", err)
+	if err := validateBackupName(desiredName); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	diffFrom := ""
+	if df, exist := query["diff-from"]; exist && df[0] != "" {
+		diffFrom = df[0]
+		if err := GetLocalBackup(c, diffFrom); err != nil {
+			writeError(w, r, c, fmt.Errorf("%w: diff-from %v", ErrBadRequest, err))
 			return
 		}
-	}()
-	out, err := json.Marshal(APIResult{Type: "success", Message: ""})
+	}
+	partitions := query.Get("partitions")
+	_, rbac := query["rbac"]
+	labels, err := ParseLabels(query["label"])
+	if err != nil {
+		writeError(w, r, c, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	if !api.tryLock(w, r, c, "create") {
+		return
+	}
+
+	id := api.runAsync(r, "create", desiredName, func(ctx context.Context) error {
+		defer api.locks.release("create")
+		return api.createBackup(ctx, c, desiredName, tablePattern, partitions, diffFrom, rbac, labels)
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
+}
+
+// tryLock - take lock for command or write error when the command can't run now
+func (api *APIServer) tryLock(w http.ResponseWriter, r *http.Request, c Config, command string) bool {
+	if atomic.LoadInt32(&api.draining) == 1 {
+		writeError(w, r, c, ErrAPIShutdown)
+		return false
+	}
+	if !api.locks.tryAcquire(command) {
+		err := fmt.Errorf("%w, can't run '%s'", ErrAPILocked, command)
+		log.Println(err)
+		writeError(w, r, c, err)
+		return false
+	}
+	return true
+}
+
+// createBackup - create backup and update metrics
+func (api *APIServer) createBackup(ctx context.Context, c Config, backupName, tablePattern, partitions, diffFrom string, rbac bool, labels map[string]string) error {
+	start := time.Now()
+	api.metrics.LastBackupStart.Set(float64(start.Unix()))
+	err := CreateBackup(ctx, c, backupName, tablePattern, partitions, diffFrom, rbac, labels)
+	end := time.Now()
+	state := CommandState{Success: 1, Start: start.Unix(), End: end.Unix(), Duration: end.Sub(start).Nanoseconds()}
+	api.metrics.LastBackupDuration.Set(float64(state.Duration))
+	api.metrics.LastBackupEnd.Set(float64(state.End))
+	if err != nil {
+		api.metrics.FailedBackups.Inc()
+		state.Success = 0
+	} else {
+		api.metrics.SuccessfulBackups.Inc()
+	}
+	api.metrics.LastBackupSuccess.Set(state.Success)
+	api.metrics.saveState("create", state)
 	if err != nil {
-		api.metrics.FailedBackups.Inc()
-		api.metrics.LastBackupSuccess.Set(0)
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
-		fmt.Fprintf(w, string(out))
-		return
+		log.Printf("CreateBackup error: %v", err)
+		return err
 	}
-	api.metrics.SuccessfulBackups.Inc()
-	api.metrics.LastBackupSuccess.Set(1)
-	fmt.Fprintf(w, string(out))
-	return
+	return nil
 }
 
 // httpFreezeHandler - freeze tables
 func (api *APIServer) httpFreezeHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	if locked := api.lock.TryAcquire(1); !locked {
-		log.Println(ErrAPILocked)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: ErrAPILocked.Error()})
-		fmt.Fprintf(w, string(out))
+	if !api.tryLock(w, r, c, "freeze") {
 		return
 	}
-	defer api.lock.Release(1)
+	defer api.locks.release("freeze")
 
 	tablePattern := ""
-	if err := Freeze(c, tablePattern); err != nil {
+	if err := Freeze(context.Background(), c, "", tablePattern, ""); err != nil {
 		log.Printf("Freeze error: = %+v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-		fmt.Fprintf(w, string(out))
-		return
-	}
-	out, err := json.Marshal(APIResult{Type: "success"})
-	if err != nil {
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, err)
 		return
 	}
-	fmt.Fprintf(w, string(out))
-	return
+	writeResult(w, r, c, APIResult{Type: "success"})
 }
 
 // httpCleanHandler - clean ./shadow directory
 func (api *APIServer) httpCleanHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	if locked := api.lock.TryAcquire(1); !locked {
-		log.Println(ErrAPILocked)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: ErrAPILocked.Error()})
-		fmt.Fprintf(w, string(out))
+	if !api.tryLock(w, r, c, "clean") {
 		return
 	}
-	defer api.lock.Release(1)
+	defer api.locks.release("clean")
 
 	if err := Clean(c); err != nil {
 		log.Printf("Clean error: = %+v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, err)
 		return
 	}
-	out, err := json.Marshal(APIResult{Type: "success"})
+	writeResult(w, r, c, APIResult{Type: "success"})
+}
+
+// httpCleanRemoteBrokenHandler - remove remote backups which can't be downloaded in background
+func (api *APIServer) httpCleanRemoteBrokenHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
 	if err != nil {
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, err)
+		return
+	}
+	if c.General.RemoteStorage == "none" {
+		writeError(w, r, c, fmt.Errorf("%w: remote storage is not configured", ErrBadRequest))
+		return
+	}
+	if !api.tryLock(w, r, c, "clean_remote_broken") {
 		return
 	}
-	fmt.Fprintf(w, string(out))
-	return
+	id := api.runAsync(r, "clean_remote_broken", "", func(ctx context.Context) error {
+		defer api.locks.release("clean_remote_broken")
+		removed, err := CleanRemoteBroken(ctx, c)
+		if err != nil {
+			log.Printf("CleanRemoteBroken error: %+v\n", err)
+			return err
+		}
+		for _, backup := range removed {
+			log.Printf("Broken backup '%s' is removed: %s", backup.Name, backup.Reason)
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
 }
 
 // httpUploadHandler - upload a backup to remote storage
 func (api *APIServer) httpUploadHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
 	vars := mux.Vars(r)
 	diffFrom := ""
 	query := r.URL.Query()
 	if df, exist := query["diff-from"]; exist {
 		diffFrom = df[0]
 	}
+	tablePattern := ""
+	if tp, exist := query["table"]; exist {
+		tablePattern = tp[0]
+	}
 	name := vars["name"]
-	go func() {
-		id := api.status.start("upload", name)
-		defer api.status.stop(id)
-		if err := Upload(c, name, diffFrom); err != nil {
-			log.Printf("Upload error: %+v\n", err)
+	if err := GetLocalBackup(c, name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	if diffFrom != "" {
+		if err := GetLocalBackup(c, diffFrom); err != nil {
+			writeError(w, r, c, fmt.Errorf("%w: diff-from %v", ErrBadRequest, err))
 			return
 		}
-	}()
-	out, err := json.Marshal(APIResult{Type: "success"})
-	if err != nil {
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
-		fmt.Fprintf(w, string(out))
-		return
 	}
-	fmt.Fprintf(w, string(out))
-	return
-}
-
-// httpRestoreHandler - restore a backup from local storage
-func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	if locked := api.lock.TryAcquire(1); !locked {
-		log.Println(ErrAPILocked)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: ErrAPILocked.Error()})
-		fmt.Fprintf(w, string(out))
+	if !api.tryLock(w, r, c, "upload") {
 		return
 	}
-	defer api.lock.Release(1)
-
-	vars := mux.Vars(r)
-	tablePattern := ""
-	schemaOnly := false
-	dataOnly := false
+	id := api.runAsync(r, "upload", name, func(ctx context.Context) error {
+		defer api.locks.release("upload")
+		if err := Upload(ctx, c, name, diffFrom, tablePattern); err != nil {
+			log.Printf("Upload error: %+v\n", err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
+}
 
-	query := r.URL.Query()
+// restoreQuery - arguments of restore from query of restore and restore_remote
+func restoreQuery(query url.Values) (tablePattern string, schemaOnly, dataOnly bool, opts RestoreOptions, err error) {
 	if tp, exist := query["table"]; exist {
 		tablePattern = tp[0]
 	}
-	if _, exist := query["schema"]; exist {
-		schemaOnly = true
+	_, schemaOnly = query["schema"]
+	_, dataOnly = query["data"]
+	opts = RestoreOptions{
+		Partitions:      query.Get("partitions"),
+		DatabaseMapping: query.Get("restore_database_mapping"),
+		TableMapping:    query.Get("restore_table_mapping"),
+		OnCluster:       query.Get("on_cluster"),
 	}
-	if _, exist := query["data"]; exist {
-		dataOnly = true
+	_, opts.RBAC = query["rbac"]
+	_, opts.DropIfExists = query["rm"]
+	_, opts.SchemaAsNonReplicated = query["restore_schema_as_non_replicated"]
+	_, opts.SchemaAsReplicated = query["restore_schema_as_replicated"]
+	opts.UUID = query.Get("restore_uuid")
+	if err := validateRestoreUUID(opts.UUID); err != nil {
+		return "", false, false, opts, fmt.Errorf("%w: %v", ErrBadRequest, err)
 	}
-	if err := Restore(c, vars["name"], tablePattern, schemaOnly, dataOnly); err != nil {
-		log.Printf("Download error: %+v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-		fmt.Fprintf(w, string(out))
-		return
+	if opts.SchemaAsNonReplicated && opts.SchemaAsReplicated {
+		return "", false, false, opts, fmt.Errorf("%w: restore_schema_as_non_replicated and restore_schema_as_replicated can't be used together", ErrBadRequest)
+	}
+	if _, err := parseRestoreMapping(opts.DatabaseMapping, opts.TableMapping); err != nil {
+		return "", false, false, opts, fmt.Errorf("%w: %v", ErrBadRequest, err)
 	}
-	out, err := json.Marshal(APIResult{Type: "success"})
+	return tablePattern, schemaOnly, dataOnly, opts, nil
+}
+
+// httpRestoreHandler - restore a backup from local storage
+func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	vars := mux.Vars(r)
+	tablePattern, schemaOnly, dataOnly, opts, err := restoreQuery(r.URL.Query())
 	if err != nil {
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, err)
+		return
+	}
+	name := vars["name"]
+	if err := GetLocalBackup(c, name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	if !api.tryLock(w, r, c, "restore") {
 		return
 	}
-	fmt.Fprintf(w, string(out))
-	return
+	id := api.runAsync(r, "restore", name, func(ctx context.Context) error {
+		defer api.locks.release("restore")
+		if err := Restore(ctx, c, name, tablePattern, schemaOnly, dataOnly, opts); err != nil {
+			log.Printf("Restore error: %+v\n", err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
 }
 
 // httpDownloadHandler - download a backup from remote to local storage
 func (api *APIServer) httpDownloadHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
 	vars := mux.Vars(r)
 	name := vars["name"]
-	go func() {
-		id := api.status.start("download", name)
-		defer api.status.stop(id)
-		if err := Download(c, name); err != nil {
+	if err := validateBackupName(name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	tablePattern := ""
+	if tp, exist := r.URL.Query()["table"]; exist {
+		tablePattern = tp[0]
+	}
+	if _, err := GetRemoteBackup(r.Context(), c, name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	if !api.tryLock(w, r, c, "download") {
+		return
+	}
+	id := api.runAsync(r, "download", name, func(ctx context.Context) error {
+		defer api.locks.release("download")
+		if err := Download(ctx, c, name, tablePattern); err != nil {
 			log.Printf("Download error: %+v\n", err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
+}
+
+// httpCopyHandler - copy a backup from one remote storage to another
+func (api *APIServer) httpCopyHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	name := mux.Vars(r)["name"]
+	if err := validateBackupName(name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	for _, remote := range []string{from, to} {
+		if _, err := c.WithRemote(remote); err != nil {
+			writeError(w, r, c, fmt.Errorf("%w: %v", ErrBadRequest, err))
 			return
 		}
-	}()
-	out, err := json.Marshal(APIResult{Type: "success"})
-	if err != nil {
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
-		fmt.Fprintf(w, string(out))
+	}
+	if from == to {
+		writeError(w, r, c, fmt.Errorf("%w: 'from' and 'to' must be different remotes", ErrBadRequest))
+		return
+	}
+	if !api.tryLock(w, r, c, "copy") {
 		return
 	}
-	fmt.Fprintf(w, string(out))
-	return
+	id := api.runAsync(r, "copy", name, func(ctx context.Context) error {
+		defer api.locks.release("copy")
+		if err := CopyBackup(ctx, c, name, from, to); err != nil {
+			log.Printf("Copy error: %+v\n", err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
 }
 
 // httpDeleteHandler - delete a backup from local or remote storage
 func (api *APIServer) httpDeleteHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	if locked := api.lock.TryAcquire(1); !locked {
-		log.Println(ErrAPILocked)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: ErrAPILocked.Error()})
-		fmt.Fprintf(w, string(out))
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
 		return
 	}
-	defer api.lock.Release(1)
-
 	vars := mux.Vars(r)
+	if vars["where"] != "local" && vars["where"] != "remote" {
+		writeError(w, r, c, fmt.Errorf("%w: Backup location must be 'local' or 'remote'.", ErrBadRequest))
+		return
+	}
+	if !api.tryLock(w, r, c, "delete") {
+		return
+	}
+	defer api.locks.release("delete")
+
+	finishMetrics := api.metrics.start("delete")
 	switch vars["where"] {
 	case "local":
-		if err := RemoveBackupLocal(c, vars["name"]); err != nil {
+		if err = RemoveBackupLocal(c, vars["name"]); err != nil {
 			log.Printf("RemoveBackupLocal error: %+v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-			fmt.Fprintf(w, string(out))
-			return
 		}
 	case "remote":
-		if err := RemoveBackupRemote(c, vars["name"]); err != nil {
+		_, force := r.URL.Query()["force_cascade"]
+		if _, exists := r.URL.Query()["force"]; exists {
+			force = true
+		}
+		if err = RemoveBackupRemote(r.Context(), c, vars["name"], force); err != nil {
 			log.Printf("RemoveBackupRemote error: %+v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
-			fmt.Fprintf(w, string(out))
-			return
 		}
+	}
+	finishMetrics(err)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	writeResult(w, r, c, APIResult{Type: "success"})
+}
+
+// httpVerifyHandler - verify a local or remote backup without restoring it
+func (api *APIServer) httpVerifyHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	vars := mux.Vars(r)
+	name := vars["name"]
+	if err := validateBackupName(name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	verify := VerifyLocal
+	switch vars["where"] {
+	case "local":
+	case "remote":
+		verify = VerifyRemote
 	default:
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: "Backup location must be 'local' or 'remote'."})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, fmt.Errorf("%w: Backup location must be 'local' or 'remote'.", ErrBadRequest))
+		return
+	}
+	if !api.tryLock(w, r, c, "verify") {
 		return
 	}
-	out, err := json.Marshal(APIResult{Type: "success"})
+	id := api.runAsync(r, "verify", name, func(ctx context.Context) error {
+		defer api.locks.release("verify")
+		if err := verify(ctx, c, name); err != nil {
+			log.Printf("Verify error: %+v\n", err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
+}
+
+// httpCreateRemoteHandler - create a backup, upload it and remove local backup
+func (api *APIServer) httpCreateRemoteHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
 	if err != nil {
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
-		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
-		fmt.Fprintf(w, string(out))
+		writeError(w, r, c, err)
+		return
+	}
+	query := r.URL.Query()
+	name := NewBackupName()
+	if dn, exist := query["name"]; exist && dn[0] != "" {
+		name = dn[0]
+	}
+	if err := validateBackupName(name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	diffFrom := query.Get("diff-from")
+	if diffFrom != "" {
+		if err := GetLocalBackup(c, diffFrom); err != nil {
+			writeError(w, r, c, fmt.Errorf("%w: diff-from %v", ErrBadRequest, err))
+			return
+		}
+	}
+	tablePattern := query.Get("table")
+	partitions := query.Get("partitions")
+	_, rbac := query["rbac"]
+	_, keepLocal := query["keep_local"]
+	labels, err := ParseLabels(query["label"])
+	if err != nil {
+		writeError(w, r, c, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	if !api.tryLock(w, r, c, "create_remote") {
 		return
 	}
-	fmt.Fprintf(w, string(out))
-	return
+	id := api.runAsync(r, "create_remote", name, func(ctx context.Context) error {
+		defer api.locks.release("create_remote")
+		if err := CreateRemote(ctx, c, name, tablePattern, partitions, diffFrom, rbac, labels, keepLocal); err != nil {
+			log.Printf("CreateRemote error: %+v\n", err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
 }
 
-func (api *APIServer) httpBackupStatusHandler(w http.ResponseWriter, r *http.Request, c Config) {
-	s := api.status.status()
-	out, err := json.Marshal(api.status.status())
+// httpRestoreRemoteHandler - download a backup and restore it
+func (api *APIServer) httpRestoreRemoteHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	c, err := remoteConfig(r, c)
 	if err != nil {
-		e := fmt.Sprintf("marshal error: %v", err)
-		log.Println(e)
+		writeError(w, r, c, err)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := validateBackupName(name); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	tablePattern, schemaOnly, dataOnly, opts, err := restoreQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	if !api.tryLock(w, r, c, "restore_remote") {
+		return
+	}
+	id := api.runAsync(r, "restore_remote", name, func(ctx context.Context) error {
+		defer api.locks.release("restore_remote")
+		if err := RestoreRemote(ctx, c, name, tablePattern, schemaOnly, dataOnly, opts); err != nil {
+			log.Printf("RestoreRemote error: %+v\n", err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
+}
+
+// httpBackupStatusHandler - display state of async job by id or of the latest one
+func (api *APIServer) httpBackupStatusHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	job, ok := api.status.get(mux.Vars(r)["job_id"])
+	if !ok {
+		writeError(w, r, c, ErrJobNotFound)
+		return
+	}
+	writeResult(w, r, c, job)
+}
+
+// httpCancelHandler - cancel running async job
+func (api *APIServer) httpCancelHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	id := mux.Vars(r)["job_id"]
+	if err := api.status.cancelJob(id); err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	log.Printf("Job '%s' is cancelled by API request", id)
+	writeResult(w, r, c, APIResult{Type: "success"})
+}
+
+// httpEventsHandler - stream progress events as Server-Sent Events
+func httpEventsHandler(w http.ResponseWriter, r *http.Request, c Config, done <-chan struct{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
 		w.WriteHeader(http.StatusInternalServerError)
-		out, _ := json.Marshal(APIResult{Type: "error", Message: e})
+		out, _ := json.Marshal(APIResult{Type: "error", Message: "streaming is not supported"})
 		fmt.Fprintf(w, string(out))
 		return
 	}
-	fmt.Fprintf(w, string(out))
-	return
+	name := r.URL.Query().Get("name")
+	events, unsubscribe := SubscribeEvents()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e := <-events:
+			if name != "" && e.Backup != name {
+				continue
+			}
+			out, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("marshal error: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, out)
+			flusher.Flush()
+		}
+	}
+}
+
+// runAsync - start fn in background and track its state, returns job id
+func (api *APIServer) runAsync(r *http.Request, command, name string, fn func(ctx context.Context) error) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	reqID := requestID(r)
+	id := api.status.start(reqID, command, name, cancel)
+	ctx = withJobID(ctx, id)
+	current := api.snapshot()
+	config := current.config
+	audit, user, callbacks := current.audit, auditUser(config.API, r), callbackURLs(config.API, r)
+	history, parameters := current.history, requestParameters(r)
+	api.running.Add(1)
+	go func() {
+		defer api.running.Done()
+		log.Printf("request_id=%s job_id=%s: '%s %s' started", reqID, id, command, name)
+		publishEvent(Event{Operation: command, Backup: name, Type: "start"})
+		finishMetrics := api.metrics.start(command)
+		err := fn(ctx)
+		if err != nil && ctx.Err() == context.Canceled {
+			err = context.Canceled
+		}
+		finishMetrics(err)
+		if err != nil {
+			log.Printf("request_id=%s job_id=%s: '%s %s' failed: %v", reqID, id, command, name, err)
+		} else {
+			log.Printf("request_id=%s job_id=%s: '%s %s' finished", reqID, id, command, name)
+		}
+		api.status.stop(id, err)
+		if job, ok := api.status.get(id); ok {
+			if err := history.add(HistoryEntry{
+				ID:         id,
+				RequestID:  reqID,
+				Command:    command,
+				Name:       name,
+				Parameters: parameters,
+				Status:     job.Status,
+				Error:      job.Error,
+				Started:    job.Started,
+				Finished:   job.Finished,
+			}); err != nil {
+				log.Printf("History error: %v", err)
+			}
+			if err := audit.write(AuditEntry{
+				Time:       time.Now(),
+				RequestID:  reqID,
+				JobID:      id,
+				User:       user,
+				Command:    command,
+				Parameters: map[string]string{"name": name},
+				Outcome:    job.Status,
+				Error:      job.Error,
+			}); err != nil {
+				log.Printf("Audit error: %v", err)
+			}
+			if len(callbacks) > 0 {
+				var size int64
+				if job.Status == JobSuccess {
+					size = backupSize(config, command, name)
+				}
+				go sendCallbacks(config.API, callbacks, CallbackPayload{
+					JobID:     id,
+					RequestID: reqID,
+					Command:   command,
+					Name:      name,
+					Status:    job.Status,
+					Error:     job.Error,
+					Started:   job.Started,
+					Finished:  job.Finished,
+					Duration:  float64(job.Finished - job.Started),
+					Size:      size,
+				})
+			}
+		}
+		finish := Event{Operation: command, Backup: name, Type: "finish"}
+		if err != nil {
+			finish.Error = err.Error()
+		}
+		publishEvent(finish)
+	}()
+	return id
 }
 
 const rootHtml = `<html><body>
@@ -586,23 +1661,28 @@ const rootHtml = `<html><body>
 See: <a href="https://github.com/AlexAkulov/clickhouse-backup#api-configuration">https://github.com/AlexAkulov/clickhouse-backup#api-configuration</a>
 </body></html>`
 
-func registerMetricsHandlers(r *mux.Router, enablemetrics bool, enablepprof bool) {
+// registerMetricsHandlers - register /health, /metrics and /debug/pprof/*,
+// /metrics and /debug/pprof/* require basic auth when api.metrics_user is set
+func registerMetricsHandlers(r *mux.Router, config APIConfig) {
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "OK")
 	})
-	if enablemetrics {
-		r.Handle("/metrics", promhttp.Handler())
+	protect := func(h http.Handler) http.Handler {
+		return requireBasicAuth(config.MetricsUser, config.MetricsPassword, h)
 	}
-	if enablepprof {
-		r.HandleFunc("/debug/pprof/", pprof.Index)
-		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
-		r.Handle("/debug/pprof/block", pprof.Handler("block"))
-		r.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-		r.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-		r.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	if config.EnableMetrics {
+		r.Handle("/metrics", protect(promhttp.Handler()))
+	}
+	if config.EnablePprof {
+		r.Handle("/debug/pprof/", protect(http.HandlerFunc(pprof.Index)))
+		r.Handle("/debug/pprof/cmdline", protect(http.HandlerFunc(pprof.Cmdline)))
+		r.Handle("/debug/pprof/profile", protect(http.HandlerFunc(pprof.Profile)))
+		r.Handle("/debug/pprof/symbol", protect(http.HandlerFunc(pprof.Symbol)))
+		r.Handle("/debug/pprof/trace", protect(http.HandlerFunc(pprof.Trace)))
+		r.Handle("/debug/pprof/block", protect(pprof.Handler("block")))
+		r.Handle("/debug/pprof/goroutine", protect(pprof.Handler("goroutine")))
+		r.Handle("/debug/pprof/heap", protect(pprof.Handler("heap")))
+		r.Handle("/debug/pprof/threadcreate", protect(pprof.Handler("threadcreate")))
 	}
 }
 
@@ -613,8 +1693,30 @@ type Metrics struct {
 	LastBackupDuration prometheus.Gauge
 	SuccessfulBackups  prometheus.Counter
 	FailedBackups      prometheus.Counter
+	Commands           map[string]*CommandMetrics
+	InProgress         *prometheus.GaugeVec
+	// backup inventory, refreshed by refreshInventoryMetrics
+	NumberBackupsLocal  prometheus.Gauge
+	NumberBackupsRemote prometheus.Gauge
+	LastBackupSize      *prometheus.GaugeVec
+	OldestBackup        *prometheus.GaugeVec
+	Watch               *WatchMetrics
+	state               *metricsState
+}
+
+// CommandMetrics - last_<command>_* gauges and counters of upload, download, restore, delete, create_remote and restore_remote
+type CommandMetrics struct {
+	LastSuccess  prometheus.Gauge
+	LastStart    prometheus.Gauge
+	LastEnd      prometheus.Gauge
+	LastDuration prometheus.Gauge
+	Successful   prometheus.Counter
+	Failed       prometheus.Counter
 }
 
+// metricsCommands - commands with own last_<command>_* metrics, create is covered by last_backup_*
+var metricsCommands = []string{"upload", "download", "restore", "delete", "create_remote", "restore_remote"}
+
 // setupMetrics - resister prometheus metrics
 func setupMetrics() Metrics {
 	m := Metrics{}
@@ -648,14 +1750,161 @@ func setupMetrics() Metrics {
 		Name:      "failed_backups",
 		Help:      "Number of Failed Backups.",
 	})
+	m.InProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "in_progress",
+		Help:      "Number of running operations by command.",
+	}, []string{"command"})
+	m.NumberBackupsLocal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "number_backups_local",
+		Help:      "Number of local backups.",
+	})
+	m.NumberBackupsRemote = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "number_backups_remote",
+		Help:      "Number of remote backups.",
+	})
+	m.LastBackupSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "last_backup_size_bytes",
+		Help:      "Size of the newest backup in bytes.",
+	}, []string{"location"})
+	m.OldestBackup = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "oldest_backup_timestamp",
+		Help:      "Creation timestamp of the oldest backup.",
+	}, []string{"location"})
+	uploaded := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes uploaded to remote storage.",
+	}, func() float64 { return float64(uploadMeter.Total()) })
+	downloaded := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes downloaded from remote storage.",
+	}, func() float64 { return float64(downloadMeter.Total()) })
+	uploadSpeed := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "upload_speed_bytes",
+		Help:      "Current upload speed in bytes per second.",
+	}, uploadMeter.Speed)
+	downloadSpeed := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "download_speed_bytes",
+		Help:      "Current download speed in bytes per second.",
+	}, downloadMeter.Speed)
+	retries := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "remote_retries_total",
+		Help:      "Retries of remote storage operations failed with transient errors.",
+	}, func() float64 { return float64(remoteRetries.Retries()) })
+	retryFailures := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "remote_retry_failures_total",
+		Help:      "Remote storage operations failed with transient errors after all retries.",
+	}, func() float64 { return float64(remoteRetries.Failures()) })
 	prometheus.MustRegister(
+		retries,
+		retryFailures,
+		uploaded,
+		downloaded,
+		uploadSpeed,
+		downloadSpeed,
 		m.LastBackupDuration,
 		m.LastBackupStart,
 		m.LastBackupEnd,
 		m.LastBackupSuccess,
 		m.SuccessfulBackups,
 		m.FailedBackups,
+		m.InProgress,
+		m.NumberBackupsLocal,
+		m.NumberBackupsRemote,
+		m.LastBackupSize,
+		m.OldestBackup,
 	)
 	m.LastBackupSuccess.Set(2) // 0=failed, 1=success, 2=unknown
+	m.Watch = setupWatchMetrics()
+	m.Commands = map[string]*CommandMetrics{}
+	for _, command := range metricsCommands {
+		m.Commands[command] = setupCommandMetrics(command)
+	}
 	return m
 }
+
+// setupCommandMetrics - resister last_<command>_* metrics
+func setupCommandMetrics(command string) *CommandMetrics {
+	cm := &CommandMetrics{}
+	cm.LastDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      fmt.Sprintf("last_%s_duration", command),
+		Help:      fmt.Sprintf("Last %s duration in nanoseconds.", command),
+	})
+	cm.LastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      fmt.Sprintf("last_%s_success", command),
+		Help:      fmt.Sprintf("Last %s success boolean: 0=failed, 1=success, 2=unknown.", command),
+	})
+	cm.LastStart = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      fmt.Sprintf("last_%s_start", command),
+		Help:      fmt.Sprintf("Last %s start timestamp.", command),
+	})
+	cm.LastEnd = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      fmt.Sprintf("last_%s_end", command),
+		Help:      fmt.Sprintf("Last %s end timestamp.", command),
+	})
+	cm.Successful = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      fmt.Sprintf("successful_%ss", command),
+		Help:      fmt.Sprintf("Number of successful %ss.", command),
+	})
+	cm.Failed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      fmt.Sprintf("failed_%ss", command),
+		Help:      fmt.Sprintf("Number of failed %ss.", command),
+	})
+	prometheus.MustRegister(
+		cm.LastDuration,
+		cm.LastStart,
+		cm.LastEnd,
+		cm.LastSuccess,
+		cm.Successful,
+		cm.Failed,
+	)
+	cm.LastSuccess.Set(2) // 0=failed, 1=success, 2=unknown
+	return cm
+}
+
+// start - count command in in_progress and set last_<command>_start, returned func must be called when command is finished
+func (m *Metrics) start(command string) func(err error) {
+	if m.InProgress == nil {
+		return func(error) {}
+	}
+	start := time.Now()
+	m.InProgress.WithLabelValues(command).Inc()
+	cm, ok := m.Commands[command]
+	if ok {
+		cm.LastStart.Set(float64(start.Unix()))
+	}
+	return func(err error) {
+		m.InProgress.WithLabelValues(command).Dec()
+		if !ok {
+			return
+		}
+		end := time.Now()
+		state := CommandState{Success: 1, Start: start.Unix(), End: end.Unix(), Duration: end.Sub(start).Nanoseconds()}
+		cm.LastDuration.Set(float64(state.Duration))
+		cm.LastEnd.Set(float64(state.End))
+		if err != nil {
+			cm.Failed.Inc()
+			state.Success = 0
+		} else {
+			cm.Successful.Inc()
+		}
+		cm.LastSuccess.Set(state.Success)
+		m.saveState(command, state)
+	}
+}
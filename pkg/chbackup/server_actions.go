@@ -0,0 +1,387 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// APIAction - body of POST /backup/actions
+type APIAction struct {
+	Command string `json:"command"`
+}
+
+// apiAction - parsed CLI command ready to be run by API
+type apiAction struct {
+	Command string
+	Name    string
+	Run     func(ctx context.Context) error
+}
+
+// splitCommandArgs - split command line into arguments, single and double quotes are supported
+func splitCommandArgs(command string) ([]string, error) {
+	args := []string{}
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range command {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote in command '%s'", command)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// newActionFlagSet - flag set which doesn't print usage to stderr
+func newActionFlagSet(command string) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+// tableFlag - register '--table, --tables, -t' flag the same way as CLI does
+func tableFlag(fs *flag.FlagSet) *string {
+	tablePattern := fs.String("table", "", "")
+	fs.StringVar(tablePattern, "tables", "", "")
+	fs.StringVar(tablePattern, "t", "", "")
+	return tablePattern
+}
+
+// labelFlag - register repeated '--label' flag, its values are parsed by ParseLabels
+func labelFlag(fs *flag.FlagSet) *labelArgs {
+	labels := &labelArgs{}
+	fs.Var(labels, "label", "")
+	return labels
+}
+
+// remoteFlag - register '--remote' flag, config with selected remote storage is returned by actionRemoteConfig
+func remoteFlag(fs *flag.FlagSet) *string {
+	return fs.String("remote", "", "")
+}
+
+func actionRemoteConfig(c Config, remote string) (Config, error) {
+	config, err := c.WithRemote(remote)
+	if err != nil {
+		return c, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return config, nil
+}
+
+// parseAction - parse command with CLI syntax into action
+func (api *APIServer) parseAction(c Config, command string) (apiAction, error) {
+	args, err := splitCommandArgs(command)
+	if err != nil {
+		return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	if len(args) == 0 {
+		return apiAction{}, fmt.Errorf("%w: command is required", ErrBadRequest)
+	}
+	action := apiAction{Command: args[0]}
+	fs := newActionFlagSet(args[0])
+	switch action.Command {
+	case "create":
+		tablePattern := tableFlag(fs)
+		diffFrom := fs.String("diff-from", "", "")
+		partitions := fs.String("partitions", "", "")
+		rbac := fs.Bool("rbac", false, "")
+		labelArgs := labelFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		labels, err := ParseLabels(*labelArgs)
+		if err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		action.Name = fs.Arg(0)
+		if action.Name == "" {
+			action.Name = NewBackupName()
+		}
+		action.Run = func(ctx context.Context) error {
+			return api.createBackup(ctx, c, action.Name, *tablePattern, *partitions, *diffFrom, *rbac, labels)
+		}
+	case "create_remote":
+		tablePattern := tableFlag(fs)
+		diffFrom := fs.String("diff-from", "", "")
+		partitions := fs.String("partitions", "", "")
+		rbac := fs.Bool("rbac", false, "")
+		keepLocal := fs.Bool("keep-local", false, "")
+		labelArgs := labelFlag(fs)
+		remote := remoteFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		labels, err := ParseLabels(*labelArgs)
+		if err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		if c, err = actionRemoteConfig(c, *remote); err != nil {
+			return apiAction{}, err
+		}
+		action.Name = fs.Arg(0)
+		if action.Name == "" {
+			action.Name = NewBackupName()
+		}
+		action.Run = func(ctx context.Context) error {
+			return CreateRemote(ctx, c, action.Name, *tablePattern, *partitions, *diffFrom, *rbac, labels, *keepLocal)
+		}
+	case "upload":
+		tablePattern := tableFlag(fs)
+		diffFrom := fs.String("diff-from", "", "")
+		remote := remoteFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		if c, err = actionRemoteConfig(c, *remote); err != nil {
+			return apiAction{}, err
+		}
+		action.Name = fs.Arg(0)
+		action.Run = func(ctx context.Context) error {
+			return Upload(ctx, c, action.Name, *diffFrom, *tablePattern)
+		}
+	case "download":
+		tablePattern := tableFlag(fs)
+		remote := remoteFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		if c, err = actionRemoteConfig(c, *remote); err != nil {
+			return apiAction{}, err
+		}
+		action.Name = fs.Arg(0)
+		action.Run = func(ctx context.Context) error {
+			return Download(ctx, c, action.Name, *tablePattern)
+		}
+	case "restore":
+		tablePattern := tableFlag(fs)
+		schemaOnly := fs.Bool("schema", false, "")
+		fs.BoolVar(schemaOnly, "s", false, "")
+		dataOnly := fs.Bool("data", false, "")
+		fs.BoolVar(dataOnly, "d", false, "")
+		opts := RestoreOptions{}
+		fs.StringVar(&opts.Partitions, "partitions", "", "")
+		fs.StringVar(&opts.DatabaseMapping, "restore-database-mapping", "", "")
+		fs.StringVar(&opts.TableMapping, "restore-table-mapping", "", "")
+		fs.StringVar(&opts.OnCluster, "on-cluster", "", "")
+		fs.BoolVar(&opts.RBAC, "rbac", false, "")
+		fs.BoolVar(&opts.DropIfExists, "rm", false, "")
+		fs.BoolVar(&opts.DropIfExists, "drop-if-exists", false, "")
+		fs.BoolVar(&opts.SchemaAsNonReplicated, "restore-schema-as-non-replicated", false, "")
+		fs.BoolVar(&opts.SchemaAsReplicated, "restore-schema-as-replicated", false, "")
+		fs.StringVar(&opts.UUID, "restore-uuid", "", "")
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		action.Name = fs.Arg(0)
+		action.Run = func(ctx context.Context) error {
+			return Restore(ctx, c, action.Name, *tablePattern, *schemaOnly, *dataOnly, opts)
+		}
+	case "restore_remote":
+		tablePattern := tableFlag(fs)
+		schemaOnly := fs.Bool("schema", false, "")
+		fs.BoolVar(schemaOnly, "s", false, "")
+		dataOnly := fs.Bool("data", false, "")
+		fs.BoolVar(dataOnly, "d", false, "")
+		opts := RestoreOptions{}
+		fs.StringVar(&opts.Partitions, "partitions", "", "")
+		fs.StringVar(&opts.DatabaseMapping, "restore-database-mapping", "", "")
+		fs.StringVar(&opts.TableMapping, "restore-table-mapping", "", "")
+		fs.StringVar(&opts.OnCluster, "on-cluster", "", "")
+		fs.BoolVar(&opts.RBAC, "rbac", false, "")
+		fs.BoolVar(&opts.DropIfExists, "rm", false, "")
+		fs.BoolVar(&opts.DropIfExists, "drop-if-exists", false, "")
+		fs.BoolVar(&opts.SchemaAsNonReplicated, "restore-schema-as-non-replicated", false, "")
+		fs.BoolVar(&opts.SchemaAsReplicated, "restore-schema-as-replicated", false, "")
+		fs.StringVar(&opts.UUID, "restore-uuid", "", "")
+		remote := remoteFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		if c, err = actionRemoteConfig(c, *remote); err != nil {
+			return apiAction{}, err
+		}
+		action.Name = fs.Arg(0)
+		action.Run = func(ctx context.Context) error {
+			return RestoreRemote(ctx, c, action.Name, *tablePattern, *schemaOnly, *dataOnly, opts)
+		}
+	case "delete":
+		remote := remoteFlag(fs)
+		force := fs.Bool("force-cascade", false, "")
+		fs.BoolVar(force, "force", false, "")
+		labelArgs := labelFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		if c, err = actionRemoteConfig(c, *remote); err != nil {
+			return apiAction{}, err
+		}
+		labels, err := ParseLabels(*labelArgs)
+		if err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		where := fs.Arg(0)
+		action.Name = fs.Arg(1)
+		if len(labels) > 0 {
+			if action.Name != "" {
+				return apiAction{}, fmt.Errorf("%w: backup name and --label can't be used together", ErrBadRequest)
+			}
+			if where != "local" && where != "remote" {
+				return apiAction{}, fmt.Errorf("%w: backup location must be 'local' or 'remote'", ErrBadRequest)
+			}
+			action.Run = func(ctx context.Context) error {
+				return RemoveBackupsByLabels(ctx, c, where, labels, *force)
+			}
+			return action, nil
+		}
+		switch where {
+		case "local":
+			action.Run = func(ctx context.Context) error {
+				return RemoveBackupLocal(c, action.Name)
+			}
+		case "remote":
+			action.Run = func(ctx context.Context) error {
+				return RemoveBackupRemote(ctx, c, action.Name, *force)
+			}
+		default:
+			return apiAction{}, fmt.Errorf("%w: backup location must be 'local' or 'remote'", ErrBadRequest)
+		}
+	case "verify":
+		remote := remoteFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		if c, err = actionRemoteConfig(c, *remote); err != nil {
+			return apiAction{}, err
+		}
+		where := fs.Arg(0)
+		action.Name = fs.Arg(1)
+		switch where {
+		case "local":
+			action.Run = func(ctx context.Context) error {
+				return VerifyLocal(ctx, c, action.Name)
+			}
+		case "remote":
+			action.Run = func(ctx context.Context) error {
+				return VerifyRemote(ctx, c, action.Name)
+			}
+		default:
+			return apiAction{}, fmt.Errorf("%w: backup location must be 'local' or 'remote'", ErrBadRequest)
+		}
+	case "copy":
+		from := fs.String("from", "", "")
+		to := fs.String("to", "", "")
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		for _, remote := range []string{*from, *to} {
+			if _, err := actionRemoteConfig(c, remote); err != nil {
+				return apiAction{}, err
+			}
+		}
+		action.Name = fs.Arg(0)
+		action.Run = func(ctx context.Context) error {
+			return CopyBackup(ctx, c, action.Name, *from, *to)
+		}
+	case "freeze":
+		tablePattern := tableFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		action.Run = func(ctx context.Context) error {
+			return Freeze(ctx, c, "", *tablePattern, "")
+		}
+		return action, nil
+	case "clean":
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		action.Run = func(ctx context.Context) error {
+			return Clean(c)
+		}
+		return action, nil
+	case "clean_remote_broken":
+		remote := remoteFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return apiAction{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		if c, err = actionRemoteConfig(c, *remote); err != nil {
+			return apiAction{}, err
+		}
+		action.Run = func(ctx context.Context) error {
+			_, err := CleanRemoteBroken(ctx, c)
+			return err
+		}
+		return action, nil
+	default:
+		return apiAction{}, fmt.Errorf("%w: unknown command '%s'", ErrBadRequest, action.Command)
+	}
+	if err := validateBackupName(action.Name); err != nil {
+		return apiAction{}, err
+	}
+	return action, nil
+}
+
+// httpActionsHandler - run any CLI command in background
+func (api *APIServer) httpActionsHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, c, fmt.Errorf("%w: can't read request body with %v", ErrBadRequest, err))
+		return
+	}
+	var request APIAction
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeError(w, r, c, fmt.Errorf("%w: can't parse request body with %v", ErrBadRequest, err))
+		return
+	}
+	action, err := api.parseAction(c, request.Command)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	if !api.tryLock(w, r, c, action.Command) {
+		return
+	}
+	id := api.runAsync(r, action.Command, action.Name, func(ctx context.Context) error {
+		defer api.locks.release(action.Command)
+		if err := action.Run(ctx); err != nil {
+			log.Printf("Action '%s' error: %+v\n", request.Command, err)
+			return err
+		}
+		return nil
+	})
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
+}
@@ -0,0 +1,86 @@
+package chbackup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommandArgs(t *testing.T) {
+	args, err := splitCommandArgs(`create  --tables db.* "my backup"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"create", "--tables", "db.*", "my backup"}, args)
+
+	args, err = splitCommandArgs(`restore -t 'db.table' --schema b\ 1`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"restore", "-t", "db.table", "--schema", "b 1"}, args)
+
+	_, err = splitCommandArgs(`create "unterminated`)
+	assert.Error(t, err)
+}
+
+func TestParseAction(t *testing.T) {
+	api := APIServer{}
+	c := *DefaultConfig()
+
+	action, err := api.parseAction(c, "create --tables=db.* backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, "create", action.Command)
+	assert.Equal(t, "backup1", action.Name)
+
+	action, err = api.parseAction(c, "upload --diff-from backup1 backup2")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup2", action.Name)
+
+	action, err = api.parseAction(c, "download --tables=db.events backup2")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup2", action.Name)
+
+	action, err = api.parseAction(c, "create_remote --keep-local --tables=db.* --label ticket=INC-1 backup3")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup3", action.Name)
+
+	_, err = api.parseAction(c, "create_remote --label ticket backup3")
+	assert.True(t, errors.Is(err, ErrBadRequest))
+
+	action, err = api.parseAction(c, "restore_remote --schema backup3")
+	assert.NoError(t, err)
+	assert.Equal(t, "restore_remote", action.Command)
+
+	action, err = api.parseAction(c, "restore --rm --tables=db.* backup3")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup3", action.Name)
+
+	_, err = api.parseAction(c, "restore_remote --remote=unknown backup3")
+	assert.True(t, errors.Is(err, ErrBadRequest))
+
+	action, err = api.parseAction(c, "delete --force-cascade remote backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup1", action.Name)
+
+	_, err = api.parseAction(c, "delete somewhere backup1")
+	assert.True(t, errors.Is(err, ErrBadRequest))
+
+	_, err = api.parseAction(c, "create --label ticket=INC-1 --label reason=test backup4")
+	assert.NoError(t, err)
+
+	_, err = api.parseAction(c, "delete --label ticket=INC-1 remote")
+	assert.NoError(t, err)
+
+	_, err = api.parseAction(c, "delete --label ticket=INC-1 remote backup4")
+	assert.True(t, errors.Is(err, ErrBadRequest))
+
+	_, err = api.parseAction(c, "create --label ticket backup4")
+	assert.True(t, errors.Is(err, ErrBadRequest))
+
+	action, err = api.parseAction(c, "clean_remote_broken")
+	assert.NoError(t, err)
+	assert.Equal(t, "clean_remote_broken", action.Command)
+
+	_, err = api.parseAction(c, "restore ../backup")
+	assert.True(t, errors.Is(err, ErrBadRequest))
+
+	_, err = api.parseAction(c, "unknown")
+	assert.True(t, errors.Is(err, ErrBadRequest))
+}
@@ -0,0 +1,188 @@
+package chbackup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AuditEntry - record of API operation in api.audit_log
+type AuditEntry struct {
+	Time       time.Time         `json:"time"`
+	RequestID  string            `json:"request_id"`
+	JobID      string            `json:"job_id,omitempty"`
+	User       string            `json:"user"`
+	Client     string            `json:"client,omitempty"`
+	Command    string            `json:"command"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// auditLog - append-only file with one JSON AuditEntry per line, empty path disables audit
+type auditLog struct {
+	path string
+	sync.Mutex
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+func (a *auditLog) write(entry AuditEntry) error {
+	if a == nil || a.path == "" {
+		return nil
+	}
+	out, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("can't open audit log with %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(out, '\n')); err != nil {
+		return fmt.Errorf("can't write audit log with %v", err)
+	}
+	return f.Sync()
+}
+
+// read - return entries matched by filter, only the last limit entries are returned when limit > 0
+func (a *auditLog) read(filter func(AuditEntry) bool, limit int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	if a == nil || a.path == "" {
+		return entries, nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open audit log with %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read audit log with %v", err)
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// auditUser - identify who made request: TLS client certificate, token fingerprint or 'anonymous'
+func auditUser(config APIConfig, r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if token := requestToken(config, r); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:])[:12]
+	}
+	return "anonymous"
+}
+
+// requestParameters - path variables and query arguments of request
+func requestParameters(r *http.Request) map[string]string {
+	parameters := map[string]string{}
+	for k, v := range mux.Vars(r) {
+		parameters[k] = v
+	}
+	for k, v := range r.URL.Query() {
+		parameters[k] = v[0]
+	}
+	return parameters
+}
+
+// audited - record call of handler and its response status in api.audit_log,
+// request body is not recorded because config updates may contain secrets
+func (api *APIServer) audited(config APIConfig, command string, next http.HandlerFunc) http.HandlerFunc {
+	if config.AuditLog == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		entry := AuditEntry{
+			Time:       time.Now(),
+			RequestID:  requestID(r),
+			User:       auditUser(config, r),
+			Client:     client,
+			Command:    command,
+			Parameters: requestParameters(r),
+			Status:     recorder.status,
+			Outcome:    "accepted",
+		}
+		if recorder.status >= http.StatusBadRequest {
+			entry.Outcome = "rejected"
+		}
+		api.writeAudit(entry)
+	}
+}
+
+// writeAudit - audit errors must not break API, so they are only logged
+func (api *APIServer) writeAudit(entry AuditEntry) {
+	if err := api.snapshot().audit.write(entry); err != nil {
+		log.Printf("Audit error: %v", err)
+	}
+}
+
+// httpAuditHandler - display records of api.audit_log
+func (api *APIServer) httpAuditHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	query := r.URL.Query()
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, r, c, fmt.Errorf("%w: limit must be non-negative integer", ErrBadRequest))
+			return
+		}
+		limit = parsed
+	}
+	command, requestIDFilter := query.Get("command"), query.Get("request_id")
+	entries, err := api.snapshot().audit.read(func(entry AuditEntry) bool {
+		return (command == "" || entry.Command == command) && (requestIDFilter == "" || entry.RequestID == requestIDFilter)
+	}, limit)
+	if err != nil {
+		writeError(w, r, c, err)
+		return
+	}
+	items := []interface{}{}
+	for _, entry := range entries {
+		items = append(items, entry)
+	}
+	writeList(w, r, c, items)
+}
@@ -0,0 +1,75 @@
+package chbackup
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrAPIUnauthorized = errors.New("Authentication required")
+)
+
+// requireAuth - allow request only with one of configured api.auth_tokens,
+// token is accepted as 'Authorization: Bearer <token>' or via api.api_key_header
+func requireAuth(config APIConfig, next http.HandlerFunc) http.HandlerFunc {
+	if len(config.AuthTokens) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAuthorized(config, r) {
+			next(w, r)
+			return
+		}
+		log.Printf("Unauthorized request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		// empty Config, 401 is returned even with api.legacy_rest
+		writeError(w, r, Config{}, ErrAPIUnauthorized)
+	}
+}
+
+// requireBasicAuth - allow request only with configured basic auth credentials, no-op when user is empty
+func requireBasicAuth(user, password string, next http.Handler) http.Handler {
+	if user == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("Unauthorized request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="clickhouse-backup"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		out, _ := json.Marshal(APIResult{Type: "error", Message: ErrAPIUnauthorized.Error()})
+		fmt.Fprintf(w, string(out))
+	})
+}
+
+// requestToken - token passed as 'Authorization: Bearer <token>' or via api.api_key_header
+func requestToken(config APIConfig, r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	} else if config.APIKeyHeader != "" {
+		return r.Header.Get(config.APIKeyHeader)
+	}
+	return ""
+}
+
+func isAuthorized(config APIConfig, r *http.Request) bool {
+	token := requestToken(config, r)
+	if token == "" {
+		return false
+	}
+	for _, allowed := range config.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package chbackup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAuthorized(t *testing.T) {
+	config := APIConfig{AuthTokens: []string{"secret", "other"}, APIKeyHeader: "X-API-Key"}
+	for _, tc := range []struct {
+		name       string
+		config     APIConfig
+		header     string
+		value      string
+		authorized bool
+	}{
+		{name: "bearer", config: config, header: "Authorization", value: "Bearer secret", authorized: true},
+		{name: "second token", config: config, header: "Authorization", value: "Bearer other", authorized: true},
+		{name: "bearer with spaces", config: config, header: "Authorization", value: "Bearer  secret ", authorized: true},
+		{name: "wrong bearer", config: config, header: "Authorization", value: "Bearer wrong"},
+		{name: "empty bearer", config: config, header: "Authorization", value: "Bearer "},
+		{name: "token prefix", config: config, header: "Authorization", value: "Bearer secre"},
+		{name: "basic scheme", config: config, header: "Authorization", value: "Basic c2VjcmV0"},
+		{name: "api key", config: config, header: "X-API-Key", value: "secret", authorized: true},
+		{name: "wrong api key", config: config, header: "X-API-Key", value: "wrong"},
+		{name: "api key header disabled", config: APIConfig{AuthTokens: []string{"secret"}}, header: "X-API-Key", value: "secret"},
+		{name: "custom api key header", config: APIConfig{AuthTokens: []string{"secret"}, APIKeyHeader: "X-Token"}, header: "X-Token", value: "secret", authorized: true},
+		{name: "missing token", config: config},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/backup/clean", nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			assert.Equal(t, tc.authorized, isAuthorized(tc.config, r))
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	called := false
+	next := func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}
+	// auth is disabled without api.auth_tokens
+	w := httptest.NewRecorder()
+	requireAuth(APIConfig{}, next)(w, httptest.NewRequest("POST", "/backup/clean", nil))
+	assert.True(t, called)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	called = false
+	w = httptest.NewRecorder()
+	requireAuth(APIConfig{AuthTokens: []string{"secret"}}, next)(w, httptest.NewRequest("POST", "/backup/clean", nil))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+}
+
+func TestAuthRoutes(t *testing.T) {
+	config := *DefaultConfig()
+	config.API.AuthTokens = []string{"secret"}
+	api := &APIServer{config: config, status: AsyncStatus{jobs: map[string]*AsyncJob{}}}
+	router := api.setupRouter(config, make(chan struct{}))
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		header string
+		value  string
+		status int
+	}{
+		{name: "read-only route without token", method: "GET", url: "/backup/config/default", status: http.StatusOK},
+		{name: "versioned read-only route without token", method: "GET", url: "/api/v1/backup/config/default", status: http.StatusOK},
+		{name: "health without token", method: "GET", url: "/health/live", status: http.StatusOK},
+		{name: "mutating route without token", method: "POST", url: "/backup/cancel/unknown", status: http.StatusUnauthorized},
+		{name: "versioned mutating route without token", method: "POST", url: "/api/v1/backup/cancel/unknown", status: http.StatusUnauthorized},
+		{name: "mutating route with wrong token", method: "POST", url: "/backup/cancel/unknown", header: "Authorization", value: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "mutating route with bearer", method: "POST", url: "/backup/cancel/unknown", header: "Authorization", value: "Bearer secret", status: http.StatusNotFound},
+		{name: "mutating route with api key", method: "POST", url: "/api/v1/backup/cancel/unknown", header: "X-API-Key", value: "secret", status: http.StatusNotFound},
+		{name: "config without token", method: "GET", url: "/backup/config", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.url, nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package chbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// CallbackPayload - JSON posted to api.callback_urls and '?callback=' URLs when async operation is finished
+type CallbackPayload struct {
+	JobID     string  `json:"job_id"`
+	RequestID string  `json:"request_id"`
+	Command   string  `json:"command"`
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	Started   int64   `json:"started"`
+	Finished  int64   `json:"finished"`
+	Duration  float64 `json:"duration"`
+	Size      int64   `json:"size,omitempty"`
+}
+
+// callbackURLs - api.callback_urls and valid URLs passed as '?callback=' query arguments
+func callbackURLs(config APIConfig, r *http.Request) []string {
+	urls := append([]string{}, config.CallbackURLs...)
+	for _, callback := range r.URL.Query()["callback"] {
+		u, err := url.Parse(callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Printf("Invalid callback URL '%s' is ignored", callback)
+			continue
+		}
+		urls = append(urls, callback)
+	}
+	return urls
+}
+
+// getLocalBackupSize - size of files in local backup, hard links are counted as regular files
+func getLocalBackupSize(config Config, backupName string) int64 {
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return 0
+	}
+	var size int64
+	filepath.Walk(path.Join(dataPath, "backup", backupName), func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// backupSize - remote size for upload and download, local size for others
+func backupSize(config Config, command, backupName string) int64 {
+	if backupName == "" {
+		return 0
+	}
+	if command == "upload" {
+		if backup, err := GetRemoteBackup(context.Background(), config, backupName); err == nil {
+			return backup.Size
+		}
+		return 0
+	}
+	return getLocalBackupSize(config, backupName)
+}
+
+// sendCallbacks - POST payload to each URL, failed requests are retried api.callback_retries times with exponential backoff
+func sendCallbacks(config APIConfig, urls []string, payload CallbackPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Callback marshal error: %v", err)
+		return
+	}
+	timeout, err := time.ParseDuration(config.CallbackTimeout)
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	for _, callbackURL := range urls {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := postCallback(client, callbackURL, body)
+			if err == nil {
+				break
+			}
+			if attempt >= config.CallbackRetries {
+				log.Printf("Callback to %s for job %s failed: %v", callbackURL, payload.JobID, err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func postCallback(client *http.Client, callbackURL string, body []byte) error {
+	resp, err := client.Post(callbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
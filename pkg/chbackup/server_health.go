@@ -0,0 +1,117 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck - result of one readiness check
+type HealthCheck struct {
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// HealthResult - response of /health/live and /health/ready
+type HealthResult struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// runHealthCheck - run check with timeout, check is left in background when it doesn't respect ctx
+func runHealthCheck(timeout time.Duration, check func(ctx context.Context) error) HealthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+	hc := HealthCheck{Status: "ok", Duration: time.Since(start).Seconds()}
+	if err != nil {
+		hc.Status = "fail"
+		hc.Error = err.Error()
+	}
+	return hc
+}
+
+// checkClickHouse - connect to ClickHouse and run 'SELECT 1'
+func checkClickHouse(ctx context.Context, config Config) error {
+	ch := &ClickHouse{Config: &config.ClickHouse}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse with: %v", err)
+	}
+	defer ch.Close()
+	var one int
+	return ch.GetConn().QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// checkRemoteStorage - check bucket of remote storage is accessible
+func checkRemoteStorage(ctx context.Context, config Config) error {
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return err
+	}
+	if err := bd.Connect(); err != nil {
+		return fmt.Errorf("can't connect to remote storage with: %v", err)
+	}
+	return bd.CheckBucket(ctx)
+}
+
+// httpLiveHandler - process is alive and serves requests
+func httpLiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.Marshal(HealthResult{Status: "ok"})
+	fmt.Fprintln(w, string(out))
+}
+
+// httpReadyHandler - check ClickHouse and, when api.ready_check_remote is set, remote storage
+func httpReadyHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	timeout, err := time.ParseDuration(c.API.ReadyTimeout)
+	if err != nil {
+		timeout = 5 * time.Second
+	}
+	checks := map[string]func(ctx context.Context) error{
+		"clickhouse": func(ctx context.Context) error {
+			return checkClickHouse(ctx, c)
+		},
+	}
+	if c.API.ReadyCheckRemote && c.General.RemoteStorage != "none" {
+		checks["remote_storage"] = func(ctx context.Context) error {
+			return checkRemoteStorage(ctx, c)
+		}
+	}
+	result := HealthResult{Status: "ok", Checks: map[string]HealthCheck{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			hc := runHealthCheck(timeout, check)
+			mu.Lock()
+			defer mu.Unlock()
+			result.Checks[name] = hc
+			if hc.Status != "ok" {
+				result.Status = "fail"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	out, _ := json.Marshal(result)
+	fmt.Fprintln(w, string(out))
+}
@@ -0,0 +1,116 @@
+package chbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HistoryEntry - finished async operation kept in api.history_file
+type HistoryEntry struct {
+	ID         string
+	RequestID  string
+	Command    string
+	Name       string
+	Parameters map[string]string `json:",omitempty"`
+	Status     string
+	Error      string `json:",omitempty"`
+	Started    int64
+	Finished   int64
+}
+
+// operationHistory - ring buffer of the last api.history_size operations, persisted to api.history_file when it is set
+type operationHistory struct {
+	path    string
+	size    int
+	entries []HistoryEntry
+	sync.RWMutex
+}
+
+// loadOperationHistory - read history saved by previous run, missing file means empty history
+func loadOperationHistory(path string, size int) (*operationHistory, error) {
+	h := &operationHistory{path: path, size: size, entries: []HistoryEntry{}}
+	if path == "" {
+		return h, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read history file with %v", err)
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		return nil, fmt.Errorf("can't parse history file with %v", err)
+	}
+	h.trim()
+	return h, nil
+}
+
+func (h *operationHistory) trim() {
+	if h.size > 0 && len(h.entries) > h.size {
+		h.entries = append([]HistoryEntry{}, h.entries[len(h.entries)-h.size:]...)
+	}
+}
+
+// add - append entry, drop the oldest ones and save history
+func (h *operationHistory) add(entry HistoryEntry) error {
+	h.Lock()
+	defer h.Unlock()
+	h.entries = append(h.entries, entry)
+	h.trim()
+	if h.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(h.entries)
+	if err != nil {
+		return err
+	}
+	// write to temporary file and rename, so history is never truncated by crash
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("can't save history with %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't save history with %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can't save history with %v", err)
+	}
+	return os.Rename(tmp.Name(), h.path)
+}
+
+// list - entries matched by filter, the newest first
+func (h *operationHistory) list(filter func(HistoryEntry) bool) []HistoryEntry {
+	h.RLock()
+	defer h.RUnlock()
+	result := []HistoryEntry{}
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if filter(h.entries[i]) {
+			result = append(result, h.entries[i])
+		}
+	}
+	return result
+}
+
+// httpHistoryHandler - display the last finished async operations
+func (api *APIServer) httpHistoryHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	query := r.URL.Query()
+	command, name, status := query.Get("command"), query.Get("name"), query.Get("status")
+	entries := api.snapshot().history.list(func(entry HistoryEntry) bool {
+		return (command == "" || entry.Command == command) &&
+			(name == "" || entry.Name == name) &&
+			(status == "" || entry.Status == status)
+	})
+	items := []interface{}{}
+	for _, entry := range entries {
+		items = append(items, entry)
+	}
+	writeList(w, r, c, items)
+}
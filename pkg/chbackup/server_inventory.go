@@ -0,0 +1,65 @@
+package chbackup
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// refreshInventoryMetrics - update number_backups_*, last_backup_size_bytes and oldest_backup_timestamp
+// every api.metrics_refresh_interval until done is closed
+func (api *APIServer) refreshInventoryMetrics(done <-chan struct{}) {
+	for {
+		config := api.snapshot().config
+		if config.API.EnableMetrics {
+			api.updateInventoryMetrics(config)
+		}
+		interval, err := time.ParseDuration(config.API.MetricsRefreshInterval)
+		if err != nil || interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// updateInventoryMetrics - list local and remote backups, errors are logged and the previous values are kept
+func (api *APIServer) updateInventoryMetrics(config Config) {
+	if localBackups, err := ListLocalBackups(config); err != nil {
+		log.Printf("Can't refresh local backup metrics: %v", err)
+	} else {
+		api.metrics.NumberBackupsLocal.Set(float64(len(localBackups)))
+		if len(localBackups) > 0 {
+			// ListLocalBackups returns backups sorted by date
+			newest := localBackups[len(localBackups)-1]
+			api.metrics.LastBackupSize.WithLabelValues("local").Set(float64(getLocalBackupSize(config, newest.Name)))
+			api.metrics.OldestBackup.WithLabelValues("local").Set(float64(localBackups[0].Date.Unix()))
+		}
+	}
+	if config.General.RemoteStorage == "none" {
+		return
+	}
+	remoteBackups, err := getRemoteBackups(context.Background(), config)
+	if err != nil {
+		log.Printf("Can't refresh remote backup metrics: %v", err)
+		return
+	}
+	api.metrics.NumberBackupsRemote.Set(float64(len(remoteBackups)))
+	if len(remoteBackups) == 0 {
+		return
+	}
+	oldest, newest := remoteBackups[0], remoteBackups[0]
+	for _, backup := range remoteBackups {
+		if backup.Date.Before(oldest.Date) {
+			oldest = backup
+		}
+		if backup.Date.After(newest.Date) {
+			newest = backup
+		}
+	}
+	api.metrics.LastBackupSize.WithLabelValues("remote").Set(float64(newest.Size))
+	api.metrics.OldestBackup.WithLabelValues("remote").Set(float64(oldest.Date.Unix()))
+}
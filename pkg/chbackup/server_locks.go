@@ -0,0 +1,100 @@
+package chbackup
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// lockedCommands - commands which take a lock when run by API
+var lockedCommands = map[string]bool{
+	"create":              true,
+	"upload":              true,
+	"download":            true,
+	"restore":             true,
+	"delete":              true,
+	"verify":              true,
+	"create_remote":       true,
+	"restore_remote":      true,
+	"freeze":              true,
+	"clean":               true,
+	"clean_remote_broken": true,
+	"copy":                true,
+	"config":              true,
+	"watch":               true,
+}
+
+// commandLocks - one lock per command, commands from different pairs of api.allow_parallel can't run at the same time
+type commandLocks struct {
+	allowed map[string]bool
+	running map[string]bool
+	sync.Mutex
+}
+
+// parallelPairKey - key of commands pair independent of order
+func parallelPairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "+" + b
+}
+
+// parseAllowParallel - parse api.allow_parallel items like 'create+upload'
+func parseAllowParallel(allowParallel []string) (map[string]bool, error) {
+	allowed := map[string]bool{}
+	for _, item := range allowParallel {
+		commands := strings.Split(strings.TrimSpace(item), "+")
+		if len(commands) != 2 {
+			return nil, fmt.Errorf("invalid api.allow_parallel item '%s', '<command>+<command>' is expected", item)
+		}
+		for _, command := range commands {
+			if !lockedCommands[command] {
+				return nil, fmt.Errorf("unknown command '%s' in api.allow_parallel", command)
+			}
+		}
+		if commands[0] == commands[1] {
+			return nil, fmt.Errorf("invalid api.allow_parallel item '%s', two '%s' can't run at the same time", item, commands[0])
+		}
+		allowed[parallelPairKey(commands[0], commands[1])] = true
+	}
+	return allowed, nil
+}
+
+func newCommandLocks(allowParallel []string) (*commandLocks, error) {
+	l := &commandLocks{running: map[string]bool{}}
+	return l, l.setPolicy(allowParallel)
+}
+
+// setPolicy - replace api.allow_parallel policy, already running commands keep their locks
+func (l *commandLocks) setPolicy(allowParallel []string) error {
+	allowed, err := parseAllowParallel(allowParallel)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.allowed = allowed
+	return nil
+}
+
+// tryAcquire - take lock for command if the same command is not running and it is allowed to run with all running commands
+func (l *commandLocks) tryAcquire(command string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.running[command] {
+		return false
+	}
+	for running := range l.running {
+		if !l.allowed[parallelPairKey(command, running)] {
+			return false
+		}
+	}
+	l.running[command] = true
+	return true
+}
+
+func (l *commandLocks) release(command string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.running, command)
+}
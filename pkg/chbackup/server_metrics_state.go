@@ -0,0 +1,128 @@
+package chbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CommandState - values of last_<command>_* gauges, create is saved as last_backup_*
+type CommandState struct {
+	Success  float64 `json:"success"`
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Duration int64   `json:"duration"`
+}
+
+// metricsState - last values of gauges saved to api.metrics_state_file, so alerts don't flap after restart
+type metricsState struct {
+	path     string
+	commands map[string]CommandState
+	sync.Mutex
+}
+
+// loadMetricsState - read state saved by previous run, missing file means empty state
+func loadMetricsState(path string) (*metricsState, error) {
+	s := &metricsState{path: path, commands: map[string]CommandState{}}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read metrics state file with %v", err)
+	}
+	if err := json.Unmarshal(data, &s.commands); err != nil {
+		return nil, fmt.Errorf("can't parse metrics state file with %v", err)
+	}
+	return s, nil
+}
+
+// set - update state of command and save it
+func (s *metricsState) set(command string, state CommandState) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.commands[command] = state
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.commands)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("can't save metrics state with %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't save metrics state with %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can't save metrics state with %v", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// replace - switch to state loaded from another file, the pointer held by Metrics stays the same
+func (s *metricsState) replace(other *metricsState) {
+	if s == nil {
+		return
+	}
+	other.Lock()
+	path, commands := other.path, other.commands
+	other.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	s.path, s.commands = path, commands
+}
+
+// lastGauges - success, start, end and duration gauges of command
+func (m *Metrics) lastGauges(command string) (success, start, end, duration prometheus.Gauge, ok bool) {
+	if command == "create" {
+		return m.LastBackupSuccess, m.LastBackupStart, m.LastBackupEnd, m.LastBackupDuration, m.LastBackupSuccess != nil
+	}
+	cm, ok := m.Commands[command]
+	if !ok {
+		return nil, nil, nil, nil, false
+	}
+	return cm.LastSuccess, cm.LastStart, cm.LastEnd, cm.LastDuration, true
+}
+
+// restoreState - set gauges to values saved by previous run
+func (m *Metrics) restoreState() {
+	if m.state == nil {
+		return
+	}
+	m.state.Lock()
+	defer m.state.Unlock()
+	for command, state := range m.state.commands {
+		success, start, end, duration, ok := m.lastGauges(command)
+		if !ok {
+			continue
+		}
+		success.Set(state.Success)
+		start.Set(float64(state.Start))
+		end.Set(float64(state.End))
+		duration.Set(float64(state.Duration))
+	}
+}
+
+// saveState - save values of last_* gauges of finished command, errors are only logged
+func (m *Metrics) saveState(command string, state CommandState) {
+	if err := m.state.set(command, state); err != nil {
+		log.Printf("Metrics state error: %v", err)
+	}
+}
@@ -0,0 +1,539 @@
+package chbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiParameter - query or path parameter of API route
+type apiParameter struct {
+	Name        string
+	In          string
+	Description string
+}
+
+// apiOperation - description of API route used for generating OpenAPI specification
+type apiOperation struct {
+	Summary    string
+	Parameters []apiParameter
+	// Response - value of the type returned on success, nil means plain text
+	Response interface{}
+	// Auth - route is protected by api.auth_tokens
+	Auth bool
+}
+
+var (
+	nameParameter     = apiParameter{Name: "name", In: "path", Description: "Backup name"}
+	tableParameter    = apiParameter{Name: "table", In: "query", Description: "Works the same as the '--table' CLI argument"}
+	callbackParameter = apiParameter{Name: "callback", In: "query", Description: "URL which receives POST with result when operation is finished, can be repeated"}
+	remoteParameter   = apiParameter{Name: "remote", In: "query", Description: "Name of remote storage from 'remotes' config section, general.remote_storage is used by default"}
+	formatParameter   = apiParameter{Name: "format", In: "query", Description: "'json' for JSON array or 'ndjson' for newline-delimited JSON objects, default is 'json' for /api/v1 and 'ndjson' for legacy routes"}
+)
+
+// apiOperations - documentation of every API route, keys are 'METHOD /path' or '/path' for all methods
+// TestOpenAPIRoutesDocumented fails when a route is registered without documentation
+var apiOperations = map[string]apiOperation{
+	"/": {
+		Summary: "API index page",
+	},
+	"/openapi.json": {
+		Summary:  "OpenAPI specification of this API",
+		Response: map[string]interface{}{},
+	},
+	"/backup/tables": {
+		Summary:    "Print list of tables",
+		Parameters: []apiParameter{formatParameter},
+		Response:   []APITablesResult{},
+	},
+	"/backup/list": {
+		Summary: "Print list of local and remote backups",
+		Parameters: []apiParameter{
+			formatParameter,
+			{Name: "location", In: "query", Description: "'local' or 'remote', both by default"},
+			{Name: "name_regex", In: "query", Description: "Regular expression for backup names"},
+			{Name: "label", In: "query", Description: "Only backups with this label as key=value, can be repeated"},
+			{Name: "since", In: "query", Description: "Only backups created at or after this time, RFC3339 or backup name time format"},
+			{Name: "until", In: "query", Description: "Only backups created at or before this time, RFC3339 or backup name time format"},
+			{Name: "sort", In: "query", Description: "'name', 'date' or 'size', '-' prefix means descending order"},
+			{Name: "limit", In: "query", Description: "Maximum number of backups to return"},
+			{Name: "offset", In: "query", Description: "Number of backups to skip"},
+			remoteParameter,
+		},
+		Response: []APIListResult{},
+	},
+	"/backup/check": {
+		Summary:    "Check credentials, bucket and list, put, get and delete permissions of remote storage by probe object",
+		Parameters: []apiParameter{remoteParameter},
+		Response:   RemoteCheckResult{},
+		Auth:       true,
+	},
+	"/backup/remote/{name}": {
+		Summary:    "Describe remote backup by its metadata without downloading it: tables, sizes, partitions and required backups",
+		Parameters: []apiParameter{nameParameter, remoteParameter},
+		Response:   BackupDescription{},
+	},
+	"/backup/broken": {
+		Summary:    "List remote backups which can't be downloaded: without meta.json, with missing objects or required backups",
+		Parameters: []apiParameter{remoteParameter},
+		Response:   []BrokenBackup{},
+	},
+	"/backup/create": {
+		Summary: "Create new backup, async",
+		Parameters: []apiParameter{
+			tableParameter,
+			{Name: "name", In: "query", Description: "Backup name, by default the current time is used"},
+			{Name: "diff-from", In: "query", Description: "Works the same as the '--diff-from' CLI argument of create"},
+			{Name: "partitions", In: "query", Description: "Works the same as the '--partitions' CLI argument of create"},
+			{Name: "rbac", In: "query", Description: "Save users, roles, quotas, settings profiles and row policies too"},
+			{Name: "label", In: "query", Description: "Works the same as the '--label' CLI argument of create, can be repeated"},
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"/backup/clean": {
+		Summary:  "Remove data in 'shadow' folder",
+		Response: APIResult{},
+		Auth:     true,
+	},
+	"/backup/clean/remote_broken": {
+		Summary:    "Remove remote backups which can't be downloaded, async",
+		Parameters: []apiParameter{remoteParameter},
+		Response:   APIAsyncResult{},
+		Auth:       true,
+	},
+	"/backup/freeze": {
+		Summary:  "Freeze tables",
+		Response: APIResult{},
+		Auth:     true,
+	},
+	"/backup/upload/{name}": {
+		Summary: "Upload backup to remote storage, async",
+		Parameters: []apiParameter{
+			nameParameter,
+			tableParameter,
+			{Name: "diff-from", In: "query", Description: "Works the same as the '--diff-from' CLI argument"},
+			remoteParameter,
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"/backup/download/{name}": {
+		Summary:    "Download backup from remote storage, async",
+		Parameters: []apiParameter{nameParameter, tableParameter, remoteParameter, callbackParameter},
+		Response:   APIAsyncResult{},
+		Auth:       true,
+	},
+	"/backup/copy/{name}": {
+		Summary: "Copy backup from one remote storage to another, async",
+		Parameters: []apiParameter{
+			nameParameter,
+			{Name: "from", In: "query", Description: "Name of source remote from 'remotes' config section, general.remote_storage by default"},
+			{Name: "to", In: "query", Description: "Name of destination remote from 'remotes' config section, general.remote_storage by default"},
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"/backup/restore/{name}": {
+		Summary: "Create schema and restore data from backup, async",
+		Parameters: []apiParameter{
+			nameParameter,
+			tableParameter,
+			{Name: "schema", In: "query", Description: "Restore schema only"},
+			{Name: "data", In: "query", Description: "Restore data only"},
+			{Name: "partitions", In: "query", Description: "Works the same as the '--partitions' CLI argument of restore"},
+			{Name: "restore_database_mapping", In: "query", Description: "Works the same as the '--restore-database-mapping' CLI argument of restore"},
+			{Name: "restore_table_mapping", In: "query", Description: "Works the same as the '--restore-table-mapping' CLI argument of restore"},
+			{Name: "on_cluster", In: "query", Description: "Works the same as the '--on-cluster' CLI argument of restore"},
+			{Name: "rbac", In: "query", Description: "Restore users, roles, quotas, settings profiles and row policies too"},
+			{Name: "rm", In: "query", Description: "Works the same as the '--rm' CLI argument of restore"},
+			{Name: "restore_schema_as_non_replicated", In: "query", Description: "Works the same as the '--restore-schema-as-non-replicated' CLI argument of restore"},
+			{Name: "restore_schema_as_replicated", In: "query", Description: "Works the same as the '--restore-schema-as-replicated' CLI argument of restore"},
+			{Name: "restore_uuid", In: "query", Description: "Works the same as the '--restore-uuid' CLI argument of restore"},
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"/backup/create_remote": {
+		Summary: "Create new backup, upload it and remove local backup, async",
+		Parameters: []apiParameter{
+			tableParameter,
+			{Name: "name", In: "query", Description: "Backup name, by default the current time is used"},
+			{Name: "diff-from", In: "query", Description: "Works the same as the '--diff-from' CLI argument of create_remote"},
+			{Name: "partitions", In: "query", Description: "Works the same as the '--partitions' CLI argument of create_remote"},
+			{Name: "rbac", In: "query", Description: "Save users, roles, quotas, settings profiles and row policies too"},
+			{Name: "label", In: "query", Description: "Works the same as the '--label' CLI argument of create_remote, can be repeated"},
+			{Name: "keep_local", In: "query", Description: "Keep local backup after upload"},
+			remoteParameter,
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"/backup/restore_remote/{name}": {
+		Summary: "Download backup and restore it, async",
+		Parameters: []apiParameter{
+			nameParameter,
+			tableParameter,
+			{Name: "schema", In: "query", Description: "Restore schema only"},
+			{Name: "data", In: "query", Description: "Restore data only"},
+			{Name: "partitions", In: "query", Description: "Works the same as the '--partitions' CLI argument of restore"},
+			{Name: "restore_database_mapping", In: "query", Description: "Works the same as the '--restore-database-mapping' CLI argument of restore"},
+			{Name: "restore_table_mapping", In: "query", Description: "Works the same as the '--restore-table-mapping' CLI argument of restore"},
+			{Name: "on_cluster", In: "query", Description: "Works the same as the '--on-cluster' CLI argument of restore"},
+			{Name: "rbac", In: "query", Description: "Restore users, roles, quotas, settings profiles and row policies too"},
+			{Name: "rm", In: "query", Description: "Works the same as the '--rm' CLI argument of restore"},
+			{Name: "restore_schema_as_non_replicated", In: "query", Description: "Works the same as the '--restore-schema-as-non-replicated' CLI argument of restore"},
+			{Name: "restore_schema_as_replicated", In: "query", Description: "Works the same as the '--restore-schema-as-replicated' CLI argument of restore"},
+			{Name: "restore_uuid", In: "query", Description: "Works the same as the '--restore-uuid' CLI argument of restore"},
+			remoteParameter,
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"/backup/delete/{where}/{name}": {
+		Summary: "Delete specific backup",
+		Parameters: []apiParameter{
+			{Name: "where", In: "path", Description: "'local' or 'remote'"},
+			nameParameter,
+			remoteParameter,
+			{Name: "force_cascade", In: "query", Description: "Works the same as the '--force-cascade' CLI argument of delete"},
+			{Name: "force", In: "query", Description: "Alias of 'force_cascade'"},
+		},
+		Response: APIResult{},
+		Auth:     true,
+	},
+	"/backup/verify/{where}/{name}": {
+		Summary: "Verify checksums of files, archives and data parts of backup without restoring it, async",
+		Parameters: []apiParameter{
+			{Name: "where", In: "path", Description: "'local' or 'remote'"},
+			nameParameter,
+			remoteParameter,
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"/backup/config/default": {
+		Summary:  "Print default config in YAML format",
+		Response: APIGenericResult{},
+	},
+	"GET /backup/config": {
+		Summary:  "Print current config in YAML format",
+		Response: APIGenericResult{},
+		Auth:     true,
+	},
+	"POST /backup/config": {
+		Summary:  "Update current config, YAML config is expected in request body",
+		Response: APIResult{},
+		Auth:     true,
+	},
+	"/backup/config/reload": {
+		Summary:  "Reload config from file, the same as SIGHUP",
+		Response: APIResult{},
+		Auth:     true,
+	},
+	"/backup/status": {
+		Summary:  "Display state of the latest async operation",
+		Response: AsyncJob{},
+	},
+	"/backup/status/{job_id}": {
+		Summary:    "Display state of async operation",
+		Parameters: []apiParameter{{Name: "job_id", In: "path", Description: "JobID returned by async operation"}},
+		Response:   AsyncJob{},
+	},
+	"/backup/events": {
+		Summary:    "Stream progress events of running operations as Server-Sent Events",
+		Parameters: []apiParameter{{Name: "name", In: "query", Description: "Receive events only for this backup"}},
+	},
+	"/backup/cancel/{job_id}": {
+		Summary:    "Cancel async operation and remove partially created data",
+		Parameters: []apiParameter{{Name: "job_id", In: "path", Description: "JobID returned by async operation"}},
+		Response:   APIResult{},
+		Auth:       true,
+	},
+	"/backup/actions": {
+		Summary:    "Run CLI command passed as {\"command\": \"...\"} in request body, async",
+		Parameters: []apiParameter{callbackParameter},
+		Response:   APIAsyncResult{},
+		Auth:       true,
+	},
+	"POST /backup/watch": {
+		Summary: "Start watch cycles, async, the job runs until it is cancelled",
+		Parameters: []apiParameter{
+			tableParameter,
+			{Name: "watch_interval", In: "query", Description: "Works the same as the '--watch-interval' CLI argument of watch"},
+			{Name: "full_interval", In: "query", Description: "Works the same as the '--full-interval' CLI argument of watch"},
+			callbackParameter,
+		},
+		Response: APIAsyncResult{},
+		Auth:     true,
+	},
+	"GET /backup/watch": {
+		Summary:  "Display state of watch cycles",
+		Response: WatchState{},
+	},
+	"/backup/history": {
+		Summary: "Print the last finished async operations, the newest first",
+		Parameters: []apiParameter{
+			formatParameter,
+			{Name: "command", In: "query", Description: "Only operations of this command"},
+			{Name: "name", In: "query", Description: "Only operations with this backup"},
+			{Name: "status", In: "query", Description: "'success', 'error' or 'cancelled'"},
+		},
+		Response: []HistoryEntry{},
+	},
+	"/backup/audit": {
+		Summary: "Print records of api.audit_log",
+		Parameters: []apiParameter{
+			formatParameter,
+			{Name: "command", In: "query", Description: "Only records of this command"},
+			{Name: "request_id", In: "query", Description: "Only records of this request"},
+			{Name: "limit", In: "query", Description: "Maximum number of the latest records to return, 100 by default, 0 means all"},
+		},
+		Response: []AuditEntry{},
+		Auth:     true,
+	},
+	"/health": {
+		Summary: "Health check",
+	},
+	"/health/live": {
+		Summary:  "Liveness check, always succeeds while the server is running",
+		Response: HealthResult{},
+	},
+	"/health/ready": {
+		Summary:  "Readiness check of ClickHouse connection and optionally remote storage, returns 503 when any check fails",
+		Response: HealthResult{},
+	},
+	"/metrics": {
+		Summary: "Prometheus metrics",
+	},
+}
+
+var pathParameterRE = regexp.MustCompile(`{([^}:]+)(:[^}]+)?}`)
+
+// undocumentedRoute - routes which are not part of API specification
+func undocumentedRoute(path string) bool {
+	return strings.HasPrefix(path, "/debug/pprof/")
+}
+
+// findAPIOperation - return documentation for route, routes under /api/v1 share documentation with legacy routes
+func findAPIOperation(method, path string) (apiOperation, bool) {
+	path = strings.TrimPrefix(path, apiV1Prefix)
+	if op, ok := apiOperations[method+" "+path]; ok {
+		return op, true
+	}
+	op, ok := apiOperations[path]
+	return op, ok
+}
+
+// buildOpenAPISpec - walk registered routes and build OpenAPI 3 specification
+func buildOpenAPISpec(r *mux.Router) (map[string]interface{}, error) {
+	paths := map[string]map[string]interface{}{}
+	schemas := map[string]interface{}{}
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		// prefix routes of subrouters like '/api/v1' don't have handler
+		if route.GetHandler() == nil {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil || undocumentedRoute(path) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		path = pathParameterRE.ReplaceAllString(path, "{$1}")
+		for _, method := range methods {
+			op, ok := findAPIOperation(method, path)
+			if !ok {
+				return fmt.Errorf("route '%s %s' is not documented", method, path)
+			}
+			if _, ok := paths[path]; !ok {
+				paths[path] = map[string]interface{}{}
+			}
+			v1 := strings.HasPrefix(path, apiV1Prefix+"/")
+			operation := op.openAPI(method, v1, schemas)
+			if v1 {
+				operation["operationId"] = "v1" + strings.Title(operation["operationId"].(string))
+			}
+			paths[path][strings.ToLower(method)] = operation
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "clickhouse-backup API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}, nil
+}
+
+// openAPI - describe operation, /api/v1 routes return APIError with machine-readable code on errors
+func (op apiOperation) openAPI(method string, v1 bool, schemas map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationID(method, op.Summary),
+	}
+	if len(op.Parameters) > 0 {
+		parameters := []interface{}{}
+		for _, p := range op.Parameters {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Description,
+				"required":    p.In == "path",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		result["parameters"] = parameters
+	}
+	errorType := reflect.TypeOf(APIResult{})
+	if v1 {
+		errorType = reflect.TypeOf(APIError{})
+	}
+	success := map[string]interface{}{"description": "Success"}
+	if op.Response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": jsonSchema(reflect.TypeOf(op.Response), schemas),
+			},
+		}
+	}
+	result["responses"] = map[string]interface{}{
+		"200": success,
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": jsonSchema(errorType, schemas),
+				},
+			},
+		},
+	}
+	if op.Auth {
+		result["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+	}
+	return result
+}
+
+func operationID(method, summary string) string {
+	words := strings.FieldsFunc(summary, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	id := strings.ToLower(method)
+	for _, w := range words {
+		id += strings.Title(strings.ToLower(w))
+	}
+	return id
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema - describe Go type the same way as encoding/json marshals it
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		return structSchema(t, schemas)
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	collectProperties(t, properties, schemas)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func collectProperties(t reflect.Type, properties map[string]interface{}, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			collectProperties(field.Type, properties, schemas)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = jsonSchema(field.Type, schemas)
+	}
+}
+
+// httpOpenAPIHandler - display OpenAPI specification generated from registered routes
+func httpOpenAPIHandler(w http.ResponseWriter, r *http.Request, router *mux.Router) {
+	spec, err := buildOpenAPISpec(router)
+	if err != nil {
+		log.Printf("OpenAPI error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
+		fmt.Fprintf(w, string(out))
+		return
+	}
+	out, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		out, _ := json.Marshal(APIResult{Type: "error", Message: err.Error()})
+		fmt.Fprintf(w, string(out))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(out))
+}
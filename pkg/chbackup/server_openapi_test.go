@@ -0,0 +1,47 @@
+package chbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPIRoutesDocumented(t *testing.T) {
+	config := DefaultConfig()
+	config.API.EnableMetrics = true
+	config.API.EnablePprof = true
+	api := &APIServer{}
+	router := api.setupRouter(*config, make(chan struct{}))
+
+	spec, err := buildOpenAPISpec(router)
+	require.NoError(t, err)
+	_, err = json.Marshal(spec)
+	require.NoError(t, err)
+
+	paths := spec["paths"].(map[string]map[string]interface{})
+	// clients are generated with method names from operationId
+	operationIDs := map[string]string{}
+	for path, methods := range paths {
+		for method, operation := range methods {
+			id := operation.(map[string]interface{})["operationId"].(string)
+			previous, exists := operationIDs[id]
+			assert.False(t, exists, "operationId '%s' of '%s %s' is used by '%s'", id, method, path, previous)
+			operationIDs[id] = method + " " + path
+		}
+	}
+	for key := range apiOperations {
+		found := false
+		for path, methods := range paths {
+			for method := range methods {
+				if key == path || key == fmt.Sprintf("%s %s", strings.ToUpper(method), path) {
+					found = true
+				}
+			}
+		}
+		assert.True(t, found, "documented route '%s' is not registered", key)
+	}
+}
@@ -0,0 +1,231 @@
+package chbackup
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrAPIRateLimited - returned when api.rate_limit or api.rate_limit_per_ip is exceeded
+	ErrAPIRateLimited = errors.New("Too many requests")
+	// ErrAPIOverloaded - returned when api.max_queued_requests requests are already waiting
+	ErrAPIOverloaded = errors.New("Too many concurrent requests")
+)
+
+// rateLimiterCleanupInterval - how often buckets of idle clients are removed
+const rateLimiterCleanupInterval = time.Minute
+
+// tokenBucket - allow rate requests per second with bursts up to burst requests, not safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket - burst less than 1 means one second of rate
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// take - take one token, returns time to wait for next token when bucket is empty
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter - global and per client IP token buckets, zero rate disables limit
+type rateLimiter struct {
+	global      *tokenBucket
+	perIPRate   float64
+	perIPBurst  int
+	clients     map[string]*tokenBucket
+	lastCleanup time.Time
+	sync.Mutex
+}
+
+func newRateLimiter(config APIConfig) *rateLimiter {
+	now := time.Now()
+	l := &rateLimiter{
+		perIPRate:   config.RateLimitPerIP,
+		perIPBurst:  config.RateLimitPerIPBurst,
+		clients:     map[string]*tokenBucket{},
+		lastCleanup: now,
+	}
+	if config.RateLimit > 0 {
+		l.global = newTokenBucket(config.RateLimit, config.RateLimitBurst, now)
+	}
+	return l
+}
+
+// allow - check limit of client and global limit, returns time after which request may be retried
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.perIPRate > 0 {
+		if now.Sub(l.lastCleanup) > rateLimiterCleanupInterval {
+			for ip, bucket := range l.clients {
+				if bucket.refill(now); bucket.tokens >= bucket.burst {
+					delete(l.clients, ip)
+				}
+			}
+			l.lastCleanup = now
+		}
+		bucket, ok := l.clients[client]
+		if !ok {
+			bucket = newTokenBucket(l.perIPRate, l.perIPBurst, now)
+			l.clients[client] = bucket
+		}
+		if ok, wait := bucket.take(now); !ok {
+			return false, wait
+		}
+	}
+	if l.global != nil {
+		return l.global.take(now)
+	}
+	return true, 0
+}
+
+// requestQueue - at most max requests are served at the same time, up to maxWaiting requests wait for timeout
+type requestQueue struct {
+	slots      chan struct{}
+	waiting    int32
+	maxWaiting int32
+	timeout    time.Duration
+}
+
+// newRequestQueue - nil queue means no limit
+func newRequestQueue(config APIConfig) *requestQueue {
+	if config.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	timeout, err := time.ParseDuration(config.QueueTimeout)
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	return &requestQueue{
+		slots:      make(chan struct{}, config.MaxConcurrentRequests),
+		maxWaiting: int32(config.MaxQueuedRequests),
+		timeout:    timeout,
+	}
+}
+
+// acquire - take slot or wait for it in queue, release must be called when acquire returns nil
+func (q *requestQueue) acquire(r *http.Request) error {
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if atomic.AddInt32(&q.waiting, 1) > q.maxWaiting {
+		atomic.AddInt32(&q.waiting, -1)
+		return ErrAPIOverloaded
+	}
+	defer atomic.AddInt32(&q.waiting, -1)
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w, waited %s", ErrAPIOverloaded, q.timeout)
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+func (q *requestQueue) release() {
+	<-q.slots
+}
+
+// requestLimits - rate limiter and request queue, replaced when related api.* settings are changed
+type requestLimits struct {
+	config  APIConfig
+	limiter *rateLimiter
+	queue   *requestQueue
+	sync.RWMutex
+}
+
+func newRequestLimits(config APIConfig) *requestLimits {
+	return &requestLimits{config: config, limiter: newRateLimiter(config), queue: newRequestQueue(config)}
+}
+
+// set - apply new config, state of limiters is kept when their settings are not changed
+func (rl *requestLimits) set(config APIConfig) {
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.config.RateLimit != config.RateLimit || rl.config.RateLimitBurst != config.RateLimitBurst ||
+		rl.config.RateLimitPerIP != config.RateLimitPerIP || rl.config.RateLimitPerIPBurst != config.RateLimitPerIPBurst {
+		rl.limiter = newRateLimiter(config)
+	}
+	if rl.config.MaxConcurrentRequests != config.MaxConcurrentRequests || rl.config.MaxQueuedRequests != config.MaxQueuedRequests ||
+		rl.config.QueueTimeout != config.QueueTimeout {
+		// requests in the old queue release their slots there
+		rl.queue = newRequestQueue(config)
+	}
+	rl.config = config
+}
+
+// unlimitedPath - health checks are never limited, so orchestrator doesn't restart busy server
+func unlimitedPath(path string) bool {
+	return strings.HasPrefix(path, "/health")
+}
+
+// middleware - reject requests over rate limits with 429 and queue requests over api.max_concurrent_requests,
+// long-lived /backup/events streams don't take queue slots
+func (rl *requestLimits) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rl.RLock()
+		limiter, queue := rl.limiter, rl.queue
+		rl.RUnlock()
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if ok, wait := limiter.allow(client); !ok {
+			log.Printf("Rate limit exceeded by %s for %s %s", client, r.Method, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			// empty Config, 429 is returned even with api.legacy_rest
+			writeError(w, r, Config{}, ErrAPIRateLimited)
+			return
+		}
+		if queue != nil && !strings.HasSuffix(r.URL.Path, "/backup/events") {
+			if err := queue.acquire(r); err != nil {
+				writeError(w, r, Config{}, err)
+				return
+			}
+			defer queue.release()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
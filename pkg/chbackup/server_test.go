@@ -0,0 +1,471 @@
+package chbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListFormat(t *testing.T) {
+	assert.Equal(t, "ndjson", listFormat(httptest.NewRequest("GET", "/backup/list", nil)))
+	assert.Equal(t, "json", listFormat(httptest.NewRequest("GET", "/backup/list?format=json", nil)))
+	assert.Equal(t, "json", listFormat(httptest.NewRequest("GET", "/api/v1/backup/list", nil)))
+	assert.Equal(t, "ndjson", listFormat(httptest.NewRequest("GET", "/api/v1/backup/list?format=ndjson", nil)))
+}
+
+func TestWriteList(t *testing.T) {
+	c := *DefaultConfig()
+	w := httptest.NewRecorder()
+	writeList(w, httptest.NewRequest("GET", "/api/v1/backup/tables", nil), c, []interface{}{})
+	assert.Equal(t, "[]\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	writeList(w, httptest.NewRequest("GET", "/backup/tables?format=json", nil), c, []interface{}{APIResult{Type: "table"}, APIResult{Type: "table"}})
+	assert.Equal(t, "[{\"Type\":\"table\",\"Message\":\"\"},{\"Type\":\"table\",\"Message\":\"\"}]\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	writeList(w, httptest.NewRequest("GET", "/backup/tables?format=xml", nil), c, []interface{}{})
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestParseListQuery(t *testing.T) {
+	q, err := parseListQuery(httptest.NewRequest("GET", "/backup/list?location=remote&name_regex=^daily&since=2019-02-01T00-00-00&sort=-date&limit=2&offset=1", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "remote", q.Location)
+	assert.Equal(t, "-date", q.Sort)
+	assert.Equal(t, 2, q.Limit)
+	assert.Equal(t, 1, q.Offset)
+	assert.True(t, q.Filter.Match(Backup{Name: "daily1", Date: timeParse("2019-03-28T19-50-12")}))
+	assert.False(t, q.Filter.Match(Backup{Name: "daily0", Date: timeParse("2019-01-28T19-50-12")}))
+	assert.False(t, q.Filter.Match(Backup{Name: "weekly1", Date: timeParse("2019-03-28T19-50-12")}))
+
+	for _, bad := range []string{"location=s3", "name_regex=(", "since=yesterday", "sort=color", "limit=-1", "offset=x"} {
+		_, err := parseListQuery(httptest.NewRequest("GET", "/backup/list?"+bad, nil))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSortAndPaginateListResults(t *testing.T) {
+	backups := []APIListResult{
+		{"local", Backup{Name: "two", Size: 3, Date: timeParse("2019-02-28T19-50-12")}},
+		{"remote", Backup{Name: "one", Size: 2, Date: timeParse("2019-01-28T19-50-12")}},
+		{"remote", Backup{Name: "three", Size: 1, Date: timeParse("2019-03-28T19-50-12")}},
+	}
+	sortListResults(backups, "-date")
+	assert.Equal(t, "three", backups[0].Name)
+	assert.Equal(t, "one", backups[2].Name)
+	sortListResults(backups, "size")
+	assert.Equal(t, "three", backups[0].Name)
+	sortListResults(backups, "name")
+	assert.Equal(t, []APIListResult{backups[0]}, paginateListResults(backups, 0, 1))
+	assert.Equal(t, "three", paginateListResults(backups, 1, 5)[0].Name)
+	assert.Equal(t, 2, len(paginateListResults(backups, 1, 0)))
+	assert.Equal(t, 0, len(paginateListResults(backups, 3, 0)))
+}
+
+func TestCommandLocks(t *testing.T) {
+	locks, err := newCommandLocks([]string{"create+upload"})
+	assert.NoError(t, err)
+	assert.True(t, locks.tryAcquire("create"))
+	assert.False(t, locks.tryAcquire("create"))
+	assert.True(t, locks.tryAcquire("upload"))
+	assert.False(t, locks.tryAcquire("restore"))
+	locks.release("create")
+	locks.release("upload")
+	assert.True(t, locks.tryAcquire("restore"))
+	assert.False(t, locks.tryAcquire("restore"))
+	assert.False(t, locks.tryAcquire("upload"))
+
+	for _, bad := range []string{"create", "create+create", "create+unknown"} {
+		_, err := newCommandLocks([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAsyncStatus(t *testing.T) {
+	status := AsyncStatus{jobs: map[string]*AsyncJob{}}
+	_, ok := status.get("")
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	id := status.start("request", "upload", "backup1", cancel)
+	ctx = withJobID(ctx, id)
+	job, ok := status.get("")
+	assert.True(t, ok)
+	assert.Equal(t, id, job.ID)
+	assert.Equal(t, "request", job.RequestID)
+	assert.Equal(t, JobInProgress, job.Status)
+	assert.Nil(t, job.Progress)
+
+	// progress is tracked by remote path but found by job ID
+	bar := StartNewByteBar(false, 100)
+	bar.Add64(40)
+	trackProgress(ctx, "backup1/shadow/default/t1", bar)
+	job, _ = status.get(id)
+	if assert.NotNil(t, job.Progress) {
+		assert.Equal(t, Progress{Current: 40, Total: 100}, *job.Progress)
+	}
+	untrackProgress(ctx, "backup1/shadow/default/t1")
+	_, ok = GetProgress(id)
+	assert.False(t, ok)
+
+	assert.NoError(t, status.cancelJob(id))
+	assert.Equal(t, context.Canceled, ctx.Err())
+	status.stop(id, context.Canceled)
+	job, _ = status.get(id)
+	assert.Equal(t, JobCancelled, job.Status)
+	assert.NotZero(t, job.Finished)
+	assert.True(t, errors.Is(status.cancelJob(id), ErrBadRequest))
+	assert.True(t, errors.Is(status.cancelJob("unknown"), ErrJobNotFound))
+
+	failedID := status.start("", "download", "backup2", func() {})
+	status.stop(failedID, errors.New("failed"))
+	job, _ = status.get("")
+	assert.Equal(t, failedID, job.ID)
+	assert.Equal(t, JobError, job.Status)
+	assert.Equal(t, "failed", job.Error)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	id1 := status.start("", "create", "backup3", cancel1)
+	status.start("", "upload", "backup3", cancel2)
+	status.stop(id1, nil)
+	// stop cancels context of finished job to release its resources
+	assert.Equal(t, context.Canceled, ctx1.Err())
+	job, _ = status.get(id1)
+	assert.Equal(t, JobSuccess, job.Status)
+	status.cancelAll()
+	assert.Equal(t, context.Canceled, ctx2.Err())
+}
+
+func newTestAPIServer(config Config) *APIServer {
+	locks, _ := newCommandLocks(nil)
+	history, _ := loadOperationHistory("", 0)
+	return &APIServer{config: config, locks: locks, history: history, status: AsyncStatus{jobs: map[string]*AsyncJob{}}}
+}
+
+// waitContext - job function which runs until its context is cancelled
+func waitContext(started chan struct{}) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return fmt.Errorf("upload is interrupted: %w", ctx.Err())
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	config := *DefaultConfig()
+	api := newTestAPIServer(config)
+	router := api.setupRouter(config, make(chan struct{}))
+	started := make(chan struct{})
+	id := api.runAsync(httptest.NewRequest("POST", "/backup/upload/backup1", nil), "upload", "backup1", waitContext(started))
+	<-started
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/backup/cancel/"+id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.running.Wait()
+	job, _ := api.status.get(id)
+	assert.Equal(t, JobCancelled, job.Status)
+	assert.Empty(t, job.Error)
+
+	// finished job can't be cancelled again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/backup/cancel/"+id, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestShutdown(t *testing.T) {
+	config := *DefaultConfig()
+	config.API.ShutdownTimeout = "1s"
+	api := newTestAPIServer(config)
+	finished := false
+	api.runAsync(httptest.NewRequest("POST", "/backup/create", nil), "create", "backup1", func(ctx context.Context) error {
+		time.Sleep(50 * time.Millisecond)
+		finished = true
+		return nil
+	})
+	// running job is waited
+	assert.NoError(t, api.shutdown(&http.Server{}))
+	assert.True(t, finished)
+
+	// new jobs are refused during drain
+	w := httptest.NewRecorder()
+	assert.False(t, api.tryLock(w, httptest.NewRequest("POST", "/backup/create", nil), config, "create"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// job which doesn't finish in time is cancelled
+	config.API.ShutdownTimeout = "50ms"
+	api = newTestAPIServer(config)
+	started := make(chan struct{})
+	id := api.runAsync(httptest.NewRequest("POST", "/backup/upload/backup1", nil), "upload", "backup1", waitContext(started))
+	<-started
+	assert.Equal(t, ErrAPIShutdown, api.shutdown(&http.Server{}))
+	job, _ := api.status.get(id)
+	assert.Equal(t, JobCancelled, job.Status)
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var id string
+	handler := accessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = requestID(r)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/backup/list", nil))
+	assert.NotEmpty(t, id)
+	assert.Equal(t, id, w.Header().Get(RequestIDHeader))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/backup/list", nil)
+	req.Header.Set(RequestIDHeader, "client-id")
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "client-id", id)
+	assert.Equal(t, "client-id", w.Header().Get(RequestIDHeader))
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	audit := newAuditLog(path.Join(dir, "audit.log"))
+	entries, err := audit.read(func(AuditEntry) bool { return true }, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	for _, command := range []string{"create", "upload", "create"} {
+		assert.NoError(t, audit.write(AuditEntry{Command: command, Outcome: "accepted"}))
+	}
+	entries, err = audit.read(func(entry AuditEntry) bool { return entry.Command == "create" }, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	entries, err = audit.read(func(AuditEntry) bool { return true }, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditEntry{{Command: "create", Outcome: "accepted"}}, entries)
+
+	assert.NoError(t, newAuditLog("").write(AuditEntry{}))
+}
+
+func TestSendCallbacks(t *testing.T) {
+	attempts := 0
+	var received CallbackPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer ts.Close()
+
+	config := DefaultConfig().API
+	config.CallbackURLs = []string{ts.URL}
+	urls := callbackURLs(config, httptest.NewRequest("POST", "/backup/create?callback=ftp://example.com&callback="+ts.URL, nil))
+	assert.Equal(t, []string{ts.URL, ts.URL}, urls)
+
+	sendCallbacks(config, urls[:1], CallbackPayload{JobID: "1", Command: "create", Status: JobSuccess})
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, "1", received.JobID)
+	assert.Equal(t, JobSuccess, received.Status)
+}
+
+func TestOperationHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	historyFile := path.Join(dir, "history.json")
+
+	history, err := loadOperationHistory(historyFile, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, history.list(func(HistoryEntry) bool { return true }))
+	for _, id := range []string{"1", "2", "3"} {
+		assert.NoError(t, history.add(HistoryEntry{ID: id, Command: "create", Status: JobSuccess}))
+	}
+
+	history, err = loadOperationHistory(historyFile, 2)
+	assert.NoError(t, err)
+	entries := history.list(func(HistoryEntry) bool { return true })
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "3", entries[0].ID)
+	assert.Equal(t, "2", entries[1].ID)
+
+	history, err = loadOperationHistory(historyFile, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", history.list(func(HistoryEntry) bool { return true })[0].ID)
+}
+
+func TestMetricsState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := path.Join(dir, "metrics.json")
+
+	state, err := loadMetricsState(stateFile)
+	assert.NoError(t, err)
+	assert.Empty(t, state.commands)
+	assert.NoError(t, state.set("create", CommandState{Success: 1, Start: 10, End: 20, Duration: 10}))
+	assert.NoError(t, state.set("upload", CommandState{Success: 0, Start: 30, End: 40, Duration: 10}))
+
+	state, err = loadMetricsState(stateFile)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]CommandState{
+		"create": {Success: 1, Start: 10, End: 20, Duration: 10},
+		"upload": {Success: 0, Start: 30, End: 40, Duration: 10},
+	}, state.commands)
+}
+
+func TestApplyConfigKeepsSnapshotConsistent(t *testing.T) {
+	config := *DefaultConfig()
+	state, err := loadMetricsState("")
+	assert.NoError(t, err)
+	locks, err := newCommandLocks(config.API.AllowParallel)
+	assert.NoError(t, err)
+	api := &APIServer{config: config, locks: locks, limits: newRequestLimits(config.API)}
+	api.metrics.state = state
+	api.routes = &routesSwitch{done: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			current := api.snapshot()
+			assert.NotEmpty(t, current.config.API.ListenAddr)
+		}
+	}()
+	updated := config
+	updated.API.MetricsStateFile = ""
+	updated.API.ShutdownTimeout = "1s"
+	assert.False(t, api.applyConfig(&updated))
+	<-done
+	assert.Equal(t, "1s", api.snapshot().config.API.ShutdownTimeout)
+	assert.Equal(t, time.Second, api.shutdownTimeout())
+}
+
+func TestKeepListener(t *testing.T) {
+	config := *DefaultConfig()
+	api := &APIServer{config: config}
+	previous := config.API
+	api.config.API.ListenAddr = "localhost:1"
+	api.config.API.TLSCert = "/missing.crt"
+	api.keepListener(previous)
+	assert.False(t, listenerChanged(previous, api.snapshot().config.API))
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		ok, _ := bucket.take(now)
+		assert.True(t, ok)
+	}
+	ok, wait := bucket.take(now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = bucket.take(now.Add(500 * time.Millisecond))
+	assert.True(t, ok)
+	// tokens are never refilled over burst
+	bucket.refill(now.Add(time.Hour))
+	assert.Equal(t, float64(3), bucket.tokens)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(APIConfig{RateLimitPerIP: 1, RateLimitPerIPBurst: 1})
+	ok, _ := limiter.allow("10.0.0.1")
+	assert.True(t, ok)
+	ok, wait := limiter.allow("10.0.0.1")
+	assert.False(t, ok)
+	assert.True(t, wait > 0)
+	ok, _ = limiter.allow("10.0.0.2")
+	assert.True(t, ok)
+
+	limiter = newRateLimiter(APIConfig{})
+	for i := 0; i < 100; i++ {
+		ok, _ := limiter.allow("10.0.0.1")
+		assert.True(t, ok)
+	}
+}
+
+func TestRequestQueue(t *testing.T) {
+	assert.Nil(t, newRequestQueue(APIConfig{}))
+	queue := newRequestQueue(APIConfig{MaxConcurrentRequests: 1, MaxQueuedRequests: 0, QueueTimeout: "10ms"})
+	r := httptest.NewRequest("GET", "/backup/list", nil)
+	assert.NoError(t, queue.acquire(r))
+	assert.True(t, errors.Is(queue.acquire(r), ErrAPIOverloaded))
+	queue.maxWaiting = 1
+	assert.True(t, errors.Is(queue.acquire(r), ErrAPIOverloaded))
+	queue.release()
+	assert.NoError(t, queue.acquire(r))
+	queue.release()
+}
+
+func TestRequireBasicAuth(t *testing.T) {
+	handler := requireBasicAuth("prometheus", "secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		user, password string
+		code           int
+	}{
+		{"prometheus", "secret", http.StatusOK},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	c := *DefaultConfig()
+	err := fmt.Errorf("%w: 'test'", ErrBackupNotFound)
+
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("POST", "/api/v1/backup/upload/test", nil), c, err)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var apiErr APIError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+	assert.Equal(t, APIError{Type: "error", Code: ErrorCodeBackupNotFound, Message: err.Error()}, apiErr)
+
+	c.API.LegacyREST = true
+	w = httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("POST", "/backup/upload/test", nil), c, err)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var result APIResult
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, APIResult{Type: "error", Message: err.Error()}, result)
+
+	w = httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("POST", "/api/v1/backup/create", nil), c, ErrAPILocked)
+	assert.Equal(t, http.StatusLocked, w.Code)
+}
+
+func TestRunHealthCheck(t *testing.T) {
+	hc := runHealthCheck(time.Second, func(ctx context.Context) error { return nil })
+	assert.Equal(t, "ok", hc.Status)
+
+	hc = runHealthCheck(time.Second, func(ctx context.Context) error { return fmt.Errorf("connection refused") })
+	assert.Equal(t, HealthCheck{Status: "fail", Duration: hc.Duration, Error: "connection refused"}, hc)
+
+	hc = runHealthCheck(10*time.Millisecond, func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	assert.Equal(t, "fail", hc.Status)
+	assert.Equal(t, "timeout after 10ms", hc.Error)
+}
@@ -0,0 +1,121 @@
+package chbackup
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateLoader - serve certificate from api.tls_cert and api.tls_key
+// and reload it when files on disk are changed
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+	sync.Mutex
+}
+
+func newCertificateLoader(certFile, keyFile string) (*certificateLoader, error) {
+	loader := &certificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := loader.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// GetCertificate - implements tls.Config.GetCertificate
+func (l *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.Lock()
+	defer l.Unlock()
+	modTime, err := l.lastModified()
+	if err != nil {
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, err
+	}
+	if l.cert != nil && !modTime.After(l.modTime) {
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			log.Printf("can't reload TLS certificate, keep using the previous one: %v", err)
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("can't load TLS certificate with %v", err)
+	}
+	if l.cert != nil {
+		log.Printf("TLS certificate '%s' reloaded", l.certFile)
+	}
+	l.cert = &cert
+	l.modTime = modTime
+	return l.cert, nil
+}
+
+func (l *certificateLoader) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(l.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(l.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// setupTLS - return tls.Config for API server or nil when TLS is disabled
+func setupTLS(config APIConfig) (*tls.Config, error) {
+	if config.TLSCert == "" && config.TLSKey == "" {
+		if config.TLSClientCA != "" {
+			return nil, fmt.Errorf("api.tls_client_ca requires api.tls_cert and api.tls_key")
+		}
+		return nil, nil
+	}
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return nil, fmt.Errorf("both api.tls_cert and api.tls_key must be set")
+	}
+	loader, err := newCertificateLoader(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.GetCertificate,
+	}
+	if config.TLSClientCA != "" {
+		clientCAs, err := loadCertPool(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool - read PEM encoded CA bundle
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read CA bundle with %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,167 @@
+package chbackup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// watchSlot - watcher started by API, the last one is kept after it is stopped to show its state
+type watchSlot struct {
+	watcher *Watcher
+	sync.Mutex
+}
+
+func (s *watchSlot) get() *Watcher {
+	s.Lock()
+	defer s.Unlock()
+	return s.watcher
+}
+
+func (s *watchSlot) set(w *Watcher) {
+	s.Lock()
+	defer s.Unlock()
+	s.watcher = w
+}
+
+// startWatch - run watcher as async job holding 'watch' lock, the lock must be taken by caller.
+// Create and upload of watcher update the same metrics as create and upload started by API
+func (api *APIServer) startWatch(r *http.Request, c Config, w *Watcher) string {
+	w.create = func(ctx context.Context, backupName, diffFrom string) error {
+		return api.createBackup(ctx, c, backupName, w.tablePattern, "", diffFrom, false, nil)
+	}
+	w.upload = func(ctx context.Context, backupName, diffFrom string) error {
+		finishMetrics := api.metrics.start("upload")
+		err := Upload(ctx, c, backupName, diffFrom, "")
+		finishMetrics(err)
+		return err
+	}
+	w.cycleFinished = api.metrics.watchCycleFinished
+	api.watch.set(w)
+	api.metrics.setWatchRunning(true)
+	return api.runAsync(r, "watch", "", func(ctx context.Context) error {
+		defer api.locks.release("watch")
+		defer api.metrics.setWatchRunning(false)
+		return w.Run(ctx)
+	})
+}
+
+// startServerWatch - start watcher of 'server --watch' as if it was started by POST /backup/watch
+func (api *APIServer) startServerWatch(c Config) error {
+	if c.General.RemoteStorage == "none" {
+		return fmt.Errorf("watch requires remote storage")
+	}
+	w, err := NewWatcher(c, "", "", "")
+	if err != nil {
+		return err
+	}
+	if !api.locks.tryAcquire("watch") {
+		return fmt.Errorf("%w, can't run 'watch'", ErrAPILocked)
+	}
+	r, err := http.NewRequest(http.MethodPost, "/backup/watch", nil)
+	if err != nil {
+		api.locks.release("watch")
+		return err
+	}
+	api.startWatch(r, c, w)
+	return nil
+}
+
+// stopWatch - finish running watcher after its current cycle, called on shutdown
+func (api *APIServer) stopWatch() {
+	if w := api.watch.get(); w != nil {
+		w.Stop()
+	}
+}
+
+// httpWatchHandler - start watch cycles, job is finished by /backup/cancel/{job_id} or on shutdown
+func (api *APIServer) httpWatchHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	if c.General.RemoteStorage == "none" {
+		writeError(w, r, c, fmt.Errorf("%w: watch requires remote storage", ErrBadRequest))
+		return
+	}
+	query := r.URL.Query()
+	watcher, err := NewWatcher(c, query.Get("table"), query.Get("watch_interval"), query.Get("full_interval"))
+	if err != nil {
+		writeError(w, r, c, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	if !api.tryLock(w, r, c, "watch") {
+		return
+	}
+	id := api.startWatch(r, c, watcher)
+	writeResult(w, r, c, APIAsyncResult{Type: "acknowledged", JobID: id})
+}
+
+// httpWatchStateHandler - display state of running or the last watcher
+func (api *APIServer) httpWatchStateHandler(w http.ResponseWriter, r *http.Request, c Config) {
+	state := WatchState{Status: WatchStopped}
+	if watcher := api.watch.get(); watcher != nil {
+		state = watcher.State()
+	}
+	writeResult(w, r, c, state)
+}
+
+// WatchMetrics - watch_* metrics of watcher started by API
+type WatchMetrics struct {
+	Running      prometheus.Gauge
+	Cycles       prometheus.Counter
+	Failures     prometheus.Counter
+	LastFullTime prometheus.Gauge
+}
+
+// setupWatchMetrics - resister watch_* metrics
+func setupWatchMetrics() *WatchMetrics {
+	wm := &WatchMetrics{
+		Running: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "clickhouse_backup",
+			Name:      "watch_running",
+			Help:      "Watch is running boolean: 0=stopped, 1=running.",
+		}),
+		Cycles: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "clickhouse_backup",
+			Name:      "watch_cycles_total",
+			Help:      "Number of finished watch cycles.",
+		}),
+		Failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "clickhouse_backup",
+			Name:      "watch_failures_total",
+			Help:      "Number of failed watch cycles.",
+		}),
+		LastFullTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "clickhouse_backup",
+			Name:      "watch_last_full_timestamp",
+			Help:      "Start timestamp of the last full backup uploaded by watch.",
+		}),
+	}
+	prometheus.MustRegister(wm.Running, wm.Cycles, wm.Failures, wm.LastFullTime)
+	return wm
+}
+
+func (m *Metrics) setWatchRunning(running bool) {
+	if m.Watch == nil {
+		return
+	}
+	if running {
+		m.Watch.Running.Set(1)
+	} else {
+		m.Watch.Running.Set(0)
+	}
+}
+
+// watchCycleFinished - update watch_* metrics after cycle of watcher
+func (m *Metrics) watchCycleFinished(state WatchState, err error) {
+	if m.Watch == nil {
+		return
+	}
+	m.Watch.Cycles.Inc()
+	if err != nil {
+		m.Watch.Failures.Inc()
+	}
+	if state.LastFullTime != nil {
+		m.Watch.LastFullTime.Set(float64(state.LastFullTime.Unix()))
+	}
+}
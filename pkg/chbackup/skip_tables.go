@@ -0,0 +1,151 @@
+package chbackup
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// isRegexPattern - pattern with '^' prefix or '$' suffix is regular expression, other patterns are globs
+func isRegexPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "^") || strings.HasSuffix(pattern, "$")
+}
+
+// matchPattern - name is matched by glob or regular expression, invalid patterns don't match anything
+func matchPattern(pattern, name string) bool {
+	if isRegexPattern(pattern) {
+		matched, _ := regexp.MatchString(pattern, name)
+		return matched
+	}
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
+
+// splitTablePattern - patterns of comma separated '--tables' value, e.g. 'db1.*,db2.events_*,^analytics\..*_local$'
+func splitTablePattern(tablePattern string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(tablePattern, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// validatePatterns - check syntax of globs and regular expressions of setting
+func validatePatterns(setting string, patterns []string) error {
+	for _, pattern := range patterns {
+		if isRegexPattern(pattern) {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("can't parse '%s' of %s with %v", pattern, setting, err)
+			}
+		} else if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("can't parse '%s' of %s with %v", pattern, setting, err)
+		}
+	}
+	return nil
+}
+
+// tableFilter - tables which create, upload and restore always skip, databases are matched by skip_databases
+// and '<db>.<table>' by skip_tables. Upload and download with --tables skip tables which don't match patterns too
+type tableFilter struct {
+	databases []string
+	tables    []string
+	patterns  []string
+}
+
+func newTableFilter(config ClickHouseConfig) tableFilter {
+	return tableFilter{
+		databases: config.SkipDatabases,
+		tables:    config.SkipTables,
+	}
+}
+
+// withTablePattern - filter which skips tables not matched by comma separated tablePattern of --tables too,
+// inner tables of matched materialized views aren't skipped
+func (f tableFilter) withTablePattern(tablePattern string) tableFilter {
+	if tablePattern != "" {
+		f.patterns = withInnerTablePatterns(splitTablePattern(tablePattern))
+	}
+	return f
+}
+
+// withoutTablePattern - filter of skip_databases and skip_tables only, it's used for backups required by downloaded one
+func (f tableFilter) withoutTablePattern() tableFilter {
+	f.patterns = nil
+	return f
+}
+
+// skip - table is matched by skip_databases or skip_tables or isn't matched by patterns of --tables
+func (f tableFilter) skip(database, table string) bool {
+	for _, pattern := range f.databases {
+		if matchPattern(pattern, database) {
+			return true
+		}
+	}
+	name := fmt.Sprintf("%s.%s", database, table)
+	for _, pattern := range f.tables {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	for _, pattern := range f.patterns {
+		if matchPattern(pattern, name) {
+			return false
+		}
+	}
+	return len(f.patterns) > 0
+}
+
+// skipFile - file of backup relative to backup directory is 'metadata/<db>/<table>.sql', 'shadow/<db>/<table>/...'
+// or 'files/<db>/<table>/...' of skipped table, other files aren't skipped
+func (f tableFilter) skipFile(file string) bool {
+	parts := strings.SplitN(filepath.ToSlash(file), "/", 4)
+	if len(parts) < 3 {
+		return false
+	}
+	var table string
+	switch {
+	case parts[0] == "metadata" && len(parts) == 3 && strings.HasSuffix(parts[2], ".sql"):
+		table = strings.TrimSuffix(parts[2], ".sql")
+	case (parts[0] == "shadow" || parts[0] == tableFilesDir) && len(parts) == 4:
+		table = parts[2]
+	default:
+		return false
+	}
+	database, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return false
+	}
+	if table, err = url.PathUnescape(table); err != nil {
+		return false
+	}
+	return f.skip(database, table)
+}
+
+// restoreTables - tables which aren't skipped
+func (f tableFilter) restoreTables(tables RestoreTables) RestoreTables {
+	result := RestoreTables{}
+	for _, table := range tables {
+		if f.skip(table.Database, table.Table) {
+			log.Printf("Skip `%s`.`%s`", table.Database, table.Table)
+			continue
+		}
+		result = append(result, table)
+	}
+	return result
+}
+
+// backupTables - tables with data which aren't skipped
+func (f tableFilter) backupTables(tables []BackupTable) []BackupTable {
+	result := []BackupTable{}
+	for _, table := range tables {
+		if !f.skip(table.Database, table.Name) {
+			result = append(result, table)
+		}
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableFilter(t *testing.T) {
+	filter := tableFilter{
+		databases: []string{"information_schema", "^staging_[0-9]+$"},
+		tables:    []string{"system.*", `^default\..*_local$`},
+	}
+	assert.True(t, filter.skip("system", "parts"))
+	assert.True(t, filter.skip("information_schema", "tables"))
+	assert.True(t, filter.skip("staging_12", "events"))
+	assert.False(t, filter.skip("staging_old", "events"))
+	assert.True(t, filter.skip("default", "events_local"))
+	assert.False(t, filter.skip("default", "events"))
+
+	assert.True(t, filter.skipFile("metadata/system/parts.sql"))
+	assert.True(t, filter.skipFile("shadow/default/events%5Flocal/all_1_1_0/data.bin"))
+	assert.False(t, filter.skipFile("shadow/default/events/all_1_1_0/data.bin"))
+	assert.True(t, filter.skipFile("files/default/events%5Flocal/data.bin"))
+	assert.False(t, filter.skipFile("files/default/events/data.bin"))
+	assert.False(t, filter.skipFile("metadata/default.sql"))
+	assert.False(t, filter.skipFile("part_disks.json"))
+
+	selected := filter.withTablePattern("default.events,default.mv")
+	assert.False(t, selected.skip("default", "events"))
+	assert.False(t, selected.skip("default", ".inner.mv"))
+	assert.True(t, selected.skip("default", "users"))
+	assert.True(t, selected.skip("default", "events_local"))
+	assert.False(t, selected.skipFile("disks.json"))
+	bd := &BackupDestination{skipTables: selected}
+	assert.False(t, bd.skipArchive("shadow/default/events.tar.zst"))
+	assert.True(t, bd.skipArchive("shadow/default/users.tar.zst"))
+	assert.False(t, bd.skipArchive("metadata.tar.zst"))
+
+	assert.Equal(t, []string{"db1.*", "db2.events_*", `^analytics\..*_local$`}, splitTablePattern(` db1.*,db2.events_*,,^analytics\..*_local$`))
+	assert.Empty(t, splitTablePattern(""))
+
+	assert.NoError(t, validatePatterns("clickhouse.skip_tables", filter.tables))
+	assert.Error(t, validatePatterns("clickhouse.skip_tables", []string{"^default\\.(events$"}))
+	assert.Error(t, validatePatterns("clickhouse.skip_tables", []string{"default.[events"}))
+}
@@ -0,0 +1,278 @@
+package chbackup
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Backup stream is archive of local backup for pipes, e.g. 'clickhouse-backup export | ssh host clickhouse-backup restore --stdin',
+// files are placed under '<backup_name>/' in order of restore: metadata and other files first, then data parts grouped by table,
+// meta.json with checksums of files is the last file of stream
+
+// streamOrder - files of backup in order of stream, files of 'shadow' are the last and sorted, so parts of each table go together
+func streamOrder(files []string) []string {
+	result := append([]string{}, files...)
+	sort.SliceStable(result, func(i, j int) bool {
+		iShadow, jShadow := strings.HasPrefix(result[i], "shadow/"), strings.HasPrefix(result[j], "shadow/")
+		if iShadow != jShadow {
+			return jShadow
+		}
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// ExportBackup - write local backup as archive of compressionFormat to out, when backupName isn't local backup
+// new backup of tables matched by tablePattern is created, exported and removed
+func ExportBackup(ctx context.Context, config Config, backupName, tablePattern, partitions string, rbac bool, compressionFormat string, out io.Writer) error {
+	z, err := getArchiveWriter(compressionFormat, 1, config.General.CompressionConcurrency)
+	if err != nil {
+		return err
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
+	if backupName == "" || GetLocalBackup(config, backupName) != nil {
+		if backupName == "" {
+			backupName = NewBackupName()
+		}
+		if err := CreateBackup(ctx, config, backupName, tablePattern, partitions, "", rbac, nil); err != nil {
+			return err
+		}
+		defer func() {
+			if err := RemoveBackupLocal(config, backupName); err != nil {
+				log.Printf("can't remove '%s' with %v", backupName, err)
+			}
+		}()
+	}
+	backupsPath := path.Join(dataPath, "backup")
+	files, totalBytes, err := listBackupFiles(path.Join(backupsPath, backupName))
+	if err != nil {
+		return err
+	}
+	files = streamOrder(files)
+	for i := range files {
+		files[i] = path.Join(backupName, files[i])
+	}
+	log.Printf("Export '%s', %d files, %s", backupName, len(files), FormatBytes(totalBytes))
+	// progress bar isn't shown, stdout is used by stream
+	bar := StartNewByteBar(false, totalBytes)
+	trackProgress(ctx, backupName, bar)
+	defer untrackProgress(ctx, backupName)
+	if err := z.Create(out); err != nil {
+		return err
+	}
+	result := newArchiveResult()
+	if err := writeArchiveFiles(ctx, z, backupsPath, backupName, "", files, bar, result); err != nil {
+		z.Close()
+		return fmt.Errorf("can't export '%s' with %v", backupName, err)
+	}
+	if err := writeArchiveMetaFile(z, result.metaFile("")); err != nil {
+		z.Close()
+		return err
+	}
+	if err := z.Close(); err != nil {
+		return fmt.Errorf("can't export '%s' with %v", backupName, err)
+	}
+	log.Println("  Done.")
+	return nil
+}
+
+// streamTable - 'shadow/<db>/<table>' of file of backup, empty for files out of 'shadow'
+func streamTable(relativePath string) string {
+	parts := strings.SplitN(relativePath, "/", 4)
+	if len(parts) < 4 || parts[0] != "shadow" {
+		return ""
+	}
+	return path.Join(parts[:3]...)
+}
+
+// RestoreStream - restore backup written by export from in. Schema is created when all files out of 'shadow' are read,
+// parts of each table are attached as soon as the table is read and then removed, so restore doesn't need space for the whole backup
+func RestoreStream(ctx context.Context, config Config, in io.Reader, compressionFormat, tablePattern string, schemaOnly, dataOnly bool, opts RestoreOptions) error {
+	if err := validatePatterns("--tables", splitTablePattern(tablePattern)); err != nil {
+		return err
+	}
+	if config.General.DryRun {
+		return fmt.Errorf("--dry-run isn't supported with --stdin, stream can't be read twice")
+	}
+	z, err := getArchiveReader(compressionFormat)
+	if err != nil {
+		return err
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
+	withSchema := schemaOnly || (schemaOnly == dataOnly)
+	withData := dataOnly || (schemaOnly == dataOnly)
+	if err := z.Open(newContextReader(ctx, in), 0); err != nil {
+		return err
+	}
+	defer z.Close()
+	backupName, backupPath := "", ""
+	var metafile MetaFile
+	checksums := map[string]string{}
+	schemaDone := false
+	finishSchema := func() error {
+		if schemaDone {
+			return nil
+		}
+		schemaDone = true
+		if !withSchema {
+			if opts.RBAC {
+				return restoreRBAC(config, backupName)
+			}
+			return nil
+		}
+		return Restore(ctx, config, backupName, tablePattern, true, false, opts)
+	}
+	currentTable := ""
+	restoreTable := func() error {
+		if currentTable == "" {
+			return nil
+		}
+		defer os.RemoveAll(path.Join(backupPath, currentTable))
+		if err := restoreStreamTable(ctx, config, backupName, tablePattern, opts); err != nil {
+			return err
+		}
+		currentTable = ""
+		return nil
+	}
+	defer func() {
+		if backupPath != "" {
+			if err := os.RemoveAll(backupPath); err != nil {
+				log.Printf("can't remove '%s' with %v", backupPath, err)
+			}
+		}
+	}()
+	for {
+		file, err := z.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		header, ok := file.Header.(*tar.Header)
+		if !ok {
+			return fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
+		}
+		if header.Name == MetaFileName {
+			b, err := ioutil.ReadAll(file)
+			if err != nil {
+				return fmt.Errorf("can't read %s", MetaFileName)
+			}
+			if err := json.Unmarshal(b, &metafile); err != nil {
+				return err
+			}
+			continue
+		}
+		parts := strings.SplitN(header.Name, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("unexpected '%s' in stream, it should be written by export", header.Name)
+		}
+		if backupName == "" {
+			backupName = parts[0]
+			backupPath = path.Join(dataPath, "backup", backupName)
+			if _, err := os.Stat(backupPath); err == nil || !os.IsNotExist(err) {
+				backupPath = ""
+				return fmt.Errorf("can't restore stream with '%s' already exists", path.Join(dataPath, "backup", backupName))
+			}
+			log.Printf("Restore '%s' from stream", backupName)
+		} else if parts[0] != backupName {
+			return fmt.Errorf("stream contains files of '%s' and '%s'", backupName, parts[0])
+		}
+		if table := streamTable(parts[1]); table != "" {
+			if err := finishSchema(); err != nil {
+				return err
+			}
+			if !withData {
+				file.Close()
+				continue
+			}
+			if table != currentTable {
+				if err := restoreTable(); err != nil {
+					return err
+				}
+				currentTable = table
+			}
+		}
+		checksum, err := extractArchiveFile(file, path.Join(backupPath, parts[1]))
+		if err != nil {
+			return err
+		}
+		checksums[header.Name] = checksum
+	}
+	if backupName == "" {
+		return fmt.Errorf("stream is empty")
+	}
+	if isEmbeddedBackup(backupPath) {
+		// data of embedded backup isn't in 'shadow', so the whole backup is read before RESTORE
+		if err := restoreEmbeddedBackup(ctx, config, backupName, tablePattern, schemaOnly, dataOnly, opts); err != nil {
+			return err
+		}
+	} else {
+		if err := finishSchema(); err != nil {
+			return err
+		}
+		if err := restoreTable(); err != nil {
+			return err
+		}
+		// files of tables are read before 'shadow', they're restored by the first table with parts or here
+		if withData {
+			if err := restoreFileTables(ctx, config, backupName, tablePattern, opts); err != nil {
+				return err
+			}
+		}
+	}
+	// parts of skipped tables aren't read, so only read files are verified
+	for name, checksum := range checksums {
+		if expected, ok := metafile.Checksums[name]; ok && expected != checksum {
+			return fmt.Errorf("checksum mismatch of '%s' in stream, stream is corrupted", name)
+		}
+	}
+	removeRestoreJournal(dataPath, backupName)
+	log.Println("  Done.")
+	return nil
+}
+
+// restoreStreamTable - attach parts of table which is read from stream, it is the only table in 'shadow' of backup,
+// table which isn't matched by tablePattern or doesn't have parts of opts.Partitions is skipped
+func restoreStreamTable(ctx context.Context, config Config, backupName, tablePattern string, opts RestoreOptions) error {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	tables, err := ch.GetBackupTables(backupName)
+	ch.Close()
+	if err != nil {
+		return err
+	}
+	restoreTables := newTableFilter(config.ClickHouse).backupTables(parseTablePatternForRestoreData(tables, tablePattern))
+	if partitionIDs := parsePartitions(opts.Partitions); len(partitionIDs) > 0 {
+		filtered := []BackupTable{}
+		for _, table := range restoreTables {
+			if table = filterPartitions(table, partitionIDs); len(table.Partitions) > 0 {
+				filtered = append(filtered, table)
+			}
+		}
+		restoreTables = filtered
+	}
+	if len(restoreTables) == 0 {
+		return nil
+	}
+	return RestoreData(ctx, config, backupName, tablePattern, opts)
+}
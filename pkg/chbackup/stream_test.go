@@ -0,0 +1,30 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamOrder(t *testing.T) {
+	files := []string{
+		"shadow/default/events/all_2_2_0/data.bin",
+		"metadata/default/events.sql",
+		"shadow/default/events/all_1_1_0/data.bin",
+		"disks.json",
+		"shadow/db/users/all_1_1_0/data.bin",
+	}
+	assert.Equal(t, []string{
+		"disks.json",
+		"metadata/default/events.sql",
+		"shadow/db/users/all_1_1_0/data.bin",
+		"shadow/default/events/all_1_1_0/data.bin",
+		"shadow/default/events/all_2_2_0/data.bin",
+	}, streamOrder(files))
+}
+
+func TestStreamTable(t *testing.T) {
+	assert.Equal(t, "shadow/default/events", streamTable("shadow/default/events/all_1_1_0/data.bin"))
+	assert.Equal(t, "", streamTable("metadata/default/events.sql"))
+	assert.Equal(t, "", streamTable("shadow/default/events"))
+}
@@ -0,0 +1,355 @@
+package chbackup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/djherbis/buffer.v1"
+	"gopkg.in/djherbis/nio.v2"
+)
+
+// archiveUnit - archive of backup uploaded as archive per table which contains the file:
+// 'shadow/<database>/<table>' for data parts of table, 'metadata' for all other files
+func archiveUnit(relativePath string) string {
+	parts := strings.SplitN(filepath.ToSlash(relativePath), "/", 4)
+	if len(parts) == 4 && parts[0] == "shadow" {
+		return path.Join(parts[:3]...)
+	}
+	return "metadata"
+}
+
+// groupByArchive - files of backup grouped by archive name relative to backup directory, archive names are sorted
+func groupByArchive(files []string, extension string) ([]string, map[string][]string) {
+	groups := map[string][]string{}
+	for _, file := range files {
+		archive := archiveUnit(file) + "." + extension
+		groups[archive] = append(groups[archive], file)
+	}
+	archives := make([]string, 0, len(groups))
+	for archive := range groups {
+		archives = append(archives, archive)
+	}
+	sort.Strings(archives)
+	return archives, groups
+}
+
+// TableStreamUpload - upload backup as archive per table by general.upload_concurrency workers.
+// Archives bigger than general.max_file_size are split into several objects.
+// meta.json is uploaded the last, so backup isn't listed until all archives are uploaded.
+// After the first failed archive no new archives are started, errors of all failed archives are returned in order of archive names
+// and uploaded archives are removed.
+func (bd *BackupDestination) TableStreamUpload(ctx context.Context, localPath, remotePath, diffFromPath string) error {
+	backupDir := path.Join(bd.path, remotePath)
+	metaName := path.Join(backupDir, MetaFileName)
+	if _, err := bd.GetFile(ctx, metaName); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	files, totalBytes, err := bd.uploadFiles(localPath)
+	if err != nil {
+		return err
+	}
+	if err := checkDiffFromPath(diffFromPath); err != nil {
+		return err
+	}
+	archives, groups := groupByArchive(files, getExtension(bd.compressionFormat))
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	result := newArchiveResult()
+
+	started, err := runArchiveWorkers(ctx, bd.uploadConcurrency, "upload", archives, func(archive string) error {
+		parts, err := bd.putArchive(ctx, path.Join(backupDir, archive), localPath, remotePath, diffFromPath, groups[archive], bar, result)
+		result.setParts(archive, parts)
+		return err
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		if err = bd.putMetaFile(ctx, metaName, archives, diffFromPath, result); err == nil {
+			bar.Finish()
+			return nil
+		}
+	}
+	log.Printf("Upload of '%s' failed, removing uploaded archives", remotePath)
+	for _, archive := range archives[:started] {
+		for part := 0; part == 0 || part < result.partsOf(archive); part++ {
+			archiveName := archivePartName(path.Join(backupDir, archive), part)
+			if err := bd.DeleteFile(context.Background(), archiveName); err != nil && !errors.Is(err, ErrNotFound) {
+				log.Printf("can't remove '%s' with %v", archiveName, err)
+			}
+		}
+	}
+	return err
+}
+
+// putArchive - stream files to archive on remote storage, return number of started objects of archive
+func (bd *BackupDestination) putArchive(ctx context.Context, archiveName, localPath, remotePath, diffFromPath string, files []string, bar *Bar, result *archiveResult) (int, error) {
+	buf := buffer.New(BufferSize)
+	body, w := nio.Pipe(buf)
+	go func() {
+		z, _ := getArchiveWriter(bd.compressionFormat, bd.compressionLevel, bd.compressionConcurrency)
+		err := z.Create(w)
+		if err == nil {
+			err = writeArchiveFiles(ctx, z, localPath, remotePath, diffFromPath, files, bar, result)
+			if closeErr := z.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		w.CloseWithError(err)
+	}()
+	parts, err := bd.putArchiveParts(ctx, archiveName, bd.uploadLimiter.reader(ctx, body))
+	if err != nil {
+		// unblock writer
+		body.Close()
+	}
+	return parts, err
+}
+
+// archivePartName - object of part of archive split by general.max_file_size, the first part is put with name of archive
+func archivePartName(archiveName string, part int) string {
+	if part == 0 {
+		return archiveName
+	}
+	return fmt.Sprintf("%s.%d", archiveName, part)
+}
+
+// putArchiveParts - put archive as objects of bd.maxFileSize bytes, the next object is started when the previous one is full.
+// Return number of started objects
+func (bd *BackupDestination) putArchiveParts(ctx context.Context, archiveName string, body io.ReadCloser) (int, error) {
+	if bd.maxFileSize <= 0 {
+		return 1, bd.PutFile(ctx, archiveName, body)
+	}
+	r := bufio.NewReader(body)
+	for part := 0; ; part++ {
+		if err := bd.PutFile(ctx, archivePartName(archiveName, part), ioutil.NopCloser(io.LimitReader(r, bd.maxFileSize))); err != nil {
+			return part + 1, err
+		}
+		if _, err := r.Peek(1); err == io.EOF {
+			return part + 1, nil
+		} else if err != nil {
+			return part + 1, err
+		}
+	}
+}
+
+// archiveObjects - objects of archive of backup, archive split by general.max_file_size has several objects
+func (m MetaFile) archiveObjects(backupDir, archive string) []string {
+	objects := []string{path.Join(backupDir, archive)}
+	for part := 1; part < m.ArchiveParts[archive]; part++ {
+		objects = append(objects, archivePartName(objects[0], part))
+	}
+	return objects
+}
+
+// getArchiveReader - content of archive stored as objects, objects of split archive are read one by one
+func (bd *BackupDestination) getArchiveReader(ctx context.Context, objects []string) (io.ReadCloser, error) {
+	if len(objects) == 1 {
+		return bd.GetFileReader(ctx, objects[0])
+	}
+	return &archivePartsReader{ctx: ctx, bd: bd, objects: objects}, nil
+}
+
+// archivePartsReader - concatenation of objects of split archive, the next object is opened when the previous one is read
+type archivePartsReader struct {
+	ctx     context.Context
+	bd      *BackupDestination
+	objects []string
+	current io.ReadCloser
+}
+
+func (r *archivePartsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.objects) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := r.bd.GetFileReader(r.ctx, r.objects[0])
+			if err != nil {
+				return 0, fmt.Errorf("can't read '%s' with %v", r.objects[0], err)
+			}
+			r.current, r.objects = reader, r.objects[1:]
+		}
+		n, err := r.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		err = r.current.Close()
+		r.current = nil
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *archivePartsReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+func (bd *BackupDestination) putMetaFile(ctx context.Context, metaName string, archives []string, diffFromPath string, result *archiveResult) error {
+	metafile := result.metaFile(diffFromPath)
+	metafile.Archives = archives
+	metafile.CompressionFormat = bd.compressionFormat
+	content, err := json.MarshalIndent(metafile, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal json with %v", err)
+	}
+	return bd.PutFile(ctx, metaName, ioutil.NopCloser(bytes.NewReader(content)))
+}
+
+// runArchiveWorkers - call process for archives by concurrency workers, after the first error no new archives are started
+// and running ones are finished, so errors don't depend on timing of workers. Return number of started archives
+func runArchiveWorkers(ctx context.Context, concurrency int, operation string, archives []string, process func(archive string) error) (int, error) {
+	errs := make([]error, len(archives))
+	jobs := make(chan int)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if errs[i] = process(archives[i]); errs[i] != nil {
+					failOnce.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
+	started := 0
+schedule:
+	for ; started < len(archives); started++ {
+		select {
+		case jobs <- started:
+		case <-failed:
+			break schedule
+		case <-ctx.Done():
+			break schedule
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return started, joinArchiveErrors(operation, archives[:started], errs[:started])
+}
+
+// joinArchiveErrors - one error for all failed archives in order of archives
+func joinArchiveErrors(operation string, archives []string, errs []error) error {
+	messages := []string{}
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		messages = append(messages, fmt.Sprintf("'%s': %v", archives[i], err))
+	}
+	switch len(messages) {
+	case 0:
+		return nil
+	case 1:
+		return first
+	}
+	return fmt.Errorf("can't %s %d archives: %s", operation, len(messages), strings.Join(messages, "; "))
+}
+
+// skipArchive - archive 'shadow/<database>/<table>.<extension>' contains data parts of table skipped by skipTables
+func (bd *BackupDestination) skipArchive(archive string) bool {
+	unit := strings.TrimSuffix(archive, "."+getExtension(formatOfArchive(archive)))
+	if archiveUnit(path.Join(unit, "part", "file")) != unit {
+		return false
+	}
+	return bd.skipTables.skipFile(path.Join(unit, "part"))
+}
+
+// tableStreamDownload - download and extract backup uploaded as archive per table by general.download_concurrency workers,
+// archives contain different files, so they are extracted to the same directory simultaneously. Backup with cas layout is downloaded from pool
+func (bd *BackupDestination) tableStreamDownload(ctx context.Context, remotePath, localPath string) (MetaFile, error) {
+	var metafile MetaFile
+	backupDir := path.Join(bd.path, remotePath)
+	reader, err := bd.GetFileReader(ctx, path.Join(backupDir, MetaFileName))
+	if err != nil {
+		return metafile, err
+	}
+	content, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return metafile, fmt.Errorf("can't read %s with %v", MetaFileName, err)
+	}
+	if err := json.Unmarshal(content, &metafile); err != nil {
+		return metafile, err
+	}
+	switch metafile.Layout {
+	case casLayout:
+		return metafile, bd.casDownload(ctx, metafile, remotePath, localPath)
+	case directoryLayout:
+		return metafile, bd.directoryDownload(ctx, metafile, remotePath, localPath)
+	}
+	archives := []string{}
+	for _, archive := range metafile.Archives {
+		if !bd.skipArchive(archive) {
+			archives = append(archives, archive)
+		}
+	}
+	var totalBytes int64
+	for _, archive := range archives {
+		for _, object := range metafile.archiveObjects(backupDir, archive) {
+			file, err := bd.GetFile(ctx, object)
+			if err != nil {
+				return metafile, fmt.Errorf("can't get '%s' with %v", object, err)
+			}
+			totalBytes += file.Size()
+		}
+	}
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	trackProgress(ctx, remotePath, bar)
+	defer untrackProgress(ctx, remotePath)
+	checksums := map[string]string{}
+	var checksumsMutex sync.Mutex
+	_, err = runArchiveWorkers(ctx, bd.downloadConcurrency, "download", archives, func(archive string) error {
+		reader, err := bd.getArchiveReader(ctx, metafile.archiveObjects(backupDir, archive))
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		bufReader := nio.NewReader(newContextReader(ctx, reader), buffer.New(BufferSize))
+		format := metafile.CompressionFormat
+		if format == "" {
+			format = formatOfArchive(archive)
+		}
+		_, archiveChecksums, err := bd.extractArchive(bar.NewProxyReader(bufReader), format, remotePath, localPath)
+		if err != nil {
+			return fmt.Errorf("can't extract with %v", err)
+		}
+		checksumsMutex.Lock()
+		defer checksumsMutex.Unlock()
+		for name, checksum := range archiveChecksums {
+			checksums[name] = checksum
+		}
+		return nil
+	})
+	if err != nil {
+		return metafile, err
+	}
+	if err := verifyChecksums(bd.selectedChecksums(metafile.Checksums), checksums, remotePath); err != nil {
+		return metafile, err
+	}
+	bar.Finish()
+	return metafile, nil
+}
@@ -0,0 +1,167 @@
+package chbackup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupByArchive(t *testing.T) {
+	archives, groups := groupByArchive([]string{
+		"metadata/default/t1.sql",
+		"shadow/default/t1/all_1_1_0/data.bin",
+		"shadow/default/t1/all_2_2_0/data.bin",
+		"shadow/default/t2/all_1_1_0/data.bin",
+	}, "tar.gz")
+	assert.Equal(t, []string{"metadata.tar.gz", "shadow/default/t1.tar.gz", "shadow/default/t2.tar.gz"}, archives)
+	assert.Len(t, groups["shadow/default/t1.tar.gz"], 2)
+}
+
+func TestJoinArchiveErrors(t *testing.T) {
+	archives := []string{"a.tar", "b.tar", "c.tar"}
+	assert.NoError(t, joinArchiveErrors("upload", archives, make([]error, 3)))
+	err := errors.New("failed")
+	assert.Equal(t, err, joinArchiveErrors("upload", archives, []error{nil, err, nil}))
+	assert.EqualError(t, joinArchiveErrors("upload", archives, []error{errors.New("first"), nil, errors.New("second")}),
+		"can't upload 2 archives: 'a.tar': first; 'c.tar': second")
+}
+
+func TestRunArchiveWorkers(t *testing.T) {
+	tables := []string{"t1", "t2", "t3", "t4", "t5", "t6", "t7", "t8"}
+	var running, maxRunning int32
+	processed := map[string]bool{}
+	mu := sync.Mutex{}
+	started, err := runArchiveWorkers(context.Background(), 3, "freeze", tables, func(table string) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		processed[table] = true
+		mu.Unlock()
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, len(tables), started)
+	assert.Len(t, processed, len(tables))
+	assert.True(t, maxRunning <= 3, "%d workers were running", maxRunning)
+
+	// no new tables are started after the first error
+	started, err = runArchiveWorkers(context.Background(), 2, "freeze", tables, func(table string) error {
+		if table == "t2" {
+			return errors.New("failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	assert.EqualError(t, err, "failed")
+	assert.True(t, started < len(tables), "%d tables were started", started)
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	assert.Nil(t, newBandwidthLimiter(0))
+	limiter := newBandwidthLimiter(1000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.wait(context.Background(), 100))
+	}
+	assert.True(t, time.Since(start) >= 250*time.Millisecond)
+}
+
+func TestTableStreamUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table_archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"metadata/default/t1.sql":              "CREATE TABLE t1",
+		"metadata/default/t2.sql":              "CREATE TABLE t2",
+		"shadow/default/t1/all_1_1_0/data.bin": "t1 data",
+		"shadow/default/t2/all_1_1_0/data.bin": "t2 data",
+	}
+	localPath := filepath.Join(dir, "backup", "backup1")
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(localPath, name)), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(localPath, name), []byte(content), 0640))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "remote"), 0750))
+	bd := &BackupDestination{
+		RemoteStorage:       &FileStorage{Config: &FileConfig{Path: filepath.Join(dir, "remote")}},
+		compressionFormat:   "tar",
+		disableProgressBar:  true,
+		uploadConcurrency:   2,
+		downloadConcurrency: 2,
+	}
+	require.NoError(t, bd.TableStreamUpload(context.Background(), localPath, "backup1", ""))
+	backups, err := bd.BackupList(context.Background())
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "backup1", backups[0].Name)
+
+	downloadPath := filepath.Join(dir, "download", "backup1")
+	require.NoError(t, bd.CompressedStreamDownload(context.Background(), "backup1", downloadPath))
+	for name, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(downloadPath, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	}
+}
+
+func TestTableStreamUploadMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table_archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"metadata/default/t1.sql":              "CREATE TABLE t1",
+		"shadow/default/t1/all_1_1_0/data.bin": strings.Repeat("t1 data ", 1000),
+	}
+	localPath := filepath.Join(dir, "backup", "backup1")
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(localPath, name)), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(localPath, name), []byte(content), 0640))
+	}
+	remotePath := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(remotePath, 0750))
+	bd := &BackupDestination{
+		RemoteStorage:       &FileStorage{Config: &FileConfig{Path: remotePath}},
+		compressionFormat:   "tar",
+		disableProgressBar:  true,
+		uploadConcurrency:   1,
+		downloadConcurrency: 1,
+		maxFileSize:         2048,
+	}
+	require.NoError(t, bd.TableStreamUpload(context.Background(), localPath, "backup1", ""))
+	metafile, err := bd.readMetaFile(context.Background(), path.Join("backup1", MetaFileName))
+	require.NoError(t, err)
+	parts := metafile.ArchiveParts["shadow/default/t1.tar"]
+	assert.True(t, parts > 1)
+	assert.NotContains(t, metafile.ArchiveParts, "metadata.tar")
+	for part := 0; part < parts; part++ {
+		info, err := os.Stat(filepath.Join(remotePath, archivePartName("backup1/shadow/default/t1.tar", part)))
+		require.NoError(t, err)
+		assert.True(t, info.Size() <= 2048)
+	}
+
+	downloadPath := filepath.Join(dir, "download", "backup1")
+	require.NoError(t, bd.CompressedStreamDownload(context.Background(), "backup1", downloadPath))
+	for name, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(downloadPath, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	}
+}
@@ -0,0 +1,247 @@
+package chbackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Tables of Log, TinyLog, StripeLog, Set and Join engines don't have FREEZE and write files of their data path in place,
+// so their files can't be hard linked. 'create' detaches each table of clickhouse.backup_file_engines, copies its files
+// to 'files/<db>/<table>' of backup and attaches it back, 'restore' copies them into the restored table while it's detached
+
+// tableFilesDir - directory of backup with files of tables of clickhouse.backup_file_engines
+const tableFilesDir = "files"
+
+// fileEngines - engines supported by clickhouse.backup_file_engines, data of their tables is copied as files of detached table,
+// Set and Join load their files on ATTACH
+var fileEngines = []string{"Log", "TinyLog", "StripeLog", "Set", "Join"}
+
+func isFileEngine(engine string) bool {
+	for _, e := range fileEngines {
+		if e == engine {
+			return true
+		}
+	}
+	return false
+}
+
+// FileTable - table of one of fileEngines, Copy is set when its engine is in clickhouse.backup_file_engines
+type FileTable struct {
+	Database  string   `db:"database"`
+	Name      string   `db:"name"`
+	Engine    string   `db:"engine"`
+	DataPaths []string `db:"data_paths"`
+	Skip      bool
+	Copy      bool
+}
+
+// GetFileTables - return tables of all fileEngines, tables skipped by skip_tables are marked,
+// tables of engines which aren't in clickhouse.backup_file_engines are backed up as schema only
+func (ch *ClickHouse) GetFileTables() ([]FileTable, error) {
+	var tables []FileTable
+	q := fmt.Sprintf("SELECT database, name, engine, data_paths FROM `system`.`tables` WHERE is_temporary = 0 AND engine IN ('%s')", strings.Join(fileEngines, "', '"))
+	if err := ch.conn.Select(&tables, q); err != nil {
+		return nil, fmt.Errorf("can't get tables of %s with %v", strings.Join(fileEngines, ", "), err)
+	}
+	skipTables := newTableFilter(*ch.Config)
+	for i, t := range tables {
+		tables[i].Skip = skipTables.skip(t.Database, t.Name)
+		for _, engine := range ch.Config.BackupFileEngines {
+			tables[i].Copy = tables[i].Copy || engine == t.Engine
+		}
+	}
+	return tables, nil
+}
+
+// withDetachedTable - run fn while table is detached, so files of table aren't changed by inserts,
+// table is attached back even when fn fails
+func (ch *ClickHouse) withDetachedTable(database, table string, fn func() error) error {
+	query := fmt.Sprintf("DETACH TABLE `%s`.`%s`", database, table)
+	log.Println(query)
+	if _, err := ch.conn.Exec(query); err != nil {
+		return fmt.Errorf("can't detach `%s`.`%s` with %v", database, table, err)
+	}
+	fnErr := fn()
+	query = fmt.Sprintf("ATTACH TABLE `%s`.`%s`", database, table)
+	log.Println(query)
+	if _, err := ch.conn.Exec(query); err != nil {
+		if fnErr != nil {
+			log.Printf("can't copy files of `%s`.`%s` with %v", database, table, fnErr)
+		}
+		return fmt.Errorf("can't attach `%s`.`%s` back with %v, attach it manually", database, table, err)
+	}
+	return fnErr
+}
+
+// copyTableFiles - copy files of src to dst, chown is called for each copied file and directory when it's set
+func copyTableFiles(src, dst string, chown func(string) error) error {
+	return filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, relativePath)
+		if info.IsDir() {
+			if err := os.MkdirAll(dstPath, 0750); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() {
+			log.Printf("'%s' is not a regular file, skipping", filePath)
+			return nil
+		} else if err := copyFile(filePath, dstPath); err != nil {
+			return fmt.Errorf("can't copy '%s' with %v", filePath, err)
+		}
+		if chown != nil {
+			return chown(dstPath)
+		}
+		return nil
+	})
+}
+
+// backupFileTables - copy files of tables of clickhouse.backup_file_engines matched by tablePattern to backupPath,
+// tables don't have partitions, so they aren't copied with --partitions. Matched tables of other fileEngines are logged,
+// only their schema is backed up
+func backupFileTables(ctx context.Context, config Config, backupPath, tablePattern, partitions string) error {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	tables, err := ch.GetFileTables()
+	if err != nil {
+		return err
+	}
+	filter := newTableFilter(config.ClickHouse).withTablePattern(tablePattern)
+	for _, table := range tables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if table.Skip || filter.skip(table.Database, table.Name) || len(table.DataPaths) == 0 {
+			continue
+		}
+		if !table.Copy {
+			log.Printf("Warning: `%s`.`%s` of engine %s is backed up as schema only, add %s to clickhouse.backup_file_engines to back up its data", table.Database, table.Name, table.Engine, table.Engine)
+			continue
+		}
+		if partitions != "" {
+			log.Printf("Skip `%s`.`%s`, %s doesn't have partitions", table.Database, table.Name, table.Engine)
+			continue
+		}
+		log.Printf("Copy files of `%s`.`%s`", table.Database, table.Name)
+		dst := path.Join(backupPath, tableFilesDir, TablePathEncode(table.Database), TablePathEncode(table.Name))
+		if err := ch.withDetachedTable(table.Database, table.Name, func() error {
+			return copyTableFiles(table.DataPaths[0], dst, nil)
+		}); err != nil {
+			return fmt.Errorf("can't backup files of `%s`.`%s` with %v", table.Database, table.Name, err)
+		}
+	}
+	return nil
+}
+
+// listFileTables - tables with files in 'files/<db>/<table>' of backup which aren't skipped by filter
+func listFileTables(backupPath string, filter tableFilter) ([]Table, error) {
+	dirs, err := filepath.Glob(filepath.Join(backupPath, tableFilesDir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	tables := []Table{}
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		database, err := url.PathUnescape(filepath.Base(filepath.Dir(dir)))
+		if err != nil {
+			return nil, err
+		}
+		name, err := url.PathUnescape(filepath.Base(dir))
+		if err != nil {
+			return nil, err
+		}
+		if !filter.skip(database, name) {
+			tables = append(tables, Table{Database: database, Name: name})
+		}
+	}
+	return tables, nil
+}
+
+// restoreFileTables - replace files of restored tables by files of tables of backup matched by tablePattern,
+// tables restored by previous restore are skipped. Tables don't have partitions, so they aren't restored with --partitions
+func restoreFileTables(ctx context.Context, config Config, backupName, tablePattern string, opts RestoreOptions) error {
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
+	backupPath := path.Join(dataPath, "backup", backupName)
+	tables, err := listFileTables(backupPath, newTableFilter(config.ClickHouse).withTablePattern(tablePattern))
+	if err != nil || len(tables) == 0 {
+		return err
+	}
+	if opts.Partitions != "" {
+		log.Printf("Files of %d tables aren't restored with --partitions", len(tables))
+		return nil
+	}
+	mapping, err := parseRestoreMapping(opts.DatabaseMapping, opts.TableMapping)
+	if err != nil {
+		return err
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with %v", err)
+	}
+	defer ch.Close()
+	journal, err := loadRestoreJournal(dataPath, backupName)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		database, name := mapping.database(table.Database), mapping.table(table.Name)
+		if journal.isCopied(database, name) {
+			log.Printf("Skip `%s`.`%s`, its files are restored by previous restore", database, name)
+			continue
+		}
+		exists, err := ch.TableExists(database, name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("'%s.%s' is not created. Restore schema first or create missing tables manually", database, name)
+		}
+		publishTableEvent("restore", backupName, database, name)
+		tableDataPath, err := ch.GetTableDataPath(database, name)
+		if err != nil {
+			return err
+		}
+		src := path.Join(backupPath, tableFilesDir, TablePathEncode(table.Database), TablePathEncode(table.Name))
+		if err := ch.withDetachedTable(database, name, func() error {
+			if err := os.MkdirAll(tableDataPath, 0750); err != nil {
+				return err
+			}
+			if err := cleanDir(tableDataPath); err != nil {
+				return err
+			}
+			return copyTableFiles(src, tableDataPath, ch.Chown)
+		}); err != nil {
+			return fmt.Errorf("can't restore files of `%s`.`%s` with %v", database, name, err)
+		}
+		if err := journal.copied(database, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
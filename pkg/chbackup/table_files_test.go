@@ -0,0 +1,45 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tableData := filepath.Join(dir, "data", "default", "log")
+	require.NoError(t, os.MkdirAll(tableData, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tableData, "data.bin"), []byte("data"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tableData, "sizes.json"), []byte("{}"), 0640))
+
+	backupPath := filepath.Join(dir, "backup", "test")
+	dst := filepath.Join(backupPath, tableFilesDir, "default", TablePathEncode("log.1"))
+	chowned := []string{}
+	require.NoError(t, copyTableFiles(tableData, dst, func(name string) error {
+		chowned = append(chowned, name)
+		return nil
+	}))
+	content, err := ioutil.ReadFile(filepath.Join(dst, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(content))
+	assert.Equal(t, []string{dst, filepath.Join(dst, "data.bin"), filepath.Join(dst, "sizes.json")}, chowned)
+	require.NoError(t, os.MkdirAll(filepath.Join(backupPath, tableFilesDir, "system", "query_log"), os.ModePerm))
+
+	tables, err := listFileTables(backupPath, newTableFilter(DefaultConfig().ClickHouse))
+	require.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "default", Name: "log.1"}}, tables)
+	tables, err = listFileTables(backupPath, newTableFilter(DefaultConfig().ClickHouse).withTablePattern("default.events"))
+	require.NoError(t, err)
+	assert.Empty(t, tables)
+
+	config := DefaultConfig()
+	config.ClickHouse.BackupFileEngines = []string{"Log", "Memory"}
+	assert.EqualError(t, validateConfig(config), "clickhouse.backup_file_engines doesn't support 'Memory', supported engines are Log, TinyLog, StripeLog, Set, Join")
+}
@@ -0,0 +1,165 @@
+package chbackup
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// transferSpeedWindow - period used to calculate current transfer speed
+	transferSpeedWindow = time.Second
+	// transferIdleTimeout - speed is reported as 0 when nothing was transferred for this period
+	transferIdleTimeout = 5 * time.Second
+)
+
+// transferMeter - count bytes transferred to or from remote storage and calculate current speed
+type transferMeter struct {
+	total       int64
+	windowStart time.Time
+	windowBytes int64
+	lastUpdate  time.Time
+	speed       float64
+	sync.Mutex
+}
+
+var (
+	uploadMeter   = &transferMeter{}
+	downloadMeter = &transferMeter{}
+)
+
+// transferMeterFor - meter of bytes transferred by command, nil for commands which don't use remote storage
+func transferMeterFor(command string) *transferMeter {
+	switch command {
+	case "upload", "copy":
+		return uploadMeter
+	case "download":
+		return downloadMeter
+	}
+	return nil
+}
+
+func (m *transferMeter) add(n int64) {
+	atomic.AddInt64(&m.total, n)
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	if m.windowStart.IsZero() || now.Sub(m.lastUpdate) > transferIdleTimeout {
+		m.windowStart, m.windowBytes = now, 0
+	}
+	m.windowBytes += n
+	m.lastUpdate = now
+	if elapsed := now.Sub(m.windowStart); elapsed >= transferSpeedWindow {
+		m.speed = float64(m.windowBytes) / elapsed.Seconds()
+		m.windowStart, m.windowBytes = now, 0
+	}
+}
+
+// Total - bytes transferred since start of process
+func (m *transferMeter) Total() int64 {
+	return atomic.LoadInt64(&m.total)
+}
+
+// Speed - bytes per second during the last transferSpeedWindow
+func (m *transferMeter) Speed() float64 {
+	m.Lock()
+	defer m.Unlock()
+	if time.Since(m.lastUpdate) > transferIdleTimeout {
+		return 0
+	}
+	return m.speed
+}
+
+// meteredReader - count bytes read through the reader
+type meteredReader struct {
+	io.ReadCloser
+	meter *transferMeter
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.meter.add(int64(n))
+	return n, err
+}
+
+// GetFileReader - remote file reader which counts downloaded bytes
+func (bd *BackupDestination) GetFileReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := bd.RemoteStorage.GetFileReader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredReader{ReadCloser: reader, meter: downloadMeter}, nil
+}
+
+// GetFileReaderWithOffset - remote file reader from offset which counts downloaded bytes
+func (bd *BackupDestination) GetFileReaderWithOffset(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	reader, err := bd.RemoteStorage.GetFileReaderWithOffset(ctx, key, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredReader{ReadCloser: reader, meter: downloadMeter}, nil
+}
+
+// PutFile - upload file to remote storage counting uploaded bytes
+func (bd *BackupDestination) PutFile(ctx context.Context, key string, r io.ReadCloser) error {
+	return bd.RemoteStorage.PutFile(ctx, key, &meteredReader{ReadCloser: r, meter: uploadMeter})
+}
+
+// bandwidthLimiter - limit total speed of all readers created by one limiter, nil limiter doesn't limit
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	next           time.Time
+	sync.Mutex
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait - sleep until n more bytes are allowed, unused bandwidth isn't accumulated
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.Unlock()
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reader - r limited by l
+func (l *bandwidthLimiter) reader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ReadCloser: r, ctx: ctx, limiter: l}
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
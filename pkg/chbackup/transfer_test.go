@@ -0,0 +1,28 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferMeter(t *testing.T) {
+	meter := &transferMeter{}
+	reader := &meteredReader{ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")), meter: meter}
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(data))
+	assert.Equal(t, int64(10), meter.Total())
+	assert.Equal(t, float64(0), meter.Speed())
+
+	meter.windowStart = time.Now().Add(-2 * time.Second)
+	meter.add(100)
+	assert.Equal(t, int64(110), meter.Total())
+	assert.InDelta(t, 55, meter.Speed(), 1)
+
+	meter.lastUpdate = time.Now().Add(-transferIdleTimeout - time.Second)
+	assert.Equal(t, float64(0), meter.Speed())
+}
@@ -1,6 +1,7 @@
 package chbackup
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,6 +22,23 @@ type Backup struct {
 	Name string
 	Size int64
 	Date time.Time
+
+	// Tables, ClickHouseVersion, RequiredBackup and Labels - details of backup from manifest.json
+	Tables            int               `json:",omitempty"`
+	ClickHouseVersion string            `json:",omitempty"`
+	RequiredBackup    string            `json:",omitempty"`
+	Labels            map[string]string `json:",omitempty"`
+}
+
+// setManifest - set details of backup from its manifest, backups without manifest don't have details
+func (b *Backup) setManifest(manifest *Manifest) {
+	if manifest == nil {
+		return
+	}
+	b.Tables = len(manifest.Tables)
+	b.ClickHouseVersion = manifest.ClickHouseVersion
+	b.RequiredBackup = manifest.RequiredBackup
+	b.Labels = manifest.Labels
 }
 
 func cleanDir(dir string) error {
@@ -62,26 +81,76 @@ func isClickhouseShadow(path string) bool {
 	return true
 }
 
-func moveShadow(shadowPath, backupPath string) error {
+// moveShadow - move frozen data from 'shadow/<N>/data/<db>/<table>' and 'shadow/<N>/store/<uuid prefix>/<uuid>'
+// to '<db>/<table>' of backupPath, storePaths are '<db>/<table>' by '<uuid prefix>/<uuid>', return moved '<db>/<table>/<part>'.
+// Directories are created first, then files of concurrency tables are moved simultaneously
+func moveShadow(ctx context.Context, shadowPath, backupPath string, storePaths map[string]string, concurrency int) ([]string, error) {
+	parts := []string{}
+	tables := []string{}
+	tableFiles := map[string][][2]string{}
 	if err := filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
 		relativePath := strings.Trim(strings.TrimPrefix(filePath, shadowPath), "/")
 		pathParts := strings.SplitN(relativePath, "/", 3)
 		if len(pathParts) != 3 {
 			return nil
 		}
-		dstFilePath := filepath.Join(backupPath, pathParts[2])
+		tablePath := pathParts[2]
+		if pathParts[1] == "store" {
+			storeParts := strings.SplitN(pathParts[2], "/", 3)
+			if len(storeParts) < 2 {
+				return nil
+			}
+			table, ok := storePaths[path.Join(storeParts[0], storeParts[1])]
+			if !ok {
+				log.Printf("'%s' doesn't belong to known table, skipping", filePath)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			tablePath = table
+			if len(storeParts) == 3 {
+				tablePath = path.Join(table, storeParts[2])
+			}
+		}
+		dstFilePath := filepath.Join(backupPath, tablePath)
 		if info.IsDir() {
+			if strings.Count(tablePath, "/") == 2 {
+				parts = append(parts, tablePath)
+			}
 			return os.MkdirAll(dstFilePath, os.ModePerm)
 		}
 		if !info.Mode().IsRegular() {
 			log.Printf("'%s' is not a regular file, skipping", filePath)
 			return nil
 		}
-		return os.Rename(filePath, dstFilePath)
+		table := tablePath
+		if tableParts := strings.SplitN(tablePath, "/", 3); len(tableParts) == 3 {
+			table = path.Join(tableParts[0], tableParts[1])
+		}
+		if _, ok := tableFiles[table]; !ok {
+			tables = append(tables, table)
+		}
+		tableFiles[table] = append(tableFiles[table], [2]string{filePath, dstFilePath})
+		return nil
 	}); err != nil {
-		return err
+		return nil, err
+	}
+	_, err := runArchiveWorkers(ctx, concurrency, "move", tables, func(table string) error {
+		for _, file := range tableFiles[table] {
+			if err := moveFile(file[0], file[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return cleanDir(shadowPath)
+	return parts, cleanDir(shadowPath)
 }
 
 func copyFile(srcFile string, dstFile string) error {
@@ -112,10 +181,109 @@ func GetBackupsToDelete(backups []Backup, keep int) []Backup {
 	return []Backup{}
 }
 
-func getArchiveWriter(format string, level int) (archiver.Writer, error) {
+// RetentionPolicy - remote backups to keep: KeepLast newest ones and the newest backup of each of KeepDaily last days,
+// KeepWeekly last ISO weeks and KeepMonthly last months which have backups, like 'restic forget'. Days, weeks and months are in UTC
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+}
+
+func newRetentionPolicy(config Config) RetentionPolicy {
+	return RetentionPolicy{
+		KeepLast:    config.General.BackupsToKeepRemote,
+		KeepDaily:   config.General.KeepDaily,
+		KeepWeekly:  config.General.KeepWeekly,
+		KeepMonthly: config.General.KeepMonthly,
+	}
+}
+
+// Enabled - policy removes backups, zero policy keeps all backups
+func (p RetentionPolicy) Enabled() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+// GetBackupsToDeleteByPolicy - backups which aren't kept by policy, backups are sorted from the newest one
+func GetBackupsToDeleteByPolicy(backups []Backup, policy RetentionPolicy) []Backup {
+	if !policy.Enabled() {
+		return []Backup{}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Date.After(backups[j].Date)
+	})
+	type period struct {
+		keep int
+		name func(t time.Time) string
+		last string
+	}
+	periods := []*period{
+		{keep: policy.KeepDaily, name: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{keep: policy.KeepWeekly, name: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{keep: policy.KeepMonthly, name: func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	result := []Backup{}
+	for i, backup := range backups {
+		keep := i < policy.KeepLast
+		for _, p := range periods {
+			// the first backup of period is the newest one
+			if name := p.name(backup.Date.UTC()); p.keep > 0 && name != p.last {
+				p.last = name
+				p.keep--
+				keep = true
+			}
+		}
+		if !keep {
+			result = append(result, backup)
+		}
+	}
+	return result
+}
+
+// BackupFilter - select backups by name and creation date, zero values match any backup
+type BackupFilter struct {
+	NameRegex *regexp.Regexp
+	Since     time.Time
+	Until     time.Time
+	// Labels - backup must have all of them
+	Labels map[string]string
+}
+
+// Match - check if backup satisfies filter
+func (f BackupFilter) Match(backup Backup) bool {
+	if f.NameRegex != nil && !f.NameRegex.MatchString(backup.Name) {
+		return false
+	}
+	if !f.Since.IsZero() && backup.Date.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && backup.Date.After(f.Until) {
+		return false
+	}
+	return matchLabels(backup.Labels, f.Labels)
+}
+
+// FilterBackups - return backups which satisfy filter
+func FilterBackups(backups []Backup, filter BackupFilter) []Backup {
+	result := []Backup{}
+	for _, backup := range backups {
+		if filter.Match(backup) {
+			result = append(result, backup)
+		}
+	}
+	return result
+}
+
+// getArchiveWriter - archive of compression format, concurrency is number of threads of zstd
+func getArchiveWriter(format string, level, concurrency int) (archiver.Writer, error) {
 	switch format {
-	case "tar":
+	case "tar", "none":
 		return &archiver.Tar{}, nil
+	case "zstd":
+		return &tarZstd{Tar: archiver.NewTar(), level: level, concurrency: concurrency}, nil
 	case "lz4":
 		return &archiver.TarLz4{CompressionLevel: level, Tar: archiver.NewTar()}, nil
 	case "bzip2":
@@ -127,13 +295,24 @@ func getArchiveWriter(format string, level int) (archiver.Writer, error) {
 	case "xz":
 		return &archiver.TarXz{Tar: archiver.NewTar()}, nil
 	}
-	return nil, fmt.Errorf("wrong compression_format, supported: 'lz4', 'bzip2', 'gzip', 'sz', 'xz'")
+	return nil, fmt.Errorf("wrong compression_format, supported: 'zstd', 'lz4', 'bzip2', 'gzip', 'sz', 'xz', 'tar', 'none'")
+}
+
+// backupNameOfKey - name of backup which remote file belongs to, key is '<basePath>/<backup>.<extension>' or '<basePath>/<backup>/...'
+func backupNameOfKey(basePath, key string) string {
+	backupName := strings.Split(strings.TrimPrefix(strings.TrimPrefix(key, basePath), "/"), "/")[0]
+	for _, ext := range []string{".zst", ".lz4", ".bz2", ".gz", ".sz", ".xz"} {
+		backupName = strings.TrimSuffix(backupName, ext)
+	}
+	return strings.TrimSuffix(backupName, ".tar")
 }
 
 func getExtension(format string) string {
 	switch format {
-	case "tar":
+	case "tar", "none":
 		return "tar"
+	case "zstd":
+		return "tar.zst"
 	case "lz4":
 		return "tar.lz4"
 	case "bzip2":
@@ -150,8 +329,10 @@ func getExtension(format string) string {
 
 func getArchiveReader(format string) (archiver.Reader, error) {
 	switch format {
-	case "tar":
+	case "tar", "none":
 		return archiver.NewTar(), nil
+	case "zstd":
+		return &tarZstd{Tar: archiver.NewTar()}, nil
 	case "lz4":
 		return archiver.NewTarLz4(), nil
 	case "bzip2":
@@ -163,7 +344,7 @@ func getArchiveReader(format string) (archiver.Reader, error) {
 	case "xz":
 		return archiver.NewTarXz(), nil
 	}
-	return nil, fmt.Errorf("wrong compression_format, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 'xz'")
+	return nil, fmt.Errorf("wrong compression_format, supported: 'zstd', 'lz4', 'bzip2', 'gzip', 'sz', 'xz', 'tar', 'none'")
 }
 
 // FormatBytes - Convert bytes to human readable string
@@ -209,3 +390,20 @@ func parseTime(text string) (t time.Time, err error) {
 	}
 	return
 }
+
+// contextReader - io.Reader which stops reading when ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
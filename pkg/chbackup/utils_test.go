@@ -1,11 +1,18 @@
 package chbackup
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func timeParse(s string) time.Time {
@@ -31,3 +38,79 @@ func TestGetBackupsToDelete(t *testing.T) {
 	assert.Equal(t, expectedData, GetBackupsToDelete(testData, 3))
 	assert.Equal(t, []Backup{}, GetBackupsToDelete([]Backup{testData[0]}, 3))
 }
+
+func TestGetBackupsToDeleteByPolicy(t *testing.T) {
+	testData := []Backup{
+		{Name: "mar15", Date: timeParse("2019-03-15T10-00-00")},
+		{Name: "apr25", Date: timeParse("2019-04-25T10-00-00")},
+		{Name: "may02", Date: timeParse("2019-05-02T10-00-00")},
+		{Name: "may07", Date: timeParse("2019-05-07T10-00-00")},
+		{Name: "may09", Date: timeParse("2019-05-09T10-00-00")},
+		{Name: "may10a", Date: timeParse("2019-05-10T08-00-00")},
+		{Name: "may10b", Date: timeParse("2019-05-10T20-00-00")},
+	}
+	names := func(backups []Backup) []string {
+		result := []string{}
+		for _, backup := range backups {
+			result = append(result, backup.Name)
+		}
+		return result
+	}
+	policy := RetentionPolicy{KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 3}
+	assert.Equal(t, []string{"may10a", "may07"}, names(GetBackupsToDeleteByPolicy(testData, policy)))
+	policy.KeepLast = 2
+	assert.Equal(t, []string{"may07"}, names(GetBackupsToDeleteByPolicy(testData, policy)))
+	assert.Equal(t, []string{"may09", "may07", "may02", "apr25", "mar15"}, names(GetBackupsToDeleteByPolicy(testData, RetentionPolicy{KeepLast: 2})))
+	assert.Equal(t, []string{}, names(GetBackupsToDeleteByPolicy(testData, RetentionPolicy{})))
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newContextReader(ctx, bytes.NewReader([]byte("data")))
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	cancel()
+	_, err = r.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+	_, err = ioutil.ReadAll(newContextReader(ctx, bytes.NewReader([]byte("data"))))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestMoveShadowConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shadow")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	shadowPath := filepath.Join(dir, "shadow")
+	backupPath := filepath.Join(dir, "backup")
+	writeShadow := func() {
+		for i := 1; i <= 8; i++ {
+			for _, part := range []string{"all_1_1_0", "all_2_2_0"} {
+				file := filepath.Join(shadowPath, "1/data/default", fmt.Sprintf("t%d", i), part, "data.bin")
+				require.NoError(t, os.MkdirAll(filepath.Dir(file), os.ModePerm))
+				require.NoError(t, ioutil.WriteFile(file, []byte("data"), 0640))
+			}
+		}
+	}
+	writeShadow()
+	parts, err := moveShadow(context.Background(), shadowPath, backupPath, nil, 4)
+	require.NoError(t, err)
+	assert.Len(t, parts, 16)
+	for i := 1; i <= 8; i++ {
+		assert.FileExists(t, filepath.Join(backupPath, fmt.Sprintf("default/t%d/all_1_1_0/data.bin", i)))
+		assert.FileExists(t, filepath.Join(backupPath, fmt.Sprintf("default/t%d/all_2_2_0/data.bin", i)))
+	}
+	names, err := ioutil.ReadDir(shadowPath)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	// shadow isn't cleaned when create is cancelled
+	require.NoError(t, os.RemoveAll(backupPath))
+	writeShadow()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = moveShadow(ctx, shadowPath, backupPath, nil, 4)
+	assert.Equal(t, context.Canceled, err)
+	assert.DirExists(t, filepath.Join(shadowPath, "1"))
+}
@@ -0,0 +1,575 @@
+package chbackup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Verification reads backup without restoring it: SHA256 of files of remote backup are compared with meta.json,
+// sizes of files of each data part are compared with checksums.txt of the part, and every table with data parts must have metadata
+
+// errUnsupportedPartChecksums - checksums.txt of format or compression which isn't supported, files of such part aren't checked
+var errUnsupportedPartChecksums = errors.New("unsupported format of checksums.txt")
+
+// verifyFiles - files of backup collected for verification
+type verifyFiles struct {
+	// sizes - size of each file relative to backup directory, -1 for files hard linked to required backup
+	sizes map[string]int64
+	// partChecksums - content of checksums.txt of each data part by path of the part
+	partChecksums map[string][]byte
+	// partDisks - content of disks.json of remote backup
+	partDisks []byte
+	sync.Mutex
+}
+
+func newVerifyFiles() *verifyFiles {
+	return &verifyFiles{sizes: map[string]int64{}, partChecksums: map[string][]byte{}}
+}
+
+// add - add file, content is kept only for checksums.txt of data parts and disks.json
+func (f *verifyFiles) add(name string, size int64, content []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.sizes[name] = size
+	if content != nil && isPartChecksums(name) {
+		f.partChecksums[path.Dir(name)] = content
+	}
+	if name == partDisksFileName {
+		f.partDisks = content
+	}
+}
+
+// isPartChecksums - file is checksums.txt of data part or of projection of data part in 'shadow'
+func isPartChecksums(name string) bool {
+	return strings.HasPrefix(name, "shadow/") && path.Base(name) == partChecksumsFile
+}
+
+// shadowPart - database, table and part of file in 'shadow' of backup, shadow of old format is 'shadow/<N>/data/<db>/<table>/<part>'
+func shadowPart(name string) (database, table, part string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) >= 7 && parts[0] == "shadow" && parts[2] == "data" {
+		parts = append(parts[:1], parts[3:]...)
+	}
+	if len(parts) < 5 || parts[0] != "shadow" {
+		return "", "", "", false
+	}
+	database, _ = url.PathUnescape(parts[1])
+	table, _ = url.PathUnescape(parts[2])
+	return database, table, path.Join(parts[:4]...), true
+}
+
+// verifyBackupFiles - check that every table with data parts has metadata, every part has checksums.txt and files with sizes from it,
+// parts of partDisks are in backup and parts of manifest are in backup with the same checksums.txt, return found problems
+func verifyBackupFiles(files *verifyFiles, partDisks map[string]string, manifest *Manifest) []string {
+	problems := []string{}
+	metadata := map[string]bool{}
+	tables := map[string]bool{}
+	parts := map[string]bool{}
+	for name := range files.sizes {
+		if strings.HasPrefix(name, "metadata/") && strings.HasSuffix(name, ".sql") {
+			p := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "metadata/"), ".sql"), "/")
+			if len(p) == 2 {
+				database, _ := url.PathUnescape(p[0])
+				table, _ := url.PathUnescape(p[1])
+				metadata[fmt.Sprintf("`%s`.`%s`", database, table)] = true
+			}
+			continue
+		}
+		if database, table, part, ok := shadowPart(name); ok {
+			tables[fmt.Sprintf("`%s`.`%s`", database, table)] = true
+			parts[part] = true
+		}
+	}
+	for table := range tables {
+		if !metadata[table] {
+			problems = append(problems, fmt.Sprintf("data parts of %s don't have metadata", table))
+		}
+	}
+	for part := range parts {
+		problems = append(problems, verifyPartFiles(files, part, fmt.Sprintf("part '%s'", part))...)
+	}
+	for part := range partDisks {
+		if !parts[path.Join("shadow", part)] {
+			problems = append(problems, fmt.Sprintf("part '%s' of %s isn't in backup", part, partDisksFileName))
+		}
+	}
+	problems = append(problems, verifyManifest(manifest, files, parts)...)
+	sort.Strings(problems)
+	return problems
+}
+
+// verifyPartFiles - check files of part in dir by its checksums.txt, description names the part in problems.
+// Projection of part is directory '<name>.proj' listed in checksums.txt of part, its files are checked by its own checksums.txt
+func verifyPartFiles(files *verifyFiles, dir, description string) []string {
+	problems := []string{}
+	content, ok := files.partChecksums[dir]
+	if !ok {
+		// checksums.txt hard linked to required backup isn't read
+		if _, ok := files.sizes[path.Join(dir, partChecksumsFile)]; !ok {
+			problems = append(problems, fmt.Sprintf("%s doesn't have %s", description, partChecksumsFile))
+		}
+		return problems
+	}
+	sizes, err := parsePartChecksums(content)
+	if err == errUnsupportedPartChecksums {
+		log.Printf("Files of %s aren't checked, %v", description, err)
+		return problems
+	}
+	if err != nil {
+		return append(problems, fmt.Sprintf("can't read %s of %s with %v", partChecksumsFile, description, err))
+	}
+	for name, size := range sizes {
+		if strings.HasSuffix(name, ".proj") {
+			projection := fmt.Sprintf("projection '%s' of %s", strings.TrimSuffix(name, ".proj"), description)
+			problems = append(problems, verifyPartFiles(files, path.Join(dir, name), projection)...)
+			continue
+		}
+		actual, ok := files.sizes[path.Join(dir, name)]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("file '%s' of %s is missing", name, description))
+		case actual >= 0 && uint64(actual) != size:
+			problems = append(problems, fmt.Sprintf("size of '%s' of %s is %d, %d is expected", name, description, actual, size))
+		}
+	}
+	return problems
+}
+
+// parsePartChecksums - sizes of files of data part by checksums.txt, formats 3 and 4 are supported
+func parsePartChecksums(content []byte) (map[string]uint64, error) {
+	r := bufio.NewReader(bytes.NewReader(content))
+	header, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, "checksums format version: ") {
+		return nil, fmt.Errorf("unexpected header")
+	}
+	var data []byte
+	switch version := strings.TrimSpace(strings.TrimPrefix(header, "checksums format version: ")); version {
+	case "3":
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	case "4":
+		compressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = decompressBlocks(compressed); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errUnsupportedPartChecksums
+	}
+	br := bytes.NewReader(data)
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]uint64, count)
+	for i := uint64(0); i < count; i++ {
+		nameLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		// hash of file, then is_compressed flag
+		hashAndFlag := make([]byte, 17)
+		if _, err := io.ReadFull(br, hashAndFlag); err != nil {
+			return nil, err
+		}
+		if hashAndFlag[16] != 0 {
+			// uncompressed size and hash
+			if _, err := binary.ReadUvarint(br); err != nil {
+				return nil, err
+			}
+			if _, err := io.ReadFull(br, make([]byte, 16)); err != nil {
+				return nil, err
+			}
+		}
+		sizes[string(name)] = size
+	}
+	return sizes, nil
+}
+
+// decompressBlocks - decompress data written by CompressedWriteBuffer of ClickHouse: each block is 16 bytes of checksum,
+// method byte, compressed size with 9 bytes of header and decompressed size, NONE, LZ4 and ZSTD methods are supported
+func decompressBlocks(compressed []byte) ([]byte, error) {
+	var result []byte
+	for len(compressed) > 0 {
+		if len(compressed) < 25 {
+			return nil, fmt.Errorf("compressed block is truncated")
+		}
+		method := compressed[16]
+		compressedSize := int(binary.LittleEndian.Uint32(compressed[17:21]))
+		decompressedSize := int(binary.LittleEndian.Uint32(compressed[21:25]))
+		if compressedSize < 9 || 16+compressedSize > len(compressed) {
+			return nil, fmt.Errorf("compressed block is truncated")
+		}
+		block := compressed[25 : 16+compressedSize]
+		compressed = compressed[16+compressedSize:]
+		switch method {
+		case 0x02:
+			result = append(result, block...)
+		case 0x82:
+			decompressed, err := lz4DecompressBlock(block, decompressedSize)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, decompressed...)
+		case 0x90:
+			decoder, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			decompressed, err := decoder.DecodeAll(block, nil)
+			decoder.Close()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, decompressed...)
+		default:
+			return nil, errUnsupportedPartChecksums
+		}
+	}
+	return result, nil
+}
+
+// lz4DecompressBlock - decompress LZ4 block without frame
+func lz4DecompressBlock(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	pos := 0
+	readLength := func(length int) (int, error) {
+		if length != 15 {
+			return length, nil
+		}
+		for pos < len(src) {
+			b := src[pos]
+			pos++
+			length += int(b)
+			if b != 255 {
+				return length, nil
+			}
+		}
+		return 0, fmt.Errorf("lz4 block is truncated")
+	}
+	for pos < len(src) {
+		token := src[pos]
+		pos++
+		literals, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if pos+literals > len(src) {
+			return nil, fmt.Errorf("lz4 block is truncated")
+		}
+		dst = append(dst, src[pos:pos+literals]...)
+		pos += literals
+		if pos == len(src) {
+			// the last sequence has only literals
+			break
+		}
+		if pos+2 > len(src) {
+			return nil, fmt.Errorf("lz4 block is truncated")
+		}
+		offset := int(src[pos]) | int(src[pos+1])<<8
+		pos += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("wrong offset in lz4 block")
+		}
+		match, err := readLength(int(token & 15))
+		if err != nil {
+			return nil, err
+		}
+		start := len(dst) - offset
+		for i := 0; i < match+4; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != size {
+		return nil, fmt.Errorf("lz4 block is decompressed to %d bytes, %d is expected", len(dst), size)
+	}
+	return dst, nil
+}
+
+// VerifyLocal - check files of local backup by checksums.txt of data parts and metadata of tables without restoring it
+func VerifyLocal(ctx context.Context, config Config, backupName string) error {
+	if err := GetLocalBackup(config, backupName); err != nil {
+		return err
+	}
+	backupPath := path.Join(getDataPath(config), "backup", backupName)
+	log.Printf("Verify local backup '%s'", backupName)
+	files := newVerifyFiles()
+	err := filepath.Walk(backupPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(filePath, backupPath), "/")
+		var content []byte
+		if isPartChecksums(name) {
+			if content, err = ioutil.ReadFile(filePath); err != nil {
+				return err
+			}
+		}
+		files.add(name, info.Size(), content)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	partDisks, err := readPartDisks(backupPath)
+	if err != nil {
+		return err
+	}
+	manifest, err := readManifest(backupPath)
+	if err != nil {
+		return err
+	}
+	return verifyResult(backupName, verifyBackupFiles(files, partDisks, manifest))
+}
+
+// VerifyRemote - read all files of remote backup without extracting them, compare their SHA256 with meta.json,
+// then check backup as VerifyLocal does
+func VerifyRemote(ctx context.Context, config Config, backupName string) error {
+	if _, err := GetRemoteBackup(ctx, config, backupName); err != nil {
+		return err
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return err
+	}
+	if err := bd.Connect(); err != nil {
+		return err
+	}
+	log.Printf("Verify remote backup '%s'", backupName)
+	problems, err := bd.verifyBackup(ctx, backupName)
+	if err != nil {
+		return err
+	}
+	return verifyResult(backupName, problems)
+}
+
+func verifyResult(backupName string, problems []string) error {
+	for _, problem := range problems {
+		log.Printf("  %s", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("backup '%s' is broken, %d problems found", backupName, len(problems))
+	}
+	log.Println("  Done.")
+	return nil
+}
+
+// verifyBackup - read archives or files of pool of backup and return found problems
+func (bd *BackupDestination) verifyBackup(ctx context.Context, remotePath string) ([]string, error) {
+	files := newVerifyFiles()
+	checksums := map[string]string{}
+	var checksumsMutex sync.Mutex
+	// readArchive - read archive stored as objects, split archive has several objects
+	readArchive := func(objects ...string) (MetaFile, error) {
+		archiveName := objects[0]
+		reader, err := bd.getArchiveReader(ctx, objects)
+		if err != nil {
+			return MetaFile{}, err
+		}
+		defer reader.Close()
+		metafile, archiveChecksums, err := readArchiveFiles(newContextReader(ctx, reader), formatOfArchive(archiveName), files)
+		if err != nil {
+			return metafile, fmt.Errorf("can't read '%s' with %v", archiveName, err)
+		}
+		checksumsMutex.Lock()
+		defer checksumsMutex.Unlock()
+		for name, checksum := range archiveChecksums {
+			checksums[name] = checksum
+		}
+		return metafile, nil
+	}
+	var metafile MetaFile
+	archiveName, _, err := bd.getBackupArchive(ctx, remotePath)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if metafile, err = bd.readMetaFile(ctx, path.Join(bd.path, remotePath, MetaFileName)); err != nil {
+			return nil, err
+		}
+		if metafile.Layout == casLayout {
+			err = bd.verifyCASFiles(ctx, metafile, files, checksums)
+			break
+		}
+		if metafile.Layout == directoryLayout {
+			err = bd.verifyObjectFiles(ctx, metafile, func(name string) string { return bd.directoryKey(remotePath, name) }, files, checksums)
+			break
+		}
+		_, err = runArchiveWorkers(ctx, bd.downloadConcurrency, "verify", metafile.Archives, func(archive string) error {
+			_, err := readArchive(metafile.archiveObjects(path.Join(bd.path, remotePath), archive)...)
+			return err
+		})
+	case err == nil:
+		metafile, err = readArchive(archiveName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	for name, expected := range metafile.Checksums {
+		if actual, ok := checksums[name]; ok && actual != expected {
+			problems = append(problems, fmt.Sprintf("checksum mismatch of '%s'", name))
+		} else if !ok {
+			problems = append(problems, fmt.Sprintf("file '%s' of %s is missing", name, MetaFileName))
+		}
+	}
+	if metafile.RequiredBackup != "" {
+		backupList, err := bd.BackupList(ctx)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, backup := range backupList {
+			found = found || backup.Name == metafile.RequiredBackup
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("required backup '%s' is missing", metafile.RequiredBackup))
+		}
+	}
+	for _, name := range metafile.Hardlinks {
+		files.add(name, -1, nil)
+	}
+	partDisks := map[string]string{}
+	if files.partDisks != nil {
+		if err := json.Unmarshal(files.partDisks, &partDisks); err != nil {
+			problems = append(problems, fmt.Sprintf("can't parse %s with %v", partDisksFileName, err))
+		}
+	}
+	manifest, err := bd.readRemoteManifest(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(problems)
+	return append(problems, verifyBackupFiles(files, partDisks, manifest)...), nil
+}
+
+// readArchiveFiles - read files of archive, add them to files and return meta.json if archive contains it and SHA256 of files
+func readArchiveFiles(archiveReader io.Reader, format string, files *verifyFiles) (MetaFile, map[string]string, error) {
+	var metafile MetaFile
+	checksums := map[string]string{}
+	z, err := getArchiveReader(format)
+	if err != nil {
+		return metafile, checksums, err
+	}
+	if err := z.Open(archiveReader, 0); err != nil {
+		return metafile, checksums, err
+	}
+	defer z.Close()
+	for {
+		file, err := z.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return metafile, checksums, err
+		}
+		header, ok := file.Header.(*tar.Header)
+		if !ok {
+			return metafile, checksums, fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
+		}
+		if header.Name == MetaFileName {
+			b, err := ioutil.ReadAll(file)
+			if err != nil {
+				return metafile, checksums, fmt.Errorf("can't read %s", MetaFileName)
+			}
+			if err := json.Unmarshal(b, &metafile); err != nil {
+				return metafile, checksums, err
+			}
+			continue
+		}
+		checksum, size, content, err := readVerifiedFile(file, header.Name)
+		file.Close()
+		if err != nil {
+			return metafile, checksums, err
+		}
+		checksums[header.Name] = checksum
+		files.add(header.Name, size, content)
+	}
+	return metafile, checksums, nil
+}
+
+// readVerifiedFile - SHA256 and size of file, content is returned for checksums.txt of data parts and disks.json
+func readVerifiedFile(reader io.Reader, name string) (string, int64, []byte, error) {
+	fileHash := sha256.New()
+	var content *bytes.Buffer
+	w := io.Writer(fileHash)
+	if isPartChecksums(name) || name == partDisksFileName {
+		content = &bytes.Buffer{}
+		w = io.MultiWriter(fileHash, content)
+	}
+	size, err := io.Copy(w, reader)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if content == nil {
+		return hex.EncodeToString(fileHash.Sum(nil)), size, nil, nil
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), size, content.Bytes(), nil
+}
+
+// verifyCASFiles - read files of backup with cas layout from pool
+func (bd *BackupDestination) verifyCASFiles(ctx context.Context, metafile MetaFile, files *verifyFiles, checksums map[string]string) error {
+	return bd.verifyObjectFiles(ctx, metafile, func(name string) string { return bd.casKey(metafile.Checksums[name]) }, files, checksums)
+}
+
+// verifyObjectFiles - read files of backup stored as separate objects with keys by objectKey, missing objects are reported by caller
+func (bd *BackupDestination) verifyObjectFiles(ctx context.Context, metafile MetaFile, objectKey func(name string) string, files *verifyFiles, checksums map[string]string) error {
+	names := make([]string, 0, len(metafile.Checksums))
+	for name := range metafile.Checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var checksumsMutex sync.Mutex
+	_, err := runArchiveWorkers(ctx, bd.downloadConcurrency, "verify", names, func(name string) error {
+		reader, err := bd.GetFileReader(ctx, objectKey(name))
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		checksum, size, content, err := readVerifiedFile(newContextReader(ctx, reader), name)
+		if err != nil {
+			return err
+		}
+		checksumsMutex.Lock()
+		checksums[name] = checksum
+		checksumsMutex.Unlock()
+		files.add(name, size, content)
+		return nil
+	})
+	return err
+}
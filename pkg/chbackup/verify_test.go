@@ -0,0 +1,102 @@
+package chbackup
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// partChecksumsV3 - body of checksums.txt of format 3 with sizes of files
+func partChecksumsV3(sizes map[string]uint64) []byte {
+	uvarint := make([]byte, binary.MaxVarintLen64)
+	appendUvarint := func(data []byte, x uint64) []byte {
+		return append(data, uvarint[:binary.PutUvarint(uvarint, x)]...)
+	}
+	data := appendUvarint(nil, uint64(len(sizes)))
+	for name, size := range sizes {
+		data = appendUvarint(data, uint64(len(name)))
+		data = append(data, name...)
+		data = appendUvarint(data, size)
+		data = append(data, make([]byte, 16)...)
+		// compressed file with uncompressed size and hash
+		data = append(data, 1)
+		data = appendUvarint(data, size*2)
+		data = append(data, make([]byte, 16)...)
+	}
+	return data
+}
+
+func TestParsePartChecksums(t *testing.T) {
+	sizes := map[string]uint64{"data.bin": 1000, "data.mrk2": 48}
+	v3 := append([]byte("checksums format version: 3\n"), partChecksumsV3(sizes)...)
+	parsed, err := parsePartChecksums(v3)
+	require.NoError(t, err)
+	assert.Equal(t, sizes, parsed)
+
+	body := partChecksumsV3(sizes)
+	block := make([]byte, 25, 25+len(body))
+	block[16] = 0x02
+	binary.LittleEndian.PutUint32(block[17:21], uint32(9+len(body)))
+	binary.LittleEndian.PutUint32(block[21:25], uint32(len(body)))
+	v4 := append([]byte("checksums format version: 4\n"), append(block, body...)...)
+	parsed, err = parsePartChecksums(v4)
+	require.NoError(t, err)
+	assert.Equal(t, sizes, parsed)
+
+	_, err = parsePartChecksums(v4[:len(v4)-1])
+	assert.Error(t, err)
+	_, err = parsePartChecksums([]byte("checksums format version: 2\ncolumns.txt\n"))
+	assert.Equal(t, errUnsupportedPartChecksums, err)
+}
+
+func TestLZ4DecompressBlock(t *testing.T) {
+	// 'abc', match of 6 bytes at offset 3, then the last literal 'd'
+	block := []byte{0x32, 'a', 'b', 'c', 3, 0, 0x10, 'd'}
+	decompressed, err := lz4DecompressBlock(block, 10)
+	require.NoError(t, err)
+	assert.Equal(t, "abcabcabcd", string(decompressed))
+	_, err = lz4DecompressBlock(block[:5], 10)
+	assert.Error(t, err)
+}
+
+func TestVerifyBackupFiles(t *testing.T) {
+	files := newVerifyFiles()
+	files.add("metadata/default/events.sql", 100, nil)
+	files.add("shadow/default/events/all_1_1_0/checksums.txt", 10, append([]byte("checksums format version: 3\n"), partChecksumsV3(map[string]uint64{"data.bin": 1000})...))
+	files.add("shadow/default/events/all_1_1_0/data.bin", 1000, nil)
+	files.add("shadow/default/events/all_2_2_0/checksums.txt", -1, nil)
+	assert.Empty(t, verifyBackupFiles(files, map[string]string{"default/events/all_1_1_0": "hdd"}, nil))
+
+	files.add("shadow/default/events/all_1_1_0/data.bin", 999, nil)
+	files.add("shadow/default/users/all_1_1_0/data.bin", 10, nil)
+	assert.Equal(t, []string{
+		"data parts of `default`.`users` don't have metadata",
+		"part 'default/events/all_3_3_0' of disks.json isn't in backup",
+		"part 'shadow/default/users/all_1_1_0' doesn't have checksums.txt",
+		"size of 'data.bin' of part 'shadow/default/events/all_1_1_0' is 999, 1000 is expected",
+	}, verifyBackupFiles(files, map[string]string{"default/events/all_3_3_0": "hdd"}, nil))
+}
+
+func TestVerifyProjectionFiles(t *testing.T) {
+	files := newVerifyFiles()
+	files.add("metadata/default/events.sql", 100, nil)
+	files.add("shadow/default/events/all_1_1_0/checksums.txt", 10, append([]byte("checksums format version: 3\n"), partChecksumsV3(map[string]uint64{"data.bin": 1000, "daily.proj": 548})...))
+	files.add("shadow/default/events/all_1_1_0/data.bin", 1000, nil)
+	files.add("shadow/default/events/all_1_1_0/daily.proj/checksums.txt", 10, append([]byte("checksums format version: 3\n"), partChecksumsV3(map[string]uint64{"data.bin": 500, "data.mrk3": 48})...))
+	files.add("shadow/default/events/all_1_1_0/daily.proj/data.bin", 500, nil)
+	files.add("shadow/default/events/all_1_1_0/daily.proj/data.mrk3", 48, nil)
+	assert.Empty(t, verifyBackupFiles(files, nil, nil))
+
+	files.add("shadow/default/events/all_1_1_0/daily.proj/data.bin", 499, nil)
+	delete(files.sizes, "shadow/default/events/all_1_1_0/daily.proj/data.mrk3")
+	assert.Equal(t, []string{
+		"file 'data.mrk3' of projection 'daily' of part 'shadow/default/events/all_1_1_0' is missing",
+		"size of 'data.bin' of projection 'daily' of part 'shadow/default/events/all_1_1_0' is 499, 500 is expected",
+	}, verifyBackupFiles(files, nil, nil))
+
+	delete(files.partChecksums, "shadow/default/events/all_1_1_0/daily.proj")
+	delete(files.sizes, "shadow/default/events/all_1_1_0/daily.proj/checksums.txt")
+	assert.Equal(t, []string{"projection 'daily' of part 'shadow/default/events/all_1_1_0' doesn't have checksums.txt"}, verifyBackupFiles(files, nil, nil))
+}
@@ -0,0 +1,194 @@
+package chbackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	WatchStopped   = "stopped"
+	WatchCreating  = "creating"
+	WatchUploading = "uploading"
+	WatchWaiting   = "waiting"
+)
+
+// WatchState - state of watch cycles, response of GET /backup/watch
+type WatchState struct {
+	Status        string     `json:"status"`
+	WatchInterval string     `json:"watch_interval,omitempty"`
+	FullInterval  string     `json:"full_interval,omitempty"`
+	Cycles        int        `json:"cycles"`
+	Failures      int        `json:"failures"`
+	LastBackup    string     `json:"last_backup,omitempty"`
+	LastFull      string     `json:"last_full,omitempty"`
+	LastFullTime  *time.Time `json:"last_full_time,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextRun       *time.Time `json:"next_run,omitempty"`
+}
+
+// Watcher - create and upload backup each watch interval, backup is uploaded with --diff-from the last full backup
+// until full interval is passed since it, then the next full backup is uploaded
+type Watcher struct {
+	config        Config
+	tablePattern  string
+	watchInterval time.Duration
+	fullInterval  time.Duration
+	// create, upload - run steps of cycle, API server replaces them to update metrics
+	create func(ctx context.Context, backupName, diffFrom string) error
+	upload func(ctx context.Context, backupName, diffFrom string) error
+	// cycleFinished - called after each cycle with its error
+	cycleFinished func(state WatchState, err error)
+	state         WatchState
+	stop          chan struct{}
+	stopOnce      sync.Once
+	sync.Mutex
+}
+
+// NewWatcher - empty intervals mean general.watch_interval and general.full_interval
+func NewWatcher(config Config, tablePattern, watchInterval, fullInterval string) (*Watcher, error) {
+	if watchInterval == "" {
+		watchInterval = config.General.WatchInterval
+	}
+	if fullInterval == "" {
+		fullInterval = config.General.FullInterval
+	}
+	watch, full, err := parseWatchIntervals(watchInterval, fullInterval)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		config:        config,
+		tablePattern:  tablePattern,
+		watchInterval: watch,
+		fullInterval:  full,
+		state:         WatchState{Status: WatchStopped, WatchInterval: watch.String(), FullInterval: full.String()},
+		cycleFinished: func(WatchState, error) {},
+		stop:          make(chan struct{}),
+	}
+	w.create = func(ctx context.Context, backupName, diffFrom string) error {
+		return CreateBackup(ctx, config, backupName, tablePattern, "", diffFrom, false, nil)
+	}
+	w.upload = func(ctx context.Context, backupName, diffFrom string) error {
+		return Upload(ctx, config, backupName, diffFrom, "")
+	}
+	return w, nil
+}
+
+func parseWatchIntervals(watchInterval, fullInterval string) (time.Duration, time.Duration, error) {
+	watch, err := time.ParseDuration(watchInterval)
+	if err != nil || watch <= 0 {
+		return 0, 0, fmt.Errorf("invalid watch interval '%s'", watchInterval)
+	}
+	full, err := time.ParseDuration(fullInterval)
+	if err != nil || full <= 0 {
+		return 0, 0, fmt.Errorf("invalid full interval '%s'", fullInterval)
+	}
+	if full < watch {
+		return 0, 0, fmt.Errorf("full interval %s can't be less than watch interval %s", full, watch)
+	}
+	return watch, full, nil
+}
+
+// State - copy of the current state
+func (w *Watcher) State() WatchState {
+	w.Lock()
+	defer w.Unlock()
+	return w.state
+}
+
+func (w *Watcher) setStatus(status string) {
+	w.Lock()
+	defer w.Unlock()
+	w.state.Status = status
+	if status != WatchWaiting {
+		w.state.NextRun = nil
+	}
+}
+
+// Stop - finish Run after the current cycle
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// Run - run cycles until ctx is cancelled or Stop is called, failed cycle is logged and repeated after watch interval
+func (w *Watcher) Run(ctx context.Context) error {
+	log.Printf("Watch: backup each %s, full backup each %s", w.watchInterval, w.fullInterval)
+	defer w.setStatus(WatchStopped)
+	for {
+		start := time.Now()
+		err := w.cycle(ctx, start)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		next := start.Add(w.watchInterval)
+		w.Lock()
+		w.state.Cycles++
+		w.state.LastError = ""
+		if err != nil {
+			w.state.Failures++
+			w.state.LastError = err.Error()
+			log.Printf("Watch: cycle failed: %v", err)
+		}
+		w.state.Status = WatchWaiting
+		w.state.NextRun = &next
+		state := w.state
+		w.Unlock()
+		w.cycleFinished(state, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.stop:
+			log.Printf("Watch: stopped")
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// cycle - create and upload full backup or increment of the last full backup, increment requires local copy of full backup
+func (w *Watcher) cycle(ctx context.Context, start time.Time) error {
+	state := w.State()
+	diffFrom := ""
+	if state.LastFull != "" && start.Sub(*state.LastFullTime) < w.fullInterval {
+		if err := GetLocalBackup(w.config, state.LastFull); err != nil {
+			log.Printf("Watch: full backup '%s' isn't found locally, creating new full backup", state.LastFull)
+		} else {
+			diffFrom = state.LastFull
+		}
+	}
+	backupName := "full-" + NewBackupName()
+	if diffFrom != "" {
+		backupName = "increment-" + NewBackupName()
+	}
+	w.setStatus(WatchCreating)
+	if err := w.create(ctx, backupName, diffFrom); err != nil {
+		return fmt.Errorf("can't create '%s' with %v", backupName, err)
+	}
+	w.setStatus(WatchUploading)
+	if err := w.upload(ctx, backupName, diffFrom); err != nil {
+		return fmt.Errorf("can't upload '%s' with %v", backupName, err)
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.state.LastBackup = backupName
+	if diffFrom == "" {
+		w.state.LastFull = backupName
+		w.state.LastFullTime = &start
+	}
+	return nil
+}
+
+// Watch - run watch cycles until ctx is cancelled, empty intervals mean general.watch_interval and general.full_interval
+func Watch(ctx context.Context, config Config, tablePattern, watchInterval, fullInterval string) error {
+	if config.General.RemoteStorage == "none" {
+		return fmt.Errorf("watch requires remote storage")
+	}
+	w, err := NewWatcher(config, tablePattern, watchInterval, fullInterval)
+	if err != nil {
+		return err
+	}
+	return w.Run(ctx)
+}
@@ -0,0 +1,61 @@
+package chbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcherCycles(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "watch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = dataPath
+	w, err := NewWatcher(*config, "", "1h", "24h")
+	require.NoError(t, err)
+	uploads := map[string]string{}
+	w.create = func(ctx context.Context, backupName, diffFrom string) error {
+		return os.MkdirAll(filepath.Join(dataPath, "backup", backupName), os.ModePerm)
+	}
+	w.upload = func(ctx context.Context, backupName, diffFrom string) error {
+		uploads[backupName] = diffFrom
+		return nil
+	}
+	ctx := context.Background()
+	start := time.Now()
+
+	require.NoError(t, w.cycle(ctx, start))
+	full := w.State().LastFull
+	assert.True(t, strings.HasPrefix(full, "full-"))
+	assert.Equal(t, "", uploads[full])
+
+	require.NoError(t, w.cycle(ctx, start.Add(time.Hour)))
+	increment := w.State().LastBackup
+	assert.True(t, strings.HasPrefix(increment, "increment-"))
+	assert.Equal(t, full, uploads[increment])
+	assert.Equal(t, full, w.State().LastFull)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(dataPath, "backup", full)))
+	require.NoError(t, w.cycle(ctx, start.Add(2*time.Hour)))
+	assert.True(t, strings.HasPrefix(w.State().LastFull, "full-"))
+	assert.Equal(t, start.Add(2*time.Hour), *w.State().LastFullTime)
+}
+
+func TestParseWatchIntervals(t *testing.T) {
+	watch, full, err := parseWatchIntervals("1h", "24h")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, watch)
+	assert.Equal(t, 24*time.Hour, full)
+	_, _, err = parseWatchIntervals("2h", "1h")
+	assert.Error(t, err)
+	_, _, err = parseWatchIntervals("0s", "1h")
+	assert.Error(t, err)
+}